@@ -0,0 +1,435 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/net/websocket"
+)
+
+// bridgeCmd represents the bridge command
+var bridgeCmd = &cobra.Command{
+	Use:   "bridge",
+	Short: "Bridge an oscsync master to other protocols",
+}
+
+// bridgeWSCmd represents the bridge ws command
+var bridgeWSCmd = &cobra.Command{
+	Use:   "ws",
+	Short: "Bridge an oscsync master to WebSocket clients",
+	Long: `Bridge an oscsync master to WebSocket clients
+
+Every WebSocket client talks to the master as if it were an OSC client of its own.
+Clients that send /sync/slave/add become slaves of the master and receive its pulses,
+transport changes and cues. Every other message is sent to the master,
+so clients can change the tempo or ask for it.
+
+Messages are binary OSC frames, or JSON text frames if the client connects with ?format=json.
+
+Browsers send the origin of the page that connects. By default only pages from localhost
+and from the bridge's own address may connect, so that other web sites can not control the master.
+--allow-origin lists the origins that may connect instead, * allows any.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		master, err := resolveServer(viper.GetString("master"))
+		if err != nil {
+			return errors.Wrap(err, "resolving master")
+		}
+		b := &wsBridge{
+			master:       master,
+			heartbeat:    viper.GetDuration("heartbeat"),
+			allowOrigins: configStrings("allow-origin"),
+		}
+
+		return errors.Wrap(serveHTTP(context.Background(), viper.GetString("listen"), b.Handler()), "running bridge")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(bridgeCmd)
+	bridgeCmd.AddCommand(bridgeWSCmd)
+
+	flags := bridgeWSCmd.Flags()
+	flags.String("master", "127.0.0.1", "host[:port] of the oscsync master")
+	flags.String("listen", "127.0.0.1:8090", "host:port the WebSocket clients connect to")
+	flags.Duration("heartbeat", 5*time.Second, "how often to register the clients with the master again, 0 registers once")
+	flags.StringSlice("allow-origin", nil, "comma-separated origins of the web pages that may connect, e.g. https://app.example.com, or * for any (default is localhost and the bridge's own address)")
+}
+
+// Formats of WebSocket messages.
+const (
+	wsFormatJSON = "json"
+	wsFormatOSC  = "osc"
+)
+
+// WSMessage is an OSC message in the JSON format of the WebSocket bridge.
+// Types are the OSC type tags of the arguments.
+// They are optional for messages from clients, numbers without a fraction are ints without them.
+type WSMessage struct {
+	Address   string        `json:"address"`
+	Types     string        `json:"types,omitempty"`
+	Arguments []interface{} `json:"args"`
+}
+
+// wsBridge connects WebSocket clients to an oscsync master.
+// allowOrigins are the origins of the web pages that may connect,
+// if it is empty only localhost and the bridge's own address may.
+type wsBridge struct {
+	master       net.Addr
+	heartbeat    time.Duration
+	allowOrigins []string
+}
+
+// Handler returns the HTTP handler that accepts the WebSocket clients.
+// Clients from origins that are not allowed are rejected.
+func (b *wsBridge) Handler() websocket.Server {
+	return websocket.Server{Handler: b.serveClient, Handshake: b.checkOrigin}
+}
+
+// checkOrigin rejects the handshake of a client from an origin that is not allowed.
+// Clients that are not browsers send no origin and are accepted.
+func (b *wsBridge) checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return errors.Wrap(err, "parsing origin")
+	}
+	if origin == nil || b.allowsOrigin(origin, req.Host) {
+		return nil
+	}
+	slog.Warn("rejected WebSocket client", "origin", origin.String(), "remote", req.RemoteAddr)
+	return errors.Errorf("origin %s is not allowed", origin)
+}
+
+// allowsOrigin returns true if a page from origin may connect to the bridge at host.
+// The bridge's own address only counts if it is an IP address,
+// since a host name can be made to point at the bridge by any web site.
+func (b *wsBridge) allowsOrigin(origin *url.URL, host string) bool {
+	if len(b.allowOrigins) > 0 {
+		for _, allowed := range b.allowOrigins {
+			if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin.Scheme+"://"+origin.Host) {
+				return true
+			}
+		}
+		return false
+	}
+	hostname := origin.Hostname()
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && (ip.IsLoopback() || strings.EqualFold(origin.Host, host))
+}
+
+// serveClient relays messages between a WebSocket client and the master
+// with a UDP connection of its own, until either of them fails.
+func (b *wsBridge) serveClient(ws *websocket.Conn) {
+	_ = b.relay(ws)
+}
+
+// relay relays messages between a WebSocket client and the master.
+func (b *wsBridge) relay(ws *websocket.Conn) error {
+	defer func() { _ = ws.Close() }()
+
+	format := wsFormatOSC
+	if ws.Request().URL.Query().Get("format") == wsFormatJSON {
+		format = wsFormatJSON
+	}
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+
+	conn, err := oscnet.ListenUDPContext(ctx, "udp", &net.UDPAddr{})
+	if err != nil {
+		return errors.Wrap(err, "listening for the master")
+	}
+	c := &wsClient{
+		bridge: b,
+		ws:     ws,
+		conn:   conn,
+		format: format,
+		port:   int32(conn.LocalAddr().(*net.UDPAddr).Port),
+	}
+	defer c.unregister()
+
+	errs := make(chan error, 3)
+	go func() {
+		errs <- conn.Serve(1, osc.Dispatcher{oscnet.DefaultAddress: osc.Method(c.send)})
+	}()
+	go func() {
+		errs <- c.receive()
+	}()
+	if b.heartbeat > 0 {
+		go func() {
+			errs <- c.runHeartbeat(ctx)
+		}()
+	}
+	return <-errs
+}
+
+// wsClient is a WebSocket client of the bridge.
+type wsClient struct {
+	bridge *wsBridge
+	ws     *websocket.Conn
+	conn   *oscnet.UDPConn
+	format string
+	port   int32
+
+	// registrations are the messages that registered the client with the master.
+	mu            sync.Mutex
+	registrations map[string]osc.Message
+}
+
+// send sends a message from the master to the client.
+func (c *wsClient) send(m osc.Message) error {
+	if c.format == wsFormatOSC {
+		return errors.Wrap(websocket.Message.Send(c.ws, oscnet.Bytes(m)), "sending OSC frame")
+	}
+	var (
+		types = make([]byte, len(m.Arguments))
+		args  = make([]interface{}, len(m.Arguments))
+	)
+	for i, arg := range m.Arguments {
+		types[i], args[i] = arg.Typetag(), argumentValue(arg)
+	}
+	msg := WSMessage{Address: m.Address, Types: string(types), Arguments: args}
+	return errors.Wrap(websocket.JSON.Send(c.ws, msg), "sending JSON frame")
+}
+
+// receive sends the messages of the client to the master until the client goes away.
+func (c *wsClient) receive() error {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(c.ws, &data); err != nil {
+			return errors.Wrap(err, "receiving from client")
+		}
+		m, err := parseWSMessage(data)
+		if err != nil {
+			// Malformed messages are dropped like malformed OSC packets.
+			slog.Debug("dropped malformed message", "client", c.ws.Request().RemoteAddr, errAttr(err))
+			continue
+		}
+		if err := c.sendToMaster(m); err != nil {
+			return err
+		}
+	}
+}
+
+// sendToMaster sends a message of the client to the master.
+// Slaves register with their own host and port, so the bridge adds its host and port
+// to the messages that add or remove the client as a slave.
+func (c *wsClient) sendToMaster(m osc.Message) error {
+	if isSlaveAddress(m.Address, syncosc.AddressSlaveAdd) || isSlaveAddress(m.Address, syncosc.AddressSlaveRemove) {
+		m.Arguments = append(osc.Arguments{osc.String("127.0.0.1"), osc.Int(c.port)}, m.Arguments...)
+		c.remember(m)
+	}
+	return errors.Wrapf(c.conn.SendTo(c.bridge.master, m), "sending %s to master", m.Address)
+}
+
+// remember keeps track of the sessions the client is registered with.
+func (c *wsClient) remember(m osc.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.registrations == nil {
+		c.registrations = map[string]osc.Message{}
+	}
+	if isSlaveAddress(m.Address, syncosc.AddressSlaveAdd) {
+		c.registrations[m.Address] = m
+		return
+	}
+	add := strings.TrimSuffix(m.Address, "/remove") + "/add"
+	delete(c.registrations, add)
+}
+
+// runHeartbeat registers the client with the master again every heartbeat.
+func (c *wsClient) runHeartbeat(ctx context.Context) error {
+	ticker := time.NewTicker(c.bridge.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			c.mu.Lock()
+			regs := make([]osc.Message, 0, len(c.registrations))
+			for _, m := range c.registrations {
+				regs = append(regs, m)
+			}
+			c.mu.Unlock()
+
+			for _, m := range regs {
+				if err := c.conn.SendTo(c.bridge.master, m); err != nil {
+					return errors.Wrap(err, "registering with master")
+				}
+			}
+		}
+	}
+}
+
+// unregister removes the client from the master's slaves and closes its connection.
+func (c *wsClient) unregister() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, m := range c.registrations {
+		_ = c.conn.SendTo(c.bridge.master, osc.Message{
+			Address:   strings.TrimSuffix(addr, "/add") + "/remove",
+			Arguments: m.Arguments[:2],
+		})
+	}
+	_ = c.conn.Close()
+}
+
+// isSlaveAddress returns true if addr is the given slave address of any session.
+func isSlaveAddress(addr, slaveAddr string) bool {
+	suffix := strings.TrimPrefix(slaveAddr, syncosc.AddressPrefix)
+	return strings.HasPrefix(addr, syncosc.AddressPrefix) && strings.HasSuffix(addr, "/"+suffix)
+}
+
+// parseWSMessage parses a message from a client,
+// which is JSON if it starts with { and an OSC message otherwise.
+// Without type tags the numbers of a JSON message for an oscsync method
+// get the types the method expects, and whole numbers are ints otherwise.
+func parseWSMessage(data []byte) (osc.Message, error) {
+	if len(data) == 0 || data[0] != '{' {
+		return oscnet.ParseMessage(data, nil)
+	}
+	var msg WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return osc.Message{}, errors.Wrap(err, "decoding JSON message")
+	}
+	if !strings.HasPrefix(msg.Address, "/") {
+		return osc.Message{}, errors.Errorf("invalid address %q", msg.Address)
+	}
+	if err := osc.ValidateAddress(msg.Address); err != nil {
+		return osc.Message{}, err
+	}
+	if msg.Types != "" && len(msg.Types) != len(msg.Arguments) {
+		return osc.Message{}, errors.Errorf("expected %d type tags, got %q", len(msg.Arguments), msg.Types)
+	}
+	m := osc.Message{Address: msg.Address}
+	types := msg.Types
+	if types == "" {
+		types = methodTypetag(msg.Address)
+	}
+	for i, v := range msg.Arguments {
+		var typetag byte
+		if i < len(types) && (msg.Types != "" || isNumberTypetag(types[i])) {
+			typetag = types[i]
+		}
+		arg, err := jsonArgument(v, typetag)
+		if err != nil {
+			return osc.Message{}, errors.Wrapf(err, "reading argument %d", i)
+		}
+		m.Arguments = append(m.Arguments, arg)
+	}
+	return m, nil
+}
+
+// methodTypetag returns the type tag of the oscsync method at addr in any session,
+// or the empty string if addr is not an oscsync method.
+func methodTypetag(addr string) string {
+	if method, ok := serverMethods[addr]; ok {
+		return method.typetag
+	}
+	if method, ok := sessionMethods[addr]; ok {
+		return method.typetag
+	}
+	// Strip the session name from /sync/name/...
+	rest := strings.TrimPrefix(addr, syncosc.AddressPrefix)
+	if rest == addr {
+		return ""
+	}
+	idx := strings.Index(rest, "/")
+	if idx == -1 {
+		return ""
+	}
+	return sessionMethods[syncosc.AddressPrefix+rest[idx+1:]].typetag
+}
+
+// isNumberTypetag returns true if typetag is the type tag of an int or a float.
+func isNumberTypetag(typetag byte) bool {
+	return typetag == osc.TypetagInt || typetag == osc.TypetagFloat
+}
+
+// jsonArgument converts a JSON value to an OSC argument.
+// A zero type tag infers the type from the value.
+func jsonArgument(v interface{}, typetag byte) (osc.Argument, error) {
+	switch x := v.(type) {
+	case float64:
+		if typetag == 0 {
+			typetag = osc.TypetagFloat
+			if x == math.Trunc(x) {
+				typetag = osc.TypetagInt
+			}
+		}
+		switch typetag {
+		case osc.TypetagInt:
+			return osc.Int(int32(x)), nil
+		case osc.TypetagFloat:
+			return osc.Float(float32(x)), nil
+		}
+	case string:
+		if typetag == 0 || typetag == osc.TypetagString {
+			return osc.String(x), nil
+		}
+	case bool:
+		if typetag == 0 || typetag == osc.TypetagTrue || typetag == osc.TypetagFalse {
+			return osc.Bool(x), nil
+		}
+	}
+	return nil, errors.Errorf("can not convert %v to type %q", v, string(typetag))
+}
+
+// argumentValue returns the value of an OSC argument for the JSON format.
+func argumentValue(arg osc.Argument) interface{} {
+	switch arg.Typetag() {
+	case osc.TypetagInt:
+		i, _ := arg.ReadInt32()
+		return i
+	case osc.TypetagFloat:
+		f, _ := arg.ReadFloat32()
+		return f
+	case osc.TypetagString:
+		s, _ := arg.ReadString()
+		return s
+	case osc.TypetagBlob:
+		b, _ := arg.ReadBlob()
+		return b
+	case osc.TypetagTrue:
+		return true
+	case osc.TypetagFalse:
+		return false
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"golang.org/x/net/websocket"
+)
+
+// testMaster is a fake master that passes the messages it receives to a channel.
+type testMaster struct {
+	conn     *oscnet.UDPConn
+	messages chan osc.Message
+}
+
+func newTestMaster(ctx context.Context, t *testing.T) *testMaster {
+	conn, err := oscnet.ListenUDPContext(ctx, "udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testMaster{conn: conn, messages: make(chan osc.Message, 16)}
+
+	go func() {
+		_ = conn.Serve(1, osc.Dispatcher{
+			oscnet.DefaultAddress: osc.Method(func(msg osc.Message) error {
+				m.messages <- msg
+				return nil
+			}),
+		})
+	}()
+	return m
+}
+
+func (m *testMaster) receive(t *testing.T) osc.Message {
+	select {
+	case msg := <-m.messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for a message to the master")
+	}
+	return osc.Message{}
+}
+
+func newTestBridge(t *testing.T, master *testMaster) *httptest.Server {
+	b := &wsBridge{master: master.conn.LocalAddr()}
+	return httptest.NewServer(b.Handler())
+}
+
+func dialBridge(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/" + query
+	ws, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// register registers a client with the fake master and returns the address the master pulses.
+func register(t *testing.T, master *testMaster, ws *websocket.Conn, msg WSMessage, group string) net.Addr {
+	if err := websocket.JSON.Send(ws, msg); err != nil {
+		t.Fatal(err)
+	}
+	m := master.receive(t)
+	if expected, got := msg.Address, m.Address; expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+	addr, err := readUDPAddr(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readGroup(m, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := group; expected != got {
+		t.Fatalf("expected group %q, got %q", expected, got)
+	}
+	return addr
+}
+
+func TestBridgeOSC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	master := newTestMaster(ctx, t)
+	srv := newTestBridge(t, master)
+	defer srv.Close()
+
+	ws := dialBridge(t, srv, "")
+	addr := register(t, master, ws, WSMessage{Address: syncosc.AddressSlaveAdd, Arguments: []interface{}{"visuals"}}, "visuals")
+
+	pulse := osc.Message{
+		Address:   syncosc.AddressPulse,
+		Arguments: osc.Arguments{osc.Float(120), osc.Int(7)},
+	}
+	if err := master.conn.SendTo(addr, pulse); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := osc.ParseMessage(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pulse.Equal(got) {
+		t.Fatalf("expected %v, got %v", pulse, got)
+	}
+	// Binary OSC frames from the client are sent to the master as they are.
+	tempo := osc.Message{Address: syncosc.AddressTempo, Arguments: osc.Arguments{osc.Float(140)}}
+	if err := websocket.Message.Send(ws, tempo.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if m := master.receive(t); !tempo.Equal(m) {
+		t.Fatalf("expected %v, got %v", tempo, m)
+	}
+	// The client is removed from the master's slaves when it goes away.
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := master.receive(t)
+	if expected, got := syncosc.AddressSlaveRemove, m.Address; expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+	removed, err := readUDPAddr(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := addr.String(), removed.String(); expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestBridgeJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	master := newTestMaster(ctx, t)
+	srv := newTestBridge(t, master)
+	defer srv.Close()
+
+	ws := dialBridge(t, srv, "?format=json")
+	defer func() { _ = ws.Close() }()
+
+	addr := register(t, master, ws, WSMessage{Address: "/sync/live/slave/add"}, "")
+
+	transport := osc.Message{
+		Address:   "/sync/live/transport",
+		Arguments: osc.Arguments{osc.String(syncosc.TransportStop)},
+	}
+	if err := master.conn.SendTo(addr, transport); err != nil {
+		t.Fatal(err)
+	}
+	var msg WSMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := transport.Address, msg.Address; expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+	if expected, got := "s", msg.Types; expected != got {
+		t.Fatalf("expected types %s, got %s", expected, got)
+	}
+	if len(msg.Arguments) != 1 || msg.Arguments[0] != syncosc.TransportStop {
+		t.Fatalf("expected arguments [%s], got %v", syncosc.TransportStop, msg.Arguments)
+	}
+	// The bridge knows that the tempo is a float even if it is a whole number.
+	if err := websocket.JSON.Send(ws, WSMessage{Address: "/sync/live/tempo", Arguments: []interface{}{140}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := osc.Message{Address: "/sync/live/tempo", Arguments: osc.Arguments{osc.Float(140)}}
+	if got := master.receive(t); !expected.Equal(got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestParseWSMessage(t *testing.T) {
+	for i, testcase := range []struct {
+		input  string
+		output osc.Message
+		err    bool
+	}{
+		{
+			input:  `{"address":"/sync/meter","args":[6,8]}`,
+			output: osc.Message{Address: "/sync/meter", Arguments: osc.Arguments{osc.Int(6), osc.Int(8)}},
+		},
+		{
+			input:  `{"address":"/sync/tempo","args":[92.5,"bar"]}`,
+			output: osc.Message{Address: "/sync/tempo", Arguments: osc.Arguments{osc.Float(92.5), osc.String("bar")}},
+		},
+		{
+			input:  `{"address":"/sync/tempo","args":[120]}`,
+			output: osc.Message{Address: "/sync/tempo", Arguments: osc.Arguments{osc.Float(120)}},
+		},
+		{
+			input:  `{"address":"/sync/live/tempo","args":[120,"bar"]}`,
+			output: osc.Message{Address: "/sync/live/tempo", Arguments: osc.Arguments{osc.Float(120), osc.String("bar")}},
+		},
+		{
+			input:  `{"address":"/sync/live/meter","args":[6,8]}`,
+			output: osc.Message{Address: "/sync/live/meter", Arguments: osc.Arguments{osc.Int(6), osc.Int(8)}},
+		},
+		{
+			input:  `{"address":"/sync/session/add","args":["live",100]}`,
+			output: osc.Message{Address: "/sync/session/add", Arguments: osc.Arguments{osc.String("live"), osc.Float(100)}},
+		},
+		{
+			input:  `{"address":"/sync/tempo","types":"i","args":[120]}`,
+			output: osc.Message{Address: "/sync/tempo", Arguments: osc.Arguments{osc.Int(120)}},
+		},
+		{
+			input:  `{"address":"/synth/freq","args":[440]}`,
+			output: osc.Message{Address: "/synth/freq", Arguments: osc.Arguments{osc.Int(440)}},
+		},
+		{
+			input: `{"address":"/sync/tempo","types":"s","args":[92.5]}`,
+			err:   true,
+		},
+		{
+			input: `{"address":"/sync/tempo","types":"ff","args":[92.5]}`,
+			err:   true,
+		},
+		{
+			input: `{"address":"sync","args":[]}`,
+			err:   true,
+		},
+	} {
+		got, err := parseWSMessage([]byte(testcase.input))
+		if testcase.err {
+			if err == nil {
+				t.Fatalf("(test case %d) expected error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if !testcase.output.Equal(got) {
+			t.Fatalf("(test case %d) expected %v, got %v", i, testcase.output, got)
+		}
+	}
+}
+
+// handshake starts a WebSocket handshake with the bridge from a page with the given origin
+// and returns the status code of the response.
+func handshake(t *testing.T, srv *httptest.Server, origin string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestBridgeOrigin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	master := newTestMaster(ctx, t)
+
+	for _, testcase := range []struct {
+		allow  []string
+		origin string
+		status int
+	}{
+		// Clients that are not browsers send no origin.
+		{origin: "", status: http.StatusSwitchingProtocols},
+		{origin: "http://localhost:3000", status: http.StatusSwitchingProtocols},
+		{origin: "http://127.0.0.1:3000", status: http.StatusSwitchingProtocols},
+		{origin: "http://[::1]:3000", status: http.StatusSwitchingProtocols},
+		{origin: "https://evil.example.com", status: http.StatusForbidden},
+		{origin: "http://10.0.0.5", status: http.StatusForbidden},
+		{allow: []string{"https://app.example.com"}, origin: "https://app.example.com", status: http.StatusSwitchingProtocols},
+		{allow: []string{"https://app.example.com/"}, origin: "https://APP.example.com", status: http.StatusSwitchingProtocols},
+		{allow: []string{"https://app.example.com"}, origin: "http://app.example.com", status: http.StatusForbidden},
+		{allow: []string{"https://app.example.com"}, origin: "http://localhost:3000", status: http.StatusForbidden},
+		{allow: []string{"*"}, origin: "https://evil.example.com", status: http.StatusSwitchingProtocols},
+	} {
+		b := &wsBridge{master: master.conn.LocalAddr(), allowOrigins: testcase.allow}
+		srv := httptest.NewServer(b.Handler())
+
+		if got := handshake(t, srv, testcase.origin); testcase.status != got {
+			t.Fatalf("origin %q allowing %q: expected status %d, got %d", testcase.origin, testcase.allow, testcase.status, got)
+		}
+		srv.Close()
+	}
+}
+
+func TestBridgeAllowsOwnAddress(t *testing.T) {
+	b := &wsBridge{}
+
+	for _, testcase := range []struct {
+		origin, host string
+		allowed      bool
+	}{
+		{origin: "http://10.0.0.5:8090", host: "10.0.0.5:8090", allowed: true},
+		{origin: "http://10.0.0.5:8091", host: "10.0.0.5:8090", allowed: false},
+
+		// A host name could point at the bridge after the page was loaded.
+		{origin: "http://bridge.example.com:8090", host: "bridge.example.com:8090", allowed: false},
+	} {
+		origin, err := url.Parse(testcase.origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.allowsOrigin(origin, testcase.host); testcase.allowed != got {
+			t.Fatalf("expected %s allowed at %s to be %t, got %t", testcase.origin, testcase.host, testcase.allowed, got)
+		}
+	}
+}
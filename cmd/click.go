@@ -0,0 +1,321 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// clickCmd represents the click command
+var clickCmd = &cobra.Command{
+	Use:   "click [file]",
+	Short: "Render a click track of a tempo map to a WAV file",
+	Long: `Render a click track of a tempo map to a WAV file
+
+The tempo map is a YAML file with the tempo and meter to start with, the number of bars
+and the changes, which happen on a bar and beat like cues:
+
+  tempo: 120
+  meter: 4/4
+  bars: 16
+  changes:
+    - bar: 5
+      meter: 6/8
+    - bar: 9
+      tempo: 90
+      ramp: 2 bars
+
+The beats are timed like the pulses of the master: tempo and meter changes take effect
+on the pulse they fall on, and a meter change in the middle of a bar starts a new bar.
+A ramp changes the tempo on every pulse until it reaches the new tempo after the ramp's length.
+Downbeats are accented.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.Errorf("expected a WAV file, got %d arguments", len(args))
+		}
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		m, err := readClickMap(viper.GetString("tempo-map"))
+		if err != nil {
+			return err
+		}
+		c := click{
+			sampleRate: viper.GetInt("sample-rate"),
+			amplitude:  viper.GetFloat64("amplitude"),
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return errors.Wrap(err, "creating WAV file")
+		}
+		if err := c.Render(f, m); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return errors.Wrap(f.Close(), "closing WAV file")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(clickCmd)
+
+	flags := clickCmd.Flags()
+	flags.String("tempo-map", "", "YAML file with the tempo map")
+	flags.Int("sample-rate", 48000, "sample rate of the file")
+	flags.Float64("amplitude", 0.8, "amplitude of the accented clicks, between 0 and 1")
+}
+
+// clickMap is a tempo map read from YAML.
+type clickMap struct {
+	Tempo   float32          `yaml:"tempo"`
+	Meter   string           `yaml:"meter"`
+	Bars    uint64           `yaml:"bars"`
+	Changes []clickMapChange `yaml:"changes"`
+}
+
+// clickMapChange is a tempo or meter change at a bar and beat, both counted from 1.
+// The beat is 1 if it is empty.
+// Ramp is how long the tempo takes to reach the new tempo, e.g. "4 beats" or "2 bars",
+// counted in the meter of the change.
+type clickMapChange struct {
+	Bar   uint64  `yaml:"bar"`
+	Beat  uint64  `yaml:"beat"`
+	Tempo float32 `yaml:"tempo"`
+	Ramp  string  `yaml:"ramp"`
+	Meter string  `yaml:"meter"`
+}
+
+// readClickMap reads a tempo map from a YAML file.
+func readClickMap(path string) (clickMap, error) {
+	if path == "" {
+		return clickMap{}, errors.New("expected --tempo-map")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return clickMap{}, errors.Wrap(err, "reading tempo map")
+	}
+	var m clickMap
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return clickMap{}, errors.Wrap(err, "parsing tempo map")
+	}
+	return m, nil
+}
+
+// clickBeat is a beat of a click track.
+type clickBeat struct {
+	sample   int64
+	downbeat bool
+}
+
+// Beats returns the first sample of every beat of the tempo map at a sample rate,
+// and the number of samples until the end of the last bar.
+func (m clickMap) Beats(sampleRate int) ([]clickBeat, int64, error) {
+	if m.Tempo <= 0 {
+		return nil, 0, errors.Errorf("tempo must be positive, got %g", m.Tempo)
+	}
+	if m.Bars == 0 {
+		return nil, 0, errors.New("tempo map must have at least one bar")
+	}
+	meter := DefaultMeter
+	if m.Meter != "" {
+		var err error
+		if meter, err = ParseMeter(m.Meter); err != nil {
+			return nil, 0, err
+		}
+	}
+	changes := make([]clickMapChange, len(m.Changes))
+	copy(changes, m.Changes)
+	for i := range changes {
+		if changes[i].Beat == 0 {
+			changes[i].Beat = 1
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Bar < changes[j].Bar || changes[i].Bar == changes[j].Bar && changes[i].Beat < changes[j].Beat
+	})
+	var (
+		tempo     = m.Tempo
+		barOrigin uint64
+		originBar uint64
+		ramp      *tempoRamp
+		elapsed   time.Duration
+		beats     []clickBeat
+		sample    = func(d time.Duration) int64 {
+			// The first sample at or after d.
+			sr := int64(sampleRate)
+			return int64(d/time.Second)*sr + (int64(d%time.Second)*sr+int64(time.Second)-1)/int64(time.Second)
+		}
+	)
+	for pulse := uint64(0); ; pulse++ {
+		pos := positionAt(pulse, barOrigin, originBar, meter)
+
+		for pos.OnBeat() && len(changes) > 0 {
+			c := changes[0]
+			if c.Bar > pos.Bar || c.Bar == pos.Bar && c.Beat > pos.Beat {
+				break
+			}
+			if c.Bar != pos.Bar || c.Beat != pos.Beat {
+				return nil, 0, errors.Errorf("change at bar %d beat %d is not a beat of the tempo map", c.Bar, c.Beat)
+			}
+			changes = changes[1:]
+
+			if c.Meter != "" {
+				next, err := ParseMeter(c.Meter)
+				if err != nil {
+					return nil, 0, errors.Wrapf(err, "change at bar %d beat %d", c.Bar, c.Beat)
+				}
+				originBar, barOrigin, meter = meterOriginBar(pos), pulse, next
+				pos = positionAt(pulse, barOrigin, originBar, meter)
+			}
+			r, err := c.ramp(tempo, pulse, meter)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "change at bar %d beat %d", c.Bar, c.Beat)
+			}
+			if r != nil {
+				ramp = r
+			}
+		}
+		if pos.Bar > m.Bars {
+			if len(changes) > 0 {
+				return nil, 0, errors.Errorf("change at bar %d beat %d is after the last bar", changes[0].Bar, changes[0].Beat)
+			}
+			return beats, sample(elapsed), nil
+		}
+		if ramp != nil {
+			tempo = ramp.At(pulse)
+			if pulse >= ramp.end {
+				ramp = nil
+			}
+		}
+		if pos.OnBeat() {
+			beats = append(beats, clickBeat{sample: sample(elapsed), downbeat: pos.Beat == 1})
+		}
+		elapsed += syncosc.GetPulseDuration(tempo)
+	}
+}
+
+// tempoRamp changes the tempo on every pulse from start to end.
+type tempoRamp struct {
+	from, to   float32
+	start, end uint64
+}
+
+// At returns the tempo of a pulse of the ramp.
+func (r tempoRamp) At(pulse uint64) float32 {
+	if pulse >= r.end {
+		return r.to
+	}
+	return r.from + (r.to-r.from)*float32(pulse-r.start)/float32(r.end-r.start)
+}
+
+// ramp returns the ramp of a tempo change from tempo at a pulse,
+// or nil if the change does not change the tempo.
+// A change without a ramp is a ramp that ends at the pulse.
+func (c clickMapChange) ramp(tempo float32, pulse uint64, meter Meter) (*tempoRamp, error) {
+	if c.Tempo == 0 {
+		if c.Ramp != "" {
+			return nil, errors.New("ramp without a tempo")
+		}
+		return nil, nil
+	}
+	if c.Tempo < 0 {
+		return nil, errors.Errorf("tempo must be positive, got %g", c.Tempo)
+	}
+	r := &tempoRamp{from: tempo, to: c.Tempo, start: pulse, end: pulse}
+	if c.Ramp == "" {
+		return r, nil
+	}
+	q, err := ParseQuantization(c.Ramp)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ramp")
+	}
+	switch q.Unit {
+	case QuantizeBeat:
+		r.end += q.Count * meter.PulsesPerBeat()
+	case QuantizeBar:
+		r.end += q.Count * meter.PulsesPerBar()
+	default:
+		return nil, errors.Errorf("invalid ramp %q, expected beats or bars", c.Ramp)
+	}
+	return r, nil
+}
+
+// Click sounds.
+const (
+	clickLength        = 30 * time.Millisecond
+	clickDecay         = 5 * time.Millisecond
+	clickDownbeatPitch = 1600
+	clickBeatPitch     = 800
+)
+
+// click renders click tracks.
+type click struct {
+	sampleRate int
+	amplitude  float64
+}
+
+// Render writes a WAV file with the click of a tempo map to w.
+// Every click starts at its peak on the first sample of its beat and decays quickly.
+// Downbeats are higher and twice as loud as the other beats.
+func (c click) Render(w io.Writer, m clickMap) error {
+	if c.amplitude < 0 || c.amplitude > 1 {
+		return errors.Errorf("invalid amplitude %g, expected between 0 and 1", c.amplitude)
+	}
+	beats, samples, err := m.Beats(c.sampleRate)
+	if err != nil {
+		return err
+	}
+	wav, err := newWAVWriter(w, c.sampleRate, samples)
+	if err != nil {
+		return err
+	}
+	var (
+		sr     = float64(c.sampleRate)
+		length = int64(clickLength.Seconds() * sr)
+		decay  = clickDecay.Seconds() * sr
+	)
+	for s := int64(0); s < samples; s++ {
+		for len(beats) > 1 && beats[1].sample <= s {
+			beats = beats[1:]
+		}
+		var v float64
+
+		if b := beats[0]; s >= b.sample && s-b.sample < length {
+			var (
+				n     = float64(s - b.sample)
+				amp   = c.amplitude / 2
+				pitch = float64(clickBeatPitch)
+			)
+			if b.downbeat {
+				amp, pitch = c.amplitude, clickDownbeatPitch
+			}
+			v = amp * math.Exp(-n/decay) * math.Cos(2*math.Pi*pitch*n/sr)
+		}
+		if err := wav.Write(v); err != nil {
+			return err
+		}
+	}
+	return wav.Close()
+}
@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+func TestClickMapBeats(t *testing.T) {
+	for i, testcase := range []struct {
+		m       clickMap
+		beats   []clickBeat
+		samples int64
+	}{
+		// A pulse at 120 bpm is 20833334ns long, so every beat is 16ns late
+		// and starts on the sample after a multiple of 24000.
+		{
+			m: clickMap{Tempo: 120, Bars: 2},
+			beats: []clickBeat{
+				{sample: 0, downbeat: true},
+				{sample: 24001},
+				{sample: 48001},
+				{sample: 72001},
+				{sample: 96001, downbeat: true},
+				{sample: 120001},
+				{sample: 144001},
+				{sample: 168001},
+			},
+			samples: 192001,
+		},
+		// A meter change in the middle of a bar starts a new bar.
+		// A pulse at 60 bpm is 41666668ns long.
+		{
+			m: clickMap{
+				Tempo: 120,
+				Meter: "4/4",
+				Bars:  3,
+				Changes: []clickMapChange{
+					{Bar: 1, Beat: 3, Meter: "3/4", Tempo: 60},
+				},
+			},
+			beats: []clickBeat{
+				{sample: 0, downbeat: true},
+				{sample: 24001},
+				{sample: 48001, downbeat: true},
+				{sample: 96001},
+				{sample: 144001},
+				{sample: 192001, downbeat: true},
+				{sample: 240001},
+				{sample: 288001},
+			},
+			samples: 336001,
+		},
+		// Changes are sorted and counted in the meter of the bars before them.
+		// An eighth note at 120 bpm is 12 pulses, 250000008ns.
+		{
+			m: clickMap{
+				Tempo: 120,
+				Meter: "2/4",
+				Bars:  3,
+				Changes: []clickMapChange{
+					{Bar: 3, Beat: 2, Tempo: 120},
+					{Bar: 2, Meter: "3/8"},
+				},
+			},
+			beats: []clickBeat{
+				{sample: 0, downbeat: true},
+				{sample: 24001},
+				{sample: 48001, downbeat: true},
+				{sample: 60001},
+				{sample: 72001},
+				{sample: 84001, downbeat: true},
+				{sample: 96001},
+				{sample: 108001},
+			},
+			samples: 120001,
+		},
+	} {
+		beats, samples, err := testcase.m.Beats(48000)
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if expected, got := testcase.beats, beats; !reflect.DeepEqual(expected, got) {
+			t.Fatalf("(test case %d) expected %v, got %v", i, expected, got)
+		}
+		if expected, got := testcase.samples, samples; expected != got {
+			t.Fatalf("(test case %d) expected %d samples, got %d", i, expected, got)
+		}
+	}
+}
+
+func TestClickMapRamp(t *testing.T) {
+	m := clickMap{
+		Tempo:   60,
+		Bars:    3,
+		Changes: []clickMapChange{{Bar: 2, Tempo: 120, Ramp: "1 bar"}},
+	}
+	beats, samples, err := m.Beats(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 12, len(beats); expected != got {
+		t.Fatalf("expected %d beats, got %d", expected, got)
+	}
+	// The ramp changes the tempo on every pulse of the second bar,
+	// by 60/96 bpm from 60 bpm, and the third bar is at 120 bpm.
+	var (
+		bar1 = 96 * syncosc.GetPulseDuration(60)
+		bar2 time.Duration
+		bar3 = 96 * syncosc.GetPulseDuration(120)
+	)
+	for i := 0; i < 96; i++ {
+		bar2 += syncosc.GetPulseDuration(60 + 60*float32(i)/96)
+	}
+	sample := func(d time.Duration) int64 {
+		return (int64(d)*48000 + int64(time.Second) - 1) / int64(time.Second)
+	}
+	if expected, got := sample(bar1), beats[4].sample; expected != got {
+		t.Fatalf("expected bar 2 at sample %d, got %d", expected, got)
+	}
+	if expected, got := sample(bar1+bar2), beats[8].sample; expected != got {
+		t.Fatalf("expected bar 3 at sample %d, got %d", expected, got)
+	}
+	if expected, got := sample(bar1+bar2+bar3), samples; expected != got {
+		t.Fatalf("expected %d samples, got %d", expected, got)
+	}
+	for i := 5; i < 9; i++ {
+		prev, beat := beats[i-1].sample-beats[i-2].sample, beats[i].sample-beats[i-1].sample
+		if beat >= prev {
+			t.Fatalf("expected beat %d to be shorter than %d samples, got %d", i, prev, beat)
+		}
+	}
+}
+
+func TestClickMapInvalid(t *testing.T) {
+	for i, m := range []clickMap{
+		{Tempo: 0, Bars: 1},
+		{Tempo: 120},
+		{Tempo: 120, Bars: 1, Meter: "5/6"},
+		{Tempo: 120, Bars: 2, Changes: []clickMapChange{{Bar: 1, Beat: 5, Tempo: 90}}},
+		{Tempo: 120, Bars: 2, Changes: []clickMapChange{{Bar: 2, Ramp: "2 bars"}}},
+		{Tempo: 120, Bars: 2, Changes: []clickMapChange{{Bar: 2, Tempo: 90, Ramp: "now"}}},
+		{Tempo: 120, Bars: 2, Changes: []clickMapChange{{Bar: 2, Tempo: -1}}},
+		{Tempo: 120, Bars: 2, Changes: []clickMapChange{{Bar: 4, Tempo: 90}}},
+		// Bar 2 is cut short to 2 beats by the meter change.
+		{Tempo: 120, Bars: 3, Changes: []clickMapChange{{Bar: 1, Meter: "2/4"}, {Bar: 2, Beat: 3, Tempo: 90}}},
+	} {
+		if _, _, err := m.Beats(48000); err == nil {
+			t.Fatalf("(test case %d) expected an error", i)
+		}
+	}
+}
+
+func TestClickRender(t *testing.T) {
+	m := clickMap{
+		Tempo:   120,
+		Meter:   "4/4",
+		Bars:    3,
+		Changes: []clickMapChange{{Bar: 1, Beat: 3, Meter: "3/4", Tempo: 60}},
+	}
+	var buf bytes.Buffer
+	if err := (click{sampleRate: 48000, amplitude: 0.8}).Render(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	_, samples := readTestWAV(t, buf.Bytes())
+
+	if expected, got := 336001, len(samples); expected != got {
+		t.Fatalf("expected %d samples, got %d", expected, got)
+	}
+	// A click starts at its peak after silence.
+	var onsets []clickBeat
+	for i, s := range samples {
+		silent := true
+		for j := i - 10; j < i; j++ {
+			if j >= 0 && samples[j] != 0 {
+				silent = false
+			}
+		}
+		if s != 0 && silent {
+			switch s {
+			case 26214:
+				onsets = append(onsets, clickBeat{sample: int64(i), downbeat: true})
+			case 13107:
+				onsets = append(onsets, clickBeat{sample: int64(i)})
+			default:
+				t.Fatalf("click at sample %d starts at %d", i, s)
+			}
+		}
+	}
+	beats, _, err := m.Beats(48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := beats, onsets; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected clicks %v, got %v", expected, got)
+	}
+}
+
+func TestParseMeter(t *testing.T) {
+	for i, testcase := range []struct {
+		input string
+		meter Meter
+		err   bool
+	}{
+		{input: "4/4", meter: Meter{Beats: 4, Unit: 4}},
+		{input: "7/8", meter: Meter{Beats: 7, Unit: 8}},
+		{input: " 12/16 ", meter: Meter{Beats: 12, Unit: 16}},
+		{input: "5/6", err: true},
+		{input: "0/4", err: true},
+		{input: "4", err: true},
+		{input: "4/4/4", err: true},
+	} {
+		meter, err := ParseMeter(testcase.input)
+		if testcase.err {
+			if err == nil {
+				t.Fatalf("(test case %d) expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if expected, got := testcase.meter, meter; expected != got {
+			t.Fatalf("(test case %d) expected %s, got %s", i, expected, got)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/scgolang/oscsync/dnssd"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// bindFlags makes every flag of a command settable in the config file
+// and with an OSCSYNC_* environment variable.
+// Only the flags of the command that runs are bound, since commands share flag names.
+func bindFlags(cmd *cobra.Command) error {
+	return errors.Wrap(viper.BindPFlags(cmd.Flags()), "binding flags")
+}
+
+// addServerFlags adds the flags that every command that runs a server has.
+func addServerFlags(flags *pflag.FlagSet) {
+	flags.String("host", "0.0.0.0", "listen addr")
+	flags.IntP("port", "p", syncosc.MasterPort, "listen port")
+	flags.Float32P("tempo", "t", 120, "tempo in bpm")
+	flags.Float32("min-tempo", defaultSettings.minTempo, "lowest tempo in bpm that can be set")
+	flags.Float32("max-tempo", defaultSettings.maxTempo, "highest tempo in bpm that can be set")
+	flags.Duration("slave-ttl", defaultSettings.slaveTTL, "remove slaves that have not registered again for this long, 0 keeps them forever")
+	flags.Int32("ppqn", defaultSettings.ppqn, "pulses per quarter note sent to slaves, must divide 24")
+	flags.Int32("max-send-failures", defaultSettings.maxSendFailures, "remove slaves that this many packets in a row could not be sent to, 0 keeps them forever")
+	flags.StringSlice("static-slaves", nil, "comma-separated slaves that are pulsed without registering, as host:port?group=g&session=s&ppqn=n&latency=d&timecode=frame")
+	flags.String("timecode", "", "send SMPTE timecode at this frame rate (24, 25, 29.97df or 30) to the slaves that subscribe to it")
+	flags.String("advertise", "", "advertise the server with mDNS under this name")
+	flags.String("mdns-addr", dnssd.MulticastAddr, "address the mDNS responder listens on")
+	flags.String("oscquery", "", "serve an OSCQuery description of the server at this host:port")
+	flags.String("http", "", "serve the HTTP API at this host:port")
+	flags.String("metrics", "", "serve Prometheus metrics at this host:port, they are also served by the HTTP API")
+}
+
+// configStrings returns a list from the config.
+// Lists can be written as YAML lists or as comma-separated strings,
+// which is the only way to set them with flags and environment variables.
+func configStrings(key string) []string {
+	var ss []string
+	for _, s := range viper.GetStringSlice(key) {
+		for _, field := range strings.Split(s, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				ss = append(ss, field)
+			}
+		}
+	}
+	return ss
+}
+
+// readServerConfig reads the configuration of a server from the flags, environment and config file.
+// Settings that the command has no flag for are left out,
+// so that a config file can be shared by the serve and peer commands.
+func readServerConfig(flags *pflag.FlagSet) (ServerConfig, error) {
+	settings, err := readSettings()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	var staticSlaves []staticSlave
+	for _, spec := range configStrings("static-slaves") {
+		ss, err := parseStaticSlave(spec)
+		if err != nil {
+			return ServerConfig{}, err
+		}
+		staticSlaves = append(staticSlaves, ss)
+	}
+	var timecode FrameRate
+	if rate := viper.GetString("timecode"); rate != "" {
+		if timecode, err = ParseFrameRate(rate); err != nil {
+			return ServerConfig{}, err
+		}
+	}
+	config := ServerConfig{
+		host:         viper.GetString("host"),
+		port:         viper.GetInt("port"),
+		tempo:        float32(viper.GetFloat64("tempo")),
+		failover:     viper.GetDuration("failover"),
+		settings:     settings,
+		staticSlaves: staticSlaves,
+		advertise:    viper.GetString("advertise"),
+		mdnsAddr:     viper.GetString("mdns-addr"),
+		oscQuery:     viper.GetString("oscquery"),
+		httpAddr:     viper.GetString("http"),
+		metricsAddr:  viper.GetString("metrics"),
+		timecode:     timecode,
+	}
+	if flags.Lookup("standby") != nil {
+		config.primary = viper.GetString("standby")
+	}
+	if flags.Lookup("state") != nil {
+		config.stateFile = viper.GetString("state")
+		config.resume = viper.GetBool("resume")
+		config.resumeClock = viper.GetBool("resume-clock")
+	}
+	if flags.Lookup("id") != nil {
+		config.id = int32(viper.GetInt("id"))
+		config.peerHosts = configStrings("peers")
+	}
+	return config, nil
+}
+
+// settings are the server settings that can be changed while the server is running.
+type settings struct {
+	minTempo float32
+	maxTempo float32
+	slaveTTL time.Duration
+	ppqn     int32
+
+	// maxSendFailures is how many packets in a row can fail to be sent to a slave
+	// before it is removed, 0 never removes slaves.
+	maxSendFailures int32
+}
+
+// defaultSettings are the settings of a server that has not been configured.
+var defaultSettings = settings{
+	minTempo: 1,
+	maxTempo: 999,
+	ppqn:     syncosc.PulsesPerQuarter,
+
+	maxSendFailures: 96,
+}
+
+// readSettings reads the live settings from the flags, environment and config file.
+func readSettings() (settings, error) {
+	s := settings{
+		minTempo: float32(viper.GetFloat64("min-tempo")),
+		maxTempo: float32(viper.GetFloat64("max-tempo")),
+		slaveTTL: viper.GetDuration("slave-ttl"),
+		ppqn:     int32(viper.GetInt("ppqn")),
+
+		maxSendFailures: int32(viper.GetInt("max-send-failures")),
+	}
+	return s, s.validate()
+}
+
+// validate returns an error if the settings can not be used.
+func (s settings) validate() error {
+	if s.minTempo <= 0 || s.maxTempo < s.minTempo {
+		return errors.Errorf("invalid tempo limits [%f, %f]", s.minTempo, s.maxTempo)
+	}
+	if s.slaveTTL < 0 {
+		return errors.Errorf("slave TTL must not be negative, got %s", s.slaveTTL)
+	}
+	if s.ppqn <= 0 || syncosc.PulsesPerQuarter%s.ppqn != 0 {
+		return errors.Errorf("ppqn must divide %d, got %d", syncosc.PulsesPerQuarter, s.ppqn)
+	}
+	if s.maxSendFailures < 0 {
+		return errors.Errorf("max send failures must not be negative, got %d", s.maxSendFailures)
+	}
+	return nil
+}
+
+// validateTempo returns an error if the tempo is outside the tempo limits.
+func (s settings) validateTempo(tempo float32) error {
+	if tempo < s.minTempo || tempo > s.maxTempo {
+		return errors.Errorf("tempo must be in [%f, %f], got %f", s.minTempo, s.maxTempo, tempo)
+	}
+	return nil
+}
+
+// pulseDivider returns how many pulses of the clock make one pulse that is sent to a slave.
+func (sess *Session) pulseDivider(s *slave) uint64 {
+	ppqn := s.ppqn
+	if ppqn == 0 {
+		ppqn = sess.live.Get().ppqn
+	}
+	return uint64(syncosc.PulsesPerQuarter / ppqn)
+}
+
+// liveSettings holds the settings of a running server.
+// It is safe for concurrent use since the settings are reloaded
+// when the config file changes and read by the sessions.
+type liveSettings struct {
+	mu sync.RWMutex
+	s  settings
+}
+
+// newLiveSettings creates live settings with initial values.
+func newLiveSettings(s settings) *liveSettings {
+	return &liveSettings{s: s}
+}
+
+// Get returns the current settings.
+// A nil liveSettings returns the default settings.
+func (ls *liveSettings) Get() settings {
+	if ls == nil {
+		return defaultSettings
+	}
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	return ls.s
+}
+
+// Set changes the settings.
+func (ls *liveSettings) Set(s settings) {
+	ls.mu.Lock()
+	ls.s = s
+	ls.mu.Unlock()
+}
+
+// watchConfig reloads the live settings whenever the config file changes.
+// Settings that can not be changed while the server is running are only read at startup.
+func (srv *Server) watchConfig() {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		srv.reloadSettings(e.Name)
+	})
+	viper.WatchConfig()
+}
+
+// reloadSettings replaces the live settings with the settings in the config file at path,
+// which viper has just read again. Invalid settings are logged and the old ones are kept.
+func (srv *Server) reloadSettings(path string) {
+	s, err := readSettings()
+	if err != nil {
+		srv.log.Warn("ignoring config changes", "path", path, errAttr(err))
+		return
+	}
+	srv.live.Set(s)
+	srv.log.Info("reloaded config", "path", path)
+}
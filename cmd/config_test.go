@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// useConfig reads the config the way the commands do, from the given config file
+// and the OSCSYNC_* environment variables. The config is reset when the test ends.
+func useConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "oscsync.yaml")
+	writeConfig(t, path, yaml)
+
+	viper.Reset()
+	cfgFile = path
+	t.Cleanup(func() {
+		cfgFile, configUsed = "", ""
+		viper.Reset()
+	})
+	initConfig()
+
+	if configUsed != path {
+		t.Fatalf("expected config file %s to be used, got %q", path, configUsed)
+	}
+	return path
+}
+
+// writeConfig writes a config file.
+func writeConfig(t *testing.T, path, yaml string) {
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestServeCmd returns a command with the flags of serve,
+// without standby and peer mode, and sets the flags it is given.
+func newTestServeCmd(t *testing.T, flags map[string]string) *cobra.Command {
+	cmd := &cobra.Command{Use: "serve"}
+	addServerFlags(cmd.Flags())
+	cmd.Flags().String("state", "", "")
+	cmd.Flags().Bool("resume", false, "")
+	cmd.Flags().Bool("resume-clock", false, "")
+
+	for name, value := range flags {
+		if err := cmd.Flags().Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bindFlags(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestReadServerConfig(t *testing.T) {
+	useConfig(t, `
+tempo: 100
+port: 5000
+slave-ttl: 10s
+ppqn: 4
+max-send-failures: 5
+timecode: "25"
+state: oscsync.json
+resume: true
+standby: 10.0.0.2
+static-slaves:
+  - 10.0.0.5:9000?group=lights
+  - 10.0.0.6:8000
+`)
+	t.Setenv("OSCSYNC_SLAVE_TTL", "5s")
+	t.Setenv("OSCSYNC_MAX_SEND_FAILURES", "7")
+	t.Setenv("OSCSYNC_PORT", "5001")
+
+	cmd := newTestServeCmd(t, map[string]string{"tempo": "130", "port": "5002"})
+
+	config, err := readServerConfig(cmd.Flags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []struct {
+		name          string
+		expected, got interface{}
+	}{
+		// Flags take precedence over the environment, which takes precedence over the config file.
+		{name: "tempo from the flag", expected: float32(130), got: config.tempo},
+		{name: "port from the flag", expected: 5002, got: config.port},
+		{name: "slave TTL from the environment", expected: 5 * time.Second, got: config.settings.slaveTTL},
+		{name: "max send failures from the environment", expected: int32(7), got: config.settings.maxSendFailures},
+		{name: "ppqn from the file", expected: int32(4), got: config.settings.ppqn},
+		{name: "timecode from the file", expected: "25", got: config.timecode.String()},
+		{name: "state from the file", expected: "oscsync.json", got: config.stateFile},
+		{name: "resume from the file", expected: true, got: config.resume},
+		{name: "defaults", expected: defaultSettings.maxTempo, got: config.settings.maxTempo},
+
+		// The command has no --standby, so the setting is left out.
+		{name: "standby", expected: "", got: config.primary},
+	} {
+		if !reflect.DeepEqual(field.expected, field.got) {
+			t.Fatalf("expected %s to be %v, got %v", field.name, field.expected, field.got)
+		}
+	}
+	if len(config.staticSlaves) != 2 || config.staticSlaves[0].slave.group != "lights" {
+		t.Fatalf("expected the static slaves of the file, got %+v", config.staticSlaves)
+	}
+}
+
+func TestReadServerConfigInvalid(t *testing.T) {
+	for _, yaml := range []string{
+		"ppqn: 5",
+		"min-tempo: 0",
+		"min-tempo: 100\nmax-tempo: 90",
+		"slave-ttl: -1s",
+		"max-send-failures: -1",
+		"timecode: \"60\"",
+		"static-slaves: 10.0.0.5:9000?ppqn=5",
+	} {
+		useConfig(t, yaml)
+
+		if _, err := readServerConfig(newTestServeCmd(t, nil).Flags()); err == nil {
+			t.Fatalf("expected an error for %q", yaml)
+		}
+	}
+}
+
+func TestConfigStrings(t *testing.T) {
+	for _, testcase := range []struct {
+		name  string
+		value interface{}
+	}{
+		{name: "comma-separated", value: "10.0.0.5:9000, 10.0.0.6:8000,,"},
+		{name: "list", value: []string{"10.0.0.5:9000", "10.0.0.6:8000"}},
+		{name: "list of comma-separated", value: []string{"10.0.0.5:9000,", " 10.0.0.6:8000"}},
+	} {
+		viper.Reset()
+		viper.Set("peers", testcase.value)
+
+		if expected, got := []string{"10.0.0.5:9000", "10.0.0.6:8000"}, configStrings("peers"); !reflect.DeepEqual(expected, got) {
+			t.Fatalf("%s: expected %q, got %q", testcase.name, expected, got)
+		}
+	}
+	viper.Reset()
+
+	// Environment variables are comma-separated.
+	t.Setenv("OSCSYNC_PEERS", "10.0.0.5:9000,10.0.0.6:8000")
+	useConfig(t, "")
+
+	if expected, got := []string{"10.0.0.5:9000", "10.0.0.6:8000"}, configStrings("peers"); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	path := useConfig(t, "slave-ttl: 10s\nppqn: 4")
+
+	config, err := readServerConfig(newTestServeCmd(t, nil).Flags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reload writes the config file and reloads it like the config watcher does.
+	reload := func(yaml string) settings {
+		writeConfig(t, path, yaml)
+
+		if err := viper.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+		srv.reloadSettings(path)
+		return srv.live.Get()
+	}
+	if s := reload("slave-ttl: 20s\nppqn: 2"); s.slaveTTL != 20*time.Second || s.ppqn != 2 {
+		t.Fatalf("expected the new settings, got %+v", s)
+	}
+	// Invalid settings are rejected and the old ones are kept.
+	if s := reload("slave-ttl: 30s\nppqn: 5"); s.slaveTTL != 20*time.Second || s.ppqn != 2 {
+		t.Fatalf("expected the settings to be kept, got %+v", s)
+	}
+	if s := reload("max-tempo: 0.5"); s.maxTempo != defaultSettings.maxTempo {
+		t.Fatalf("expected the settings to be kept, got %+v", s)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// Cue is a message that the master sends to slaves at a musical position.
+// If Group is not empty the cue is only sent to the slaves in that group.
+type Cue struct {
+	ID      int32
+	Bar     uint64
+	Beat    uint64
+	Group   string
+	Message osc.Message
+}
+
+// cueSchedule holds the cues of a server.
+// It is safe for concurrent use since cues are added by the OSC handlers
+// and read by the main loop.
+type cueSchedule struct {
+	mu     sync.Mutex
+	cues   map[int32]Cue
+	nextID int32
+}
+
+// newCueSchedule creates an empty cue schedule.
+func newCueSchedule() *cueSchedule {
+	return &cueSchedule{cues: map[int32]Cue{}, nextID: 1}
+}
+
+// Add adds a cue to the schedule and returns the cue with its ID set.
+func (cs *cueSchedule) Add(cue Cue) Cue {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cue.ID = cs.nextID
+	cs.nextID++
+	cs.cues[cue.ID] = cue
+	return cue
+}
+
+// Restore adds a cue to the schedule keeping its ID.
+func (cs *cueSchedule) Restore(cue Cue) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.cues[cue.ID] = cue
+	if cue.ID >= cs.nextID {
+		cs.nextID = cue.ID + 1
+	}
+}
+
+// At returns all the cues at the given bar and beat, ordered by ID.
+func (cs *cueSchedule) At(bar, beat uint64) []Cue {
+	cues := []Cue{}
+	for _, cue := range cs.List() {
+		if cue.Bar == bar && cue.Beat == beat {
+			cues = append(cues, cue)
+		}
+	}
+	return cues
+}
+
+// List returns all the cues ordered by ID.
+func (cs *cueSchedule) List() []Cue {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cues := make([]Cue, 0, len(cs.cues))
+	for _, cue := range cs.cues {
+		cues = append(cues, cue)
+	}
+	sort.Slice(cues, func(i, j int) bool {
+		return cues[i].ID < cues[j].ID
+	})
+	return cues
+}
+
+// Remove removes a cue from the schedule.
+func (cs *cueSchedule) Remove(id int32) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.cues[id]; !ok {
+		return errors.Errorf("no cue with id %d", id)
+	}
+	delete(cs.cues, id)
+	return nil
+}
+
+// HandleCueAdd handles the OSC message to add a cue for all the slaves.
+// The master replies with the ID of the new cue.
+func (sess *Session) HandleCueAdd(m osc.Message) error {
+	return sess.addCue(m, "", m.Arguments)
+}
+
+// HandleGroupCueAdd handles the OSC message to add a cue for a group of slaves.
+// The master replies with the ID of the new cue.
+func (sess *Session) HandleGroupCueAdd(m osc.Message) error {
+	if len(m.Arguments) == 0 {
+		return errors.New("expected at least 1 argument")
+	}
+	group, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading group")
+	}
+	return sess.addCue(m, group, m.Arguments[1:])
+}
+
+// addCue adds a cue for group from the arguments bar, beat, address and the arguments of the cue message.
+func (sess *Session) addCue(m osc.Message, group string, args osc.Arguments) error {
+	if len(args) < 3 {
+		return errors.Errorf("expected at least 3 cue arguments, got %d", len(args))
+	}
+	bar, err := args[0].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading bar")
+	}
+	beat, err := args[1].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading beat")
+	}
+	if bar < 1 || beat < 1 {
+		return errors.Errorf("bar and beat are counted from 1, got %d and %d", bar, beat)
+	}
+	address, err := args[2].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading address")
+	}
+	if err := osc.ValidateAddress(address); err != nil {
+		return errors.Wrapf(err, "validating address %s", address)
+	}
+	cue := sess.cues.Add(Cue{
+		Bar:   uint64(bar),
+		Beat:  uint64(beat),
+		Group: group,
+		Message: osc.Message{
+			Address:   address,
+			Arguments: args[3:],
+		},
+	})
+	return sess.conn.SendTo(m.Sender, osc.Message{
+		Address: "/reply",
+		Arguments: osc.Arguments{
+			osc.String(m.Address),
+			osc.Int(cue.ID),
+		},
+	})
+}
+
+// HandleCueList handles the OSC message to list the cues.
+// The master sends one reply for each cue.
+func (sess *Session) HandleCueList(m osc.Message) error {
+	for _, cue := range sess.cues.List() {
+		args := osc.Arguments{
+			osc.String(sess.address(syncosc.AddressCueList)),
+			osc.Int(cue.ID),
+			osc.String(cue.Group),
+			osc.Int(int32(cue.Bar)),
+			osc.Int(int32(cue.Beat)),
+			osc.String(cue.Message.Address),
+		}
+		if err := sess.conn.SendTo(m.Sender, osc.Message{
+			Address:   "/reply",
+			Arguments: append(args, cue.Message.Arguments...),
+		}); err != nil {
+			return errors.Wrap(err, "sending cue list reply")
+		}
+	}
+	return nil
+}
+
+// HandleCueRemove handles the OSC message to remove a cue.
+func (sess *Session) HandleCueRemove(m osc.Message) error {
+	if expected, got := 1, len(m.Arguments); expected != got {
+		return errors.Errorf("expected %d arguments, got %d", expected, got)
+	}
+	id, err := m.Arguments[0].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading cue id")
+	}
+	return sess.cues.Remove(id)
+}
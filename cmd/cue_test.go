@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// rawSlave is a slave that keeps the packets it receives as they are,
+// so that bundles can be told apart from messages.
+type rawSlave struct {
+	conn  *net.UDPConn
+	slave *slave
+}
+
+// newRawSlave creates a slave in a group on the loopback interface.
+func newRawSlave(t *testing.T, group string) *rawSlave {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &rawSlave{
+		conn:  conn,
+		slave: &slave{addr: conn.LocalAddr(), group: group},
+	}
+}
+
+// read returns the next packet the slave receives.
+func (rs *rawSlave) read(t *testing.T) RecordedPacket {
+	t.Helper()
+
+	if err := rs.conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65536)
+
+	n, _, err := rs.conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return RecordedPacket{Data: buf[:n]}
+}
+
+// readMessages returns the messages of the next packet the slave receives
+// and whether the packet is a bundle.
+func (rs *rawSlave) readMessages(t *testing.T) ([]osc.Message, bool) {
+	t.Helper()
+
+	p := rs.read(t)
+	msgs, err := p.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs, bytes.HasPrefix(p.Data, []byte(osc.BundleTag))
+}
+
+// addTestCue adds a cue with a message that has the given address.
+func addTestCue(t *testing.T, sess *Session, client *testMaster, group string, bar, beat int32, address string) int32 {
+	t.Helper()
+
+	args := osc.Arguments{osc.Int(bar), osc.Int(beat), osc.String(address)}
+	m := osc.Message{Address: syncosc.AddressCueAdd, Arguments: args, Sender: client.conn.LocalAddr()}
+
+	var err error
+	if group == "" {
+		err = sess.HandleCueAdd(m)
+	} else {
+		m.Address = syncosc.AddressGroupCueAdd
+		m.Arguments = append(osc.Arguments{osc.String(group)}, args...)
+		err = sess.HandleGroupCueAdd(m)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := client.receive(t)
+
+	id, err := reply.Arguments[1].ReadInt32()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCueSchedule(t *testing.T) {
+	cs := newCueSchedule()
+
+	first := cs.Add(Cue{Bar: 2, Beat: 1, Message: osc.Message{Address: "/a"}})
+	second := cs.Add(Cue{Bar: 2, Beat: 1, Group: "drums", Message: osc.Message{Address: "/b"}})
+	cs.Add(Cue{Bar: 2, Beat: 2, Message: osc.Message{Address: "/c"}})
+
+	if first.ID != 1 || second.ID != 2 {
+		t.Fatalf("expected IDs 1 and 2, got %d and %d", first.ID, second.ID)
+	}
+	at := cs.At(2, 1)
+	if len(at) != 2 || at[0].Message.Address != "/a" || at[1].Message.Address != "/b" {
+		t.Fatalf("expected /a and /b at 2.1, got %+v", at)
+	}
+	if cues := cs.At(3, 1); len(cues) != 0 {
+		t.Fatalf("expected no cues at 3.1, got %+v", cues)
+	}
+	if err := cs.Remove(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Remove(first.ID); err == nil {
+		t.Fatal("expected an error removing a cue twice")
+	}
+	// Restored cues keep their IDs and new cues come after them.
+	cs.Restore(Cue{ID: 10, Bar: 4, Beat: 1})
+	if cue := cs.Add(Cue{Bar: 5, Beat: 1}); cue.ID != 11 {
+		t.Fatalf("expected ID 11 after a restored cue, got %d", cue.ID)
+	}
+	var ids []int32
+	for _, cue := range cs.List() {
+		ids = append(ids, cue.ID)
+	}
+	if expected, got := []int32{2, 3, 10, 11}, ids; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected IDs %v, got %v", expected, got)
+	}
+}
+
+func TestCueBundledWithPulse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess   = newTestSession(ctx, t, 120)
+		client = newTestMaster(ctx, t)
+		drums  = newRawSlave(t, "drums")
+		keys   = newRawSlave(t, "keys")
+	)
+	for _, rs := range []*rawSlave{drums, keys} {
+		rs.slave.ppqn = syncosc.PulsesPerQuarter
+		sess.addSlave(rs.slave)
+	}
+	addTestCue(t, sess, client, "", 1, 2, "/all")
+	addTestCue(t, sess, client, "drums", 1, 2, "/fill")
+	addTestCue(t, sess, client, "", 2, 1, "/later")
+
+	// Pulse 23 is the last pulse of the first beat and 24 is the second beat.
+	sess.pulse = 23
+
+	for pulse := 0; pulse < 2; pulse++ {
+		if err := sess.tick(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, testcase := range []struct {
+		slave     *rawSlave
+		addresses []string
+	}{
+		{slave: drums, addresses: []string{syncosc.AddressPulse, "/all", "/fill"}},
+		{slave: keys, addresses: []string{syncosc.AddressPulse, "/all"}},
+	} {
+		// A pulse without cues is a message.
+		msgs, bundle := testcase.slave.readMessages(t)
+		if bundle || len(msgs) != 1 || msgs[0].Address != syncosc.AddressPulse {
+			t.Fatalf("expected a pulse message, got %+v", msgs)
+		}
+		// The cues are in the same bundle as their pulse, after it.
+		msgs, bundle = testcase.slave.readMessages(t)
+		if !bundle {
+			t.Fatal("expected a bundle")
+		}
+		if expected, got := len(testcase.addresses), len(msgs); expected != got {
+			t.Fatalf("expected %d messages, got %+v", expected, msgs)
+		}
+		for i, address := range testcase.addresses {
+			if msgs[i].Address != address {
+				t.Fatalf("expected message %d to be %s, got %s", i, address, msgs[i].Address)
+			}
+		}
+		if count, err := msgs[0].Arguments[1].ReadInt32(); err != nil || count != 24 {
+			t.Fatalf("expected pulse 24, got %v", msgs[0].Arguments)
+		}
+	}
+}
+
+func TestCueListRemove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess   = newTestSession(ctx, t, 120)
+		client = newTestMaster(ctx, t)
+		list   = osc.Message{Address: syncosc.AddressCueList, Sender: client.conn.LocalAddr()}
+	)
+	addTestCue(t, sess, client, "", 1, 2, "/all")
+	fill := addTestCue(t, sess, client, "drums", 3, 4, "/fill")
+	addTestCue(t, sess, client, "", 5, 1, "/later")
+
+	// listCues returns the ID, group and address of every cue in the list.
+	listCues := func() []string {
+		if err := sess.HandleCueList(list); err != nil {
+			t.Fatal(err)
+		}
+		var cues []string
+		for range sess.cues.List() {
+			reply := client.receive(t)
+			if len(reply.Arguments) != 6 {
+				t.Fatalf("expected 6 arguments, got %v", reply.Arguments)
+			}
+			id, _ := reply.Arguments[1].ReadInt32()
+			group, _ := reply.Arguments[2].ReadString()
+			address, _ := reply.Arguments[5].ReadString()
+			cues = append(cues, fmt.Sprintf("%d %s %s", id, group, address))
+		}
+		return cues
+	}
+	if expected, got := []string{"1  /all", "2 drums /fill", "3  /later"}, listCues(); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected cues %q, got %q", expected, got)
+	}
+	remove := osc.Message{Address: syncosc.AddressCueRemove, Arguments: osc.Arguments{osc.Int(fill)}}
+
+	if err := sess.HandleCueRemove(remove); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"1  /all", "3  /later"}, listCues(); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected cues %q, got %q", expected, got)
+	}
+	if err := sess.HandleCueRemove(remove); err == nil {
+		t.Fatal("expected an error removing a cue that was removed")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/oscsync/dnssd"
+	"github.com/scgolang/oscsync/syncclient"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// discoverCmd represents the discover command
+var discoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "List the oscsync masters on the local network",
+	Long: `List the oscsync masters on the local network
+
+Masters are found with mDNS if they were started with --advertise.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("timeout"))
+		defer cancel()
+
+		masters, err := syncclient.DiscoverAddr(ctx, viper.GetString("mdns-addr"))
+		if err != nil {
+			return errors.Wrap(err, "discovering masters")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tADDRESS\tHOST")
+
+		for _, master := range masters {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", master.Instance, master.Addr(), strings.TrimSuffix(master.Host, "."))
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(discoverCmd)
+
+	flags := discoverCmd.Flags()
+	flags.Duration("timeout", syncclient.DefaultDiscoveryTimeout, "how long to wait for masters to answer")
+	flags.String("mdns-addr", dnssd.MulticastAddr, "address mDNS questions are sent to")
+}
+
+// runResponder advertises the server with mDNS until the context is done.
+func (srv *Server) runResponder(ctx context.Context) error {
+	svc := dnssd.Service{Instance: srv.advertise, Port: srv.port}
+
+	// A server that listens on one address is only advertised with that address.
+	if ip := net.ParseIP(srv.host); ip != nil && !ip.IsUnspecified() {
+		svc.IPs = []net.IP{ip}
+	}
+	r, err := dnssd.NewResponder(srv.mdnsAddr, svc)
+	if err != nil {
+		return errors.Wrap(err, "creating mDNS responder")
+	}
+	return errors.Wrap(r.Serve(ctx), "advertising server")
+}
@@ -0,0 +1,120 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+)
+
+// event is something that happened in a session, as the OSC message that announces it.
+// Events are published for every pulse and for every control change that is applied.
+type event struct {
+	session string
+
+	// group is the group of slaves the message was sent to.
+	// The empty group means all the slaves.
+	group string
+
+	msg osc.Message
+
+	// position is the position of a pulse.
+	// It is only set for pulse events.
+	position Position
+
+	// cues are the cues that were sent with a pulse.
+	// They are only set for pulse events.
+	cues []Cue
+}
+
+// eventHub passes the events of the sessions to subscribers
+// such as OSCQuery listeners.
+// It is safe for concurrent use.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+}
+
+// newEventHub creates an event hub without subscribers.
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[chan event]struct{}{}}
+}
+
+// Subscribe returns a channel that receives the events
+// and a func that cancels the subscription.
+// Events are dropped if the channel is full, so the main loops never block on a slow subscriber.
+func (h *eventHub) Subscribe(size int) (<-chan event, func()) {
+	ch := make(chan event, size)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Publish sends an event to every subscriber.
+// Publishing to a nil hub does nothing.
+func (h *eventHub) Publish(e event) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// State returns a snapshot of the session from its main loop.
+func (sess *Session) State(ctx context.Context) (SessionState, error) {
+	reply := make(chan SessionState, 1)
+
+	select {
+	case <-ctx.Done():
+		return SessionState{}, errors.Wrap(ctx.Err(), "requesting session state")
+	case sess.stateRequests <- reply:
+	}
+	select {
+	case <-ctx.Done():
+		return SessionState{}, errors.Wrap(ctx.Err(), "waiting for session state")
+	case state := <-reply:
+		return state, nil
+	}
+}
+
+// queryTimeout is how long an OSC query waits for the state of a session.
+const queryTimeout = time.Second
+
+// query returns a snapshot of the session for a method that answers a query.
+// Methods run outside the main loop, so they must not read the session's fields directly.
+func (sess *Session) query() (SessionState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	return sess.State(ctx)
+}
@@ -0,0 +1,241 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// exportMIDICmd represents the export-midi command
+var exportMIDICmd = &cobra.Command{
+	Use:   "export-midi [file]",
+	Short: "Export the tempo map of a session to a Standard MIDI File",
+	Long: `Export the tempo map of a session to a Standard MIDI File
+
+The tempo changes, meter changes and cues of a session are either recorded from the events
+of a master's HTTP API given with --http, until interrupted or the duration has passed,
+or read from a recording made with oscsync record given with --recording.
+Tempo ramps become a tempo event on every pulse that changes the tempo,
+and cues become markers with their address and arguments.
+
+The file has one pulse per tick, so its division is 24 ticks per quarter note
+for the HTTP API and --ppqn for recordings. The time the transport was stopped is left out.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.Errorf("expected a MIDI file, got %d arguments", len(args))
+		}
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		var (
+			addr      = viper.GetString("http")
+			recording = viper.GetString("recording")
+			session   = viper.GetString("session")
+			tm        *tempoMap
+		)
+		switch {
+		case addr != "" && recording != "":
+			return errors.New("expected either --http or --recording, got both")
+		case addr != "":
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer cancel()
+
+			if d := viper.GetDuration("duration"); d > 0 {
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+			tm = newTempoMap(session, syncosc.PulsesPerQuarter)
+			if err := streamTempoMap(ctx, addr, tm); err != nil {
+				return err
+			}
+		case recording != "":
+			packets, err := loadRecording(recording)
+			if err != nil {
+				return err
+			}
+			tm = newTempoMap(session, viper.GetInt("ppqn"))
+			if err := addRecording(tm, packets); err != nil {
+				return err
+			}
+		default:
+			return errors.New("expected --http or --recording")
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return errors.Wrap(err, "creating MIDI file")
+		}
+		if err := tm.WriteSMF(f, viper.GetInt("format")); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return errors.Wrap(f.Close(), "closing MIDI file")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportMIDICmd)
+
+	flags := exportMIDICmd.Flags()
+	flags.String("http", "", "host:port of the HTTP API of the master to record the events of")
+	flags.String("recording", "", "recording made with oscsync record to read instead")
+	flags.String("session", "", "session to export, the default session if empty")
+	flags.Duration("duration", 0, "how long to record events, 0 records until interrupted")
+	flags.Int("ppqn", syncosc.PulsesPerQuarter, "pulses per quarter note of the recording")
+	flags.Int("format", 1, "SMF format, 0 or 1")
+}
+
+// eventMessage is the data of a change or cue event of the HTTP API.
+type eventMessage struct {
+	Address   string          `json:"address"`
+	Arguments []ArgumentState `json:"arguments"`
+}
+
+// eventPulse is the data of a pulse event of the HTTP API.
+type eventPulse struct {
+	Tempo float32 `json:"tempo"`
+	Pulse int32   `json:"pulse"`
+}
+
+// streamTempoMap adds the events of a session from the HTTP API at addr to a tempo map
+// until the context is done. It starts with the meter of the session.
+func streamTempoMap(ctx context.Context, addr string, tm *tempoMap) error {
+	query := url.Values{}
+	if tm.session != "" {
+		query.Set("session", tm.session)
+	}
+	base := "http://" + addr
+
+	var meter MeterBody
+	if err := getJSON(ctx, base+"/meter?"+query.Encode(), &meter); err != nil {
+		return errors.Wrap(err, "getting meter")
+	}
+	if err := tm.Meter(Meter{Beats: meter.Beats, Unit: meter.Unit}); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/events?"+query.Encode(), nil)
+	if err != nil {
+		return errors.Wrap(err, "creating events request")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "requesting events")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("requesting events: %s", resp.Status)
+	}
+	if err := readEvents(resp.Body, tm); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// getJSON decodes the JSON body of a GET request.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// readEvents adds the server-sent events of the HTTP API to a tempo map until r ends.
+// Pulse, change and cue events are added, all the others are ignored.
+func readEvents(r io.Reader, tm *tempoMap) error {
+	var (
+		scanner = bufio.NewScanner(r)
+		name    string
+		data    string
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			if err := addEvent(tm, name, data); err != nil {
+				return errors.Wrapf(err, "adding %s event", name)
+			}
+			name, data = "", ""
+		}
+	}
+	return errors.Wrap(scanner.Err(), "reading events")
+}
+
+// addEvent adds a server-sent event to a tempo map.
+func addEvent(tm *tempoMap, name, data string) error {
+	switch name {
+	case "pulse":
+		var p eventPulse
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return err
+		}
+		tm.Pulse(p.Tempo, p.Pulse)
+	case "change", "cue":
+		var m eventMessage
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return err
+		}
+		args, err := decodeArguments(m.Arguments)
+		if err != nil {
+			return err
+		}
+		return tm.Add(osc.Message{Address: m.Address, Arguments: args})
+	}
+	return nil
+}
+
+// addRecording adds the messages of a recording to a tempo map.
+func addRecording(tm *tempoMap, packets []RecordedPacket) error {
+	for i, p := range packets {
+		msgs, err := p.Messages()
+		if err != nil {
+			return errors.Wrapf(err, "reading packet %d of recording", i)
+		}
+		for _, m := range msgs {
+			if err := tm.Add(m); err != nil {
+				return errors.Wrapf(err, "adding packet %d of recording", i)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// Groove is a timing template that delays pulses.
+// Offsets are measured in pulses and repeat every len(Offsets) pulses, starting on the downbeat.
+type Groove struct {
+	Name    string    `json:"name"`
+	Offsets []float32 `json:"offsets"`
+}
+
+// NewGroove creates a groove from a list of offsets.
+// Offsets can not be negative, and each offset must be less than one pulse
+// more than the next one so that the pulses stay in order.
+func NewGroove(name string, offsets []float32) (Groove, error) {
+	if name == "" {
+		return Groove{}, errors.New("groove name must not be empty")
+	}
+	if len(offsets) == 0 {
+		return Groove{}, errors.New("groove must have at least one offset")
+	}
+	for i, offset := range offsets {
+		if offset < 0 {
+			return Groove{}, errors.Errorf("pulses can only be delayed, offset %d is %f", i, offset)
+		}
+	}
+	// Every pulse has to be sent before the next one, also when the groove repeats.
+	for i, offset := range offsets {
+		if next := offsets[(i+1)%len(offsets)] + 1; offset >= next {
+			return Groove{}, errors.Errorf("offset %d is %f, so its pulse would be sent after the next pulse", i, offset)
+		}
+	}
+	return Groove{Name: name, Offsets: offsets}, nil
+}
+
+// NewSwing creates a groove that swings notes on the given grid, e.g. 16 for 16th notes.
+// The percentage is how much of each pair of grid notes is taken by the first one,
+// so 50 is straight and 66 is a triplet feel.
+func NewSwing(name string, percent float32, grid int32) (Groove, error) {
+	if percent < 50 || percent >= 100 {
+		return Groove{}, errors.Errorf("swing percentage must be in [50, 100), got %f", percent)
+	}
+	if grid <= 0 || syncosc.PulsesPerBar%grid != 0 {
+		return Groove{}, errors.Errorf("invalid swing grid %d", grid)
+	}
+	var (
+		g       = int(syncosc.PulsesPerBar / grid) // pulses per grid note
+		first   = 2 * percent / 100                // length of a pulse in the first note of the pair
+		second  = 2 - first                        // length of a pulse in the second note of the pair
+		offsets = make([]float32, 2*g)
+	)
+	for i := range offsets {
+		swung := float32(i) * first
+		if i >= g {
+			swung = float32(g)*first + float32(i-g)*second
+		}
+		offsets[i] = swung - float32(i)
+	}
+	return NewGroove(name, offsets)
+}
+
+// Offset returns the delay of the pulse that is the given number of pulses after the downbeat.
+func (g Groove) Offset(elapsed uint64, pulseDuration time.Duration) time.Duration {
+	return time.Duration(float64(g.Offsets[elapsed%uint64(len(g.Offsets))]) * float64(pulseDuration))
+}
+
+// grooveLibrary holds the grooves of a session.
+// It is safe for concurrent use since grooves are defined by the OSC handlers
+// and read by the main loop.
+type grooveLibrary struct {
+	mu      sync.RWMutex
+	grooves map[string]Groove
+}
+
+// newGrooveLibrary creates an empty groove library.
+func newGrooveLibrary() *grooveLibrary {
+	return &grooveLibrary{grooves: map[string]Groove{}}
+}
+
+// Add adds a groove to the library, replacing any groove with the same name.
+func (gl *grooveLibrary) Add(g Groove) {
+	gl.mu.Lock()
+	gl.grooves[g.Name] = g
+	gl.mu.Unlock()
+}
+
+// Get returns the named groove.
+func (gl *grooveLibrary) Get(name string) (Groove, bool) {
+	gl.mu.RLock()
+	defer gl.mu.RUnlock()
+
+	g, ok := gl.grooves[name]
+	return g, ok
+}
+
+// List returns all the grooves ordered by name.
+func (gl *grooveLibrary) List() []Groove {
+	gl.mu.RLock()
+	defer gl.mu.RUnlock()
+
+	grooves := make([]Groove, 0, len(gl.grooves))
+	for _, g := range gl.grooves {
+		grooves = append(grooves, g)
+	}
+	sort.Slice(grooves, func(i, j int) bool {
+		return grooves[i].Name < grooves[j].Name
+	})
+	return grooves
+}
+
+// Remove removes a groove from the library.
+func (gl *grooveLibrary) Remove(name string) error {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+
+	if _, ok := gl.grooves[name]; !ok {
+		return errors.Errorf("no groove named %q", name)
+	}
+	delete(gl.grooves, name)
+	return nil
+}
+
+// HandleGrooveAdd handles the OSC message to define a groove from a list of offsets in pulses.
+func (sess *Session) HandleGrooveAdd(m osc.Message) error {
+	if len(m.Arguments) < 2 {
+		return errors.Errorf("expected at least 2 arguments, got %d", len(m.Arguments))
+	}
+	name, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading groove name")
+	}
+	offsets := make([]float32, len(m.Arguments)-1)
+	for i, arg := range m.Arguments[1:] {
+		if offsets[i], err = arg.ReadFloat32(); err != nil {
+			return errors.Wrapf(err, "reading offset %d", i)
+		}
+	}
+	g, err := NewGroove(name, offsets)
+	if err != nil {
+		return err
+	}
+	sess.grooves.Add(g)
+	return nil
+}
+
+// HandleGrooveSwing handles the OSC message to define a swing groove.
+func (sess *Session) HandleGrooveSwing(m osc.Message) error {
+	if expected, got := 3, len(m.Arguments); expected != got {
+		return errors.Errorf("expected %d arguments, got %d", expected, got)
+	}
+	name, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading groove name")
+	}
+	percent, err := m.Arguments[1].ReadFloat32()
+	if err != nil {
+		return errors.Wrap(err, "reading swing percentage")
+	}
+	grid, err := m.Arguments[2].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading swing grid")
+	}
+	g, err := NewSwing(name, percent, grid)
+	if err != nil {
+		return err
+	}
+	sess.grooves.Add(g)
+	return nil
+}
+
+// HandleGrooveList handles the OSC message to list the grooves.
+// The master sends one reply for each groove.
+func (sess *Session) HandleGrooveList(m osc.Message) error {
+	for _, g := range sess.grooves.List() {
+		args := osc.Arguments{
+			osc.String(sess.address(syncosc.AddressGrooveList)),
+			osc.String(g.Name),
+		}
+		for _, offset := range g.Offsets {
+			args = append(args, osc.Float(offset))
+		}
+		if err := sess.conn.SendTo(m.Sender, osc.Message{
+			Address:   "/reply",
+			Arguments: args,
+		}); err != nil {
+			return errors.Wrap(err, "sending groove list reply")
+		}
+	}
+	return nil
+}
+
+// HandleGrooveRemove handles the OSC message to remove a groove.
+// Slaves that were assigned the groove receive straight pulses.
+func (sess *Session) HandleGrooveRemove(m osc.Message) error {
+	if expected, got := 1, len(m.Arguments); expected != got {
+		return errors.Errorf("expected %d arguments, got %d", expected, got)
+	}
+	name, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading groove name")
+	}
+	return sess.grooves.Remove(name)
+}
+
+// HandleGrooveGroup handles the OSC message to assign a groove to a group.
+// The empty groove name means the group receives straight pulses.
+func (sess *Session) HandleGrooveGroup(m osc.Message) error {
+	if len(m.Arguments) < 2 {
+		return errors.Errorf("expected at least 2 arguments, got %d", len(m.Arguments))
+	}
+	group, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading group")
+	}
+	name, err := m.Arguments[1].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading groove name")
+	}
+	return sess.assignGroove(m, 2, func(sess *Session) error {
+		sess.groupGrooves[group] = name
+		return nil
+	})
+}
+
+// HandleGrooveSlave handles the OSC message to assign a groove to a slave.
+// A slave's own groove takes precedence over the groove of its group.
+// The empty groove name means the slave uses the groove of its group.
+func (sess *Session) HandleGrooveSlave(m osc.Message) error {
+	if len(m.Arguments) < 3 {
+		return errors.Errorf("expected at least 3 arguments, got %d", len(m.Arguments))
+	}
+	addr, err := readUDPAddr(m)
+	if err != nil {
+		return errors.Wrap(err, "getting addr from osc message")
+	}
+	name, err := m.Arguments[2].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading groove name")
+	}
+	return sess.assignGroove(m, 3, func(sess *Session) error {
+		sess.slaveGrooves[addr.String()] = name
+		return nil
+	})
+}
+
+// assignGroove schedules a groove assignment.
+// The quantization is read from the argument at idx.
+func (sess *Session) assignGroove(m osc.Message, idx int, apply func(sess *Session) error) error {
+	q, err := readQuantization(m, idx)
+	if err != nil {
+		return err
+	}
+	return sess.submit(change{
+		quantize: q,
+		msg:      osc.Message{Address: m.Address, Arguments: m.Arguments[:idx]},
+		quiet:    true,
+		apply:    apply,
+	})
+}
+
+// grooveOffset returns how long a slave's pulse should be delayed.
+func (sess *Session) grooveOffset(s *slave, pulse uint64) time.Duration {
+	name := sess.slaveGrooves[s.addr.String()]
+	if name == "" {
+		name = sess.groupGrooves[s.group]
+	}
+	if name == "" {
+		return 0
+	}
+	g, ok := sess.grooves.Get(name)
+	if !ok {
+		return 0
+	}
+	return g.Offset(pulse-sess.barOrigin, syncosc.GetPulseDuration(sess.tempo))
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+func TestNewSwing(t *testing.T) {
+	for _, testcase := range []struct {
+		percent float32
+		grid    int32
+
+		// length is the number of offsets and second is the offset
+		// of the second note of each pair.
+		length int
+		second float32
+	}{
+		{percent: 50, grid: 16, length: 12, second: 0},
+		{percent: 50, grid: 8, length: 24, second: 0},
+		{percent: 66, grid: 16, length: 12, second: 1.92},
+		{percent: 200.0 / 3, grid: 16, length: 12, second: 2},
+		{percent: 200.0 / 3, grid: 8, length: 24, second: 4},
+		{percent: 75, grid: 4, length: 48, second: 12},
+	} {
+		g, err := NewSwing("swing", testcase.percent, testcase.grid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := testcase.length, len(g.Offsets); expected != got {
+			t.Fatalf("%f%% of %d: expected %d offsets, got %d", testcase.percent, testcase.grid, expected, got)
+		}
+		if g.Offsets[0] != 0 {
+			t.Fatalf("%f%% of %d: expected the downbeat to be straight, got %f", testcase.percent, testcase.grid, g.Offsets[0])
+		}
+		if got := g.Offsets[testcase.length/2]; math.Abs(float64(testcase.second-got)) > 1e-3 {
+			t.Fatalf("%f%% of %d: expected the second note to be delayed %f pulses, got %f", testcase.percent, testcase.grid, testcase.second, got)
+		}
+		// Straight swing delays nothing.
+		if testcase.percent == 50 {
+			for i, offset := range g.Offsets {
+				if offset != 0 {
+					t.Fatalf("expected offset %d of straight swing to be 0, got %f", i, offset)
+				}
+			}
+		}
+	}
+	for _, testcase := range []struct {
+		name    string
+		percent float32
+		grid    int32
+	}{
+		{name: "swing", percent: 49, grid: 16},
+		{name: "swing", percent: 100, grid: 16},
+		{name: "swing", percent: 60, grid: 0},
+		{name: "swing", percent: 60, grid: -16},
+		{name: "swing", percent: 60, grid: 7},
+		{name: "", percent: 60, grid: 16},
+	} {
+		if _, err := NewSwing(testcase.name, testcase.percent, testcase.grid); err == nil {
+			t.Fatalf("expected an error for %q, %f%% of %d", testcase.name, testcase.percent, testcase.grid)
+		}
+	}
+}
+
+func TestNewGroove(t *testing.T) {
+	for _, testcase := range []struct {
+		name    string
+		offsets []float32
+		valid   bool
+	}{
+		{name: "late", offsets: []float32{2}, valid: true},
+		{name: "push", offsets: []float32{0, 0.5, 0.25}, valid: true},
+		{name: "drag", offsets: []float32{1.5, 1, 0.9}, valid: true},
+		{name: "", offsets: []float32{0}},
+		{name: "empty"},
+		{name: "negative", offsets: []float32{0, -1}},
+		{name: "reversed", offsets: []float32{5, 0}},
+		{name: "collides", offsets: []float32{1, 0}},
+
+		// The last pulse would be sent after the downbeat of the next repetition.
+		{name: "wraps", offsets: []float32{0, 0.5, 1.5}},
+	} {
+		g, err := NewGroove(testcase.name, testcase.offsets)
+		if testcase.valid && err != nil {
+			t.Fatalf("%s: %s", testcase.name, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Fatalf("%s: expected an error for offsets %v", testcase.name, testcase.offsets)
+		}
+		if !testcase.valid {
+			continue
+		}
+		// The pulses are sent in order.
+		d := time.Second
+		for i := uint64(0); i < 10; i++ {
+			this := time.Duration(i)*d + g.Offset(i, d)
+			next := time.Duration(i+1)*d + g.Offset(i+1, d)
+			if this >= next {
+				t.Fatalf("%s: expected pulse %d to be sent before the next one", testcase.name, i)
+			}
+		}
+	}
+}
+
+func TestGrooveOffset(t *testing.T) {
+	g, err := NewGroove("push", []float32{0, 0.5, 0.25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := 20 * time.Millisecond
+
+	for elapsed, expected := range []time.Duration{0, 10 * time.Millisecond, 5 * time.Millisecond, 0, 10 * time.Millisecond} {
+		if got := g.Offset(uint64(elapsed), d); expected != got {
+			t.Fatalf("expected offset %s for pulse %d, got %s", expected, elapsed, got)
+		}
+	}
+}
+
+func TestSessionGrooveOffset(t *testing.T) {
+	sess := NewSession("", nil, 120)
+	sess.barOrigin = 96
+
+	for _, g := range []Groove{
+		{Name: "group", Offsets: []float32{1}},
+		{Name: "slave", Offsets: []float32{0.5}},
+	} {
+		sess.grooves.Add(g)
+	}
+	var (
+		d      = syncosc.GetPulseDuration(120)
+		drums  = &slave{addr: mustUDPAddr(t, "127.0.0.1:9000"), group: "drums"}
+		keys   = &slave{addr: mustUDPAddr(t, "127.0.0.1:9001"), group: "keys"}
+		solo   = &slave{addr: mustUDPAddr(t, "127.0.0.1:9002"), group: "drums"}
+		ghost  = &slave{addr: mustUDPAddr(t, "127.0.0.1:9003"), group: "drums"}
+		groups = map[string]string{"drums": "group", "keys": "missing"}
+	)
+	for group, name := range groups {
+		sess.groupGrooves[group] = name
+	}
+	sess.slaveGrooves[solo.addr.String()] = "slave"
+	sess.slaveGrooves[ghost.addr.String()] = ""
+
+	for _, testcase := range []struct {
+		name     string
+		slave    *slave
+		expected time.Duration
+	}{
+		{name: "group groove", slave: drums, expected: d},
+		{name: "missing groove", slave: keys, expected: 0},
+		{name: "slave groove before group groove", slave: solo, expected: d / 2},
+		{name: "empty slave groove", slave: ghost, expected: d},
+	} {
+		if got := sess.grooveOffset(testcase.slave, 100); testcase.expected != got {
+			t.Fatalf("%s: expected %s, got %s", testcase.name, testcase.expected, got)
+		}
+	}
+}
+
+// mustUDPAddr resolves a UDP address.
+func mustUDPAddr(t *testing.T, addr string) *net.UDPAddr {
+	t.Helper()
+
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestSendPulseGroove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		tempo  = float32(10)
+		d      = syncosc.GetPulseDuration(tempo)
+		sess   = newTestSession(ctx, t, tempo)
+		master = newTestMaster(ctx, t)
+		s      = &slave{addr: master.conn.LocalAddr(), group: "drums", ppqn: syncosc.PulsesPerQuarter}
+	)
+	g, err := NewGroove("drag", []float32{0, 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.grooves.Add(g)
+	sess.groupGrooves["drums"] = g.Name
+
+	isPulse := func(count int32) func(osc.Arguments) bool {
+		return func(args osc.Arguments) bool {
+			c, err := args[1].ReadInt32()
+			return err == nil && c == count
+		}
+	}
+	start := time.Now()
+
+	// The second pulse is sent at the same time as the first and delayed by half a pulse.
+	for pulse := uint64(0); pulse < 2; pulse++ {
+		if err := sess.sendPulse(pulse, []*slave{s}, tempo, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delay := master.receiveMatching(t, syncosc.AddressPulse, isPulse(0)).Sub(start); delay > d/4 {
+		t.Fatalf("expected the first pulse straight away, got it after %s", delay)
+	}
+	if delay := master.receiveMatching(t, syncosc.AddressPulse, isPulse(1)).Sub(start); delay < d/2 || delay > d {
+		t.Fatalf("expected the second pulse after %s, got it after %s", d/2, delay)
+	}
+}
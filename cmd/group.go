@@ -0,0 +1,108 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// Group states.
+const (
+	GroupActive  = "active"
+	GroupMuted   = "muted"
+	GroupStopped = "stopped"
+)
+
+// HandleGroupMute handles the OSC message to mute a group.
+// Muted groups do not receive any messages from the master.
+func (sess *Session) HandleGroupMute(m osc.Message) error {
+	return sess.changeGroup(m, sess.address(syncosc.AddressGroupMute), func(sess *Session, group string) {
+		sess.muted[group] = true
+	})
+}
+
+// HandleGroupUnmute handles the OSC message to unmute a group.
+func (sess *Session) HandleGroupUnmute(m osc.Message) error {
+	return sess.changeGroup(m, sess.address(syncosc.AddressGroupUnmute), func(sess *Session, group string) {
+		delete(sess.muted, group)
+	})
+}
+
+// changeGroup schedules a change to the state of the group named in the first argument of m.
+// The optional second argument is a quantization.
+func (sess *Session) changeGroup(m osc.Message, address string, apply func(sess *Session, group string)) error {
+	if len(m.Arguments) == 0 {
+		return errors.New("expected at least 1 argument")
+	}
+	group, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading group")
+	}
+	if group == "" {
+		return errors.New("group must not be empty")
+	}
+	q, err := readQuantization(m, 1)
+	if err != nil {
+		return err
+	}
+	return sess.submit(change{
+		quantize: q,
+		group:    group,
+		msg: osc.Message{
+			Address:   address,
+			Arguments: osc.Arguments{osc.String(group)},
+		},
+		apply: func(sess *Session) error {
+			apply(sess, group)
+			return nil
+		},
+	})
+}
+
+// groupState returns the state of the named group.
+func (sess *Session) groupState(group string) string {
+	if sess.muted[group] {
+		return GroupMuted
+	}
+	if sess.stopped[group] {
+		return GroupStopped
+	}
+	return GroupActive
+}
+
+// readGroup reads an optional group string argument from an OSC message.
+func readGroup(m osc.Message, idx int) (string, error) {
+	if len(m.Arguments) <= idx {
+		return "", nil
+	}
+	group, err := m.Arguments[idx].ReadString()
+	return group, errors.Wrap(err, "reading group")
+}
+
+// receives returns true if the slave should receive messages targeted at group.
+// The empty group targets every slave.
+func (sess *Session) receives(s *slave, group string) bool {
+	if sess.muted[s.group] {
+		return false
+	}
+	return group == "" || s.group == group
+}
+
+// receivesPulses returns true if the slave should receive pulses and cues.
+func (sess *Session) receivesPulses(s *slave) bool {
+	return !sess.muted[s.group] && !sess.stopped[s.group]
+}
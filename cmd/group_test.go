@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// countPulses counts the pulses a slave receives for the given duration.
+func countPulses(m *testMaster, d time.Duration) int {
+	var (
+		n       int
+		timeout = time.After(d)
+	)
+	for {
+		select {
+		case msg := <-m.messages:
+			if msg.Address == syncosc.AddressPulse {
+				n++
+			}
+		case <-timeout:
+			return n
+		}
+	}
+}
+
+func TestGroupReceives(t *testing.T) {
+	var (
+		sess  = NewSession("", nil, 120)
+		drums = &slave{group: "drums"}
+		keys  = &slave{group: "keys"}
+		solo  = &slave{}
+	)
+	sess.muted["drums"] = true
+	sess.stopped["keys"] = true
+
+	for _, testcase := range []struct {
+		name   string
+		slave  *slave
+		group  string
+		pulses bool
+		msgs   bool
+	}{
+		{name: "muted", slave: drums, group: "", pulses: false, msgs: false},
+		{name: "muted in its group", slave: drums, group: "drums", pulses: false, msgs: false},
+		{name: "stopped", slave: keys, group: "", pulses: false, msgs: true},
+		{name: "stopped in its group", slave: keys, group: "keys", pulses: false, msgs: true},
+		{name: "other group", slave: keys, group: "drums", pulses: false, msgs: false},
+		{name: "no group", slave: solo, group: "", pulses: true, msgs: true},
+		{name: "no group targeted", slave: solo, group: "keys", pulses: true, msgs: false},
+	} {
+		if expected, got := testcase.pulses, sess.receivesPulses(testcase.slave); expected != got {
+			t.Fatalf("%s: expected receivesPulses to be %t, got %t", testcase.name, expected, got)
+		}
+		if expected, got := testcase.msgs, sess.receives(testcase.slave, testcase.group); expected != got {
+			t.Fatalf("%s: expected receives to be %t, got %t", testcase.name, expected, got)
+		}
+	}
+}
+
+func TestGroupMuteAndTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess  = newTestSession(ctx, t, 120)
+		drums = newTestMaster(ctx, t)
+		keys  = newTestMaster(ctx, t)
+	)
+	sess.addSlave(&slave{addr: drums.conn.LocalAddr(), group: "drums", ppqn: syncosc.PulsesPerQuarter})
+	sess.addSlave(&slave{addr: keys.conn.LocalAddr(), group: "keys", ppqn: syncosc.PulsesPerQuarter})
+
+	go func() { _ = sess.Main(ctx) }()
+	defer sess.close()
+
+	// change handles a message and waits for the main loop to apply it.
+	change := func(handle func(osc.Message) error, args []string, applied func(SessionState) bool) {
+		t.Helper()
+
+		m := osc.Message{}
+		for _, arg := range args {
+			m.Arguments = append(m.Arguments, osc.String(arg))
+		}
+		if err := handle(m); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the change to be applied", func() bool {
+			state, err := sess.query()
+			return err == nil && applied(state)
+		})
+		// Pulses that were sent before the change are still arriving.
+		countPulses(drums, 50*time.Millisecond)
+		countPulses(keys, 50*time.Millisecond)
+	}
+	expectPulses := func(drumsReceive, keysReceive bool) {
+		t.Helper()
+
+		var (
+			d             = 250 * time.Millisecond
+			drumsN, keysN int
+			done          = make(chan struct{})
+		)
+		go func() {
+			drumsN = countPulses(drums, d)
+			close(done)
+		}()
+		keysN = countPulses(keys, d)
+		<-done
+
+		if drumsReceive != (drumsN > 0) || keysReceive != (keysN > 0) {
+			t.Fatalf("expected drums to receive pulses %t and keys %t, got %d and %d pulses", drumsReceive, keysReceive, drumsN, keysN)
+		}
+	}
+	expectPulses(true, true)
+
+	// A muted group gets no pulses while the other slaves still do.
+	change(sess.HandleGroupMute, []string{"drums"}, func(state SessionState) bool {
+		return len(state.Muted) == 1
+	})
+	expectPulses(false, true)
+
+	change(sess.HandleGroupUnmute, []string{"drums"}, func(state SessionState) bool {
+		return len(state.Muted) == 0
+	})
+	expectPulses(true, true)
+
+	// Stopping a group stops its pulses but the session keeps playing.
+	change(sess.HandleTransport, []string{syncosc.TransportStop, "", "keys"}, func(state SessionState) bool {
+		return len(state.Stopped) == 1 && state.Playing
+	})
+	expectPulses(true, false)
+
+	change(sess.HandleTransport, []string{syncosc.TransportStart, "", "keys"}, func(state SessionState) bool {
+		return len(state.Stopped) == 0
+	})
+	expectPulses(true, true)
+}
@@ -0,0 +1,381 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// httpTimeout is how long an HTTP request waits for the state of a session.
+const httpTimeout = time.Second
+
+// TempoBody is the body of GET and PUT /tempo.
+type TempoBody struct {
+	Tempo    float32 `json:"tempo"`
+	Quantize string  `json:"quantize,omitempty"`
+}
+
+// MeterBody is the body of GET and PUT /meter.
+type MeterBody struct {
+	Beats    int32  `json:"beats"`
+	Unit     int32  `json:"unit"`
+	Quantize string `json:"quantize,omitempty"`
+}
+
+// TransportBody is the body of GET and PUT /transport.
+type TransportBody struct {
+	State    string `json:"state"`
+	Quantize string `json:"quantize,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// PositionResponse is the body of GET /position.
+type PositionResponse struct {
+	Pulse    uint64  `json:"pulse"`
+	Bar      uint64  `json:"bar"`
+	Beat     uint64  `json:"beat"`
+	Tick     uint64  `json:"tick"`
+	Position string  `json:"position"`
+	Tempo    float32 `json:"tempo"`
+	Meter    Meter   `json:"meter"`
+	Playing  bool    `json:"playing"`
+}
+
+// SlaveResponse is a slave in the body of GET /slaves.
+type SlaveResponse struct {
+	Addr    string `json:"addr"`
+	Group   string `json:"group"`
+	State   string `json:"state"`
+	Kind    string `json:"kind"`
+	Healthy bool   `json:"healthy"`
+}
+
+// runHTTP serves the HTTP API of the server until the context is done.
+func (srv *Server) runHTTP(ctx context.Context) error {
+	return errors.Wrap(serveHTTP(ctx, srv.httpAddr, srv.httpHandler()), "serving HTTP API")
+}
+
+// serveHTTP serves HTTP requests on addr until the context is done.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listening on %s", addr)
+	}
+	hs := &http.Server{Handler: handler}
+
+	go func() {
+		<-ctx.Done()
+		_ = hs.Close()
+	}()
+	if err := hs.Serve(l); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// httpHandler returns the handler of the HTTP API.
+// Every endpoint takes an optional session query parameter, the default session is used without it.
+// Changes are turned into the OSC messages of the OSC API and handled by the same methods.
+func (srv *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/tempo", srv.handleHTTP(http.MethodPut, func(r *http.Request, name string) (osc.Message, error) {
+		var req TempoBody
+		if err := decodeJSON(r, &req); err != nil {
+			return osc.Message{}, err
+		}
+		return controlMessage(name, syncosc.AddressTempo, req.Quantize, "", osc.Float(req.Tempo)), nil
+	}, func(state SessionState) interface{} {
+		return TempoBody{Tempo: state.Tempo}
+	}))
+	mux.HandleFunc("/meter", srv.handleHTTP(http.MethodPut, func(r *http.Request, name string) (osc.Message, error) {
+		var req MeterBody
+		if err := decodeJSON(r, &req); err != nil {
+			return osc.Message{}, err
+		}
+		return controlMessage(name, syncosc.AddressMeter, req.Quantize, "", osc.Int(req.Beats), osc.Int(req.Unit)), nil
+	}, func(state SessionState) interface{} {
+		return MeterBody{Beats: state.Meter.Beats, Unit: state.Meter.Unit}
+	}))
+	mux.HandleFunc("/transport", srv.handleHTTP(http.MethodPut, func(r *http.Request, name string) (osc.Message, error) {
+		var req TransportBody
+		if err := decodeJSON(r, &req); err != nil {
+			return osc.Message{}, err
+		}
+		return controlMessage(name, syncosc.AddressTransport, req.Quantize, req.Group, osc.String(req.State)), nil
+	}, func(state SessionState) interface{} {
+		if state.Playing {
+			return TransportBody{State: syncosc.TransportStart}
+		}
+		return TransportBody{State: syncosc.TransportStop}
+	}))
+	mux.HandleFunc("/position", srv.handleHTTP("", nil, func(state SessionState) interface{} {
+		pos := state.Position()
+		return PositionResponse{
+			Pulse:    state.Pulse,
+			Bar:      pos.Bar,
+			Beat:     pos.Beat,
+			Tick:     pos.Tick,
+			Position: pos.String(),
+			Tempo:    state.Tempo,
+			Meter:    state.Meter,
+			Playing:  state.Playing,
+		}
+	}))
+	mux.HandleFunc("/slaves", srv.handleHTTP("", nil, func(state SessionState) interface{} {
+		var (
+			muted   = stringSet(state.Muted)
+			stopped = stringSet(state.Stopped)
+			slaves  = make([]SlaveResponse, len(state.Slaves))
+		)
+		for i, s := range state.Slaves {
+			slaves[i] = SlaveResponse{
+				Addr:    s.Addr,
+				Group:   s.Group,
+				State:   GroupActive,
+				Kind:    (&slave{static: s.Static}).kind(),
+				Healthy: !s.Unhealthy,
+			}
+			if muted[s.Group] {
+				slaves[i].State = GroupMuted
+			} else if stopped[s.Group] {
+				slaves[i].State = GroupStopped
+			}
+		}
+		return slaves
+	}))
+	mux.HandleFunc("/cues", srv.handleHTTP("", nil, func(state SessionState) interface{} {
+		return state.Cues
+	}))
+	mux.HandleFunc("/events", srv.handleEvents)
+	mux.HandleFunc("/metrics", srv.handleMetrics)
+
+	return mux
+}
+
+// handleHTTP returns the handler of an endpoint.
+// GET requests reply with the result of get for the state of the session.
+// Requests with the change method are converted to an OSC message by change
+// and accepted once the message has been handled.
+func (srv *Server) handleHTTP(
+	method string,
+	change func(r *http.Request, name string) (osc.Message, error),
+	get func(state SessionState) interface{},
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("session")
+
+		switch r.Method {
+		case http.MethodGet:
+			sess, ok := srv.session(name)
+			if !ok {
+				writeError(w, http.StatusNotFound, errors.Errorf("session %q not found", name))
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), httpTimeout)
+			defer cancel()
+
+			state, err := sess.State(ctx)
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+			writeJSON(w, get(state))
+		case method:
+			// Peers that are not leading forward the message to the leader.
+			if _, ok := srv.session(name); !ok && srv.leader() == nil {
+				writeError(w, http.StatusNotFound, errors.Errorf("session %q not found", name))
+				return
+			}
+			m, err := change(r, name)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), httpTimeout)
+			defer cancel()
+
+			if err := srv.routeSessionContext(ctx, m); err != nil {
+				if errors.Cause(err) == errSessionStopped || ctx.Err() != nil {
+					writeError(w, http.StatusServiceUnavailable, err)
+				} else {
+					writeError(w, http.StatusBadRequest, err)
+				}
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		}
+	}
+}
+
+// handleEvents streams the events of a session as server-sent events.
+// Every pulse is a pulse event, every pulse on a beat is also a position event,
+// every control change that applies to all the slaves is a change event
+// and every cue that is sent to all the slaves is a cue event.
+func (srv *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("session")
+
+	if _, ok := srv.session(name); !ok {
+		writeError(w, http.StatusNotFound, errors.Errorf("session %q not found", name))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	events, cancel := srv.events.Subscribe(64)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			if e.session != name || e.group != "" {
+				continue
+			}
+			if err := writeEvent(w, name, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes a session event as one or more server-sent events.
+func writeEvent(w http.ResponseWriter, name string, e event) error {
+	if e.msg.Address != syncosc.SessionAddress(name, syncosc.AddressPulse) {
+		return writeSSE(w, "change", map[string]interface{}{
+			"address":   e.msg.Address,
+			"arguments": encodeArguments(e.msg.Arguments),
+		})
+	}
+	tempo, _ := e.msg.Arguments[0].ReadFloat32()
+	pulse, _ := e.msg.Arguments[1].ReadInt32()
+
+	if err := writeSSE(w, "pulse", map[string]interface{}{"tempo": tempo, "pulse": pulse}); err != nil {
+		return err
+	}
+	if !e.position.OnBeat() {
+		return nil
+	}
+	if err := writeSSE(w, "position", map[string]interface{}{
+		"bar":      e.position.Bar,
+		"beat":     e.position.Beat,
+		"position": e.position.String(),
+	}); err != nil {
+		return err
+	}
+	for _, cue := range e.cues {
+		if cue.Group != "" {
+			continue
+		}
+		if err := writeSSE(w, "cue", map[string]interface{}{
+			"address":   cue.Message.Address,
+			"arguments": encodeArguments(cue.Message.Arguments),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSSE writes a server-sent event with JSON data.
+func writeSSE(w http.ResponseWriter, name string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	return err
+}
+
+// routeSessionContext routes a message like routeSession
+// but stops waiting for the main loop of the session when ctx is done.
+// The message is still handled once the main loop has room for it.
+func (srv *Server) routeSessionContext(ctx context.Context, m osc.Message) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.routeSession(m)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting for the session")
+	}
+}
+
+// session returns the session with the given name if the server is running it.
+func (srv *Server) session(name string) (*Session, bool) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	sess, ok := srv.sessions[name]
+	return sess, ok
+}
+
+// controlMessage returns the OSC message of a control change for a session.
+// The quantization is only added if it or the group is given.
+func controlMessage(name, address, quantize, group string, args ...osc.Argument) osc.Message {
+	if quantize != "" || group != "" {
+		if quantize == "" {
+			quantize = QuantizeNow
+		}
+		args = append(args, osc.String(quantize))
+	}
+	if group != "" {
+		args = append(args, osc.String(group))
+	}
+	return osc.Message{Address: syncosc.SessionAddress(name, address), Arguments: args}
+}
+
+// decodeJSON decodes the JSON body of a request.
+func decodeJSON(r *http.Request, v interface{}) error {
+	return errors.Wrap(json.NewDecoder(r.Body).Decode(v), "decoding request")
+}
+
+// writeError writes an error as the JSON body of a response.
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// stringSet returns a set of strings.
+func stringSet(ss []string) map[string]bool {
+	set := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		set[s] = true
+	}
+	return set
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHTTP serves the HTTP API of a running server.
+func newTestHTTP(t *testing.T, srv *testServer) *httptest.Server {
+	srv.sessionState(t, "")
+
+	api := httptest.NewServer(srv.httpHandler())
+	t.Cleanup(api.Close)
+	return api
+}
+
+// putJSON sends a PUT request with a JSON body and returns the status code.
+func putJSON(t *testing.T, url, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// getTempo returns the tempo from GET /tempo.
+func getTempo(t *testing.T, api *httptest.Server) float32 {
+	t.Helper()
+
+	resp, err := http.Get(api.URL + "/tempo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if expected, got := http.StatusOK, resp.StatusCode; expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+	var body TempoBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Tempo
+}
+
+func TestHTTPTempo(t *testing.T) {
+	api := newTestHTTP(t, runTestServer(t, ServerConfig{tempo: 120}))
+
+	if expected, got := float32(120), getTempo(t, api); expected != got {
+		t.Fatalf("expected tempo %f, got %f", expected, got)
+	}
+	if expected, got := http.StatusAccepted, putJSON(t, api.URL+"/tempo", `{"tempo":140}`); expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+	waitFor(t, "the tempo change", func() bool {
+		return getTempo(t, api) == 140
+	})
+	if expected, got := http.StatusBadRequest, putJSON(t, api.URL+"/tempo", `{"tempo":-1}`); expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+	if expected, got := http.StatusNotFound, putJSON(t, api.URL+"/tempo?session=nope", `{"tempo":140}`); expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+}
+
+func TestHTTPEvents(t *testing.T) {
+	api := newTestHTTP(t, runTestServer(t, ServerConfig{tempo: 120}))
+
+	resp, err := http.Get(api.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if expected, got := "text/event-stream", resp.Header.Get("Content-Type"); expected != got {
+		t.Fatalf("expected content type %s, got %s", expected, got)
+	}
+	if expected, got := http.StatusAccepted, putJSON(t, api.URL+"/tempo", `{"tempo":150}`); expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+	var (
+		lines = bufio.NewScanner(resp.Body)
+		name  string
+	)
+	for lines.Scan() {
+		line := lines.Text()
+
+		if strings.HasPrefix(line, "event: ") {
+			name = strings.TrimPrefix(line, "event: ")
+			continue
+		}
+		if name != "change" || !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var data struct {
+			Address   string          `json:"address"`
+			Arguments []ArgumentState `json:"arguments"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := "/sync/tempo", data.Address; expected != got {
+			t.Fatalf("expected address %s, got %s", expected, got)
+		}
+		if len(data.Arguments) != 1 || data.Arguments[0].Float != 150 {
+			t.Fatalf("expected tempo 150, got %v", data.Arguments)
+		}
+		return
+	}
+	t.Fatalf("expected a change event, got %v", lines.Err())
+}
+
+func TestHTTPChangeStoppedSession(t *testing.T) {
+	srv, err := NewServer(ServerConfig{tempo: 120, settings: defaultSettings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The main loop of the session never runs, so its changes are never applied.
+	sess := NewSession("", nil, 120)
+	srv.sessions[""] = sess
+
+	api := httptest.NewServer(srv.httpHandler())
+	defer api.Close()
+
+	for i := 0; i < cap(sess.changes); i++ {
+		if expected, got := http.StatusAccepted, putJSON(t, api.URL+"/tempo", `{"tempo":140}`); expected != got {
+			t.Fatalf("expected status %d, got %d", expected, got)
+		}
+	}
+	start := time.Now()
+	if expected, got := http.StatusServiceUnavailable, putJSON(t, api.URL+"/tempo", `{"tempo":140}`); expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+	if waited := time.Since(start); waited > 2*httpTimeout {
+		t.Fatalf("expected the request to time out after %s, waited %s", httpTimeout, waited)
+	}
+	sess.close()
+
+	if expected, got := http.StatusServiceUnavailable, putJSON(t, api.URL+"/tempo", `{"tempo":140}`); expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// linkCmd represents the link command
+var linkCmd = &cobra.Command{
+	Use:   "link",
+	Short: "Share the tempo and beat phase of an oscsync master with Ableton Link peers",
+	Long: `Share the tempo and beat phase of an oscsync master with Ableton Link peers
+
+The bridge registers with the master as a slave and joins a Link session on the local network,
+using Link's peer discovery over UDP multicast. Tempo changes go both ways:
+the master's tempo becomes the tempo of the Link session, and tempo changes
+of the Link session are sent to the master.
+
+When the master starts, the beats of the Link session are aligned with its beats,
+so that its downbeats fall on multiples of the quantum.
+When a Link peer starts playing while the master is stopped, the master is started
+on the next multiple of the quantum of the Link session. Stopping either side stops the other.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		master, err := resolveServer(viper.GetString("master"))
+		if err != nil {
+			return errors.Wrap(err, "resolving master")
+		}
+		var ifi *net.Interface
+		if name := viper.GetString("interface"); name != "" {
+			if ifi, err = net.InterfaceByName(name); err != nil {
+				return errors.Wrapf(err, "getting interface %s", name)
+			}
+		}
+		// The bridge starts the timeline at the master's tempo.
+		peer, err := newLinkPeer(viper.GetString("link-addr"), ifi, linkTimeline{})
+		if err != nil {
+			return err
+		}
+		b := &linkBridge{
+			master:    master,
+			session:   viper.GetString("session"),
+			group:     viper.GetString("group"),
+			heartbeat: viper.GetDuration("heartbeat"),
+			ppqn:      int32(viper.GetInt("ppqn")),
+			quantum:   viper.GetFloat64("quantum"),
+			peer:      peer,
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		return b.Run(ctx)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(linkCmd)
+
+	flags := linkCmd.Flags()
+	flags.String("master", "127.0.0.1", "host[:port] of the oscsync master")
+	flags.String("session", "", "session to bridge, the default session if empty")
+	flags.String("group", "", "group to register in")
+	flags.Duration("heartbeat", time.Second, "how often to register with the master again, 0 registers once")
+	flags.Int("ppqn", syncosc.PulsesPerQuarter, "pulses per quarter note the master sends")
+	flags.Float64("quantum", 4, "beats the phase of the Link session is aligned to")
+	flags.String("link-addr", LinkMulticastAddr, "multicast host:port of the Link peers")
+	flags.String("interface", "", "network interface to discover Link peers on, the default multicast interface if empty")
+}
+
+// linkTempoTolerance is how far apart two tempos in bpm can be and still be the same tempo.
+// Link rounds tempos to whole microseconds per beat.
+const linkTempoTolerance = 0.005
+
+// linkTempoTimeout is how long the bridge waits for the master
+// to change to a tempo of the Link session before it sends the master's tempo to Link again.
+const linkTempoTimeout = time.Second
+
+// linkBridge shares the tempo and beat phase of an oscsync master with a Link session.
+type linkBridge struct {
+	master    net.Addr
+	session   string
+	group     string
+	heartbeat time.Duration
+	ppqn      int32
+	quantum   float64
+	peer      *linkPeer
+}
+
+// Run registers the bridge with the master and bridges it to the Link session until the context is done.
+// The bridge is removed from the master's slaves and leaves the Link session when it stops.
+func (b *linkBridge) Run(ctx context.Context) error {
+	if b.ppqn <= 0 || syncosc.PulsesPerQuarter%b.ppqn != 0 {
+		return errors.Errorf("ppqn must divide %d, got %d", syncosc.PulsesPerQuarter, b.ppqn)
+	}
+	if b.quantum <= 0 {
+		return errors.Errorf("quantum must be positive, got %g", b.quantum)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := oscnet.ListenUDPContext(ctx, "udp", &net.UDPAddr{})
+	if err != nil {
+		b.peer.close()
+		return errors.Wrap(err, "listening for the master")
+	}
+	defer func() { _ = conn.Close() }()
+
+	port := int32(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	if err := b.register(conn, syncosc.AddressSlaveAdd, port); err != nil {
+		b.peer.close()
+		return err
+	}
+	defer func() { _ = b.register(conn, syncosc.AddressSlaveRemove, port) }()
+
+	var (
+		events    = make(chan osc.Message)
+		serveErrs = make(chan error, 1)
+		forward   = osc.Method(func(m osc.Message) error {
+			select {
+			case events <- m:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	)
+	go func() {
+		// One worker keeps the pulses in order.
+		serveErrs <- conn.Serve(1, osc.Dispatcher{
+			syncosc.SessionAddress(b.session, syncosc.AddressPulse):     forward,
+			syncosc.SessionAddress(b.session, syncosc.AddressTransport): forward,
+			"/reply": forward,
+		})
+	}()
+	tempo, err := b.masterTempo(ctx, conn, events, serveErrs)
+	if err != nil {
+		b.peer.close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	// The Link session starts at the master's tempo.
+	st := &linkBridgeState{
+		ppqn:     b.ppqn,
+		quantum:  b.quantum,
+		session:  b.peer.node,
+		timeline: newLinkTimeline(float64(tempo), 0, linkNow()),
+		tempo:    tempo,
+	}
+	b.peer.state.Timeline = st.timeline.Shift(b.peer.ghost)
+
+	var (
+		peerDone = make(chan struct{})
+		peerErr  error
+	)
+	go func() {
+		peerErr = b.peer.Run(ctx)
+		close(peerDone)
+	}()
+	// The peer says goodbye to the Link session before Run returns.
+	defer func() {
+		cancel()
+		<-peerDone
+	}()
+	var heartbeat <-chan time.Time
+	if b.heartbeat > 0 {
+		ticker := time.NewTicker(b.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var (
+		start     *time.Timer
+		startC    <-chan time.Time
+		scheduled int64
+	)
+	defer func() {
+		if start != nil {
+			start.Stop()
+		}
+	}()
+	for {
+		var (
+			changed bool
+			msgs    []osc.Message
+		)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-peerDone:
+			return errors.Wrap(peerErr, "running Link peer")
+		case err := <-serveErrs:
+			return errors.Wrap(err, "receiving from master")
+		case <-heartbeat:
+			if err := b.register(conn, syncosc.AddressSlaveAdd, port); err != nil {
+				return err
+			}
+		case m := <-events:
+			if changed, err = b.handle(st, m, linkNow()); err != nil {
+				slog.Debug("dropped malformed message", "address", m.Address, errAttr(err))
+			}
+		case u := <-b.peer.Updates():
+			if u.Session != st.session {
+				slog.Info("joined Link session", "peers", u.Peers, "tempo", u.Timeline.Tempo())
+			}
+			msgs = st.Link(u, linkNow())
+		case <-startC:
+			msgs = st.Start()
+		}
+		if changed {
+			if err := b.peer.Set(ctx, st.timeline, st.startStop); err != nil {
+				return nil // The context is done.
+			}
+		}
+		for _, m := range msgs {
+			m.Address = syncosc.SessionAddress(b.session, m.Address)
+			if err := conn.SendTo(b.master, m); err != nil {
+				return errors.Wrapf(err, "sending %s to master", m.Address)
+			}
+		}
+		if st.startAt != scheduled {
+			if start != nil {
+				start.Stop()
+			}
+			start, startC, scheduled = nil, nil, st.startAt
+			if scheduled != 0 {
+				start = time.NewTimer(time.Duration(scheduled-linkNow()) * time.Microsecond)
+				startC = start.C
+			}
+		}
+	}
+}
+
+// masterTempo asks the master for its tempo, which a pulse that arrives first also tells.
+func (b *linkBridge) masterTempo(ctx context.Context, conn *oscnet.UDPConn, events <-chan osc.Message, serveErrs <-chan error) (float32, error) {
+	address := syncosc.SessionAddress(b.session, syncosc.AddressTempo)
+
+	if err := conn.SendTo(b.master, osc.Message{Address: address}); err != nil {
+		return 0, errors.Wrap(err, "asking the master for its tempo")
+	}
+	timeout := time.After(2 * time.Second)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case err := <-serveErrs:
+			return 0, errors.Wrap(err, "receiving from master")
+		case <-timeout:
+			return 0, errors.New("timeout waiting for the master's tempo")
+		case m := <-events:
+			if m.Address == syncosc.SessionAddress(b.session, syncosc.AddressPulse) {
+				if p, err := syncosc.PulseFromMessage(m); err == nil {
+					return p.Tempo, nil
+				}
+				continue
+			}
+			if m.Address != "/reply" || len(m.Arguments) < 2 {
+				continue
+			}
+			if replyTo, err := m.Arguments[0].ReadString(); err != nil || replyTo != address {
+				continue
+			}
+			tempo, err := m.Arguments[1].ReadFloat32()
+			return tempo, errors.Wrap(err, "reading tempo")
+		}
+	}
+}
+
+// register sends a slave add or remove message for the bridge to the master.
+func (b *linkBridge) register(conn *oscnet.UDPConn, address string, port int32) error {
+	args := osc.Arguments{osc.String("127.0.0.1"), osc.Int(port)}
+	if address == syncosc.AddressSlaveAdd && b.group != "" {
+		args = append(args, osc.String(b.group))
+	}
+	m := osc.Message{Address: syncosc.SessionAddress(b.session, address), Arguments: args}
+
+	return errors.Wrapf(conn.SendTo(b.master, m), "sending %s to master", m.Address)
+}
+
+// handle passes a pulse or transport change of the master that arrived at now to the bridge's state.
+func (b *linkBridge) handle(st *linkBridgeState, m osc.Message, now int64) (bool, error) {
+	if m.Address == syncosc.SessionAddress(b.session, syncosc.AddressTransport) {
+		if len(m.Arguments) == 0 {
+			return false, errors.New("expected a transport state")
+		}
+		state, err := m.Arguments[0].ReadString()
+		if err != nil {
+			return false, errors.Wrap(err, "reading transport state")
+		}
+		return st.Transport(state, now), nil
+	}
+	if m.Address != syncosc.SessionAddress(b.session, syncosc.AddressPulse) {
+		return false, nil
+	}
+	p, err := syncosc.PulseFromMessage(m)
+	if err != nil {
+		return false, err
+	}
+	return st.Pulse(p, now), nil
+}
+
+// linkBridgeState is the state of a bridge between a master and a Link session.
+// Times are on the clock of the Link peer.
+type linkBridgeState struct {
+	ppqn    int32
+	quantum float64
+
+	// session, timeline and startStop are the Link session as the bridge knows it.
+	session   linkNodeID
+	timeline  linkTimeline
+	startStop linkStartStop
+
+	// playing is true if the master pulses, and tempo is the tempo of its last pulse.
+	playing bool
+	tempo   float32
+
+	// offset is the Link beat of the master's first beat, a multiple of the quantum.
+	offset float64
+
+	// linkLeads is true if the master was started for the Link session,
+	// which keeps its phase when the master's pulses arrive.
+	linkLeads bool
+
+	// pendingTempo is a tempo sent to the master that its pulses have not had yet.
+	pendingTempo float32
+	pendingUntil int64
+
+	// startAt is when the master is started for the Link session, 0 if it is not.
+	startAt int64
+}
+
+// Pulse handles a pulse of the master.
+// The first pulse after the master starts anchors the master's beats in the Link timeline,
+// and a change of the master's tempo changes the tempo of the Link session at the master's beat.
+func (st *linkBridgeState) Pulse(p syncosc.Pulse, now int64) bool {
+	var (
+		beat    = float64(p.Count) / float64(st.ppqn)
+		changed bool
+	)
+	st.tempo = p.Tempo
+
+	if !st.playing {
+		st.playing = true
+		changed = st.anchor(beat, now)
+	}
+	if st.pendingTempo != 0 {
+		if !sameLinkTempo(float64(p.Tempo), float64(st.pendingTempo)) && now < st.pendingUntil {
+			return changed
+		}
+		st.pendingTempo = 0
+	}
+	if !sameLinkTempo(float64(p.Tempo), st.timeline.Tempo()) {
+		st.timeline = newLinkTimeline(float64(p.Tempo), beat+st.offset, now)
+		changed = true
+	}
+	return changed
+}
+
+// anchor aligns the master's beat at time now with the Link timeline.
+// If the Link session leads, the master's first beat is the nearest multiple of the quantum.
+// Otherwise the Link timeline is moved so that it is, and the Link session starts playing.
+func (st *linkBridgeState) anchor(beat float64, now int64) bool {
+	st.offset = math.Round((st.timeline.BeatAt(now)-beat)/st.quantum) * st.quantum
+
+	if st.linkLeads {
+		st.linkLeads = false
+		return false
+	}
+	// Peers only take a timeline whose beat origin is later.
+	for int64(math.Round((beat+st.offset)*1e6)) <= st.timeline.BeatOrigin {
+		st.offset += st.quantum
+	}
+	st.timeline = newLinkTimeline(float64(st.tempo), beat+st.offset, now)
+
+	if !st.startStop.Playing {
+		st.startStop = linkStartStop{Playing: true, Beats: st.timeline.BeatOrigin, Timestamp: now}
+	}
+	return true
+}
+
+// Transport handles a transport change of the master.
+// A start or continue anchors the master's beats again on the next pulse.
+func (st *linkBridgeState) Transport(state string, now int64) bool {
+	st.playing = false
+
+	if state != syncosc.TransportStop {
+		return false
+	}
+	st.linkLeads = false
+
+	if !st.startStop.Playing {
+		return false
+	}
+	st.startStop = linkStartStop{
+		Playing:   false,
+		Beats:     int64(math.Round(st.timeline.BeatAt(now) * 1e6)),
+		Timestamp: now,
+	}
+	return true
+}
+
+// Link handles a change of the Link session and returns the messages for the master.
+// Changes that are older than what the bridge knows are ignored, unless the bridge joined another session.
+func (st *linkBridgeState) Link(u linkState, now int64) []osc.Message {
+	var (
+		joined = u.Session != st.session
+		msgs   []osc.Message
+	)
+	st.session = u.Session
+
+	// The master can not jump to the phase of another session,
+	// so its next pulse aligns it with the nearest multiple of the quantum.
+	if joined && st.playing {
+		st.playing, st.linkLeads = false, true
+	}
+	if joined || u.Timeline.BeatOrigin > st.timeline.BeatOrigin {
+		st.timeline = u.Timeline
+
+		if tempo := float32(u.Timeline.Tempo()); !sameLinkTempo(float64(tempo), float64(st.tempo)) {
+			msgs = append(msgs, osc.Message{
+				Address:   syncosc.AddressTempo,
+				Arguments: osc.Arguments{osc.Float(tempo)},
+			})
+			st.tempo, st.pendingTempo = tempo, tempo
+			st.pendingUntil = now + linkTempoTimeout.Microseconds()
+		}
+	}
+	if !joined && u.StartStop.Timestamp <= st.startStop.Timestamp {
+		return msgs
+	}
+	st.startStop = u.StartStop
+
+	switch {
+	case u.StartStop.Playing && !st.playing && st.startAt == 0:
+		next := math.Ceil(st.timeline.BeatAt(now)/st.quantum) * st.quantum
+		st.startAt = st.timeline.TimeAt(next)
+	case !u.StartStop.Playing:
+		st.startAt = 0
+
+		// The master stays playing until it says it stopped.
+		if st.playing {
+			msgs = append(msgs, osc.Message{
+				Address:   syncosc.AddressTransport,
+				Arguments: osc.Arguments{osc.String(syncosc.TransportStop)},
+			})
+		}
+	}
+	return msgs
+}
+
+// Start returns the message that starts the master for the Link session,
+// if the Link session still plays and the master does not.
+func (st *linkBridgeState) Start() []osc.Message {
+	st.startAt = 0
+
+	if st.playing || !st.startStop.Playing {
+		return nil
+	}
+	st.linkLeads = true
+
+	return []osc.Message{{
+		Address:   syncosc.AddressTransport,
+		Arguments: osc.Arguments{osc.String(syncosc.TransportStart)},
+	}}
+}
+
+// sameLinkTempo returns true if two tempos are the same in a Link session.
+func sameLinkTempo(a, b float64) bool {
+	return math.Abs(a-b) < linkTempoTolerance
+}
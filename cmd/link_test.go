@@ -0,0 +1,696 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// newTestLinkGroup returns a multicast address on a free port and the loopback interface,
+// so that the Link peers of a test only see each other.
+func newTestLinkGroup(t *testing.T) (string, *net.Interface) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo *net.Interface
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagLoopback != 0 && ifis[i].Flags&net.FlagUp != 0 {
+			lo = &ifis[i]
+			break
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface")
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	_ = conn.Close()
+
+	return net.JoinHostPort("224.76.78.75", strconv.Itoa(port)), lo
+}
+
+func newTestLinkPeer(t *testing.T, group string, lo *net.Interface, tempo float64) *linkPeer {
+	p, err := newLinkPeer(group, lo, newLinkTimeline(tempo, 0, linkNow()))
+	if err != nil {
+		t.Skipf("multicast on loopback is not available: %s", err)
+	}
+	return p
+}
+
+// waitLink polls the state of peers until ok returns true for it.
+func waitLink(ctx context.Context, t *testing.T, what string, ok func(states ...linkState) bool, peers ...*linkPeer) []linkState {
+	t.Helper()
+
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		states := make([]linkState, len(peers))
+		for i, p := range peers {
+			s, err := p.State(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			states[i] = s
+		}
+		if ok(states...) {
+			return states
+		}
+	}
+	t.Fatalf("timeout waiting for %s", what)
+	return nil
+}
+
+// sameLinkSession returns true if every peer sees the others in one session.
+func sameLinkSession(states ...linkState) bool {
+	for _, s := range states {
+		if s.Session != states[0].Session || s.Peers != len(states)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// linkTestClockError is how far apart in microseconds the clocks of two peers on one host can be
+// after one measured the other.
+const linkTestClockError = 2000
+
+// sameLinkTimeline returns true if two peers have the same timeline on their clocks.
+func sameLinkTimeline(a, b linkTimeline) bool {
+	d := a.TimeOrigin - b.TimeOrigin
+	return a.MicrosPerBeat == b.MicrosPerBeat && a.BeatOrigin == b.BeatOrigin && d <= linkTestClockError && d >= -linkTestClockError
+}
+
+// sameLinkStartStop returns true if two peers have the same start/stop state on their clocks.
+func sameLinkStartStop(a, b linkStartStop) bool {
+	d := a.Timestamp - b.Timestamp
+	return a.Playing == b.Playing && a.Beats == b.Beats && d <= linkTestClockError && d >= -linkTestClockError
+}
+
+// receiveMatching returns when the master received a message with an address
+// and arguments that match, skipping the other messages.
+func (m *testMaster) receiveMatching(t *testing.T, address string, match func(osc.Arguments) bool) time.Time {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-m.messages:
+			if msg.Address == address && match(msg.Arguments) {
+				return time.Now()
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", address)
+		}
+	}
+}
+
+func TestLinkMessage(t *testing.T) {
+	for i, m := range []linkMessage{
+		{
+			Type: linkAlive,
+			TTL:  linkTTL,
+			State: linkPeerState{
+				Node:      linkNodeID{1, 2, 3, 4, 5, 6, 7, 8},
+				Session:   linkNodeID{8, 7, 6, 5, 4, 3, 2, 1},
+				Timeline:  linkTimeline{MicrosPerBeat: 500000, BeatOrigin: -4000000, TimeOrigin: 1500000000000000},
+				StartStop: linkStartStop{Playing: true, Beats: 8000000, Timestamp: 1500000001000000},
+				Endpoint:  &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 54321},
+			},
+		},
+		{
+			Type: linkResponse,
+			TTL:  linkTTL,
+			State: linkPeerState{
+				Session:  linkNodeID{1},
+				Timeline: linkTimeline{MicrosPerBeat: 666667},
+			},
+		},
+		{
+			Type:  linkByeBye,
+			State: linkPeerState{Node: linkNodeID{9}},
+		},
+	} {
+		got, err := parseLinkMessage(m.Bytes())
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if !reflect.DeepEqual(m, got) {
+			t.Fatalf("(test case %d) expected %+v, got %+v", i, m, got)
+		}
+	}
+}
+
+func TestParseLinkMessageInvalid(t *testing.T) {
+	alive := linkMessage{Type: linkAlive, State: linkPeerState{Timeline: linkTimeline{MicrosPerBeat: 500000}}}.Bytes()
+
+	for i, data := range [][]byte{
+		nil,
+		[]byte("_asdp_v\x02\x01\x05\x00\x00abcdefgh"),
+		alive[:len(alive)-1],
+		linkMessage{Type: linkAlive}.Bytes(),
+		append(append([]byte{}, linkDiscoveryHeader...), 1, 5, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8),
+	} {
+		if _, err := parseLinkMessage(data); err == nil {
+			t.Fatalf("(test case %d) expected an error", i)
+		}
+	}
+}
+
+func TestLinkPingReply(t *testing.T) {
+	var ping []byte
+	ping = append(ping, linkMeasurementHeader...)
+	ping = append(ping, linkPing)
+	ping = append(ping, "__ht\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x2a"...)
+
+	session := linkNodeID{1, 2, 3, 4, 5, 6, 7, 8}
+
+	pong, ok := linkPingReply(ping, session, 1234)
+	if !ok {
+		t.Fatal("expected a pong")
+	}
+	if pong[8] != linkPong {
+		t.Fatalf("expected message type %d, got %d", linkPong, pong[8])
+	}
+	entries, err := readLinkPayload(pong[9:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		gotSession linkNodeID
+		ghost, ht  int64
+	)
+	for key, value := range map[string]interface{}{
+		linkKeySession:   &gotSession,
+		linkKeyGhostTime: &ghost,
+		linkKeyHostTime:  &ht,
+	} {
+		if ok, err := readLinkEntry(entries, key, value); err != nil || !ok {
+			t.Fatalf("expected %s in the pong, got %v", key, err)
+		}
+	}
+	if session != gotSession || ghost != 1234 || ht != 42 {
+		t.Fatalf("expected session %v at 1234 for 42, got %v at %d for %d", session, gotSession, ghost, ht)
+	}
+	if _, ok := linkPingReply(pong, session, 1234); ok {
+		t.Fatal("expected no answer to a pong")
+	}
+}
+
+// linkHex decodes a packet written in hex, ignoring spaces.
+func linkHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// The packets of TestLinkPackets are laid out byte by byte after the encoding in Link's sources,
+// instead of with the encoder of the bridge.
+func TestLinkPackets(t *testing.T) {
+	// An alive message with a timeline at 120 bpm that is at beat 4 at 12s,
+	// a start/stop state, and the IPv6 and IPv4 measurement endpoints of Link 3.
+	alive := linkHex(t, "5f617364705f7601 01 05 0000 0102030405060708"+
+		" 746d6c6e 00000018 000000000007a120 00000000003d0900 0000000000b71b00"+
+		" 73657373 00000008 0807060504030201"+
+		" 73747374 00000011 01 00000000003d0900 0000000000b71b00"+
+		" 6d657036 00000012 00000000000000000000000000000001 d431"+
+		" 6d657034 00000006 c0a80102 d431")
+
+	m, err := parseLinkMessage(alive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := linkMessage{
+		Type: linkAlive,
+		TTL:  5,
+		State: linkPeerState{
+			Node:      linkNodeID{1, 2, 3, 4, 5, 6, 7, 8},
+			Session:   linkNodeID{8, 7, 6, 5, 4, 3, 2, 1},
+			Timeline:  linkTimeline{MicrosPerBeat: 500000, BeatOrigin: 4000000, TimeOrigin: 12000000},
+			StartStop: linkStartStop{Playing: true, Beats: 4000000, Timestamp: 12000000},
+			Endpoint:  &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 54321},
+		},
+	}
+	if !reflect.DeepEqual(expected, m) {
+		t.Fatalf("expected %+v, got %+v", expected, m)
+	}
+	byebye, err := parseLinkMessage(linkHex(t, "5f617364705f7601 03 00 0000 0102030405060708"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byebye.Type != linkByeBye || byebye.State.Node != expected.State.Node {
+		t.Fatalf("expected a bye-bye of %v, got %+v", expected.State.Node, byebye)
+	}
+	// The first ping of a measurement only has the host time of the peer that measures.
+	ping := linkHex(t, "5f6c696e6b5f7601 01 5f5f6874 00000008 000000000000002a")
+	if expected, got := ping, linkPingBytes(42, 0); !bytes.Equal(expected, got) {
+		t.Fatalf("expected ping %x, got %x", expected, got)
+	}
+	pong, ok := linkPingReply(ping, expected.State.Session, 12000000)
+	if !ok {
+		t.Fatal("expected a pong")
+	}
+	expectedPong := linkHex(t, "5f6c696e6b5f7601 02 73657373 00000008 0807060504030201"+
+		" 5f5f6774 00000008 0000000000b71b00 5f5f6874 00000008 000000000000002a")
+	if !bytes.Equal(expectedPong, pong) {
+		t.Fatalf("expected pong %x, got %x", expectedPong, pong)
+	}
+	// The pings after it have the ghost time of the pong before, which the pong echoes.
+	ping = linkHex(t, "5f6c696e6b5f7601 01 5f5f6874 00000008 000000000000002b 5f706774 00000008 0000000000b71b00")
+	if expected, got := ping, linkPingBytes(43, 12000000); !bytes.Equal(expected, got) {
+		t.Fatalf("expected ping %x, got %x", expected, got)
+	}
+	payload, err := parseLinkPong(linkHex(t, "5f6c696e6b5f7601 02 73657373 00000008 0807060504030201"+
+		" 5f5f6774 00000008 0000000000b71c00 5f5f6874 00000008 000000000000002b 5f706774 00000008 0000000000b71b00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPayload := linkPongPayload{Session: expected.State.Session, GhostTime: 12000256, PrevGhostTime: 12000000, HostTime: 43}
+	if expectedPayload != payload {
+		t.Fatalf("expected %+v, got %+v", expectedPayload, payload)
+	}
+	if _, err := parseLinkPong(ping); err == nil {
+		t.Fatal("expected an error parsing a ping as a pong")
+	}
+}
+
+func TestMeasureLink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// The clock of the session is a minute behind.
+	const offset = -60000000
+
+	session := linkNodeID{1, 2, 3, 4, 5, 6, 7, 8}
+	go func() {
+		buf := make([]byte, linkMaxMessageSize)
+		for {
+			n, sender, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if pong, ok := linkPingReply(buf[:n], session, linkNow()+offset); ok {
+				_, _ = conn.WriteToUDP(pong, sender)
+			}
+		}
+	}()
+	endpoint := conn.LocalAddr().(*net.UDPAddr)
+
+	ghost, err := measureLink(ctx, endpoint, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := ghost - offset; d > linkTestClockError || d < -linkTestClockError {
+		t.Fatalf("expected offset %d, got %d", offset, ghost)
+	}
+	// Pongs of other sessions do not count.
+	if _, err := measureLink(ctx, endpoint, linkNodeID{9}); err == nil {
+		t.Fatal("expected the measurement to fail")
+	}
+}
+
+func TestLinkTimeline(t *testing.T) {
+	tl := newLinkTimeline(120, 8, 1000000)
+
+	if expected, got := int64(500000), tl.MicrosPerBeat; expected != got {
+		t.Fatalf("expected %d micros per beat, got %d", expected, got)
+	}
+	if expected, got := 12.0, tl.BeatAt(3000000); expected != got {
+		t.Fatalf("expected beat %g, got %g", expected, got)
+	}
+	if expected, got := int64(-1000000), tl.TimeAt(4); expected != got {
+		t.Fatalf("expected time %d, got %d", expected, got)
+	}
+	if expected, got := 120.0, tl.Tempo(); expected != got {
+		t.Fatalf("expected tempo %g, got %g", expected, got)
+	}
+}
+
+func TestLinkBridgeStateAnchor(t *testing.T) {
+	const now = int64(10000000)
+
+	st := &linkBridgeState{
+		ppqn:     24,
+		quantum:  4,
+		timeline: newLinkTimeline(120, 0, now-1700000), // beat 3.4 at now
+	}
+	// The master leads: the Link timeline is moved so that the master's beat 1 is Link beat 5.
+	if !st.Pulse(syncosc.Pulse{Tempo: 100, Count: 24}, now) {
+		t.Fatal("expected a change of the Link session")
+	}
+	if expected, got := 4.0, st.offset; expected != got {
+		t.Fatalf("expected offset %g, got %g", expected, got)
+	}
+	if expected, got := newLinkTimeline(100, 5, now), st.timeline; expected != got {
+		t.Fatalf("expected timeline %+v, got %+v", expected, got)
+	}
+	if expected, got := (linkStartStop{Playing: true, Beats: 5000000, Timestamp: now}), st.startStop; expected != got {
+		t.Fatalf("expected start/stop state %+v, got %+v", expected, got)
+	}
+	// The pulses that follow at the same tempo change nothing.
+	if st.Pulse(syncosc.Pulse{Tempo: 100, Count: 25}, now+25000) {
+		t.Fatal("expected no change of the Link session")
+	}
+	// Stopping the master stops the Link session.
+	if !st.Transport(syncosc.TransportStop, now+600000) {
+		t.Fatal("expected a change of the Link session")
+	}
+	if expected, got := (linkStartStop{Beats: 6000000, Timestamp: now + 600000}), st.startStop; expected != got {
+		t.Fatalf("expected start/stop state %+v, got %+v", expected, got)
+	}
+}
+
+func TestLinkBridgeStateLink(t *testing.T) {
+	const now = int64(10000000)
+
+	var (
+		session = linkNodeID{1}
+		st      = &linkBridgeState{ppqn: 24, quantum: 4, session: session, timeline: newLinkTimeline(120, 0, 0)}
+		tl      = newLinkTimeline(90, 21, now) // beat 22.5 at now+1s
+	)
+	// A peer starts playing at 90 bpm, the master is started on the next bar.
+	msgs := st.Link(linkState{
+		Session:   session,
+		Timeline:  tl,
+		StartStop: linkStartStop{Playing: true, Beats: 21000000, Timestamp: now},
+	}, now+1000000)
+
+	expected := osc.Message{Address: syncosc.AddressTempo, Arguments: osc.Arguments{osc.Float(float32(tl.Tempo()))}}
+	if len(msgs) != 1 || !expected.Equal(msgs[0]) {
+		t.Fatalf("expected %s, got %v", expected, msgs)
+	}
+	if expected, got := tl.TimeAt(24), st.startAt; expected != got {
+		t.Fatalf("expected the master to start at %d, got %d", expected, got)
+	}
+	msgs = st.Start()
+	expected = osc.Message{Address: syncosc.AddressTransport, Arguments: osc.Arguments{osc.String(syncosc.TransportStart)}}
+	if len(msgs) != 1 || !expected.Equal(msgs[0]) {
+		t.Fatalf("expected %s, got %v", expected, msgs)
+	}
+	// The master's first beat is Link beat 24, and the Link session is left alone.
+	if st.Pulse(syncosc.Pulse{Tempo: float32(tl.Tempo()), Count: 0}, tl.TimeAt(24)+3000) {
+		t.Fatal("expected no change of the Link session")
+	}
+	if expected, got := 24.0, st.offset; expected != got {
+		t.Fatalf("expected offset %g, got %g", expected, got)
+	}
+	// Until the master has the tempo of the Link session its pulses are not sent to Link.
+	st.pendingTempo, st.pendingUntil = 100, tl.TimeAt(25)
+	if st.Pulse(syncosc.Pulse{Tempo: 90, Count: 1}, tl.TimeAt(24)+25000) {
+		t.Fatal("expected no change of the Link session")
+	}
+	// An older timeline is ignored.
+	if msgs := st.Link(linkState{Session: session, Timeline: newLinkTimeline(60, 1, 0), StartStop: st.startStop}, now); len(msgs) != 0 {
+		t.Fatalf("expected no messages, got %v", msgs)
+	}
+	// A peer stops playing.
+	msgs = st.Link(linkState{
+		Session:   session,
+		Timeline:  tl,
+		StartStop: linkStartStop{Beats: 26000000, Timestamp: tl.TimeAt(26)},
+	}, tl.TimeAt(26))
+
+	expected = osc.Message{Address: syncosc.AddressTransport, Arguments: osc.Arguments{osc.String(syncosc.TransportStop)}}
+	if len(msgs) != 1 || !expected.Equal(msgs[0]) {
+		t.Fatalf("expected %s, got %v", expected, msgs)
+	}
+}
+
+func TestLinkPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group, lo := newTestLinkGroup(t)
+
+	var (
+		a            = newTestLinkPeer(t, group, lo, 120)
+		b            = newTestLinkPeer(t, group, lo, 100)
+		bctx, bclose = context.WithCancel(ctx)
+		bdone        = make(chan error, 1)
+	)
+	go func() { _ = a.Run(ctx) }()
+	go func() { bdone <- b.Run(bctx) }()
+
+	states := waitLink(ctx, t, "one session", sameLinkSession, a, b)
+
+	// The peers founded their sessions at about the same time, so the session with the lower ID wins.
+	// Both peers have the timeline of the peer that founded it.
+	founder := a
+	if bytes.Compare(a.node[:], b.node[:]) > 0 {
+		founder = b
+	}
+	if expected, got := founder.node, states[0].Session; expected != got {
+		t.Fatalf("expected session %v, got %v", expected, got)
+	}
+	if expected, got := states[0].Timeline, states[1].Timeline; !sameLinkTimeline(expected, got) {
+		t.Fatalf("expected timeline %+v, got %+v", expected, got)
+	}
+	// Both peers take a later timeline and start/stop state from either of them.
+	var (
+		now = linkNow()
+		tl  = newLinkTimeline(133, states[0].Timeline.BeatAt(now), now)
+		ss  = linkStartStop{Playing: true, Beats: tl.BeatOrigin, Timestamp: now}
+	)
+	if err := founder.Set(ctx, tl, ss); err != nil {
+		t.Fatal(err)
+	}
+	waitLink(ctx, t, "the new timeline", func(states ...linkState) bool {
+		for _, s := range states {
+			if !sameLinkTimeline(s.Timeline, tl) || !sameLinkStartStop(s.StartStop, ss) {
+				return false
+			}
+		}
+		return true
+	}, a, b)
+
+	// A peer that leaves says so.
+	bclose()
+	if err := <-bdone; err != nil {
+		t.Fatal(err)
+	}
+	waitLink(ctx, t, "the peer to leave", func(states ...linkState) bool {
+		return states[0].Peers == 0
+	}, a)
+}
+
+func TestLinkPeerJoinsOlderSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group, lo := newTestLinkGroup(t)
+
+	// The session with the higher ID was founded a minute earlier.
+	older, newer := newTestLinkPeer(t, group, lo, 120), newTestLinkPeer(t, group, lo, 100)
+	if bytes.Compare(older.node[:], newer.node[:]) < 0 {
+		older, newer = newer, older
+	}
+	older.ghost += 60000000
+	older.state.Timeline = older.state.Timeline.Shift(60000000)
+
+	go func() { _ = older.Run(ctx) }()
+	go func() { _ = newer.Run(ctx) }()
+
+	states := waitLink(ctx, t, "one session", sameLinkSession, older, newer)
+
+	if expected, got := older.node, states[0].Session; expected != got {
+		t.Fatalf("expected session %v, got %v", expected, got)
+	}
+	if expected, got := states[0].Timeline, states[1].Timeline; !sameLinkTimeline(expected, got) {
+		t.Fatalf("expected timeline %+v, got %+v", expected, got)
+	}
+}
+
+func TestLinkPeerUnreachableSender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group, lo := newTestLinkGroup(t)
+
+	var (
+		p    = newTestLinkPeer(t, group, lo, 120)
+		done = make(chan error, 1)
+
+		// Nothing can be sent to port 0.
+		sender = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	)
+	var ping []byte
+	ping = append(ping, linkMeasurementHeader...)
+	ping = append(ping, linkPing)
+	ping = append(ping, "__ht\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x2a"...)
+
+	alive := linkMessage{
+		Type: linkAlive,
+		TTL:  linkTTL,
+		State: linkPeerState{
+			Node:     linkNodeID{1, 2, 3, 4, 5, 6, 7, 8},
+			Session:  linkNodeID{1, 2, 3, 4, 5, 6, 7, 8},
+			Timeline: newLinkTimeline(100, 0, linkNow()),
+		},
+	}
+	p.receive(ctx, linkPacket{data: ping, sender: sender})
+	p.receive(ctx, linkPacket{data: alive.Bytes(), sender: sender})
+
+	go func() { done <- p.Run(ctx) }()
+
+	// The peer that could not be answered was dropped and the peer still runs.
+	waitLink(ctx, t, "the peer to run", func(states ...linkState) bool {
+		return states[0].Peers == 0 && states[0].Session == p.node
+	}, p)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkBridges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group, lo := newTestLinkGroup(t)
+
+	var (
+		masters = []*testMaster{newTestMaster(ctx, t), newTestMaster(ctx, t)}
+		peers   = []*linkPeer{newTestLinkPeer(t, group, lo, 120), newTestLinkPeer(t, group, lo, 120)}
+		tempos  = []float32{120, 100}
+		addrs   = make([]net.Addr, 2)
+		errs    = make(chan error, 2)
+	)
+	send := func(i int, m osc.Message) {
+		if err := masters[i].conn.SendTo(addrs[i], m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isTempo := func(tempo float64) func(osc.Arguments) bool {
+		return func(args osc.Arguments) bool {
+			f, err := args[0].ReadFloat32()
+			return err == nil && sameLinkTempo(float64(f), tempo)
+		}
+	}
+	// The bridges register and ask the masters for their tempo.
+	for i := range masters {
+		b := &linkBridge{master: masters[i].conn.LocalAddr(), ppqn: 24, quantum: 4, peer: peers[i]}
+		go func() { errs <- b.Run(ctx) }()
+
+		m := masters[i].receive(t)
+		if expected, got := syncosc.AddressSlaveAdd, m.Address; expected != got {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+		addr, err := readUDPAddr(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = addr
+
+		if m := masters[i].receive(t); m.Address != syncosc.AddressTempo || len(m.Arguments) != 0 {
+			t.Fatalf("expected a tempo query, got %s", m)
+		}
+		send(i, osc.Message{Address: "/reply", Arguments: osc.Arguments{osc.String(syncosc.AddressTempo), osc.Float(tempos[i])}})
+	}
+	// The bridge that joins the other's session sends the session's tempo to its master.
+	states := waitLink(ctx, t, "one session", sameLinkSession, peers...)
+
+	founder, joiner := 0, 1
+	if states[0].Session != peers[0].node {
+		founder, joiner = 1, 0
+	}
+	if !sameLinkTempo(states[0].Timeline.Tempo(), float64(tempos[founder])) {
+		t.Fatalf("expected the session at %g bpm, got %g", tempos[founder], states[0].Timeline.Tempo())
+	}
+	masters[joiner].receiveMatching(t, syncosc.AddressTempo, isTempo(float64(tempos[founder])))
+	tempos[joiner] = tempos[founder]
+
+	transport := func(state string) osc.Message {
+		return osc.Message{Address: syncosc.AddressTransport, Arguments: osc.Arguments{osc.String(state)}}
+	}
+	pulse := func(i int, tempo float32, count int32) {
+		send(i, osc.Message{Address: syncosc.AddressPulse, Arguments: osc.Arguments{osc.Float(tempo), osc.Int(count)}})
+		time.Sleep(syncosc.GetPulseDuration(tempo))
+	}
+	isState := func(state string) func(osc.Arguments) bool {
+		return func(args osc.Arguments) bool {
+			s, err := args[0].ReadString()
+			return err == nil && s == state
+		}
+	}
+	// The first master starts, which aligns the Link session with its beats.
+	send(0, transport(syncosc.TransportStart))
+	start := linkNow()
+	for count := int32(0); count < 4; count++ {
+		pulse(0, tempos[0], count)
+	}
+	states = waitLink(ctx, t, "the Link session to play", func(states ...linkState) bool {
+		return states[0].StartStop.Playing && states[1].StartStop.Playing
+	}, peers...)
+
+	if beat := states[1].Timeline.BeatAt(start); math.Abs(beat-4*math.Round(beat/4)) > 0.05 {
+		t.Fatalf("expected the first master to start on a multiple of 4 beats, started on Link beat %g", beat)
+	}
+	// The second master is started on the next bar of the Link session.
+	started := masters[1].receiveMatching(t, syncosc.AddressTransport, isState(syncosc.TransportStart))
+
+	if beat := states[1].Timeline.BeatAt(started.UnixMicro()); math.Abs(beat-4*math.Round(beat/4)) > 0.05 {
+		t.Fatalf("expected the second master to start on a multiple of 4 beats, started on Link beat %g", beat)
+	}
+	// The tempo of the second master is sent to the first.
+	send(1, transport(syncosc.TransportStart))
+	for count := int32(0); count < 24; count++ {
+		pulse(1, tempos[1], count)
+	}
+	for count := int32(24); count < 30; count++ {
+		pulse(1, 90, count)
+	}
+	masters[0].receiveMatching(t, syncosc.AddressTempo, isTempo(90))
+
+	// The first master follows, and its pulses at the new tempo change nothing.
+	for count := int32(4); count < 10; count++ {
+		pulse(0, 90, count)
+	}
+	states = waitLink(ctx, t, "the new tempo", func(states ...linkState) bool {
+		return sameLinkTimeline(states[0].Timeline, states[1].Timeline) && sameLinkTempo(states[0].Timeline.Tempo(), 90)
+	}, peers...)
+
+	// Stopping the first master stops the second one.
+	send(0, transport(syncosc.TransportStop))
+	masters[1].receiveMatching(t, syncosc.AddressTransport, isState(syncosc.TransportStop))
+
+	for _, p := range peers {
+		s, err := p.State(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.StartStop.Playing {
+			t.Fatal("expected the Link session to be stopped")
+		}
+		if !sameLinkTimeline(s.Timeline, states[0].Timeline) {
+			t.Fatalf("expected timeline %+v, got %+v", states[0].Timeline, s.Timeline)
+		}
+	}
+	cancel()
+	for range masters {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Like Link, a measurement of the clock of a session collects more than linkMeasurementPoints
+// data points, and fails after linkMeasurementRetries pings that were not answered within linkMeasurementTimeout.
+// The clock of the peer's session is measured again every linkRemeasureInterval.
+const (
+	linkMeasurementPoints  = 100
+	linkMeasurementRetries = 5
+	linkMeasurementTimeout = 50 * time.Millisecond
+	linkRemeasureInterval  = 30 * time.Second
+)
+
+// linkSessionEps is how far apart in microseconds the clocks of two sessions can be
+// and still count as founded at the same time.
+const linkSessionEps = 500000
+
+// linkPongPayload is the payload of the answer to a measurement ping.
+// HostTime and PrevGhostTime are echoed from the ping.
+type linkPongPayload struct {
+	Session       linkNodeID
+	GhostTime     int64
+	PrevGhostTime int64
+	HostTime      int64
+}
+
+// linkMeasurement is the result of measuring the clock of a session.
+// Ghost is the offset of the session's clock from the clock of the peer.
+type linkMeasurement struct {
+	session linkNodeID
+	ghost   int64
+	err     error
+}
+
+// linkPingBytes returns a measurement ping sent at a host time.
+// Every ping after the first one has the ghost time of the pong before it.
+func linkPingBytes(hostTime, prevGhostTime int64) []byte {
+	var buf bytes.Buffer
+
+	buf.Write(linkMeasurementHeader)
+	buf.WriteByte(linkPing)
+	writeLinkEntry(&buf, linkKeyHostTime, hostTime)
+
+	if prevGhostTime != 0 {
+		writeLinkEntry(&buf, linkKeyPrevGhostTime, prevGhostTime)
+	}
+	return buf.Bytes()
+}
+
+// parseLinkPong parses the answer to a measurement ping.
+func parseLinkPong(data []byte) (linkPongPayload, error) {
+	if len(data) < 9 || !bytes.Equal(data[:8], linkMeasurementHeader) || data[8] != linkPong {
+		return linkPongPayload{}, errors.New("not a Link pong")
+	}
+	entries, err := readLinkPayload(data[9:])
+	if err != nil {
+		return linkPongPayload{}, err
+	}
+	var pong linkPongPayload
+
+	if ok, err := readLinkEntry(entries, linkKeySession, &pong.Session); err != nil {
+		return linkPongPayload{}, err
+	} else if !ok {
+		return linkPongPayload{}, errors.New("Link pong has no session")
+	}
+	for key, value := range map[string]*int64{
+		linkKeyGhostTime:     &pong.GhostTime,
+		linkKeyPrevGhostTime: &pong.PrevGhostTime,
+		linkKeyHostTime:      &pong.HostTime,
+	} {
+		if _, err := readLinkEntry(entries, key, value); err != nil {
+			return linkPongPayload{}, err
+		}
+	}
+	return pong, nil
+}
+
+// measureLink measures the offset of the clock of a session from the clock of the peer
+// by pinging a peer of the session at its measurement endpoint.
+//
+// Like Link, every pong gives the ghost time of the session at the middle of the round trip
+// of its ping, and the ghost time in the middle of the pong before it at the time the ping was sent.
+// The offset is the median of them.
+func measureLink(ctx context.Context, endpoint *net.UDPAddr, session linkNodeID) (int64, error) {
+	conn, err := net.DialUDP("udp4", nil, endpoint)
+	if err != nil {
+		return 0, errors.Wrapf(err, "measuring %s", endpoint)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var (
+		data []float64
+		ping = linkPingBytes(linkNow(), 0)
+	)
+	for retries := 0; len(data) <= linkMeasurementPoints; {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if _, err := conn.Write(ping); err != nil {
+			return 0, errors.Wrapf(err, "pinging %s", endpoint)
+		}
+		pong, err := receiveLinkPong(conn, session)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if retries++; retries == linkMeasurementRetries {
+				return 0, errors.Errorf("%s did not answer %d pings", endpoint, retries)
+			}
+			ping = linkPingBytes(linkNow(), 0)
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "receiving pong from %s", endpoint)
+		}
+		now := linkNow()
+		ping = linkPingBytes(now, pong.GhostTime)
+
+		if pong.GhostTime == 0 || pong.HostTime == 0 {
+			continue
+		}
+		data = append(data, float64(pong.GhostTime)-float64(now+pong.HostTime)/2)
+
+		if pong.PrevGhostTime != 0 {
+			data = append(data, float64(pong.GhostTime+pong.PrevGhostTime)/2-float64(pong.HostTime))
+		}
+	}
+	sort.Float64s(data)
+
+	median := data[len(data)/2]
+	if len(data)%2 == 0 {
+		median = (data[len(data)/2-1] + median) / 2
+	}
+	return int64(math.Round(median)), nil
+}
+
+// receiveLinkPong waits for a pong of the session, skipping the other packets.
+// The error is a timeout if none arrives within linkMeasurementTimeout.
+func receiveLinkPong(conn *net.UDPConn, session linkNodeID) (linkPongPayload, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(linkMeasurementTimeout)); err != nil {
+		return linkPongPayload{}, err
+	}
+	buf := make([]byte, linkMaxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return linkPongPayload{}, err
+		}
+		if pong, err := parseLinkPong(buf[:n]); err == nil && pong.Session == session {
+			return pong, nil
+		}
+	}
+}
@@ -0,0 +1,770 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LinkMulticastAddr is the address of the group Ableton Link peers discover each other in.
+const LinkMulticastAddr = "224.76.78.75:20808"
+
+// Link peers announce themselves every linkBroadcastInterval,
+// and are forgotten linkTTL seconds after their last announcement.
+const (
+	linkTTL               = 5
+	linkBroadcastInterval = 250 * time.Millisecond
+	linkMaxMessageSize    = 512
+)
+
+// Protocol headers of the Link discovery and measurement messages.
+var (
+	linkDiscoveryHeader   = []byte{'_', 'a', 's', 'd', 'p', '_', 'v', 1}
+	linkMeasurementHeader = []byte{'_', 'l', 'i', 'n', 'k', '_', 'v', 1}
+)
+
+// Link message types.
+const (
+	linkAlive    = 1
+	linkResponse = 2
+	linkByeBye   = 3
+
+	linkPing = 1
+	linkPong = 2
+)
+
+// Keys of the entries of a Link payload.
+const (
+	linkKeyTimeline      = "tmln"
+	linkKeySession       = "sess"
+	linkKeyStartStop     = "stst"
+	linkKeyEndpointV4    = "mep4"
+	linkKeyHostTime      = "__ht"
+	linkKeyGhostTime     = "__gt"
+	linkKeyPrevGhostTime = "_pgt"
+)
+
+// linkNodeID identifies a Link peer, and a session by the ID of the peer that founded it.
+type linkNodeID [8]byte
+
+// newLinkNodeID returns a random node ID.
+func newLinkNodeID() (linkNodeID, error) {
+	var id linkNodeID
+	_, err := rand.Read(id[:])
+	return id, errors.Wrap(err, "creating node ID")
+}
+
+// linkTimeline maps the time of a Link session to beats.
+// The beat origin is in microbeats and the time origin in microseconds.
+type linkTimeline struct {
+	MicrosPerBeat int64
+	BeatOrigin    int64
+	TimeOrigin    int64
+}
+
+// newLinkTimeline returns a timeline at a tempo in bpm that is at beat at time t.
+func newLinkTimeline(tempo, beat float64, t int64) linkTimeline {
+	return linkTimeline{
+		MicrosPerBeat: int64(math.Round(60e6 / tempo)),
+		BeatOrigin:    int64(math.Round(beat * 1e6)),
+		TimeOrigin:    t,
+	}
+}
+
+// Tempo returns the tempo of the timeline in bpm.
+func (tl linkTimeline) Tempo() float64 {
+	return 60e6 / float64(tl.MicrosPerBeat)
+}
+
+// BeatAt returns the beat of the timeline at time t.
+func (tl linkTimeline) BeatAt(t int64) float64 {
+	return (float64(tl.BeatOrigin) + float64(t-tl.TimeOrigin)*1e6/float64(tl.MicrosPerBeat)) / 1e6
+}
+
+// TimeAt returns the time of a beat of the timeline.
+func (tl linkTimeline) TimeAt(beat float64) int64 {
+	return tl.TimeOrigin + int64(math.Round((beat*1e6-float64(tl.BeatOrigin))*float64(tl.MicrosPerBeat)/1e6))
+}
+
+// Shift returns the timeline on a clock that is d microseconds ahead.
+func (tl linkTimeline) Shift(d int64) linkTimeline {
+	tl.TimeOrigin += d
+	return tl
+}
+
+// linkStartStop says whether the peers of a Link session play.
+// Beats is the beat in microbeats and Timestamp the time the state changed at.
+type linkStartStop struct {
+	Playing   bool
+	Beats     int64
+	Timestamp int64
+}
+
+// Shift returns the start/stop state on a clock that is d microseconds ahead.
+// A state that never changed stays at time 0.
+func (ss linkStartStop) Shift(d int64) linkStartStop {
+	if ss.Timestamp != 0 {
+		ss.Timestamp += d
+	}
+	return ss
+}
+
+// linkPeerState is what a Link peer announces about itself.
+// Endpoint is where it answers measurement pings, it may be nil.
+type linkPeerState struct {
+	Node      linkNodeID
+	Session   linkNodeID
+	Timeline  linkTimeline
+	StartStop linkStartStop
+	Endpoint  *net.UDPAddr
+}
+
+// linkMessage is a message of the Link discovery protocol.
+type linkMessage struct {
+	Type  uint8
+	TTL   uint8
+	State linkPeerState
+}
+
+// Bytes returns the message in the format of the Link discovery protocol.
+// Bye-bye messages only have a header.
+func (m linkMessage) Bytes() []byte {
+	var buf bytes.Buffer
+
+	buf.Write(linkDiscoveryHeader)
+	buf.Write([]byte{m.Type, m.TTL, 0, 0}) // group 0
+	buf.Write(m.State.Node[:])
+
+	if m.Type == linkByeBye {
+		return buf.Bytes()
+	}
+	s := m.State
+	writeLinkEntry(&buf, linkKeyTimeline, s.Timeline.MicrosPerBeat, s.Timeline.BeatOrigin, s.Timeline.TimeOrigin)
+	writeLinkEntry(&buf, linkKeySession, s.Session)
+	writeLinkEntry(&buf, linkKeyStartStop, s.StartStop.Playing, s.StartStop.Beats, s.StartStop.Timestamp)
+
+	if ep := s.Endpoint; ep != nil && ep.IP.To4() != nil {
+		var ip [4]byte
+		copy(ip[:], ep.IP.To4())
+		writeLinkEntry(&buf, linkKeyEndpointV4, ip, uint16(ep.Port))
+	}
+	return buf.Bytes()
+}
+
+// writeLinkEntry writes a payload entry with the big-endian encoding of the values.
+func writeLinkEntry(buf *bytes.Buffer, key string, values ...interface{}) {
+	var value bytes.Buffer
+	for _, v := range values {
+		_ = binary.Write(&value, binary.BigEndian, v)
+	}
+	buf.WriteString(key)
+	_ = binary.Write(buf, binary.BigEndian, uint32(value.Len()))
+	buf.Write(value.Bytes())
+}
+
+// readLinkPayload returns the values of the entries of a payload by key.
+func readLinkPayload(data []byte) (map[string][]byte, error) {
+	entries := map[string][]byte{}
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.Errorf("payload entry header is cut short: %d bytes", len(data))
+		}
+		var (
+			key  = string(data[:4])
+			size = binary.BigEndian.Uint32(data[4:8])
+		)
+		data = data[8:]
+		if uint32(len(data)) < size {
+			return nil, errors.Errorf("payload entry %q is cut short: %d of %d bytes", key, len(data), size)
+		}
+		entries[key] = data[:size]
+		data = data[size:]
+	}
+	return entries, nil
+}
+
+// readLinkEntry decodes the big-endian value of a payload entry.
+// It returns false if the entry is missing.
+func readLinkEntry(entries map[string][]byte, key string, values ...interface{}) (bool, error) {
+	data, ok := entries[key]
+	if !ok {
+		return false, nil
+	}
+	r := bytes.NewReader(data)
+	for _, v := range values {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return false, errors.Wrapf(err, "reading payload entry %q", key)
+		}
+	}
+	return true, nil
+}
+
+// parseLinkMessage parses a message of the Link discovery protocol.
+func parseLinkMessage(data []byte) (linkMessage, error) {
+	const headerSize = 8 + 4 + 8
+
+	if len(data) < headerSize || !bytes.Equal(data[:8], linkDiscoveryHeader) {
+		return linkMessage{}, errors.New("not a Link discovery message")
+	}
+	m := linkMessage{Type: data[8], TTL: data[9]}
+	copy(m.State.Node[:], data[12:20])
+
+	if m.Type == linkByeBye {
+		return m, nil
+	}
+	entries, err := readLinkPayload(data[headerSize:])
+	if err != nil {
+		return linkMessage{}, err
+	}
+	s := &m.State
+
+	ok, err := readLinkEntry(entries, linkKeyTimeline, &s.Timeline.MicrosPerBeat, &s.Timeline.BeatOrigin, &s.Timeline.TimeOrigin)
+	if err != nil {
+		return linkMessage{}, err
+	}
+	if !ok || s.Timeline.MicrosPerBeat <= 0 {
+		return linkMessage{}, errors.New("Link message has no valid timeline")
+	}
+	if ok, err := readLinkEntry(entries, linkKeySession, &s.Session); err != nil {
+		return linkMessage{}, err
+	} else if !ok {
+		return linkMessage{}, errors.New("Link message has no session")
+	}
+	if _, err := readLinkEntry(entries, linkKeyStartStop, &s.StartStop.Playing, &s.StartStop.Beats, &s.StartStop.Timestamp); err != nil {
+		return linkMessage{}, err
+	}
+	var (
+		ip   [4]byte
+		port uint16
+	)
+	if ok, err := readLinkEntry(entries, linkKeyEndpointV4, &ip, &port); err != nil {
+		return linkMessage{}, err
+	} else if ok {
+		s.Endpoint = &net.UDPAddr{IP: net.IP(ip[:]), Port: int(port)}
+	}
+	return m, nil
+}
+
+// linkPingReply returns the answer to a measurement ping,
+// or false if the packet is not a ping.
+// The pong has the session and its ghost time, followed by the payload of the ping.
+func linkPingReply(ping []byte, session linkNodeID, ghostTime int64) ([]byte, bool) {
+	if len(ping) < 9 || !bytes.Equal(ping[:8], linkMeasurementHeader) || ping[8] != linkPing {
+		return nil, false
+	}
+	entries, err := readLinkPayload(ping[9:])
+	if err != nil || len(ping) > linkMaxMessageSize {
+		return nil, false
+	}
+	if _, ok := entries[linkKeyHostTime]; !ok {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	buf.Write(linkMeasurementHeader)
+	buf.WriteByte(linkPong)
+	writeLinkEntry(&buf, linkKeySession, session)
+	writeLinkEntry(&buf, linkKeyGhostTime, ghostTime)
+	buf.Write(ping[9:])
+
+	return buf.Bytes(), true
+}
+
+// linkState is the state of the session of a Link peer.
+// Times are on the clock of the peer.
+type linkState struct {
+	Session   linkNodeID
+	Timeline  linkTimeline
+	StartStop linkStartStop
+	Peers     int
+}
+
+// linkPacket is a packet a Link peer received.
+type linkPacket struct {
+	data   []byte
+	sender *net.UDPAddr
+}
+
+// linkPeer is a peer of a Link session.
+// Its clock is the wall clock in microseconds. The peers of a session share
+// the session's clock, its ghost time in Link, which starts at 0 when the session is founded.
+// A peer that joins a session measures the offset of the session's clock from its own.
+type linkPeer struct {
+	node     linkNodeID
+	group    *net.UDPAddr
+	mcast    *net.UDPConn
+	ucast    *net.UDPConn
+	endpoint *net.UDPAddr
+
+	// state is the session on its own clock, which is ghost ahead of the clock of the peer.
+	// The peers are on the clock of their session. sessions are the offsets of the clocks
+	// of the other sessions that were measured and not joined, and measuring are the sessions
+	// that are being measured. They are owned by Run.
+	state     linkState
+	ghost     int64
+	peers     map[linkNodeID]linkPeerEntry
+	sessions  map[linkNodeID]int64
+	measuring map[linkNodeID]bool
+
+	local    chan linkState
+	updates  chan linkState
+	requests chan chan linkState
+	measured chan linkMeasurement
+}
+
+// linkPeerEntry is a peer that has been seen and when it will be forgotten.
+type linkPeerEntry struct {
+	state   linkPeerState
+	expires time.Time
+}
+
+// newLinkPeer creates a peer that founds its own session with a timeline
+// and discovers the other peers at the group address on a network interface.
+// The nil interface is the system's default multicast interface.
+func newLinkPeer(groupAddr string, ifi *net.Interface, tl linkTimeline) (*linkPeer, error) {
+	group, err := net.ResolveUDPAddr("udp4", groupAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", groupAddr)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, errors.Errorf("%s is not a multicast address", groupAddr)
+	}
+	node, err := newLinkNodeID()
+	if err != nil {
+		return nil, err
+	}
+	ip, err := linkInterfaceIP(ifi)
+	if err != nil {
+		return nil, err
+	}
+	mcast, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return nil, errors.Wrapf(err, "joining %s", groupAddr)
+	}
+	ucast, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		_ = mcast.Close()
+		return nil, errors.Wrap(err, "listening for Link peers")
+	}
+	// Announcements are sent with the unicast socket, which loops them back
+	// to the peers on the same host. The multicast socket does not.
+	if ifi != nil {
+		if err := setMulticastInterface(ucast, ip); err != nil {
+			_ = mcast.Close()
+			_ = ucast.Close()
+			return nil, errors.Wrapf(err, "sending multicast on %s", ifi.Name)
+		}
+	}
+	endpoint := &net.UDPAddr{IP: ip, Port: ucast.LocalAddr().(*net.UDPAddr).Port}
+	if ip.IsUnspecified() {
+		endpoint.IP = linkDefaultIP()
+	}
+	// The clock of the session starts now.
+	ghost := -linkNow()
+
+	return &linkPeer{
+		node:      node,
+		group:     group,
+		mcast:     mcast,
+		ucast:     ucast,
+		endpoint:  endpoint,
+		state:     linkState{Session: node, Timeline: tl.Shift(ghost)},
+		ghost:     ghost,
+		peers:     map[linkNodeID]linkPeerEntry{},
+		sessions:  map[linkNodeID]int64{},
+		measuring: map[linkNodeID]bool{},
+		local:     make(chan linkState),
+		updates:   make(chan linkState, 16),
+		requests:  make(chan chan linkState),
+		measured:  make(chan linkMeasurement),
+	}, nil
+}
+
+// linkInterfaceIP returns the IPv4 address the peer sends from on a network interface,
+// or the unspecified address for the default interface.
+func linkInterfaceIP(ifi *net.Interface) (net.IP, error) {
+	if ifi == nil {
+		return net.IPv4zero, nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting addresses of %s", ifi.Name)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, errors.Errorf("%s has no IPv4 address", ifi.Name)
+}
+
+// linkDefaultIP returns the first IPv4 address of the host that is not a loopback address,
+// which is where other hosts can reach a peer that listens on every interface.
+func linkDefaultIP() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				return ipnet.IP.To4()
+			}
+		}
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// linkNow returns the time of the clock of the peer.
+func linkNow() int64 {
+	return time.Now().UnixMicro()
+}
+
+// Updates returns the changes of the peer's session that come from other peers:
+// joining another session, and timelines and start/stop states of the session.
+func (p *linkPeer) Updates() <-chan linkState {
+	return p.updates
+}
+
+// Set changes the timeline and start/stop state of the session and announces them.
+// Times are on the clock of the peer. The session and peers are ignored.
+func (p *linkPeer) Set(ctx context.Context, timeline linkTimeline, startStop linkStartStop) error {
+	select {
+	case p.local <- linkState{Timeline: timeline, StartStop: startStop}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// State returns the state of the peer's session.
+func (p *linkPeer) State(ctx context.Context) (linkState, error) {
+	c := make(chan linkState, 1)
+	select {
+	case p.requests <- c:
+	case <-ctx.Done():
+		return linkState{}, ctx.Err()
+	}
+	select {
+	case s := <-c:
+		return s, nil
+	case <-ctx.Done():
+		return linkState{}, ctx.Err()
+	}
+}
+
+// Run announces the peer and follows its session until the context is done.
+// The other peers are told that it leaves when it stops.
+func (p *linkPeer) Run(ctx context.Context) error {
+	defer func() {
+		_ = p.send(linkMessage{Type: linkByeBye, State: linkPeerState{Node: p.node}}, p.group)
+		p.close()
+	}()
+	var (
+		packets   = make(chan linkPacket)
+		errs      = make(chan error, 2)
+		ticker    = time.NewTicker(linkBroadcastInterval)
+		remeasure = time.NewTicker(linkRemeasureInterval)
+	)
+	defer ticker.Stop()
+	defer remeasure.Stop()
+
+	for _, conn := range []*net.UDPConn{p.mcast, p.ucast} {
+		go p.read(ctx, conn, packets, errs)
+	}
+	if err := p.announce(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case c := <-p.requests:
+			c <- p.host()
+		case s := <-p.local:
+			p.state.Timeline, p.state.StartStop = s.Timeline.Shift(p.ghost), s.StartStop.Shift(p.ghost)
+			if err := p.announce(); err != nil {
+				return err
+			}
+		case now := <-ticker.C:
+			p.expire(now)
+			if err := p.announce(); err != nil {
+				return err
+			}
+		case <-remeasure.C:
+			// The founder's clock is the clock of the session.
+			if p.state.Session != p.node {
+				p.measure(ctx, p.state.Session)
+			}
+		case m := <-p.measured:
+			if !p.handleMeasurement(m) {
+				continue
+			}
+			p.update()
+			if err := p.announce(); err != nil {
+				return err
+			}
+		case pkt := <-packets:
+			p.receive(ctx, pkt)
+		}
+	}
+}
+
+// close closes the sockets of the peer.
+func (p *linkPeer) close() {
+	_ = p.mcast.Close()
+	_ = p.ucast.Close()
+}
+
+// read passes the packets received with conn to Run until the context is done.
+func (p *linkPeer) read(ctx context.Context, conn *net.UDPConn, packets chan<- linkPacket, errs chan<- error) {
+	buf := make([]byte, linkMaxMessageSize)
+	for {
+		n, sender, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				errs <- errors.Wrap(err, "receiving Link packet")
+			}
+			return
+		}
+		select {
+		case packets <- linkPacket{data: append([]byte(nil), buf[:n]...), sender: sender}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receive handles a packet from another peer.
+// Packets that are not Link messages are ignored.
+// If a reply can not be sent to the peer the packet is dropped,
+// the peer asks again or is answered when it announces itself next.
+func (p *linkPeer) receive(ctx context.Context, pkt linkPacket) {
+	if pong, ok := linkPingReply(pkt.data, p.state.Session, linkNow()+p.ghost); ok {
+		if _, err := p.ucast.WriteToUDP(pong, pkt.sender); err != nil {
+			slog.Debug("dropped Link ping", "sender", pkt.sender.String(), errAttr(err))
+		}
+		return
+	}
+	m, err := parseLinkMessage(pkt.data)
+	if err != nil || m.State.Node == p.node {
+		return
+	}
+	switch m.Type {
+	case linkByeBye:
+		delete(p.peers, m.State.Node)
+		p.forget()
+		return
+	case linkAlive:
+		if err := p.send(p.message(linkResponse), pkt.sender); err != nil {
+			slog.Debug("dropped Link alive message", "sender", pkt.sender.String(), errAttr(err))
+			return
+		}
+	case linkResponse:
+	default:
+		return
+	}
+	p.peers[m.State.Node] = linkPeerEntry{
+		state:   m.State,
+		expires: time.Now().Add(time.Duration(m.TTL) * time.Second),
+	}
+	p.state.Peers = len(p.peers)
+
+	if m.State.Session != p.state.Session {
+		if _, ok := p.sessions[m.State.Session]; !ok {
+			p.measure(ctx, m.State.Session)
+		}
+		return
+	}
+	if p.follow(m.State) {
+		p.update()
+	}
+}
+
+// update passes the state of the session to the reader of the updates.
+func (p *linkPeer) update() {
+	select {
+	case p.updates <- p.host():
+	default: // The reader is behind, it gets the next update.
+	}
+}
+
+// host returns the state of the session on the clock of the peer.
+func (p *linkPeer) host() linkState {
+	s := p.state
+	s.Timeline, s.StartStop = s.Timeline.Shift(-p.ghost), s.StartStop.Shift(-p.ghost)
+	return s
+}
+
+// follow updates the session with the state of another peer of the session.
+// It returns true if the session changed.
+//
+// Like Link, a timeline replaces the session's timeline if its beat origin is later,
+// and a start/stop state replaces the session's one if it is newer.
+func (p *linkPeer) follow(s linkPeerState) bool {
+	changed := false
+	if s.Timeline.BeatOrigin > p.state.Timeline.BeatOrigin {
+		p.state.Timeline = s.Timeline
+		changed = true
+	}
+	if s.StartStop.Timestamp > p.state.StartStop.Timestamp {
+		p.state.StartStop = s.StartStop
+		changed = true
+	}
+	return changed
+}
+
+// measure starts measuring the clock of a session at the endpoint of one of its peers,
+// its founder if it is known, unless the session is being measured already.
+// Run handles the measurement when it is done.
+func (p *linkPeer) measure(ctx context.Context, session linkNodeID) {
+	if p.measuring[session] {
+		return
+	}
+	var endpoint *net.UDPAddr
+	for node, entry := range p.peers {
+		if entry.state.Session != session || entry.state.Endpoint == nil {
+			continue
+		}
+		endpoint = entry.state.Endpoint
+		if node == session {
+			break
+		}
+	}
+	if endpoint == nil {
+		return
+	}
+	p.measuring[session] = true
+
+	go func() {
+		ghost, err := measureLink(ctx, endpoint, session)
+		select {
+		case p.measured <- linkMeasurement{session: session, ghost: ghost, err: err}:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// handleMeasurement handles the measurement of the clock of a session.
+// It returns true if the peer joined the session or its clock changed.
+//
+// Like Link, the peer joins a session that is older than its own by more than linkSessionEps,
+// or that is about as old and has a lower ID, so that all peers end up in the oldest session.
+// A new measurement of the peer's own session corrects the offset of its clock.
+func (p *linkPeer) handleMeasurement(m linkMeasurement) bool {
+	delete(p.measuring, m.session)
+
+	if m.err != nil {
+		slog.Debug("failed to measure Link session", errAttr(m.err))
+		return false
+	}
+	if m.session == p.state.Session {
+		changed := m.ghost != p.ghost
+		p.ghost = m.ghost
+		return changed
+	}
+	diff := m.ghost - p.ghost
+	if diff > linkSessionEps || (diff > -linkSessionEps && bytes.Compare(m.session[:], p.state.Session[:]) < 0) {
+		return p.join(m.session, m.ghost)
+	}
+	p.sessions[m.session] = m.ghost
+	return false
+}
+
+// join joins a session with a clock that is ghost ahead of the clock of the peer,
+// taking the latest timeline and start/stop state of its peers.
+// It returns false if none of the peers of the session are left.
+func (p *linkPeer) join(session linkNodeID, ghost int64) bool {
+	joined := false
+	for _, entry := range p.peers {
+		switch {
+		case entry.state.Session != session:
+		case !joined:
+			p.state.Session, p.state.Timeline, p.state.StartStop = session, entry.state.Timeline, entry.state.StartStop
+			joined = true
+		default:
+			p.follow(entry.state)
+		}
+	}
+	if !joined {
+		return false
+	}
+	p.ghost = ghost
+	delete(p.sessions, session)
+
+	return true
+}
+
+// expire forgets the peers that have not announced themselves for their TTL.
+func (p *linkPeer) expire(now time.Time) {
+	for node, entry := range p.peers {
+		if now.After(entry.expires) {
+			delete(p.peers, node)
+		}
+	}
+	p.forget()
+}
+
+// forget counts the peers and forgets the measurements of the sessions that have no peers left.
+func (p *linkPeer) forget() {
+	p.state.Peers = len(p.peers)
+
+	for session := range p.sessions {
+		left := false
+		for _, entry := range p.peers {
+			if entry.state.Session == session {
+				left = true
+				break
+			}
+		}
+		if !left {
+			delete(p.sessions, session)
+		}
+	}
+}
+
+// message returns a message of the given type with the state of the peer.
+func (p *linkPeer) message(typ uint8) linkMessage {
+	return linkMessage{
+		Type: typ,
+		TTL:  linkTTL,
+		State: linkPeerState{
+			Node:      p.node,
+			Session:   p.state.Session,
+			Timeline:  p.state.Timeline,
+			StartStop: p.state.StartStop,
+			Endpoint:  p.endpoint,
+		},
+	}
+}
+
+// announce sends the state of the peer to the group.
+func (p *linkPeer) announce() error {
+	return p.send(p.message(linkAlive), p.group)
+}
+
+// send sends a discovery message.
+func (p *linkPeer) send(m linkMessage, to *net.UDPAddr) error {
+	_, err := p.ucast.WriteToUDP(m.Bytes(), to)
+	return errors.Wrapf(err, "sending Link message to %s", to)
+}
@@ -0,0 +1,139 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// Log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// quietAddresses are the addresses of messages that are sent over and over,
+// such as heartbeats and queries, which are only logged at debug level.
+var quietAddresses = map[string]bool{
+	syncosc.AddressCueList:      true,
+	syncosc.AddressGrooveList:   true,
+	syncosc.AddressPeerAlive:    true,
+	syncosc.AddressReplicaAdd:   true,
+	syncosc.AddressReplicaState: true,
+	syncosc.AddressSessionList:  true,
+	syncosc.AddressSlaveAdd:     true,
+	syncosc.AddressSlaveList:    true,
+}
+
+// setupLogging makes the default logger write to w at the given level and in the given format.
+func setupLogging(w io.Writer, level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return errors.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch format {
+	case LogFormatText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case LogFormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return errors.Errorf("invalid log format %q, expected %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
+// logMessages returns a dispatcher that logs the messages handled by the methods of d with their sender.
+// Rejected messages are logged as warnings.
+// If d has no default method, messages that match none of its addresses are logged as dropped.
+func logMessages(log *slog.Logger, session string, d osc.Dispatcher) osc.Dispatcher {
+	logged := osc.Dispatcher{}
+
+	for addr, handler := range d {
+		if addr == oscnet.DefaultAddress {
+			logged[addr] = handler
+			continue
+		}
+		var (
+			handler = handler
+			level   = slog.LevelInfo
+		)
+		if quietAddresses[strings.Replace(addr, syncosc.SessionAddress(session, syncosc.AddressPrefix), syncosc.AddressPrefix, 1)] {
+			level = slog.LevelDebug
+		}
+		logged[addr] = osc.Method(func(m osc.Message) error {
+			if err := handler.Handle(m); err != nil {
+				log.Warn("rejected message", append(messageAttrs(m), errAttr(err))...)
+				return err
+			}
+			if ctx := context.Background(); log.Enabled(ctx, level) {
+				log.Log(ctx, level, "handled message", messageAttrs(m)...)
+			}
+			return nil
+		})
+	}
+	if _, ok := d[oscnet.DefaultAddress]; !ok {
+		logged[oscnet.DefaultAddress] = osc.Method(func(m osc.Message) error {
+			log.Warn("dropped message with unknown address", messageAttrs(m)...)
+			return nil
+		})
+	}
+	return logged
+}
+
+// dropPacket logs a packet that could not be parsed and lets the server continue.
+// Messages that a method rejected have already been logged by logMessages,
+// and never stop the server either.
+func (srv *Server) dropPacket(err oscnet.PacketError) error {
+	if err.Parse {
+		srv.log.Warn("dropped malformed packet", "sender", fmt.Sprint(err.Sender), errAttr(err))
+	}
+	return nil
+}
+
+// messageAttrs returns the attributes a message is logged with.
+// Messages from the HTTP API have no sender.
+func messageAttrs(m osc.Message) []interface{} {
+	attrs := []interface{}{"address", m.Address, "args", argumentValues(m.Arguments)}
+
+	if m.Sender != nil {
+		attrs = append(attrs, "sender", m.Sender.String())
+	}
+	return attrs
+}
+
+// argumentValues returns the values of OSC arguments for logging.
+func argumentValues(args osc.Arguments) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = argumentValue(arg)
+	}
+	return values
+}
+
+// errAttr returns an error as a log attribute without the stack trace that pkg/errors adds to it.
+func errAttr(err error) slog.Attr {
+	return slog.String("err", err.Error())
+}
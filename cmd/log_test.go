@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// logRecords decodes the records a JSON logger wrote.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestSetupLogging(t *testing.T) {
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+
+	for _, testcase := range []struct {
+		level, format string
+		logged        []string
+	}{
+		{level: "debug", format: LogFormatText, logged: []string{"debug", "info", "warn", "error"}},
+		{level: "info", format: LogFormatText, logged: []string{"info", "warn", "error"}},
+		{level: "WARN", format: LogFormatText, logged: []string{"warn", "error"}},
+		{level: "error", format: LogFormatJSON, logged: []string{"error"}},
+	} {
+		var buf bytes.Buffer
+		if err := setupLogging(&buf, testcase.level, testcase.format); err != nil {
+			t.Fatal(err)
+		}
+		slog.Debug("debug")
+		slog.Info("info")
+		slog.Warn("warn")
+		slog.Error("error")
+
+		var messages []string
+		if testcase.format == LogFormatJSON {
+			for _, record := range logRecords(t, &buf) {
+				messages = append(messages, record["msg"].(string))
+			}
+		} else {
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				idx := strings.Index(line, "msg=")
+				if idx == -1 {
+					t.Fatalf("expected a text log line, got %q", line)
+				}
+				messages = append(messages, line[idx+len("msg="):])
+			}
+		}
+		if expected, got := strings.Join(testcase.logged, " "), strings.Join(messages, " "); expected != got {
+			t.Fatalf("level %s: expected %q to be logged, got %q", testcase.level, expected, got)
+		}
+	}
+	for _, testcase := range []struct {
+		level, format string
+	}{
+		{level: "loud", format: LogFormatText},
+		{level: "info", format: "xml"},
+	} {
+		if err := setupLogging(&bytes.Buffer{}, testcase.level, testcase.format); err == nil {
+			t.Fatalf("expected an error for level %q and format %q", testcase.level, testcase.format)
+		}
+	}
+}
+
+func TestLogMessages(t *testing.T) {
+	var (
+		ok       = osc.Method(func(osc.Message) error { return nil })
+		rejected = osc.Method(func(osc.Message) error { return errors.New("invalid tempo") })
+		live     = func(addr string) string { return syncosc.SessionAddress("live", addr) }
+		sender   = mustUDPAddr(t, "127.0.0.1:9000")
+	)
+	d := osc.Dispatcher{
+		live(syncosc.AddressTempo):    ok,
+		live(syncosc.AddressMeter):    rejected,
+		live(syncosc.AddressSlaveAdd): ok,
+	}
+	for _, testcase := range []struct {
+		level    slog.Level
+		expected []string
+	}{
+		{
+			level: slog.LevelInfo,
+			expected: []string{
+				"INFO handled message " + live(syncosc.AddressTempo),
+				"WARN rejected message " + live(syncosc.AddressMeter),
+				"WARN dropped message with unknown address /nope",
+			},
+		},
+		{
+			// Messages to quiet addresses are only logged at debug level.
+			level: slog.LevelDebug,
+			expected: []string{
+				"INFO handled message " + live(syncosc.AddressTempo),
+				"WARN rejected message " + live(syncosc.AddressMeter),
+				"DEBUG handled message " + live(syncosc.AddressSlaveAdd),
+				"WARN dropped message with unknown address /nope",
+			},
+		},
+	} {
+		var (
+			buf    bytes.Buffer
+			log    = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: testcase.level}))
+			logged = logMessages(log, "live", d)
+		)
+		for _, addr := range []string{live(syncosc.AddressTempo), live(syncosc.AddressMeter), live(syncosc.AddressSlaveAdd), "/nope"} {
+			handler, ok := logged[addr]
+			if !ok {
+				handler = logged[oscnet.DefaultAddress]
+			}
+			m := osc.Message{Address: addr, Arguments: osc.Arguments{osc.Float(120)}, Sender: sender}
+			_ = handler.Handle(m)
+		}
+		var got []string
+		for _, record := range logRecords(t, &buf) {
+			got = append(got, record["level"].(string)+" "+record["msg"].(string)+" "+record["address"].(string))
+
+			if record["sender"] != sender.String() {
+				t.Fatalf("expected sender %s, got %v", sender, record["sender"])
+			}
+			if record["msg"] == "rejected message" && record["err"] != "invalid tempo" {
+				t.Fatalf("expected the error to be logged, got %v", record["err"])
+			}
+		}
+		if expected := strings.Join(testcase.expected, "\n"); expected != strings.Join(got, "\n") {
+			t.Fatalf("level %s: expected\n%s\ngot\n%s", testcase.level, expected, strings.Join(got, "\n"))
+		}
+	}
+}
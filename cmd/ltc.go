@@ -0,0 +1,176 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ltcCmd represents the ltc command
+var ltcCmd = &cobra.Command{
+	Use:   "ltc [file]",
+	Short: "Render Linear Timecode to a WAV file",
+	Long: `Render Linear Timecode to a WAV file
+
+The file is mono 16-bit PCM and starts with the frame of --start.
+Frames follow each other like the timecode the master sends: a frame at 29.97df
+lasts 1001/30000 seconds and drop-frame timecode skips the same frame numbers.
+Frames that do not start on a sample start on the sample after.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.Errorf("expected a WAV file, got %d arguments", len(args))
+		}
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		rate, err := ParseFrameRate(viper.GetString("fps"))
+		if err != nil {
+			return err
+		}
+		tc, err := ParseTimecode(viper.GetString("start"))
+		if err != nil {
+			return err
+		}
+		start, err := rate.Frame(tc)
+		if err != nil {
+			return err
+		}
+		l := ltc{
+			rate:       rate,
+			start:      start,
+			sampleRate: viper.GetInt("sample-rate"),
+			amplitude:  viper.GetFloat64("amplitude"),
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return errors.Wrap(err, "creating WAV file")
+		}
+		if err := l.Render(f, viper.GetDuration("duration")); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return errors.Wrap(f.Close(), "closing WAV file")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(ltcCmd)
+
+	flags := ltcCmd.Flags()
+	flags.String("start", "00:00:00:00", "timecode of the first frame")
+	flags.String("fps", FrameRate25.String(), "frame rate: 24, 25, 29.97df or 30")
+	flags.Duration("duration", time.Minute, "length of the file")
+	flags.Int("sample-rate", 48000, "sample rate of the file")
+	flags.Float64("amplitude", 0.5, "amplitude of the signal, between 0 and 1")
+}
+
+// ltcFrameBits is the number of bits in a frame of Linear Timecode.
+const ltcFrameBits = 80
+
+// ltcSyncWord are the last 16 bits of every frame, in the order they are sent.
+var ltcSyncWord = [16]bool{false, false, true, true, true, true, true, true, true, true, true, true, true, true, false, true}
+
+// ltc renders Linear Timecode starting at a frame.
+type ltc struct {
+	rate       FrameRate
+	start      int64
+	sampleRate int
+	amplitude  float64
+}
+
+// Render writes a WAV file of d with the timecode to w.
+// The timecode is biphase mark coded: the signal flips at the start of every bit
+// and in the middle of the bits that are 1.
+func (l ltc) Render(w io.Writer, d time.Duration) error {
+	if l.amplitude < 0 || l.amplitude > 1 {
+		return errors.Errorf("invalid amplitude %g, expected between 0 and 1", l.amplitude)
+	}
+	var (
+		sr      = int64(l.sampleRate)
+		samples = int64(d/time.Second)*sr + int64(d%time.Second)*sr/int64(time.Second)
+	)
+	wav, err := newWAVWriter(w, l.sampleRate, samples)
+	if err != nil {
+		return err
+	}
+	var (
+		level = -l.amplitude
+		half  int64 // the next half bit
+		frame = int64(-1)
+		bits  [ltcFrameBits]bool
+	)
+	for s := int64(0); s < samples; s++ {
+		// Half bit h starts at h*sampleRate*Den/(2*80*Num) seconds,
+		// which is rounded up to the next sample.
+		for half*sr*l.rate.Den <= s*2*ltcFrameBits*l.rate.Num {
+			bit := half / 2
+			if f := bit / ltcFrameBits; f != frame {
+				frame, bits = f, l.frameBits(l.rate.Timecode(l.start+f))
+			}
+			if half%2 == 0 || bits[bit%ltcFrameBits] {
+				level = -level
+			}
+			half++
+		}
+		if err := wav.Write(level); err != nil {
+			return err
+		}
+	}
+	return wav.Close()
+}
+
+// frameBits returns the bits of a frame in the order they are sent.
+// The user bits, color frame flag and binary group flags are 0.
+func (l ltc) frameBits(tc Timecode) [ltcFrameBits]bool {
+	var bits [ltcFrameBits]bool
+
+	set := func(pos, n, v int) {
+		for i := 0; i < n; i++ {
+			bits[pos+i] = v>>uint(i)&1 == 1
+		}
+	}
+	set(0, 4, tc.Frames%10)
+	set(8, 2, tc.Frames/10)
+	set(16, 4, tc.Seconds%10)
+	set(24, 3, tc.Seconds/10)
+	set(32, 4, tc.Minutes%10)
+	set(40, 3, tc.Minutes/10)
+	set(48, 4, tc.Hours%10)
+	set(56, 2, tc.Hours/10)
+	bits[10] = l.rate.Drop
+	copy(bits[64:], ltcSyncWord[:])
+
+	// The polarity correction bit makes the number of ones even,
+	// so that every frame starts with the signal going the same way.
+	polarity := 27
+	if l.rate.FPS == 25 {
+		polarity = 59
+	}
+	ones := 0
+	for _, b := range bits {
+		if b {
+			ones++
+		}
+	}
+	bits[polarity] = ones%2 == 1
+
+	return bits
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// ltcTestFrame is a frame of Linear Timecode decoded by decodeTestLTC.
+type ltcTestFrame struct {
+	start int // the sample the frame starts at
+	tc    Timecode
+	bits  [ltcFrameBits]bool
+}
+
+// decodeTestLTC decodes the biphase mark coded frames of a signal.
+// A frame is decoded once its sync word and the bit after it started.
+func decodeTestLTC(t *testing.T, rate FrameRate, sampleRate int, samples []int16) []ltcTestFrame {
+	t.Helper()
+
+	// The signal flips at the first sample.
+	transitions := []int{0}
+	for i := 1; i < len(samples); i++ {
+		if (samples[i] > 0) != (samples[i-1] > 0) {
+			transitions = append(transitions, i)
+		}
+	}
+	var (
+		bitPeriod = float64(sampleRate) * float64(rate.Den) / float64(ltcFrameBits*rate.Num)
+		bits      []bool
+		starts    []int
+	)
+	for i := 0; i+1 < len(transitions); {
+		starts = append(starts, transitions[i])
+
+		if float64(transitions[i+1]-transitions[i]) > 0.75*bitPeriod {
+			bits = append(bits, false)
+			i++
+			continue
+		}
+		if i+2 >= len(transitions) {
+			starts = starts[:len(starts)-1]
+			break
+		}
+		if float64(transitions[i+2]-transitions[i]) > 1.25*bitPeriod {
+			t.Fatalf("half bit at sample %d is not followed by another one", transitions[i])
+		}
+		bits = append(bits, true)
+		i += 2
+	}
+	var frames []ltcTestFrame
+
+	for end := ltcFrameBits; end <= len(bits); end++ {
+		var f ltcTestFrame
+		copy(f.bits[:], bits[end-ltcFrameBits:end])
+
+		if [16]bool(f.bits[64:]) != ltcSyncWord {
+			continue
+		}
+		get := func(pos, n int) int {
+			v := 0
+			for i := 0; i < n; i++ {
+				if f.bits[pos+i] {
+					v |= 1 << uint(i)
+				}
+			}
+			return v
+		}
+		f.start = starts[end-ltcFrameBits]
+		f.tc = Timecode{
+			Hours:   get(56, 2)*10 + get(48, 4),
+			Minutes: get(40, 3)*10 + get(32, 4),
+			Seconds: get(24, 3)*10 + get(16, 4),
+			Frames:  get(8, 2)*10 + get(0, 4),
+			Drop:    f.bits[10],
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func TestLTCRender(t *testing.T) {
+	for i, testcase := range []struct {
+		rate       FrameRate
+		start      string
+		sampleRate int
+		d          time.Duration
+	}{
+		// Crosses the frame numbers dropped at the start of a minute.
+		{rate: FrameRate2997DF, start: "00:00:59;25", sampleRate: 48000, d: 500 * time.Millisecond},
+		// Crosses a ten minutes boundary, where no frame numbers are dropped.
+		{rate: FrameRate2997DF, start: "00:09:59;25", sampleRate: 44100, d: 500 * time.Millisecond},
+		// Wraps around after 24 hours.
+		{rate: FrameRate25, start: "23:59:59:20", sampleRate: 48000, d: 600 * time.Millisecond},
+		{rate: FrameRate24, start: "01:00:00:00", sampleRate: 44100, d: time.Second},
+		{rate: FrameRate30, start: "10:59:59:29", sampleRate: 96000, d: 200 * time.Millisecond},
+	} {
+		tc, err := ParseTimecode(testcase.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, err := testcase.rate.Frame(tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			buf bytes.Buffer
+			l   = ltc{rate: testcase.rate, start: start, sampleRate: testcase.sampleRate, amplitude: 0.5}
+		)
+		if err := l.Render(&buf, testcase.d); err != nil {
+			t.Fatal(err)
+		}
+		sampleRate, samples := readTestWAV(t, buf.Bytes())
+
+		if expected, got := testcase.sampleRate, sampleRate; expected != got {
+			t.Fatalf("(test case %d) expected sample rate %d, got %d", i, expected, got)
+		}
+		if expected, got := int(testcase.d.Seconds()*float64(sampleRate)), len(samples); expected != got {
+			t.Fatalf("(test case %d) expected %d samples, got %d", i, expected, got)
+		}
+		for _, s := range samples {
+			if s != 16384 && s != -16384 {
+				t.Fatalf("(test case %d) expected samples of amplitude 16384, got %d", i, s)
+			}
+		}
+		var (
+			frames = decodeTestLTC(t, testcase.rate, sampleRate, samples)
+			sr     = int64(sampleRate)
+			// frameStart is the first sample at or after the start of a frame.
+			frameStart = func(frame int64) int {
+				return int((frame*sr*testcase.rate.Den + testcase.rate.Num - 1) / testcase.rate.Num)
+			}
+			complete int
+		)
+		for frameStart(int64(complete+1)) < len(samples) {
+			complete++
+		}
+		if expected, got := complete, len(frames); expected != got {
+			t.Fatalf("(test case %d) expected %d frames, got %d", i, expected, got)
+		}
+		for j, f := range frames {
+			if expected, got := frameStart(int64(j)), f.start; expected != got {
+				t.Fatalf("(test case %d) expected frame %d to start at sample %d, got %d", i, j, expected, got)
+			}
+			if expected, got := testcase.rate.Timecode(start+int64(j)), f.tc; expected != got {
+				t.Fatalf("(test case %d) expected frame %d to be %s, got %s", i, j, expected, got)
+			}
+			if expected, got := samples[frames[0].start], samples[f.start]; expected != got {
+				t.Fatalf("(test case %d) frame %d starts with the opposite polarity", i, j)
+			}
+		}
+	}
+}
+
+func TestLTCFrameBitsPolarity(t *testing.T) {
+	for _, rate := range FrameRates {
+		polarity := 27
+		if rate.FPS == 25 {
+			polarity = 59
+		}
+		l := ltc{rate: rate}
+
+		for frame := int64(0); frame < 2*rate.FPS*60; frame++ {
+			var (
+				bits = l.frameBits(rate.Timecode(frame))
+				ones int
+			)
+			for _, b := range bits {
+				if b {
+					ones++
+				}
+			}
+			if ones%2 != 0 {
+				t.Fatalf("%s fps: frame %d has %d ones", rate, frame, ones)
+			}
+			// The binary group flags are 0, so only the polarity correction bit can be set.
+			for _, pos := range []int{27, 43, 58, 59} {
+				if pos != polarity && bits[pos] {
+					t.Fatalf("%s fps: frame %d has bit %d set", rate, frame, pos)
+				}
+			}
+		}
+	}
+}
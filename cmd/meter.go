@@ -0,0 +1,131 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// DefaultMeter is the meter the server starts with.
+var DefaultMeter = Meter{Beats: 4, Unit: 4}
+
+// Meter is a time signature.
+type Meter struct {
+	Beats int32 `json:"beats"`
+	Unit  int32 `json:"unit"`
+}
+
+// Validate returns an error if the meter can not be expressed in whole pulses.
+func (m Meter) Validate() error {
+	if m.Beats <= 0 {
+		return errors.Errorf("meter must have a positive number of beats, got %d", m.Beats)
+	}
+	if m.Unit <= 0 || m.Unit&(m.Unit-1) != 0 || syncosc.PulsesPerBar%m.Unit != 0 {
+		return errors.Errorf("invalid beat unit %d", m.Unit)
+	}
+	return nil
+}
+
+// PulsesPerBeat returns the number of pulses in one beat of the meter.
+func (m Meter) PulsesPerBeat() uint64 {
+	return uint64(syncosc.PulsesPerBar / m.Unit)
+}
+
+// PulsesPerBar returns the number of pulses in one bar of the meter.
+func (m Meter) PulsesPerBar() uint64 {
+	return uint64(m.Beats) * m.PulsesPerBeat()
+}
+
+// ParseMeter parses a time signature, e.g. "6/8".
+func ParseMeter(s string) (Meter, error) {
+	beats, unit, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Meter{}, errors.Errorf("invalid meter %q, expected beats/unit", s)
+	}
+	b, err := strconv.ParseInt(beats, 10, 32)
+	if err != nil {
+		return Meter{}, errors.Wrapf(err, "parsing beats of meter %q", s)
+	}
+	u, err := strconv.ParseInt(unit, 10, 32)
+	if err != nil {
+		return Meter{}, errors.Wrapf(err, "parsing unit of meter %q", s)
+	}
+	m := Meter{Beats: int32(b), Unit: int32(u)}
+	if err := m.Validate(); err != nil {
+		return Meter{}, err
+	}
+	return m, nil
+}
+
+// String returns the meter as a time signature, e.g. "4/4".
+func (m Meter) String() string {
+	return fmt.Sprintf("%d/%d", m.Beats, m.Unit)
+}
+
+// HandleMeter handles meter updates.
+func (sess *Session) HandleMeter(m osc.Message) error {
+	if len(m.Arguments) == 0 {
+		state, err := sess.query()
+		if err != nil {
+			return err
+		}
+		return sess.conn.SendTo(m.Sender, osc.Message{
+			Address: "/reply",
+			Arguments: osc.Arguments{
+				osc.String(sess.address(syncosc.AddressMeter)),
+				osc.Int(state.Meter.Beats),
+				osc.Int(state.Meter.Unit),
+				osc.Int(int32(state.BarOrigin)),
+				osc.Int(int32(state.OriginBar)),
+			},
+		})
+	}
+	if len(m.Arguments) < 2 {
+		return errors.Errorf("expected at least 2 arguments, got %d", len(m.Arguments))
+	}
+	beats, err := m.Arguments[0].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading beats")
+	}
+	unit, err := m.Arguments[1].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading unit")
+	}
+	meter := Meter{Beats: beats, Unit: unit}
+	if err := meter.Validate(); err != nil {
+		return err
+	}
+	q, err := readQuantization(m, 2)
+	if err != nil {
+		return err
+	}
+	return sess.submit(change{
+		quantize: q,
+		msg: osc.Message{
+			Address:   sess.address(syncosc.AddressMeter),
+			Arguments: osc.Arguments{osc.Int(beats), osc.Int(unit)},
+		},
+		apply: func(sess *Session) error {
+			sess.setMeter(meter)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,329 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// latenessBuckets are the upper bounds of the scheduling lateness histogram in seconds.
+var latenessBuckets = []float64{0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1}
+
+// metrics counts what the server does.
+// It is safe for concurrent use since the sessions count from their main loops
+// and from the goroutines that send delayed pulses.
+// A nil metrics counts nothing.
+type metrics struct {
+	mu         sync.Mutex
+	pulsesSent map[slaveKey]uint64
+	sendErrors map[slaveKey]uint64
+	lateness   map[string]*histogram
+	messages   map[messageKey]uint64
+}
+
+// slaveKey identifies a slave of a session.
+type slaveKey struct {
+	session string
+	slave   string
+}
+
+// messageKey identifies the control messages with an address and result.
+type messageKey struct {
+	address string
+	result  string
+}
+
+// histogram counts observations in buckets.
+// counts has one more element than the buckets, for the observations above the last bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newMetrics creates metrics that have not counted anything.
+func newMetrics() *metrics {
+	return &metrics{
+		pulsesSent: map[slaveKey]uint64{},
+		sendErrors: map[slaveKey]uint64{},
+		lateness:   map[string]*histogram{},
+		messages:   map[messageKey]uint64{},
+	}
+}
+
+// PulseSent counts a pulse that was sent to a slave.
+func (m *metrics) PulseSent(session, slave string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.pulsesSent[slaveKey{session: session, slave: slave}]++
+	m.mu.Unlock()
+}
+
+// SendError counts a pulse that could not be sent to a slave.
+func (m *metrics) SendError(session, slave string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.sendErrors[slaveKey{session: session, slave: slave}]++
+	m.mu.Unlock()
+}
+
+// Lateness records how late a pulse was sent compared to when it should have been sent.
+func (m *metrics) Lateness(session string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.lateness[session]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latenessBuckets)+1)}
+		m.lateness[session] = h
+	}
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latenessBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// Message counts a control message by its address and whether it was handled without an error.
+func (m *metrics) Message(address string, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	m.messages[messageKey{address: address, result: result}]++
+	m.mu.Unlock()
+}
+
+// ForgetSlave removes the counters of a slave that was removed.
+func (m *metrics) ForgetSlave(session, slave string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.pulsesSent, slaveKey{session: session, slave: slave})
+	delete(m.sendErrors, slaveKey{session: session, slave: slave})
+	m.mu.Unlock()
+}
+
+// ForgetSession removes the counters of a session that was removed.
+func (m *metrics) ForgetSession(session string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.pulsesSent {
+		if key.session == session {
+			delete(m.pulsesSent, key)
+		}
+	}
+	for key := range m.sendErrors {
+		if key.session == session {
+			delete(m.sendErrors, key)
+		}
+	}
+	delete(m.lateness, session)
+}
+
+// CountMessages returns a dispatcher that counts the messages handled by the methods of d.
+// Messages for named sessions are counted by their address in the default session.
+// The default method is not counted since it routes messages to the sessions, which count them.
+func (m *metrics) CountMessages(session string, d osc.Dispatcher) osc.Dispatcher {
+	counted := osc.Dispatcher{}
+
+	for addr, handler := range d {
+		if addr == oscnet.DefaultAddress {
+			counted[addr] = handler
+			continue
+		}
+		var (
+			handler = handler
+			base    = strings.Replace(addr, syncosc.SessionAddress(session, syncosc.AddressPrefix), syncosc.AddressPrefix, 1)
+		)
+		counted[addr] = osc.Method(func(msg osc.Message) error {
+			err := handler.Handle(msg)
+			m.Message(base, err)
+			return err
+		})
+	}
+	return counted
+}
+
+// writeCounters writes the counters in the Prometheus text format.
+func (m *metrics) writeCounters(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "oscsync_slave_pulses_sent_total", "counter", "Pulses sent to each slave.")
+	for _, key := range sortedSlaveKeys(m.pulsesSent) {
+		writeSample(w, "oscsync_slave_pulses_sent_total", float64(m.pulsesSent[key]), "session", key.session, "slave", key.slave)
+	}
+	writeHeader(w, "oscsync_slave_send_errors_total", "counter", "Pulses that could not be sent to each slave.")
+	for _, key := range sortedSlaveKeys(m.sendErrors) {
+		writeSample(w, "oscsync_slave_send_errors_total", float64(m.sendErrors[key]), "session", key.session, "slave", key.slave)
+	}
+	writeHeader(w, "oscsync_messages_total", "counter", "Control messages received by address and result.")
+	keys := make([]messageKey, 0, len(m.messages))
+	for key := range m.messages {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].address != keys[j].address {
+			return keys[i].address < keys[j].address
+		}
+		return keys[i].result < keys[j].result
+	})
+	for _, key := range keys {
+		writeSample(w, "oscsync_messages_total", float64(m.messages[key]), "address", key.address, "result", key.result)
+	}
+	writeHeader(w, "oscsync_pulse_lateness_seconds", "histogram", "How late pulses are sent compared to the ideal time on the tempo grid.")
+	sessions := make([]string, 0, len(m.lateness))
+	for session := range m.lateness {
+		sessions = append(sessions, session)
+	}
+	sort.Strings(sessions)
+
+	for _, session := range sessions {
+		var (
+			h          = m.lateness[session]
+			cumulative uint64
+		)
+		for i, le := range latenessBuckets {
+			cumulative += h.counts[i]
+			writeSample(w, "oscsync_pulse_lateness_seconds_bucket", float64(cumulative), "session", session, "le", formatFloat(le))
+		}
+		writeSample(w, "oscsync_pulse_lateness_seconds_bucket", float64(h.count), "session", session, "le", "+Inf")
+		writeSample(w, "oscsync_pulse_lateness_seconds_sum", h.sum, "session", session)
+		writeSample(w, "oscsync_pulse_lateness_seconds_count", float64(h.count), "session", session)
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+// The gauges are read from the sessions, the counters from the server's metrics.
+func (srv *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), httpTimeout)
+	defer cancel()
+
+	srv.mu.RLock()
+	sessions := make([]*Session, 0, len(srv.sessions))
+	for _, sess := range srv.sessions {
+		sessions = append(sessions, sess)
+	}
+	srv.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].name < sessions[j].name
+	})
+	states := make([]SessionState, 0, len(sessions))
+	for _, sess := range sessions {
+		state, err := sess.State(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		states = append(states, state)
+	}
+	var buf bytes.Buffer
+
+	writeHeader(&buf, "oscsync_tempo_bpm", "gauge", "Tempo of each session.")
+	for _, state := range states {
+		writeSample(&buf, "oscsync_tempo_bpm", float64(state.Tempo), "session", state.Name)
+	}
+	writeHeader(&buf, "oscsync_pulse", "gauge", "Pulse count of each session, which restarts at 0 when the transport starts.")
+	for _, state := range states {
+		writeSample(&buf, "oscsync_pulse", float64(state.Pulse), "session", state.Name)
+	}
+	writeHeader(&buf, "oscsync_slaves", "gauge", "Number of slaves of each session.")
+	for _, state := range states {
+		writeSample(&buf, "oscsync_slaves", float64(len(state.Slaves)), "session", state.Name)
+	}
+	srv.metrics.writeCounters(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = buf.WriteTo(w)
+}
+
+// runMetrics serves the metrics on their own HTTP server until the context is done.
+func (srv *Server) runMetrics(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", srv.handleMetrics)
+
+	return errors.Wrap(serveHTTP(ctx, srv.metricsAddr, mux), "serving metrics")
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeSample writes a sample with labels given as name, value pairs.
+func writeSample(w io.Writer, name string, value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatFloat(value))
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// formatFloat formats a sample value.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedSlaveKeys returns the keys of a per-slave counter in order.
+func sortedSlaveKeys(counters map[slaveKey]uint64) []slaveKey {
+	keys := make([]slaveKey, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].session != keys[j].session {
+			return keys[i].session < keys[j].session
+		}
+		return keys[i].slave < keys[j].slave
+	})
+	return keys
+}
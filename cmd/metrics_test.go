@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+func TestMetricsWriteCounters(t *testing.T) {
+	m := newMetrics()
+	m.PulseSent("", "127.0.0.1:9001")
+	m.PulseSent("", "127.0.0.1:9001")
+	m.PulseSent("", "127.0.0.1:9000")
+	m.SendError("live", `host "x"`)
+	m.Message("/sync/tempo", nil)
+	m.Message("/sync/tempo", errors.New("invalid tempo"))
+	m.Message("/sync/meter", nil)
+	m.Lateness("", 3*time.Millisecond)
+	m.Lateness("", time.Second)
+
+	var buf bytes.Buffer
+	m.writeCounters(&buf)
+
+	expected := `# HELP oscsync_slave_pulses_sent_total Pulses sent to each slave.
+# TYPE oscsync_slave_pulses_sent_total counter
+oscsync_slave_pulses_sent_total{session="",slave="127.0.0.1:9000"} 1
+oscsync_slave_pulses_sent_total{session="",slave="127.0.0.1:9001"} 2
+# HELP oscsync_slave_send_errors_total Pulses that could not be sent to each slave.
+# TYPE oscsync_slave_send_errors_total counter
+oscsync_slave_send_errors_total{session="live",slave="host \"x\""} 1
+# HELP oscsync_messages_total Control messages received by address and result.
+# TYPE oscsync_messages_total counter
+oscsync_messages_total{address="/sync/meter",result="ok"} 1
+oscsync_messages_total{address="/sync/tempo",result="error"} 1
+oscsync_messages_total{address="/sync/tempo",result="ok"} 1
+# HELP oscsync_pulse_lateness_seconds How late pulses are sent compared to the ideal time on the tempo grid.
+# TYPE oscsync_pulse_lateness_seconds histogram
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.0005"} 0
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.001"} 0
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.002"} 0
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.005"} 1
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.01"} 1
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.02"} 1
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.05"} 1
+oscsync_pulse_lateness_seconds_bucket{session="",le="0.1"} 1
+oscsync_pulse_lateness_seconds_bucket{session="",le="+Inf"} 2
+oscsync_pulse_lateness_seconds_sum{session=""} 1.003
+oscsync_pulse_lateness_seconds_count{session=""} 2
+`
+	if got := buf.String(); expected != got {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+// getMetrics returns the samples of GET /metrics by metric name and labels.
+func getMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if expected, got := "text/plain; version=0.0.4", resp.Header.Get("Content-Type"); expected != got {
+		t.Fatalf("expected content type %s, got %s", expected, got)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[idx+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %s", line, err)
+		}
+		samples[line[:idx]] = value
+	}
+	return samples
+}
+
+func TestMetricsSessionWithSlaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Slaves are never evicted, so the one that can not be sent to stays.
+	settings := defaultSettings
+	settings.maxSendFailures = 0
+
+	var (
+		srv   = runTestServer(t, ServerConfig{tempo: 120, settings: settings})
+		slave = newTestMaster(ctx, t)
+	)
+	srv.sessionState(t, "")
+
+	addr, err := net.ResolveUDPAddr("udp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slaveAddr := slave.conn.LocalAddr().(*net.UDPAddr)
+
+	// One slave that can be sent to and one that can not.
+	for _, port := range []int{slaveAddr.Port, 0} {
+		if err := slave.conn.SendTo(addr, osc.Message{
+			Address:   syncosc.AddressSlaveAdd,
+			Arguments: osc.Arguments{osc.String("127.0.0.1"), osc.Int(int32(port))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-slave.messages:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	api := httptest.NewServer(http.HandlerFunc(srv.handleMetrics))
+	defer api.Close()
+
+	var samples map[string]float64
+	waitFor(t, "pulses and send errors to be counted", func() bool {
+		samples = getMetrics(t, api.URL)
+		return samples[`oscsync_slave_pulses_sent_total{session="",slave="`+slaveAddr.String()+`"}`] > 0 &&
+			samples[`oscsync_slave_send_errors_total{session="",slave="127.0.0.1:0"}`] > 0
+	})
+	for sample, expected := range map[string]float64{
+		`oscsync_tempo_bpm{session=""}`:                                 120,
+		`oscsync_slaves{session=""}`:                                    2,
+		`oscsync_messages_total{address="/sync/slave/add",result="ok"}`: 2,
+	} {
+		if got, ok := samples[sample]; !ok || expected != got {
+			t.Fatalf("expected %s %g, got %g", sample, expected, got)
+		}
+	}
+	if samples[`oscsync_pulse{session=""}`] <= 0 {
+		t.Fatal("expected the pulse count to advance")
+	}
+	if samples[`oscsync_pulse_lateness_seconds_count{session=""}`] <= 0 {
+		t.Fatal("expected the lateness of the pulses to be recorded")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// Meta event types of Standard MIDI Files.
+const (
+	metaTrackName     = 0x03
+	metaMarker        = 0x06
+	metaEndOfTrack    = 0x2F
+	metaTempo         = 0x51
+	metaTimeSignature = 0x58
+)
+
+// maxMicrosPerQuarter is the largest tempo a Standard MIDI File can hold, in microseconds per quarter note.
+const maxMicrosPerQuarter = 1<<24 - 1
+
+// metaEvent is a meta event of a Standard MIDI File at a tick.
+type metaEvent struct {
+	tick uint64
+	typ  byte
+	data []byte
+}
+
+// tempoMap collects the tempo, meter and cue history of a session
+// from the messages the master sends, on a timeline of pulses.
+// The timeline only advances with pulses, so the time the transport was stopped is left out.
+// Since every pulse carries the tempo, a tempo ramp becomes a tempo event for every pulse that changes it.
+type tempoMap struct {
+	session string
+	ppqn    int
+
+	// tick is the tick of the last pulse.
+	tick    uint64
+	count   int32
+	started bool
+
+	micros uint32
+	meter  Meter
+
+	// pending is the meter that takes effect at the next pulse,
+	// since changes are sent just before the pulse they are applied on.
+	pending *Meter
+
+	events []metaEvent
+}
+
+// newTempoMap creates an empty tempo map for a session with pulses at the given ppqn.
+func newTempoMap(session string, ppqn int) *tempoMap {
+	return &tempoMap{session: session, ppqn: ppqn}
+}
+
+// Add adds a message from the master to the tempo map.
+// Pulses advance the timeline and change the tempo, meter changes take effect at the next pulse
+// and messages outside of the oscsync protocol are cues, which become markers at the last pulse.
+// Every other message is ignored.
+func (tm *tempoMap) Add(m osc.Message) error {
+	switch {
+	case m.Address == syncosc.SessionAddress(tm.session, syncosc.AddressPulse):
+		if len(m.Arguments) < 2 {
+			return errors.Errorf("expected 2 pulse arguments, got %d", len(m.Arguments))
+		}
+		tempo, err := m.Arguments[0].ReadFloat32()
+		if err != nil {
+			return errors.Wrap(err, "reading tempo")
+		}
+		count, err := m.Arguments[1].ReadInt32()
+		if err != nil {
+			return errors.Wrap(err, "reading pulse count")
+		}
+		tm.Pulse(tempo, count)
+	case m.Address == syncosc.SessionAddress(tm.session, syncosc.AddressMeter):
+		if len(m.Arguments) < 2 {
+			return errors.Errorf("expected 2 meter arguments, got %d", len(m.Arguments))
+		}
+		beats, err := m.Arguments[0].ReadInt32()
+		if err != nil {
+			return errors.Wrap(err, "reading beats")
+		}
+		unit, err := m.Arguments[1].ReadInt32()
+		if err != nil {
+			return errors.Wrap(err, "reading beat unit")
+		}
+		return tm.Meter(Meter{Beats: beats, Unit: unit})
+	case !strings.HasPrefix(m.Address, syncosc.AddressPrefix):
+		tm.Marker(cueMarker(m))
+	}
+	return nil
+}
+
+// Pulse adds a pulse with a tempo and a pulse count.
+// The pulse count restarts when the transport starts, the timeline carries on.
+func (tm *tempoMap) Pulse(tempo float32, count int32) {
+	switch {
+	case !tm.started:
+		tm.started = true
+		if tm.pending == nil {
+			meter := DefaultMeter
+			tm.pending = &meter
+		}
+	case count > tm.count:
+		tm.tick += uint64(count - tm.count)
+	default:
+		tm.tick++
+	}
+	tm.count = count
+
+	if micros := microsPerQuarter(tempo); micros != tm.micros {
+		tm.micros = micros
+		tm.events = append(tm.events, metaEvent{
+			tick: tm.tick,
+			typ:  metaTempo,
+			data: []byte{byte(micros >> 16), byte(micros >> 8), byte(micros)},
+		})
+	}
+	if tm.pending != nil {
+		if meter := *tm.pending; meter != tm.meter {
+			tm.meter = meter
+			tm.events = append(tm.events, metaEvent{
+				tick: tm.tick,
+				typ:  metaTimeSignature,
+				data: []byte{
+					byte(meter.Beats),
+					byte(bits.TrailingZeros32(uint32(meter.Unit))),
+					byte(meter.PulsesPerBeat()), // MIDI clocks per beat, which are 24 per quarter note like pulses.
+					8,
+				},
+			})
+		}
+		tm.pending = nil
+	}
+}
+
+// Meter changes the meter at the next pulse.
+func (tm *tempoMap) Meter(meter Meter) error {
+	if err := meter.Validate(); err != nil {
+		return err
+	}
+	if meter.Beats > math.MaxUint8 {
+		return errors.Errorf("meter must have at most %d beats, got %d", math.MaxUint8, meter.Beats)
+	}
+	tm.pending = &meter
+	return nil
+}
+
+// Marker adds a marker at the last pulse.
+func (tm *tempoMap) Marker(text string) {
+	tm.events = append(tm.events, metaEvent{tick: tm.tick, typ: metaMarker, data: []byte(text)})
+}
+
+// WriteSMF writes the tempo map as a Standard MIDI File of format 0 or 1 with the ppqn as its division.
+// The tempo changes, time signatures and markers are all in the first track,
+// which is where DAWs look for them in both formats.
+func (tm *tempoMap) WriteSMF(w io.Writer, format int) error {
+	if format != 0 && format != 1 {
+		return errors.Errorf("SMF format must be 0 or 1, got %d", format)
+	}
+	if tm.ppqn <= 0 || tm.ppqn > math.MaxInt16 {
+		return errors.Errorf("invalid ppqn %d", tm.ppqn)
+	}
+	var track bytes.Buffer
+
+	name := "oscsync"
+	if tm.session != "" {
+		name += " " + tm.session
+	}
+	writeMetaEvent(&track, 0, metaTrackName, []byte(name))
+
+	tick := uint64(0)
+	for _, e := range tm.events {
+		writeMetaEvent(&track, e.tick-tick, e.typ, e.data)
+		tick = e.tick
+	}
+	end := tick
+	if tm.started {
+		end = tm.tick + 1
+	}
+	writeMetaEvent(&track, end-tick, metaEndOfTrack, nil)
+
+	var header [14]byte
+	copy(header[:], "MThd")
+	binary.BigEndian.PutUint32(header[4:], 6)
+	binary.BigEndian.PutUint16(header[8:], uint16(format))
+	binary.BigEndian.PutUint16(header[10:], 1)
+	binary.BigEndian.PutUint16(header[12:], uint16(tm.ppqn))
+
+	var chunk [8]byte
+	copy(chunk[:], "MTrk")
+	binary.BigEndian.PutUint32(chunk[4:], uint32(track.Len()))
+
+	for _, b := range [][]byte{header[:], chunk[:], track.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return errors.Wrap(err, "writing MIDI file")
+		}
+	}
+	return nil
+}
+
+// writeMetaEvent writes a meta event to a track after delta ticks.
+func writeMetaEvent(w *bytes.Buffer, delta uint64, typ byte, data []byte) {
+	writeVarLen(w, delta)
+	w.WriteByte(0xFF)
+	w.WriteByte(typ)
+	writeVarLen(w, uint64(len(data)))
+	w.Write(data)
+}
+
+// writeVarLen writes a variable-length quantity, 7 bits per byte with the most significant bits first.
+func writeVarLen(w *bytes.Buffer, v uint64) {
+	var buf [10]byte
+
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7F)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7F) | 0x80
+	}
+	w.Write(buf[i:])
+}
+
+// microsPerQuarter returns a tempo in BPM as microseconds per quarter note,
+// limited to what a Standard MIDI File can hold.
+func microsPerQuarter(tempo float32) uint32 {
+	if tempo <= 0 {
+		return maxMicrosPerQuarter
+	}
+	micros := math.Round(6e7 / float64(tempo))
+	if micros > maxMicrosPerQuarter {
+		return maxMicrosPerQuarter
+	}
+	if micros < 1 {
+		return 1
+	}
+	return uint32(micros)
+}
+
+// cueMarker returns the text of the marker of a cue, which is its address followed by its arguments.
+func cueMarker(m osc.Message) string {
+	text := m.Address
+	for _, v := range argumentValues(m.Arguments) {
+		text += fmt.Sprintf(" %v", v)
+	}
+	return text
+}
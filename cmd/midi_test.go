@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// smfEvent is a meta event read back from a Standard MIDI File with its absolute tick.
+type smfEvent struct {
+	tick uint64
+	typ  byte
+	data string
+}
+
+// smfFile is a Standard MIDI File read back by parseSMF.
+type smfFile struct {
+	format   uint16
+	division uint16
+	tracks   [][]smfEvent
+}
+
+// parseSMF parses a Standard MIDI File that only has meta events.
+func parseSMF(t *testing.T, data []byte) smfFile {
+	t.Helper()
+
+	if len(data) < 14 || string(data[:4]) != "MThd" || binary.BigEndian.Uint32(data[4:]) != 6 {
+		t.Fatalf("invalid header %q", data)
+	}
+	f := smfFile{
+		format:   binary.BigEndian.Uint16(data[8:]),
+		division: binary.BigEndian.Uint16(data[12:]),
+	}
+	ntracks := int(binary.BigEndian.Uint16(data[10:]))
+	data = data[14:]
+
+	for i := 0; i < ntracks; i++ {
+		if len(data) < 8 || string(data[:4]) != "MTrk" {
+			t.Fatalf("track %d: invalid chunk %q", i, data)
+		}
+		size := int(binary.BigEndian.Uint32(data[4:]))
+		if len(data) < 8+size {
+			t.Fatalf("track %d: expected %d bytes, got %d", i, size, len(data)-8)
+		}
+		var (
+			track  = data[8 : 8+size]
+			events []smfEvent
+			tick   uint64
+		)
+		for len(track) > 0 {
+			var delta, length uint64
+			delta, track = readTestVarLen(t, track)
+			tick += delta
+
+			if len(track) < 2 || track[0] != 0xFF {
+				t.Fatalf("track %d: expected a meta event at tick %d, got %x", i, tick, track)
+			}
+			typ := track[1]
+			length, track = readTestVarLen(t, track[2:])
+			if uint64(len(track)) < length {
+				t.Fatalf("track %d: meta event at tick %d is cut short", i, tick)
+			}
+			events = append(events, smfEvent{tick: tick, typ: typ, data: string(track[:length])})
+			track = track[length:]
+		}
+		if n := len(events); n == 0 || events[n-1].typ != metaEndOfTrack {
+			t.Fatalf("track %d does not end with end of track", i)
+		}
+		f.tracks = append(f.tracks, events)
+		data = data[8+size:]
+	}
+	if len(data) > 0 {
+		t.Fatalf("%d bytes after the last track", len(data))
+	}
+	return f
+}
+
+func readTestVarLen(t *testing.T, data []byte) (uint64, []byte) {
+	t.Helper()
+
+	var v uint64
+	for i, b := range data {
+		v = v<<7 | uint64(b&0x7F)
+		if b&0x80 == 0 {
+			return v, data[i+1:]
+		}
+	}
+	t.Fatalf("variable-length quantity is cut short: %x", data)
+	return 0, nil
+}
+
+func tempoEvent(tick uint64, micros uint32) smfEvent {
+	return smfEvent{tick: tick, typ: metaTempo, data: string([]byte{byte(micros >> 16), byte(micros >> 8), byte(micros)})}
+}
+
+func meterEvent(tick uint64, beats, log2Unit, clocks byte) smfEvent {
+	return smfEvent{tick: tick, typ: metaTimeSignature, data: string([]byte{beats, log2Unit, clocks, 8})}
+}
+
+func writeTestSMF(t *testing.T, tm *tempoMap, format int) smfFile {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := tm.WriteSMF(&buf, format); err != nil {
+		t.Fatal(err)
+	}
+	return parseSMF(t, buf.Bytes())
+}
+
+func TestTempoMapSMF(t *testing.T) {
+	tm := newTempoMap("live", 24)
+
+	if err := tm.Meter(Meter{Beats: 3, Unit: 4}); err != nil {
+		t.Fatal(err)
+	}
+	for count := int32(0); count < 24; count++ {
+		tm.Pulse(120, count)
+	}
+	// A ramp from 120 to 123 over three pulses.
+	for i, tempo := range []float32{121, 122, 123} {
+		tm.Pulse(tempo, int32(24+i))
+	}
+	tm.Pulse(123, 27)
+
+	if err := tm.Add(osc.Message{
+		Address:   syncosc.SessionAddress("live", syncosc.AddressMeter),
+		Arguments: osc.Arguments{osc.Int(6), osc.Int(8)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The transport restarts and the pulse count with it.
+	tm.Pulse(123, 0)
+
+	if err := tm.Add(osc.Message{Address: "/lights/scene", Arguments: osc.Arguments{osc.Int(3), osc.String("red")}}); err != nil {
+		t.Fatal(err)
+	}
+	// Tempo changes are read from the pulses, so the change message is ignored.
+	if err := tm.Add(osc.Message{
+		Address:   syncosc.SessionAddress("live", syncosc.AddressTempo),
+		Arguments: osc.Arguments{osc.Float(90)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tm.Pulse(123, 1)
+
+	f := writeTestSMF(t, tm, 1)
+
+	if expected, got := uint16(1), f.format; expected != got {
+		t.Fatalf("expected format %d, got %d", expected, got)
+	}
+	if expected, got := uint16(24), f.division; expected != got {
+		t.Fatalf("expected division %d, got %d", expected, got)
+	}
+	if expected, got := 1, len(f.tracks); expected != got {
+		t.Fatalf("expected %d tracks, got %d", expected, got)
+	}
+	expected := []smfEvent{
+		{tick: 0, typ: metaTrackName, data: "oscsync live"},
+		tempoEvent(0, 500000),
+		meterEvent(0, 3, 2, 24),
+		tempoEvent(24, 495868),
+		tempoEvent(25, 491803),
+		tempoEvent(26, 487805),
+		meterEvent(28, 6, 3, 12),
+		{tick: 28, typ: metaMarker, data: "/lights/scene 3 red"},
+		{tick: 30, typ: metaEndOfTrack},
+	}
+	if got := f.tracks[0]; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestTempoMapSMFFormat0(t *testing.T) {
+	tm := newTempoMap("", 4)
+	tm.Pulse(60, 0)
+
+	f := writeTestSMF(t, tm, 0)
+
+	if expected, got := uint16(0), f.format; expected != got {
+		t.Fatalf("expected format %d, got %d", expected, got)
+	}
+	expected := []smfEvent{
+		{tick: 0, typ: metaTrackName, data: "oscsync"},
+		tempoEvent(0, 1000000),
+		meterEvent(0, 4, 2, 24),
+		{tick: 1, typ: metaEndOfTrack},
+	}
+	if got := f.tracks[0]; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if err := tm.WriteSMF(&bytes.Buffer{}, 2); err == nil {
+		t.Fatal("expected an error for format 2")
+	}
+}
+
+func TestTempoMapRecording(t *testing.T) {
+	pulse := func(tempo float32, count int32) osc.Message {
+		return osc.Message{
+			Address:   syncosc.SessionAddress("live", syncosc.AddressPulse),
+			Arguments: osc.Arguments{osc.Float(tempo), osc.Int(count)},
+		}
+	}
+	var packets []RecordedPacket
+	for count := int32(0); count < 4; count++ {
+		packets = append(packets, RecordedPacket{Data: pulse(120, count).Bytes()})
+	}
+	packets = append(packets,
+		RecordedPacket{Data: osc.Message{
+			Address:   syncosc.SessionAddress("live", syncosc.AddressTempo),
+			Arguments: osc.Arguments{osc.Float(140)},
+		}.Bytes()},
+		RecordedPacket{Data: osc.Bundle{
+			Timetag: osc.Immediately,
+			Packets: []osc.Packet{pulse(140, 4), osc.Message{Address: "/cue"}},
+		}.Bytes()},
+		// Pulses of other sessions are not part of the tempo map.
+		RecordedPacket{Data: osc.Message{
+			Address:   syncosc.AddressPulse,
+			Arguments: osc.Arguments{osc.Float(60), osc.Int(5)},
+		}.Bytes()},
+	)
+	tm := newTempoMap("live", 4)
+	if err := addRecording(tm, packets); err != nil {
+		t.Fatal(err)
+	}
+	f := writeTestSMF(t, tm, 1)
+
+	expected := []smfEvent{
+		{tick: 0, typ: metaTrackName, data: "oscsync live"},
+		tempoEvent(0, 500000),
+		meterEvent(0, 4, 2, 24),
+		tempoEvent(4, 428571),
+		{tick: 4, typ: metaMarker, data: "/cue"},
+		{tick: 5, typ: metaEndOfTrack},
+	}
+	if got := f.tracks[0]; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if expected, got := uint16(4), f.division; expected != got {
+		t.Fatalf("expected division %d, got %d", expected, got)
+	}
+}
+
+func TestTempoMapEvents(t *testing.T) {
+	events := strings.Join([]string{
+		"event: pulse",
+		`data: {"tempo":100,"pulse":0}`,
+		"",
+		"event: position",
+		`data: {"bar":1,"beat":1,"position":"1.1.0"}`,
+		"",
+		"event: cue",
+		`data: {"address":"/drop","arguments":[{"type":"f","float":0.5}]}`,
+		"",
+		"event: change",
+		`data: {"address":"/sync/meter","arguments":[{"type":"i","int":7},{"type":"i","int":8}]}`,
+		"",
+		"event: pulse",
+		`data: {"tempo":100,"pulse":1}`,
+		"",
+		"",
+	}, "\n")
+
+	tm := newTempoMap("", 24)
+	if err := readEvents(strings.NewReader(events), tm); err != nil {
+		t.Fatal(err)
+	}
+	f := writeTestSMF(t, tm, 1)
+
+	expected := []smfEvent{
+		{tick: 0, typ: metaTrackName, data: "oscsync"},
+		tempoEvent(0, 600000),
+		meterEvent(0, 4, 2, 24),
+		{tick: 0, typ: metaMarker, data: "/drop 0.5"},
+		meterEvent(1, 7, 3, 12),
+		{tick: 2, typ: metaEndOfTrack},
+	}
+	if got := f.tracks[0]; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package cmd
+
+import (
+	"net"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// setMulticastInterface returns an error, multicast is only sent on the default interface on this platform.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	return errors.Errorf("choosing the multicast interface is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,43 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package cmd
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// setMulticastInterface makes the multicast packets sent with conn
+// go out on the interface with the IPv4 address ip.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return errors.Wrap(err, "getting socket")
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	}); err != nil {
+		return errors.Wrap(err, "getting socket")
+	}
+	return errors.Wrap(serr, "setting IP_MULTICAST_IF")
+}
@@ -0,0 +1,385 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"golang.org/x/net/websocket"
+)
+
+// OSCQuery access values.
+const (
+	accessNone      = 0
+	accessRead      = 1
+	accessWrite     = 2
+	accessReadWrite = 3
+)
+
+// oscQueryNode is a node of an OSCQuery namespace.
+// See https://github.com/Vidvox/OSCQueryProposal
+type oscQueryNode struct {
+	FullPath    string                   `json:"FULL_PATH"`
+	Description string                   `json:"DESCRIPTION,omitempty"`
+	Contents    map[string]*oscQueryNode `json:"CONTENTS,omitempty"`
+	Type        string                   `json:"TYPE,omitempty"`
+	Access      int                      `json:"ACCESS,omitempty"`
+	Value       []interface{}            `json:"VALUE,omitempty"`
+	Range       []oscQueryRange          `json:"RANGE,omitempty"`
+}
+
+// oscQueryRange is the range of one argument of a method.
+type oscQueryRange struct {
+	Min  interface{}   `json:"MIN,omitempty"`
+	Max  interface{}   `json:"MAX,omitempty"`
+	Vals []interface{} `json:"VALS,omitempty"`
+}
+
+// oscQueryHostInfo describes the server to OSCQuery clients.
+type oscQueryHostInfo struct {
+	Name         string          `json:"NAME"`
+	Extensions   map[string]bool `json:"EXTENSIONS"`
+	OSCPort      int             `json:"OSC_PORT"`
+	OSCTransport string          `json:"OSC_TRANSPORT"`
+}
+
+// oscQueryCommand is a command an OSCQuery client sends over the WebSocket.
+type oscQueryCommand struct {
+	Command string `json:"COMMAND"`
+	Data    string `json:"DATA"`
+}
+
+// oscQueryMethod describes an OSC method.
+// value and rng are optional.
+type oscQueryMethod struct {
+	typetag     string
+	access      int
+	description string
+	value       func(state SessionState) []interface{}
+	rng         func(s settings) []oscQueryRange
+}
+
+// sessionMethods describes the methods of a session by their address in the default session.
+// Methods without arguments are described without a type and access.
+var sessionMethods = map[string]oscQueryMethod{
+	syncosc.AddressCueAdd:       {typetag: "iis", access: accessWrite, description: "schedule a message at a bar and beat"},
+	syncosc.AddressCueList:      {description: "list the cues"},
+	syncosc.AddressCueRemove:    {typetag: "i", access: accessWrite, description: "remove a cue"},
+	syncosc.AddressGrooveAdd:    {typetag: "sf", access: accessWrite, description: "define a groove with one offset per pulse"},
+	syncosc.AddressGrooveGroup:  {typetag: "ss", access: accessWrite, description: "assign a groove to a group"},
+	syncosc.AddressGrooveList:   {description: "list the grooves"},
+	syncosc.AddressGrooveRemove: {typetag: "s", access: accessWrite, description: "remove a groove"},
+	syncosc.AddressGrooveSlave:  {typetag: "sis", access: accessWrite, description: "assign a groove to a slave"},
+	syncosc.AddressGrooveSwing:  {typetag: "sfi", access: accessWrite, description: "define a swing groove"},
+	syncosc.AddressGroupCueAdd:  {typetag: "siis", access: accessWrite, description: "schedule a message for a group at a bar and beat"},
+	syncosc.AddressGroupMute:    {typetag: "s", access: accessWrite, description: "mute a group"},
+	syncosc.AddressGroupUnmute:  {typetag: "s", access: accessWrite, description: "unmute a group"},
+	syncosc.AddressMeter: {
+		typetag:     "ii",
+		access:      accessReadWrite,
+		description: "time signature",
+		value: func(state SessionState) []interface{} {
+			return []interface{}{state.Meter.Beats, state.Meter.Unit}
+		},
+		rng: func(s settings) []oscQueryRange {
+			return []oscQueryRange{{Min: 1}, {Vals: []interface{}{1, 2, 4, 8, 16, 32}}}
+		},
+	},
+	syncosc.AddressPulse: {
+		typetag:     "fi",
+		access:      accessRead,
+		description: "tempo and pulse count sent to the slaves",
+		value: func(state SessionState) []interface{} {
+			return []interface{}{state.Tempo, state.Pulse}
+		},
+	},
+	syncosc.AddressSlaveAdd:    {typetag: "sis", access: accessWrite, description: "add a slave at host, port and group"},
+	syncosc.AddressSlaveList:   {description: "list the slaves"},
+	syncosc.AddressSlaveRemove: {typetag: "si", access: accessWrite, description: "remove a slave"},
+	syncosc.AddressTempo: {
+		typetag:     "f",
+		access:      accessReadWrite,
+		description: "tempo in bpm",
+		value: func(state SessionState) []interface{} {
+			return []interface{}{state.Tempo}
+		},
+		rng: func(s settings) []oscQueryRange {
+			return []oscQueryRange{{Min: s.minTempo, Max: s.maxTempo}}
+		},
+	},
+	syncosc.AddressTransport: {
+		typetag:     "s",
+		access:      accessReadWrite,
+		description: "transport state",
+		value: func(state SessionState) []interface{} {
+			if state.Playing {
+				return []interface{}{syncosc.TransportStart}
+			}
+			return []interface{}{syncosc.TransportStop}
+		},
+		rng: func(s settings) []oscQueryRange {
+			return []oscQueryRange{{Vals: []interface{}{syncosc.TransportStart, syncosc.TransportStop, syncosc.TransportContinue}}}
+		},
+	},
+}
+
+// serverMethods describes the methods of the server.
+// The methods that servers use to talk to each other are left out.
+var serverMethods = map[string]oscQueryMethod{
+	syncosc.AddressSessionAdd:    {typetag: "sf", access: accessWrite, description: "create a session with a name and tempo"},
+	syncosc.AddressSessionList:   {description: "list the sessions"},
+	syncosc.AddressSessionRemove: {typetag: "s", access: accessWrite, description: "remove a session"},
+}
+
+// runOSCQuery serves the OSCQuery description of the server until the context is done.
+func (srv *Server) runOSCQuery(ctx context.Context) error {
+	return errors.Wrap(serveHTTP(ctx, srv.oscQuery, srv.oscQueryHandler()), "serving OSCQuery")
+}
+
+// oscQueryHandler returns the HTTP handler of the OSCQuery server.
+// Requests to upgrade to a WebSocket start a listener for value changes.
+func (srv *Server) oscQueryHandler() http.Handler {
+	ws := websocket.Server{Handler: srv.serveOSCQueryListener}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		attr := r.URL.RawQuery
+
+		if attr == "HOST_INFO" {
+			writeJSON(w, srv.oscQueryHostInfo())
+			return
+		}
+		root, err := srv.oscQueryNamespace(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		node := root.find(r.URL.Path)
+		if node == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if attr == "" {
+			writeJSON(w, node)
+			return
+		}
+		value, ok, err := node.attribute(attr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, map[string]interface{}{attr: value})
+	})
+}
+
+// oscQueryHostInfo returns the host info of the server.
+func (srv *Server) oscQueryHostInfo() oscQueryHostInfo {
+	return oscQueryHostInfo{
+		Name: "oscsync",
+		Extensions: map[string]bool{
+			"ACCESS":      true,
+			"DESCRIPTION": true,
+			"LISTEN":      true,
+			"RANGE":       true,
+			"VALUE":       true,
+		},
+		OSCPort:      srv.port,
+		OSCTransport: "UDP",
+	}
+}
+
+// oscQueryNamespace returns the namespace of the server with the current values of the sessions.
+func (srv *Server) oscQueryNamespace(ctx context.Context) (*oscQueryNode, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	var (
+		root     = &oscQueryNode{FullPath: "/"}
+		settings = srv.live.Get()
+	)
+	for addr, method := range serverMethods {
+		root.add(addr, method, SessionState{}, settings)
+	}
+	srv.mu.RLock()
+	sessions := make([]*Session, 0, len(srv.sessions))
+	for _, sess := range srv.sessions {
+		sessions = append(sessions, sess)
+	}
+	srv.mu.RUnlock()
+
+	for _, sess := range sessions {
+		state, err := sess.State(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting state of session %q", sess.name)
+		}
+		for addr := range sess.methods {
+			// The methods are described by their address in the default session.
+			base := strings.Replace(addr, sess.address(syncosc.AddressPrefix), syncosc.AddressPrefix, 1)
+			method, ok := sessionMethods[base]
+			if !ok {
+				continue
+			}
+			root.add(addr, method, state, settings)
+		}
+		// Pulses are sent by the session, not handled by it, but their value can be listened to.
+		root.add(sess.address(syncosc.AddressPulse), sessionMethods[syncosc.AddressPulse], state, settings)
+	}
+	return root, nil
+}
+
+// add adds a method to the namespace, creating the containers on its path.
+func (node *oscQueryNode) add(addr string, method oscQueryMethod, state SessionState, s settings) {
+	parent := node
+	parts := strings.Split(strings.Trim(addr, "/"), "/")
+
+	for i, part := range parts {
+		if parent.Contents == nil {
+			parent.Contents = map[string]*oscQueryNode{}
+		}
+		child, ok := parent.Contents[part]
+		if !ok {
+			child = &oscQueryNode{FullPath: "/" + strings.Join(parts[:i+1], "/")}
+			parent.Contents[part] = child
+		}
+		parent = child
+	}
+	parent.Description = method.description
+	parent.Type = method.typetag
+	parent.Access = method.access
+
+	if method.value != nil {
+		parent.Value = method.value(state)
+	}
+	if method.rng != nil {
+		parent.Range = method.rng(s)
+	}
+}
+
+// find returns the node at a path, or nil if there is none.
+func (node *oscQueryNode) find(path string) *oscQueryNode {
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		child, ok := node.Contents[part]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// attribute returns one attribute of a node.
+// ok is false if the node does not have the attribute.
+func (node *oscQueryNode) attribute(attr string) (value interface{}, ok bool, err error) {
+	switch attr {
+	case "FULL_PATH":
+		return node.FullPath, true, nil
+	case "CONTENTS":
+		return node.Contents, node.Contents != nil, nil
+	case "DESCRIPTION":
+		return node.Description, node.Description != "", nil
+	case "TYPE":
+		return node.Type, node.Type != "", nil
+	case "ACCESS":
+		return node.Access, true, nil
+	case "VALUE":
+		return node.Value, node.Value != nil, nil
+	case "RANGE":
+		return node.Range, node.Range != nil, nil
+	default:
+		return nil, false, errors.Errorf("unsupported attribute %q", attr)
+	}
+}
+
+// serveOSCQueryListener sends the values of the paths that an OSCQuery client listens to
+// as binary OSC messages whenever they change.
+// Changes for a group of slaves are not values of the session and are not sent.
+func (srv *Server) serveOSCQueryListener(ws *websocket.Conn) {
+	events, cancel := srv.events.Subscribe(64)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		listening = map[string]bool{}
+		done      = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+
+		for {
+			var cmd oscQueryCommand
+			if err := websocket.JSON.Receive(ws, &cmd); err != nil {
+				return
+			}
+			mu.Lock()
+			switch cmd.Command {
+			case "LISTEN":
+				listening[cmd.Data] = true
+			case "IGNORE":
+				delete(listening, cmd.Data)
+			}
+			mu.Unlock()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-events:
+			mu.Lock()
+			listened := listening[e.msg.Address]
+			mu.Unlock()
+
+			if !listened || e.group != "" {
+				continue
+			}
+			if err := websocket.Message.Send(ws, oscnet.Bytes(e.msg)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeJSON writes a value as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// getOSCQuery decodes the JSON response to an OSCQuery request.
+func getOSCQuery(t *testing.T, url string, v interface{}) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if expected, got := http.StatusOK, resp.StatusCode; expected != got {
+		t.Fatalf("expected status %d for %s, got %d", expected, url, got)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOSCQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		srv    = runTestServer(t, ServerConfig{tempo: 120})
+		client = newTestMaster(ctx, t)
+	)
+	srv.sessionState(t, "")
+
+	addr, err := net.ResolveUDPAddr("udp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.conn.SendTo(addr, osc.Message{
+		Address:   syncosc.AddressSessionAdd,
+		Arguments: osc.Arguments{osc.String("live"), osc.Float(100)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	srv.sessionState(t, "live")
+
+	api := httptest.NewServer(srv.oscQueryHandler())
+	defer api.Close()
+
+	var info oscQueryHostInfo
+	getOSCQuery(t, api.URL+"/?HOST_INFO", &info)
+
+	if expected, got := srv.oscQueryHostInfo(), info; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected host info %+v, got %+v", expected, got)
+	}
+	if expected, got := srv.port, info.OSCPort; expected != got {
+		t.Fatalf("expected OSC port %d, got %d", expected, got)
+	}
+
+	var root oscQueryNode
+	getOSCQuery(t, api.URL+"/", &root)
+
+	for _, testcase := range []struct {
+		path   string
+		typ    string
+		access int
+		value  []interface{}
+	}{
+		{path: "/sync/tempo", typ: "f", access: accessReadWrite, value: []interface{}{float64(120)}},
+		{path: "/sync/live/tempo", typ: "f", access: accessReadWrite, value: []interface{}{float64(100)}},
+		{path: "/sync/meter", typ: "ii", access: accessReadWrite, value: []interface{}{float64(4), float64(4)}},
+		{path: "/sync/transport", typ: "s", access: accessReadWrite, value: []interface{}{syncosc.TransportStart}},
+		{path: "/sync/live/pulse", typ: "fi", access: accessRead},
+		{path: "/sync/slave/add", typ: "sis", access: accessWrite},
+		{path: "/sync/session/add", typ: "sf", access: accessWrite},
+	} {
+		node := root.find(testcase.path)
+		if node == nil {
+			t.Fatalf("expected %s in the namespace", testcase.path)
+		}
+		if expected, got := testcase.path, node.FullPath; expected != got {
+			t.Fatalf("expected full path %s, got %s", expected, got)
+		}
+		if expected, got := testcase.typ, node.Type; expected != got {
+			t.Fatalf("expected type %s for %s, got %s", expected, testcase.path, got)
+		}
+		if expected, got := testcase.access, node.Access; expected != got {
+			t.Fatalf("expected access %d for %s, got %d", expected, testcase.path, got)
+		}
+		if testcase.value != nil && !reflect.DeepEqual(testcase.value, node.Value) {
+			t.Fatalf("expected value %v for %s, got %v", testcase.value, testcase.path, node.Value)
+		}
+	}
+	tempo := root.find("/sync/tempo")
+	if len(tempo.Range) != 1 || tempo.Range[0].Min != float64(1) || tempo.Range[0].Max != float64(999) {
+		t.Fatalf("expected the tempo to range from 1 to 999, got %+v", tempo.Range)
+	}
+	// The methods servers use to talk to each other are left out.
+	if root.find("/sync/replica/state") != nil {
+		t.Fatal("expected /sync/replica/state to be left out")
+	}
+
+	var value map[string][]interface{}
+	getOSCQuery(t, api.URL+"/sync/live/tempo?VALUE", &value)
+
+	if expected, got := []interface{}{float64(100)}, value["VALUE"]; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected value %v, got %v", expected, got)
+	}
+	resp, err := http.Get(api.URL + "/sync/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if expected, got := http.StatusNotFound, resp.StatusCode; expected != got {
+		t.Fatalf("expected status %d, got %d", expected, got)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+)
+
+// peerCmd represents the peer command
+var peerCmd = &cobra.Command{
+	Use:   "peer",
+	Short: "Run oscsync as one of several peers",
+	Long: `Run oscsync as one of several peers
+
+The peers elect the one with the highest ID as the leader.
+The leader runs the clock and replicates its state to the other peers.
+If the leader goes away the next highest peer continues the clock
+from where it would have been. Every peer accepts the oscsync API
+and forwards the messages for sessions to the leader.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		config, err := readServerConfig(cmd.Flags())
+		if err != nil {
+			return errors.Wrap(err, "reading config")
+		}
+		if config.id <= 0 {
+			return errors.Errorf("id must be positive, got %d", config.id)
+		}
+		srv, err := NewServer(config)
+		if err != nil {
+			return errors.Wrap(err, "creating server")
+		}
+		return errors.Wrap(srv.Run(), "running peer")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(peerCmd)
+
+	flags := peerCmd.Flags()
+	addServerFlags(flags)
+	flags.Int32("id", 0, "unique positive ID of the peer, the highest ID leads")
+	flags.StringSlice("peers", nil, "comma-separated host[:port] addresses of the other peers")
+	flags.Duration("failover", time.Second, "how long the peers wait for the leader before electing a new one")
+}
+
+// peer is another peer that has been heard from.
+type peer struct {
+	addr      net.Addr
+	leading   bool
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// HandlePeerAlive handles the heartbeat of another peer.
+func (srv *Server) HandlePeerAlive(m osc.Message) error {
+	if expected, got := 2, len(m.Arguments); expected != got {
+		return errors.Errorf("expected %d arguments, got %d", expected, got)
+	}
+	id, err := m.Arguments[0].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading peer id")
+	}
+	leading, err := m.Arguments[1].ReadInt32()
+	if err != nil {
+		return errors.Wrap(err, "reading peer leadership")
+	}
+	if id == srv.id {
+		return nil
+	}
+	now := time.Now()
+
+	srv.mu.Lock()
+	p, ok := srv.peers[id]
+	if !ok || now.Sub(p.lastSeen) >= srv.failover {
+		p = &peer{firstSeen: now}
+		srv.peers[id] = p
+	}
+	p.addr, p.leading, p.lastSeen = m.Sender, leading != 0, now
+	srv.mu.Unlock()
+
+	// Every peer receives the leader's state.
+	srv.replicas.Add(m.Sender)
+	return nil
+}
+
+// runPeer sends heartbeats to the other peers and takes over or steps down
+// whenever the election says so.
+func (srv *Server) runPeer(ctx context.Context) error {
+	addrs := make([]net.Addr, len(srv.peerHosts))
+	for i, host := range srv.peerHosts {
+		addr, err := resolveServer(host)
+		if err != nil {
+			return errors.Wrapf(err, "resolving peer %s", host)
+		}
+		addrs[i] = addr
+	}
+	started := time.Now()
+
+	ticker := time.NewTicker(srv.failover / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			srv.sendHeartbeat(addrs)
+			takeOver, stepDown := srv.elect(now, started)
+			if takeOver {
+				if err := srv.takeover(now); err != nil {
+					return errors.Wrap(err, "taking over as leader")
+				}
+			}
+			if stepDown {
+				srv.stepDown(now)
+			}
+		}
+	}
+}
+
+// sendHeartbeat tells the other peers that this peer is alive and whether it is leading.
+// A peer that the heartbeat can not be sent to is skipped,
+// the election treats it as gone until its heartbeats arrive again.
+func (srv *Server) sendHeartbeat(addrs []net.Addr) {
+	var leading int32
+	if srv.leading() {
+		leading = 1
+	}
+	msg := osc.Message{
+		Address:   syncosc.AddressPeerAlive,
+		Arguments: osc.Arguments{osc.Int(srv.id), osc.Int(leading)},
+	}
+	for _, addr := range addrs {
+		if err := srv.conn.SendTo(addr, msg); err != nil {
+			srv.log.Debug("sending heartbeat failed", "peer", addr.String(), errAttr(err))
+		}
+	}
+}
+
+// elect decides if the server should take over as the leader or step down.
+// This is the bully algorithm with heartbeats instead of election messages:
+// the peer with the highest ID that is alive leads.
+// A new leader waits until no other peer claims to lead,
+// and a leader steps down once a higher peer has been alive for half the failover time,
+// so two peers never run the clock at the same time.
+func (srv *Server) elect(now, started time.Time) (takeOver, stepDown bool) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	var (
+		leading       = srv.replicated == nil
+		higherAlive   bool
+		higherSettled bool
+		claimed       bool
+	)
+	for id, p := range srv.peers {
+		if now.Sub(p.lastSeen) >= srv.failover {
+			continue
+		}
+		if id > srv.id {
+			higherAlive = true
+			higherSettled = higherSettled || now.Sub(p.firstSeen) >= srv.failover/2
+		}
+		claimed = claimed || p.leading
+	}
+	if leading {
+		return false, higherSettled
+	}
+	return !higherAlive && !claimed && now.Sub(started) >= srv.failover, false
+}
+
+// stepDown stops the server's sessions without telling the slaves
+// and waits for the state of the new leader.
+func (srv *Server) stepDown(now time.Time) {
+	srv.mu.Lock()
+	sessions := srv.sessions
+	srv.sessions = map[string]*Session{}
+	srv.replicated = map[string]replicatedState{}
+	srv.primarySeen = now
+	srv.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.detach()
+	}
+	srv.log.Info("stepped down")
+}
+
+// leading returns true if the server is running the clock.
+func (srv *Server) leading() bool {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	return srv.replicated == nil
+}
+
+// leader returns the address of the leader if the server is a peer that is not leading.
+func (srv *Server) leader() net.Addr {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	if srv.id == 0 || srv.replicated == nil {
+		return nil
+	}
+	var (
+		now      = time.Now()
+		leader   net.Addr
+		leaderID int32
+	)
+	for id, p := range srv.peers {
+		if p.leading && id > leaderID && now.Sub(p.lastSeen) < srv.failover {
+			leader, leaderID = p.addr, id
+		}
+	}
+	return leader
+}
+
+// forwardToLeader sends a message for a session to the leader
+// if the server is a peer that is not leading.
+// The message is wrapped in a /sync/peer/forward message with the address of the original sender,
+// so the leader replies to the sender and registers it as a slave instead of this peer.
+func (srv *Server) forwardToLeader(m osc.Message) error {
+	leader := srv.leader()
+	if leader == nil {
+		return nil
+	}
+	var sender string
+	if m.Sender != nil {
+		sender = m.Sender.String()
+	}
+	return errors.Wrap(srv.conn.SendTo(leader, osc.Message{
+		Address:   syncosc.AddressPeerForward,
+		Arguments: append(osc.Arguments{osc.String(sender), osc.String(m.Address)}, m.Arguments...),
+	}), "forwarding message to leader")
+}
+
+// HandlePeerForward handles a message that another peer forwarded to the leader.
+// The message is handled as if the original sender had sent it to this peer.
+// Forwarded messages are dropped unless the server is leading,
+// so peers that disagree about the leader never forward a message back and forth.
+func (srv *Server) HandlePeerForward(m osc.Message) error {
+	if len(m.Arguments) < 2 {
+		return errors.Errorf("expected at least 2 arguments, got %d", len(m.Arguments))
+	}
+	sender, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading sender")
+	}
+	address, err := m.Arguments[1].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading address")
+	}
+	forwarded := osc.Message{Address: address, Arguments: m.Arguments[2:]}
+
+	if sender != "" {
+		if forwarded.Sender, err = net.ResolveUDPAddr("udp", sender); err != nil {
+			return errors.Wrap(err, "resolving sender")
+		}
+	}
+	if !srv.leading() {
+		srv.log.Warn("dropped message forwarded to a peer that is not leading", messageAttrs(forwarded)...)
+		return nil
+	}
+	return srv.routeSession(forwarded)
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// runTestPeers runs peers with IDs 1 to n on the loopback interface.
+func runTestPeers(t *testing.T, n int) []*testServer {
+	ports := make([]int, n)
+	for i := range ports {
+		ports[i] = freeUDPPort(t)
+	}
+	peers := make([]*testServer, n)
+	for i := range peers {
+		var hosts []string
+		for j, port := range ports {
+			if j != i {
+				hosts = append(hosts, (&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}).String())
+			}
+		}
+		peers[i] = runTestServer(t, ServerConfig{
+			port:      ports[i],
+			tempo:     120,
+			failover:  400 * time.Millisecond,
+			id:        int32(i + 1),
+			peerHosts: hosts,
+		})
+	}
+	return peers
+}
+
+// waitForLeader waits until leader is the only one of the running peers that leads
+// and the other peers have heard that it does.
+func waitForLeader(t *testing.T, peers []*testServer, leader *testServer) {
+	t.Helper()
+
+	waitFor(t, "peer "+leader.addr+" to lead", func() bool {
+		for _, p := range peers {
+			if p == leader && !p.leading() || p != leader && p.leader() == nil {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		peers    = runTestPeers(t, 3)
+		client   = newTestMaster(ctx, t)
+		follower = peers[0]
+	)
+	waitForLeader(t, peers, peers[2])
+
+	addr, err := net.ResolveUDPAddr("udp", follower.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A tempo change sent to a follower is applied by the leader.
+	if err := client.conn.SendTo(addr, osc.Message{
+		Address:   syncosc.AddressTempo,
+		Arguments: osc.Arguments{osc.Float(150)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the leader to apply the tempo change", func() bool {
+		return peers[2].sessionState(t, "").Tempo == 150
+	})
+
+	// The leader replies to a query sent to a follower.
+	if err := client.conn.SendTo(addr, osc.Message{Address: syncosc.AddressTempo}); err != nil {
+		t.Fatal(err)
+	}
+	client.receiveMatching(t, "/reply", func(args osc.Arguments) bool {
+		if len(args) != 2 {
+			return false
+		}
+		tempo, err := args[1].ReadFloat32()
+		return err == nil && tempo == 150
+	})
+
+	// The next highest peer takes over from where the leader was.
+	waitFor(t, "the followers to receive the new tempo", func() bool {
+		peers[1].mu.RLock()
+		defer peers[1].mu.RUnlock()
+
+		return peers[1].replicated[""].state.Tempo == 150
+	})
+	peers[2].stop()
+	waitForLeader(t, peers[:2], peers[1])
+
+	if tempo := peers[1].sessionState(t, "").Tempo; tempo != 150 {
+		t.Fatalf("expected tempo 150 after failover, got %f", tempo)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import "fmt"
+
+// Position is a musical position.
+// Bar and Beat are counted from 1, Tick is the number of pulses since the beat.
+type Position struct {
+	Bar  uint64
+	Beat uint64
+	Tick uint64
+}
+
+// OnBeat returns true if the position is exactly on a beat.
+func (p Position) OnBeat() bool {
+	return p.Tick == 0
+}
+
+// String returns the position as bar.beat.tick
+func (p Position) String() string {
+	return fmt.Sprintf("%d.%d.%d", p.Bar, p.Beat, p.Tick)
+}
+
+// position returns the musical position of the given pulse.
+// The pulse must not be earlier than the pulse where the current meter took effect.
+func (sess *Session) position(pulse uint64) Position {
+	return positionAt(pulse, sess.barOrigin, sess.originBar, sess.meter)
+}
+
+// Position returns the musical position of the next pulse of the session.
+func (state SessionState) Position() Position {
+	return positionAt(state.Pulse, state.BarOrigin, state.OriginBar, state.Meter)
+}
+
+// positionAt returns the musical position of a pulse in a meter that took effect
+// at pulse barOrigin, which is the start of bar originBar+1.
+func positionAt(pulse, barOrigin, originBar uint64, meter Meter) Position {
+	var (
+		elapsed = pulse - barOrigin
+		ppb     = meter.PulsesPerBar()
+		ppbeat  = meter.PulsesPerBeat()
+	)
+	return Position{
+		Bar:  originBar + elapsed/ppb + 1,
+		Beat: (elapsed%ppb)/ppbeat + 1,
+		Tick: elapsed % ppbeat,
+	}
+}
+
+// setMeter changes the meter at the current pulse.
+func (sess *Session) setMeter(meter Meter) {
+	sess.originBar = meterOriginBar(sess.position(sess.pulse))
+	sess.barOrigin = sess.pulse
+	sess.meter = meter
+}
+
+// meterOriginBar returns the originBar of a meter that takes effect at pos.
+// If the change happens in the middle of a bar, that bar is cut short
+// and pos becomes the downbeat of the next bar.
+func meterOriginBar(pos Position) uint64 {
+	if pos.Beat != 1 || pos.Tick != 0 {
+		return pos.Bar
+	}
+	return pos.Bar - 1
+}
@@ -18,38 +18,87 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/scgolang/syncclient"
-	"github.com/scgolang/syncosc"
+	"github.com/pkg/errors"
+	"github.com/scgolang/oscsync/dnssd"
+	"github.com/scgolang/oscsync/syncclient"
+	"github.com/scgolang/oscsync/syncosc"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // pulsesCmd represents the pulses command
 var pulsesCmd = &cobra.Command{
 	Use:   "pulses",
 	Short: "Display pulses from oscsync on stdout",
-	Long:  `Display pulses from oscsync on stdout`,
+	Long: `Display pulses from oscsync on stdout
+
+With several comma-separated masters the slave switches to the next one
+when the current one stops sending pulses.
+With --discover the master is found with mDNS instead.
+With --timecode the slave subscribes to the master's timecode
+and displays it for every frame instead of the pulses.
+In the config file and the environment it is show-timecode,
+so that it does not clash with the timecode setting of serve.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var (
-			ctx   = context.Background()
-			flags = cmd.Flags()
-			host  = "127.0.0.1"
-			n     = 1
-			ps    = pulseSlave{}
-		)
-		flags.StringVar(&host, "h", host, "oscsync master host name")
-		flags.IntVar(&n, "n", n, "Only display every n pulses (default is 1, i.e. every pulse)")
-		return syncclient.Connect(ctx, ps, host)
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		if err := viper.BindPFlag("show-timecode", cmd.Flags().Lookup("timecode")); err != nil {
+			return errors.Wrap(err, "binding timecode flag")
+		}
+		n := viper.GetInt("n")
+		if n <= 0 {
+			return errors.Errorf("n must be positive, got %d", n)
+		}
+		opts := syncclient.Options{
+			Heartbeat:     viper.GetDuration("heartbeat"),
+			Instance:      viper.GetString("name"),
+			DiscoveryAddr: viper.GetString("mdns-addr"),
+		}
+		slave := pulseSlave{n: int32(n)}
+
+		if viper.GetBool("show-timecode") {
+			opts.Timecode = syncosc.TimecodeFrame
+			slave.timecode = true
+		}
+		if viper.GetBool("discover") {
+			return syncclient.ConnectDiscovered(context.Background(), slave, opts)
+		}
+		return syncclient.ConnectAny(context.Background(), slave, configStrings("master"), opts)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(pulsesCmd)
+
+	flags := pulsesCmd.Flags()
+	flags.String("master", "127.0.0.1", "comma-separated host[:port] of the oscsync masters")
+	flags.IntP("n", "n", 1, "Only display every n pulses (default is 1, i.e. every pulse)")
+	flags.Duration("heartbeat", 0, "how often to register with the master again, 0 registers once")
+	flags.Bool("discover", false, "find the master with mDNS")
+	flags.String("name", "", "name of the master to discover, the first one found if empty")
+	flags.String("mdns-addr", dnssd.MulticastAddr, "address mDNS questions are sent to")
+	flags.Bool("timecode", false, "display the master's timecode instead of the pulses")
 }
 
-type pulseSlave struct{}
+// pulseSlave displays the pulses, or the timecode if timecode is true.
+type pulseSlave struct {
+	n        int32
+	timecode bool
+}
 
 // Pulse pulses the slave.
 func (ps pulseSlave) Pulse(p syncosc.Pulse) error {
-	fmt.Printf("%d\n", p.Count)
+	if !ps.timecode && p.Count%ps.n == 0 {
+		fmt.Printf("%d\n", p.Count)
+	}
+	return nil
+}
+
+// Timecode displays the timecode of a frame.
+func (ps pulseSlave) Timecode(tc syncosc.Timecode) error {
+	if ps.timecode {
+		fmt.Println(tc.Timecode)
+	}
 	return nil
 }
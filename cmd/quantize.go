@@ -0,0 +1,107 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Quantization units.
+const (
+	QuantizeNow  = "now"
+	QuantizeBeat = "beat"
+	QuantizeBar  = "bar"
+)
+
+// Quantization says which boundary a control change should be applied on.
+type Quantization struct {
+	Unit  string
+	Count uint64
+}
+
+// ParseQuantization parses a quantization such as "now", "beat", "bar", "4 beats" or "2 bars".
+// The empty string is the same as "now".
+func ParseQuantization(s string) (Quantization, error) {
+	fields := strings.Fields(strings.ToLower(s))
+
+	switch len(fields) {
+	case 0:
+		return Quantization{Unit: QuantizeNow}, nil
+	case 1:
+		return quantizationFromUnit(1, fields[0])
+	case 2:
+		count, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return Quantization{}, errors.Wrapf(err, "parsing count from %q", s)
+		}
+		if count == 0 {
+			return Quantization{}, errors.Errorf("count must be positive in %q", s)
+		}
+		return quantizationFromUnit(count, fields[1])
+	default:
+		return Quantization{}, errors.Errorf("invalid quantization %q", s)
+	}
+}
+
+// quantizationFromUnit returns a quantization for the given count and unit.
+// Plural units are accepted.
+func quantizationFromUnit(count uint64, unit string) (Quantization, error) {
+	switch strings.TrimSuffix(unit, "s") {
+	case QuantizeNow:
+		return Quantization{Unit: QuantizeNow}, nil
+	case QuantizeBeat:
+		return Quantization{Unit: QuantizeBeat, Count: count}, nil
+	case QuantizeBar:
+		return Quantization{Unit: QuantizeBar, Count: count}, nil
+	default:
+		return Quantization{}, errors.Errorf("invalid quantization unit %q", unit)
+	}
+}
+
+// Next returns the first pulse at or after next that falls on the quantization boundary.
+// Boundaries are counted from origin, which is the pulse where meter took effect.
+func (q Quantization) Next(next, origin uint64, meter Meter) uint64 {
+	var length uint64
+
+	switch q.Unit {
+	case QuantizeBeat:
+		length = q.Count * meter.PulsesPerBeat()
+	case QuantizeBar:
+		length = q.Count * meter.PulsesPerBar()
+	}
+	if length == 0 || next <= origin {
+		return next
+	}
+	elapsed := next - origin
+	if rem := elapsed % length; rem != 0 {
+		elapsed += length - rem
+	}
+	return origin + elapsed
+}
+
+// String returns the quantization in the format accepted by ParseQuantization.
+func (q Quantization) String() string {
+	if q.Unit == QuantizeNow || q.Unit == "" {
+		return QuantizeNow
+	}
+	if q.Count == 1 {
+		return q.Unit
+	}
+	return fmt.Sprintf("%d %ss", q.Count, q.Unit)
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import "testing"
+
+func TestParseQuantization(t *testing.T) {
+	for i, testcase := range []struct {
+		input string
+		q     Quantization
+		err   bool
+	}{
+		{input: "", q: Quantization{Unit: QuantizeNow}},
+		{input: "now", q: Quantization{Unit: QuantizeNow}},
+		{input: "beat", q: Quantization{Unit: QuantizeBeat, Count: 1}},
+		{input: "bar", q: Quantization{Unit: QuantizeBar, Count: 1}},
+		{input: "4 beats", q: Quantization{Unit: QuantizeBeat, Count: 4}},
+		{input: " 2 Bars ", q: Quantization{Unit: QuantizeBar, Count: 2}},
+		{input: "1 bar", q: Quantization{Unit: QuantizeBar, Count: 1}},
+		{input: "0 bars", err: true},
+		{input: "-1 bars", err: true},
+		{input: "two bars", err: true},
+		{input: "fortnight", err: true},
+		{input: "1 bar now", err: true},
+	} {
+		q, err := ParseQuantization(testcase.input)
+		if testcase.err {
+			if err == nil {
+				t.Fatalf("(test case %d) expected error for %q, got %v", i, testcase.input, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if expected, got := testcase.q, q; expected != got {
+			t.Fatalf("(test case %d) expected %v, got %v", i, expected, got)
+		}
+		// String returns what was parsed.
+		if again, err := ParseQuantization(q.String()); err != nil || again != q {
+			t.Fatalf("(test case %d) expected %q to parse as %v, got %v (%v)", i, q.String(), q, again, err)
+		}
+	}
+}
+
+func TestQuantizationNext(t *testing.T) {
+	var (
+		fourFour   = Meter{Beats: 4, Unit: 4}
+		threeFour  = Meter{Beats: 3, Unit: 4}
+		sixEight   = Meter{Beats: 6, Unit: 8}
+		now        = Quantization{Unit: QuantizeNow}
+		beat       = Quantization{Unit: QuantizeBeat, Count: 1}
+		bar        = Quantization{Unit: QuantizeBar, Count: 1}
+		twoBeats   = Quantization{Unit: QuantizeBeat, Count: 2}
+		twoBars    = Quantization{Unit: QuantizeBar, Count: 2}
+		threeBeats = Quantization{Unit: QuantizeBeat, Count: 3}
+	)
+	for i, testcase := range []struct {
+		q      Quantization
+		next   uint64
+		origin uint64
+		meter  Meter
+		pulse  uint64
+	}{
+		{q: now, next: 37, meter: fourFour, pulse: 37},
+
+		// Beats and bars in 4/4 are 24 and 96 pulses.
+		{q: beat, next: 0, meter: fourFour, pulse: 0},
+		{q: beat, next: 1, meter: fourFour, pulse: 24},
+		{q: beat, next: 24, meter: fourFour, pulse: 24},
+		{q: beat, next: 25, meter: fourFour, pulse: 48},
+		{q: bar, next: 1, meter: fourFour, pulse: 96},
+		{q: bar, next: 96, meter: fourFour, pulse: 96},
+		{q: bar, next: 97, meter: fourFour, pulse: 192},
+
+		// Beats in 6/8 are eighth notes.
+		{q: beat, next: 13, meter: sixEight, pulse: 24},
+		{q: bar, next: 1, meter: sixEight, pulse: 72},
+
+		// The meter changed to 3/4 in the middle of a bar at pulse 50,
+		// so bars start at 50, 122, 194...
+		{q: beat, next: 50, origin: 50, meter: threeFour, pulse: 50},
+		{q: beat, next: 51, origin: 50, meter: threeFour, pulse: 74},
+		{q: bar, next: 51, origin: 50, meter: threeFour, pulse: 122},
+		{q: bar, next: 122, origin: 50, meter: threeFour, pulse: 122},
+		{q: bar, next: 40, origin: 50, meter: threeFour, pulse: 40},
+
+		// Counts greater than 1 are multiples of the unit from the origin.
+		{q: twoBeats, next: 25, meter: fourFour, pulse: 48},
+		{q: twoBeats, next: 49, meter: fourFour, pulse: 96},
+		{q: twoBars, next: 97, meter: fourFour, pulse: 192},
+		{q: twoBars, next: 51, origin: 50, meter: threeFour, pulse: 194},
+		{q: threeBeats, next: 1, origin: 50, meter: sixEight, pulse: 1},
+		{q: threeBeats, next: 51, origin: 50, meter: sixEight, pulse: 86},
+	} {
+		if expected, got := testcase.pulse, testcase.q.Next(testcase.next, testcase.origin, testcase.meter); expected != got {
+			t.Fatalf("(test case %d) expected %s after pulse %d to be pulse %d, got %d", i, testcase.q, testcase.next, expected, got)
+		}
+	}
+}
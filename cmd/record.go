@@ -0,0 +1,240 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// recordCmd represents the record command
+var recordCmd = &cobra.Command{
+	Use:   "record [file]",
+	Short: "Record the packets an oscsync master sends to a slave",
+	Long: `Record the packets an oscsync master sends to a slave
+
+The recorder registers with the master as a slave and writes every packet it receives
+to the file as a JSON line with the arrival time, the sender and the raw OSC bytes,
+until it is interrupted or the duration has passed.
+Recordings are played back to slaves with oscsync replay.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.Errorf("expected a recording file, got %d arguments", len(args))
+		}
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		master, err := resolveServer(viper.GetString("master"))
+		if err != nil {
+			return errors.Wrap(err, "resolving master")
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return errors.Wrap(err, "creating recording")
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		if d := viper.GetDuration("duration"); d > 0 {
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		r := &recorder{
+			master:    master,
+			session:   viper.GetString("session"),
+			group:     viper.GetString("group"),
+			heartbeat: viper.GetDuration("heartbeat"),
+		}
+		if err := r.Record(ctx, f); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return errors.Wrap(f.Close(), "closing recording")
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(recordCmd)
+
+	flags := recordCmd.Flags()
+	flags.String("master", "127.0.0.1", "host[:port] of the oscsync master")
+	flags.String("session", "", "session to record, the default session if empty")
+	flags.String("group", "", "group to register in")
+	flags.Duration("heartbeat", time.Second, "how often to register with the master again, 0 registers once")
+	flags.Duration("duration", 0, "how long to record, 0 records until interrupted")
+}
+
+// RecordedPacket is a packet in a recording.
+// Data are the raw OSC bytes of the packet.
+type RecordedPacket struct {
+	Time   time.Time `json:"time"`
+	Sender string    `json:"sender"`
+	Data   []byte    `json:"data"`
+}
+
+// Messages returns the OSC messages of the packet, in the order they are in its bundles.
+func (p RecordedPacket) Messages() ([]osc.Message, error) {
+	packet, err := oscnet.ParsePacket(p.Data, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing packet")
+	}
+	if b, ok := packet.(osc.Bundle); ok {
+		return bundleMessages(b), nil
+	}
+	return []osc.Message{packet.(osc.Message)}, nil
+}
+
+// bundleMessages returns the messages of a bundle and the bundles in it.
+func bundleMessages(b osc.Bundle) []osc.Message {
+	var msgs []osc.Message
+	for _, p := range b.Packets {
+		switch p := p.(type) {
+		case osc.Message:
+			msgs = append(msgs, p)
+		case osc.Bundle:
+			msgs = append(msgs, bundleMessages(p)...)
+		}
+	}
+	return msgs
+}
+
+// recorder records the packets a master sends to a slave.
+type recorder struct {
+	master    net.Addr
+	session   string
+	group     string
+	heartbeat time.Duration
+}
+
+// Record registers with the master and writes the packets it sends to w
+// until the context is done. The recorder is removed from the master's slaves when it stops.
+func (r *recorder) Record(ctx context.Context, w io.Writer) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return errors.Wrap(err, "listening for the master")
+	}
+	defer func() { _ = conn.Close() }()
+
+	port := int32(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	if err := r.send(conn, syncosc.AddressSlaveAdd, port); err != nil {
+		return err
+	}
+	defer func() { _ = r.send(conn, syncosc.AddressSlaveRemove, port) }()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- writePackets(conn, w)
+	}()
+	var heartbeat <-chan time.Time
+	if r.heartbeat > 0 {
+		ticker := time.NewTicker(r.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// The deadline stops writePackets.
+			_ = conn.SetReadDeadline(time.Now())
+			return <-errs
+		case err := <-errs:
+			return err
+		case <-heartbeat:
+			if err := r.send(conn, syncosc.AddressSlaveAdd, port); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send sends a slave add or remove message for the recorder to the master.
+func (r *recorder) send(conn net.PacketConn, address string, port int32) error {
+	args := osc.Arguments{osc.String("127.0.0.1"), osc.Int(port)}
+	if address == syncosc.AddressSlaveAdd && r.group != "" {
+		args = append(args, osc.String(r.group))
+	}
+	m := osc.Message{Address: syncosc.SessionAddress(r.session, address), Arguments: args}
+
+	_, err := conn.WriteTo(oscnet.Bytes(m), r.master)
+	return errors.Wrapf(err, "sending %s to master", m.Address)
+}
+
+// writePackets writes the packets received with conn to w as JSON lines
+// until reading from conn fails. A read deadline that has passed ends the recording without an error.
+// Every packet is written as soon as it arrives, so a recording that is cut short is still usable.
+func writePackets(conn net.PacketConn, w io.Writer) error {
+	var (
+		enc = json.NewEncoder(w)
+		buf = make([]byte, 65536)
+	)
+	for {
+		n, sender, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return errors.Wrap(err, "receiving packet")
+		}
+		p := RecordedPacket{
+			Time:   time.Now(),
+			Sender: sender.String(),
+			Data:   append([]byte(nil), buf[:n]...),
+		}
+		if err := enc.Encode(p); err != nil {
+			return errors.Wrap(err, "writing recording")
+		}
+	}
+}
+
+// readRecording reads the packets of a recording.
+func readRecording(r io.Reader) ([]RecordedPacket, error) {
+	var (
+		dec     = json.NewDecoder(r)
+		packets []RecordedPacket
+	)
+	for {
+		var p RecordedPacket
+		if err := dec.Decode(&p); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "reading packet %d of recording", len(packets))
+		}
+		packets = append(packets, p)
+	}
+}
+
+// loadRecording reads the packets of a recording file.
+func loadRecording(path string) ([]RecordedPacket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening recording")
+	}
+	defer func() { _ = f.Close() }()
+
+	return readRecording(f)
+}
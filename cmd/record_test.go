@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+func TestRecordReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := runTestServer(t, ServerConfig{tempo: 120})
+	srv.sessionState(t, "")
+
+	master, err := net.ResolveUDPAddr("udp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		buf bytes.Buffer
+		r   = &recorder{master: master}
+	)
+	recordCtx, cancelRecord := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelRecord()
+
+	if err := r.Record(recordCtx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	packets, err := readRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) < 5 {
+		t.Fatalf("expected at least 5 packets in 300ms at 120 bpm, got %d", len(packets))
+	}
+	type recorded struct {
+		packet int
+		data   []byte
+	}
+	var expected []recorded
+	for i, p := range packets {
+		msgs, err := p.Messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			expected = append(expected, recorded{packet: i, data: m.Bytes()})
+		}
+	}
+	var (
+		slave = newTestMaster(ctx, t)
+		speed = 2.0
+	)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	rp := newReplayer(conn, speed)
+	rp.addSlave(slave.conn.LocalAddr())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- rp.Replay(ctx, packets)
+	}()
+	// The slave gets the messages in the order they were recorded,
+	// and every packet arrives at the time it was recorded, relative to the first one,
+	// divided by the speed.
+	var (
+		arrivals  = make([]time.Time, len(packets))
+		tolerance = 4 * syncosc.GetPulseDuration(120)
+	)
+	for i, e := range expected {
+		m := slave.receive(t)
+		if !bytes.Equal(e.data, m.Bytes()) {
+			t.Fatalf("expected message %d to be %q, got %s %v", i, e.data, m.Address, m.Arguments)
+		}
+		if arrivals[e.packet].IsZero() {
+			arrivals[e.packet] = time.Now()
+		}
+	}
+	for i, p := range packets {
+		expected := time.Duration(float64(p.Time.Sub(packets[0].Time)) / speed)
+		got := arrivals[i].Sub(arrivals[0])
+
+		if diff := got - expected; diff < -tolerance || diff > tolerance {
+			t.Fatalf("expected packet %d %s after the first, got %s", i, expected, got)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
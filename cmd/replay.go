@@ -0,0 +1,217 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay [file]",
+	Short: "Play a recording back to slaves as a fake master",
+	Long: `Play a recording back to slaves as a fake master
+
+The packets of a recording made with oscsync record are sent to the slaves given with --slaves
+and to the slaves that register with the fake master at --listen, the way they would with a real master.
+Without --slaves the replay starts when the first slave registers.
+
+Packets are sent at the times they arrived at the recorder, relative to the first one,
+so slaves see the jitter of the recording. --speed scales the time between packets,
+e.g. 2 plays the recording twice as fast. The packets are sent as they were recorded,
+so the tempo in the pulses does not change with the speed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.Errorf("expected a recording file, got %d arguments", len(args))
+		}
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		speed := viper.GetFloat64("speed")
+		if speed <= 0 {
+			return errors.Errorf("speed must be positive, got %f", speed)
+		}
+		packets, err := loadRecording(args[0])
+		if err != nil {
+			return err
+		}
+		laddr, err := net.ResolveUDPAddr("udp", viper.GetString("listen"))
+		if err != nil {
+			return errors.Wrap(err, "resolving listen address")
+		}
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return errors.Wrap(err, "listening for slaves")
+		}
+		defer func() { _ = conn.Close() }()
+
+		r := newReplayer(conn, speed)
+
+		for _, host := range configStrings("slaves") {
+			addr, err := net.ResolveUDPAddr("udp", host)
+			if err != nil {
+				return errors.Wrapf(err, "resolving slave %s", host)
+			}
+			r.addSlave(addr)
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		go r.listen()
+
+		return r.Replay(ctx, packets)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(replayCmd)
+
+	flags := replayCmd.Flags()
+	flags.String("listen", net.JoinHostPort("127.0.0.1", strconv.Itoa(syncosc.MasterPort)), "host:port slaves register with")
+	flags.StringSlice("slaves", nil, "comma-separated host:port of slaves to send the recording to without registering")
+	flags.Float64("speed", 1, "how much faster than recorded to play the recording")
+}
+
+// replayer plays recordings back to slaves.
+type replayer struct {
+	conn  net.PacketConn
+	speed float64
+
+	mu     sync.Mutex
+	slaves map[string]net.Addr
+
+	// registered is closed when there is a slave to send to.
+	registered chan struct{}
+}
+
+// newReplayer creates a replayer that sends packets with conn.
+func newReplayer(conn net.PacketConn, speed float64) *replayer {
+	return &replayer{
+		conn:       conn,
+		speed:      speed,
+		slaves:     map[string]net.Addr{},
+		registered: make(chan struct{}),
+	}
+}
+
+// Replay sends the packets to the slaves once there are any.
+// Every packet is sent at the time it was recorded relative to the first packet, divided by the speed.
+// Slaves that a packet can not be sent to are skipped.
+func (r *replayer) Replay(ctx context.Context, packets []RecordedPacket) error {
+	if len(packets) == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.registered:
+	}
+	var (
+		start  = time.Now()
+		origin = packets[0].Time
+		timer  = time.NewTimer(0)
+	)
+	defer timer.Stop()
+
+	for _, p := range packets {
+		at := start.Add(time.Duration(float64(p.Time.Sub(origin)) / r.speed))
+
+		timer.Reset(time.Until(at))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		for _, addr := range r.targets() {
+			if _, err := r.conn.WriteTo(p.Data, addr); err != nil {
+				slog.Warn("sending recorded packet failed", "slave", addr.String(), errAttr(err))
+			}
+		}
+	}
+	return nil
+}
+
+// listen adds and removes the slaves that register with the replayer
+// until reading from its connection fails.
+// Every other message is ignored.
+func (r *replayer) listen() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, sender, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m, err := oscnet.ParseMessage(buf[:n], sender)
+		if err != nil {
+			continue
+		}
+		switch {
+		case isSlaveAddress(m.Address, syncosc.AddressSlaveAdd):
+			if addr, err := readUDPAddr(m); err == nil {
+				r.addSlave(addr)
+			}
+		case isSlaveAddress(m.Address, syncosc.AddressSlaveRemove):
+			if addr, err := readUDPAddr(m); err == nil {
+				r.removeSlave(addr)
+			}
+		}
+	}
+}
+
+// addSlave adds a slave that the packets are sent to.
+func (r *replayer) addSlave(addr net.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.registered:
+	default:
+		close(r.registered)
+	}
+	r.slaves[addr.String()] = addr
+}
+
+// removeSlave removes a slave.
+func (r *replayer) removeSlave(addr net.Addr) {
+	r.mu.Lock()
+	delete(r.slaves, addr.String())
+	r.mu.Unlock()
+}
+
+// targets returns the slaves the packets are sent to.
+func (r *replayer) targets() []net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(r.slaves))
+	for _, addr := range r.slaves {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
@@ -0,0 +1,236 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+const (
+	// replicationInterval is how often a session sends its state to the standby servers.
+	replicationInterval = 100 * time.Millisecond
+
+	// replicaTTL is how long a standby server stays registered
+	// after it last asked for the primary's state.
+	replicaTTL = 10 * time.Second
+
+	// maxReplicaStateSize is the largest encoded session state that is replicated.
+	// The state is sent in a single UDP datagram, which also has to fit
+	// the OSC address and padding, and OSC connections read at most 64 KiB.
+	maxReplicaStateSize = 60 * 1024
+)
+
+// replicaSet holds the standby servers that have registered with a primary.
+// It is safe for concurrent use since replicas register with an OSC handler
+// and are read by the main loops of the sessions.
+type replicaSet struct {
+	mu       sync.Mutex
+	replicas map[string]replica
+}
+
+// replica is a standby server.
+type replica struct {
+	addr    net.Addr
+	expires time.Time
+}
+
+// newReplicaSet creates an empty replica set.
+func newReplicaSet() *replicaSet {
+	return &replicaSet{replicas: map[string]replica{}}
+}
+
+// Add adds a replica or extends its registration.
+func (rs *replicaSet) Add(addr net.Addr) {
+	rs.mu.Lock()
+	rs.replicas[addr.String()] = replica{addr: addr, expires: time.Now().Add(replicaTTL)}
+	rs.mu.Unlock()
+}
+
+// List returns the replicas whose registration has not expired.
+func (rs *replicaSet) List() []net.Addr {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var (
+		now   = time.Now()
+		addrs = make([]net.Addr, 0, len(rs.replicas))
+	)
+	for key, r := range rs.replicas {
+		if now.After(r.expires) {
+			delete(rs.replicas, key)
+			continue
+		}
+		addrs = append(addrs, r.addr)
+	}
+	return addrs
+}
+
+// replicatedState is a session's state as received by a standby server.
+type replicatedState struct {
+	state    SessionState
+	received time.Time
+}
+
+// replicate sends the state of the session to the standby servers.
+// A state that is too large to send is not replicated,
+// and a standby that the state can not be sent to is skipped.
+func (sess *Session) replicate() error {
+	if sess.replicas == nil {
+		return nil
+	}
+	replicas := sess.replicas.List()
+	if len(replicas) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(sess.snapshot())
+	if err != nil {
+		return errors.Wrap(err, "encoding session state")
+	}
+	if len(data) > maxReplicaStateSize {
+		if !sess.replicaOversize {
+			sess.log.Warn("session state is too large to replicate", "size", len(data), "max", maxReplicaStateSize)
+		}
+		sess.replicaOversize = true
+		return nil
+	}
+	if sess.replicaOversize {
+		sess.log.Info("replicating session state again", "size", len(data))
+	}
+	sess.replicaOversize = false
+
+	msg := osc.Message{
+		Address:   syncosc.AddressReplicaState,
+		Arguments: osc.Arguments{osc.String(data)},
+	}
+	for _, addr := range replicas {
+		if err := sess.conn.SendTo(addr, msg); err != nil {
+			sess.log.Debug("sending state to standby failed", "replica", addr.String(), errAttr(err))
+		}
+	}
+	return nil
+}
+
+// HandleReplicaAdd handles the OSC message a standby server sends to register with the primary.
+func (srv *Server) HandleReplicaAdd(m osc.Message) error {
+	srv.replicas.Add(m.Sender)
+	return nil
+}
+
+// HandleReplicaState handles the state of one of the primary's sessions.
+// It is ignored unless the server is a standby that has not taken over yet.
+func (srv *Server) HandleReplicaState(m osc.Message) error {
+	if expected, got := 1, len(m.Arguments); expected != got {
+		return errors.Errorf("expected %d arguments, got %d", expected, got)
+	}
+	data, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading session state")
+	}
+	if len(data) > maxReplicaStateSize {
+		return errors.Errorf("session state is %d bytes, at most %d are accepted", len(data), maxReplicaStateSize)
+	}
+	var state SessionState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return errors.Wrap(err, "decoding session state")
+	}
+	// The position is extrapolated with our own clock.
+	now := time.Now()
+	state.Time = now
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.replicated == nil {
+		return nil
+	}
+	srv.replicated[state.Name] = replicatedState{state: state, received: now}
+	srv.primarySeen = now
+	return nil
+}
+
+// runStandby keeps the server registered with the primary
+// and takes over when the primary's state stops arriving.
+// If the primary can not be reached it tries again on the next heartbeat.
+func (srv *Server) runStandby(ctx context.Context) error {
+	primary, err := resolveServer(srv.primary)
+	if err != nil {
+		return errors.Wrapf(err, "resolving primary %s", srv.primary)
+	}
+	srv.mu.Lock()
+	srv.primarySeen = time.Now()
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(srv.failover / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			srv.mu.RLock()
+			seen := srv.primarySeen
+			srv.mu.RUnlock()
+
+			if now.Sub(seen) >= srv.failover {
+				return errors.Wrap(srv.takeover(now), "taking over from primary")
+			}
+			if err := srv.conn.SendTo(primary, osc.Message{Address: syncosc.AddressReplicaAdd}); err != nil {
+				srv.log.Warn("registering with primary failed", "primary", primary.String(), errAttr(err))
+			}
+		}
+	}
+}
+
+// takeover starts the sessions that the primary was running when it was last seen.
+// Each session continues from the position it would have reached by now.
+// Sessions whose state stopped arriving before the primary did were removed from the primary.
+func (srv *Server) takeover(now time.Time) error {
+	srv.mu.Lock()
+	var (
+		states = srv.replicated
+		seen   = srv.primarySeen
+	)
+	srv.replicated = nil
+	srv.mu.Unlock()
+
+	restored := make([]SessionState, 0, len(states))
+	for _, rs := range states {
+		if seen.Sub(rs.received) < srv.failover {
+			restored = append(restored, rs.state.Extrapolate(now))
+		}
+	}
+	srv.log.Info("taking over", "sessions", len(restored))
+
+	return srv.restoreSessions(restored)
+}
+
+// resolveServer resolves the address of an oscsync server.
+// If host does not include a port syncosc.MasterPort is used.
+func resolveServer(host string) (net.Addr, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(syncosc.MasterPort))
+	}
+	return net.ResolveUDPAddr("udp", host)
+}
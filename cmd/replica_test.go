@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// testServer is a server that runs until the test stops it.
+type testServer struct {
+	*Server
+
+	addr   string
+	cancel context.CancelFunc
+	errs   chan error
+}
+
+// runTestServer runs a server on the loopback interface.
+// If the config has no port a free one is used.
+func runTestServer(t *testing.T, config ServerConfig) *testServer {
+	t.Helper()
+
+	config.host = "127.0.0.1"
+	if config.port == 0 {
+		config.port = freeUDPPort(t)
+	}
+	if config.settings == (settings{}) {
+		config.settings = defaultSettings
+	}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.ctx = ctx
+
+	ts := &testServer{
+		Server: srv,
+		addr:   net.JoinHostPort(config.host, strconv.Itoa(config.port)),
+		cancel: cancel,
+		errs:   make(chan error, 1),
+	}
+	go func() {
+		ts.errs <- srv.Run()
+	}()
+	t.Cleanup(ts.stop)
+	return ts
+}
+
+// stop stops the server and waits for it to return.
+func (ts *testServer) stop() {
+	ts.cancel()
+	<-ts.errs
+	ts.errs <- context.Canceled // Stopping again does not block.
+}
+
+// sessionState waits for the server to run a session and returns its state.
+func (ts *testServer) sessionState(t *testing.T, name string) SessionState {
+	t.Helper()
+
+	var sess *Session
+	waitFor(t, "session "+strconv.Quote(name), func() bool {
+		var ok bool
+		sess, ok = ts.session(name)
+		return ok
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	state, err := sess.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// freeUDPPort returns a UDP port of the loopback interface that is not in use.
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// waitFor waits up to 5 seconds for cond to be true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for timeout := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(timeout) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStandbyTakeover(t *testing.T) {
+	primary := runTestServer(t, ServerConfig{tempo: 133})
+	primary.sessionState(t, "")
+
+	standby := runTestServer(t, ServerConfig{
+		tempo:    120,
+		primary:  primary.addr,
+		failover: 500 * time.Millisecond,
+	})
+	waitFor(t, "the standby to receive the primary's state", func() bool {
+		standby.mu.RLock()
+		defer standby.mu.RUnlock()
+
+		_, ok := standby.replicated[""]
+		return ok
+	})
+	last := primary.sessionState(t, "")
+	primary.stop()
+
+	state := standby.sessionState(t, "")
+	if expected, got := last.Tempo, state.Tempo; expected != got {
+		t.Fatalf("expected tempo %f, got %f", expected, got)
+	}
+	// The standby takes over at least failover after the primary stopped,
+	// so a standby that did not continue the position would be far behind.
+	expected := last.Extrapolate(state.Time)
+	if diff := int64(state.Pulse) - int64(expected.Pulse); diff < -8 || diff > 8 {
+		t.Fatalf("expected pulse %d, got %d", expected.Pulse, state.Pulse)
+	}
+	// Timecode continues too.
+	tolerance := 8 * syncosc.GetPulseDuration(state.Tempo)
+	if diff := state.PlayTime - expected.PlayTime; diff < -tolerance || diff > tolerance {
+		t.Fatalf("expected play time %s, got %s", expected.PlayTime, state.PlayTime)
+	}
+}
+
+func TestReplicaStateTooLarge(t *testing.T) {
+	srv, err := NewServer(ServerConfig{
+		tempo:    120,
+		primary:  "127.0.0.1:5776",
+		failover: time.Second,
+		settings: defaultSettings,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := `{"name":"` + strings.Repeat("x", maxReplicaStateSize) + `"}`
+
+	if err := srv.HandleReplicaState(osc.Message{
+		Address:   syncosc.AddressReplicaState,
+		Arguments: osc.Arguments{osc.String(data)},
+	}); err == nil {
+		t.Fatal("expected an error for an oversize state")
+	}
+	if len(srv.replicated) > 0 {
+		t.Fatal("expected the oversize state to be ignored")
+	}
+}
@@ -16,19 +16,35 @@ package cmd
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var cfgFile string
+var (
+	cfgFile string
+
+	// configUsed is the config file that was read, if any.
+	configUsed string
+)
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "oscsync",
 	Short: "Sync programs via OSC",
 	Long:  `Sync programs via OSC`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupLogging(os.Stderr, viper.GetString("log-level"), viper.GetString("log-format")); err != nil {
+			return err
+		}
+		if configUsed != "" {
+			slog.Info("using config file", "path", configUsed)
+		}
+		return nil
+	},
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
@@ -51,20 +67,28 @@ func init() {
 	// will be global for your application.
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.oscsync.yaml)")
+	RootCmd.PersistentFlags().String("log-level", "info", "log level: debug, info, warn or error")
+	RootCmd.PersistentFlags().String("log-format", LogFormatText, "log format: text or json")
+
+	_ = viper.BindPFlag("log-level", RootCmd.PersistentFlags().Lookup("log-level"))
+	_ = viper.BindPFlag("log-format", RootCmd.PersistentFlags().Lookup("log-format"))
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" { // enable ability to specify config file via flag
 		viper.SetConfigFile(cfgFile)
+	} else {
+		viper.SetConfigName(".oscsync") // name of config file (without extension)
+		viper.AddConfigPath("$HOME")    // adding home directory as first search path
 	}
-
-	viper.SetConfigName(".oscsync") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")    // adding home directory as first search path
-	viper.AutomaticEnv()            // read in environment variables that match
+	viper.SetEnvPrefix("oscsync")                          // e.g. OSCSYNC_TEMPO
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_")) // e.g. OSCSYNC_SLAVE_TTL
+	viper.AutomaticEnv()                                   // read in environment variables that match
 
 	// If a config file is found, read it in.
+	// It is logged once the logger has been set up.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		configUsed = viper.ConfigFileUsed()
 	}
 }
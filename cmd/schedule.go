@@ -0,0 +1,141 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// change is a control change (tempo, meter, transport) that is applied
+// by the main loop on a quantization boundary.
+type change struct {
+	quantize Quantization
+
+	// group is the group of slaves that msg is sent to.
+	// The empty group means all the slaves.
+	group string
+
+	// msg is broadcast to slaves when the change is scheduled and when it is applied,
+	// unless the change is quiet.
+	msg   osc.Message
+	quiet bool
+
+	// apply is only ever invoked from the main loop.
+	apply func(sess *Session) error
+}
+
+// errSessionStopped is returned for a change to a session whose main loop has stopped.
+var errSessionStopped = errors.New("session has stopped")
+
+// submit passes a change to the main loop.
+// It fails instead of blocking if the main loop has stopped.
+func (sess *Session) submit(c change) error {
+	select {
+	case sess.changes <- c:
+		return nil
+	case <-sess.done:
+		return errSessionStopped
+	case <-sess.detached:
+		return errSessionStopped
+	}
+}
+
+// scheduledChange is a change that will be applied at a particular pulse.
+type scheduledChange struct {
+	change
+
+	pulse uint64
+}
+
+// readQuantization reads an optional quantization string argument from an OSC message.
+func readQuantization(m osc.Message, idx int) (Quantization, error) {
+	if len(m.Arguments) <= idx {
+		return Quantization{Unit: QuantizeNow}, nil
+	}
+	s, err := m.Arguments[idx].ReadString()
+	if err != nil {
+		return Quantization{}, errors.Wrap(err, "reading quantization")
+	}
+	return ParseQuantization(s)
+}
+
+// schedule queues a change for the pulse it should be applied on.
+// If the transport is stopped the change is applied immediately.
+// Slaves are told in advance about quantized changes with a /sync/schedule message
+// that has the count of the pulse the change is applied on.
+func (sess *Session) schedule(c change) error {
+	if !sess.playing {
+		return sess.applyChange(c)
+	}
+	pulse := c.quantize.Next(sess.pulse, sess.barOrigin, sess.meter)
+
+	sess.pending = append(sess.pending, scheduledChange{change: c, pulse: pulse})
+	sort.SliceStable(sess.pending, func(i, j int) bool {
+		return sess.pending[i].pulse < sess.pending[j].pulse
+	})
+	if c.quiet || c.quantize.Unit == QuantizeNow {
+		return nil
+	}
+	for _, s := range sess.slaves {
+		if sess.receives(s, c.group) {
+			sess.send(s, sess.scheduleNotice(s, pulse, c.msg))
+		}
+	}
+	return nil
+}
+
+// scheduleNotice returns the message that tells a slave that msg will be applied at pulse.
+// The pulse is counted at the slave's ppqn, like the pulses it is sent,
+// and rounded up to the first pulse the slave receives after the change.
+func (sess *Session) scheduleNotice(s *slave, pulse uint64, msg osc.Message) osc.Message {
+	div := sess.pulseDivider(s)
+
+	return osc.Message{
+		Address:   sess.address(syncosc.AddressSchedule),
+		Arguments: append(osc.Arguments{osc.Int(int32((pulse + div - 1) / div)), osc.String(msg.Address)}, msg.Arguments...),
+	}
+}
+
+// applyDue applies every pending change that is due at or before the current pulse.
+func (sess *Session) applyDue() error {
+	for len(sess.pending) > 0 && sess.pending[0].pulse <= sess.pulse {
+		c := sess.pending[0]
+		sess.pending = sess.pending[1:]
+
+		if err := sess.applyChange(c.change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyChange applies a change and tells the slaves about it.
+func (sess *Session) applyChange(c change) error {
+	if err := c.apply(sess); err != nil {
+		return errors.Wrapf(err, "applying %s", c.msg.Address)
+	}
+	if c.quiet {
+		return nil
+	}
+	sess.log.Info("applied change", "address", c.msg.Address, "args", argumentValues(c.msg.Arguments), "group", c.group, "pulse", sess.pulse)
+	sess.events.Publish(event{session: sess.name, group: c.group, msg: c.msg})
+
+	sess.broadcast(c.group, c.msg)
+	return nil
+}
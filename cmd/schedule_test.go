@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+func TestScheduleNoticePPQN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess    = newTestSession(ctx, t, 120)
+		full    = newTestMaster(ctx, t)
+		divided = newTestMaster(ctx, t)
+	)
+	sess.addSlave(&slave{addr: full.conn.LocalAddr()})
+	sess.addSlave(&slave{addr: divided.conn.LocalAddr(), ppqn: 4})
+	sess.pulse = 30
+
+	for _, testcase := range []struct {
+		quantize string
+		full     int32
+		divided  int32
+	}{
+		{quantize: "beat", full: 48, divided: 8},
+		{quantize: "bar", full: 96, divided: 16},
+	} {
+		q, err := ParseQuantization(testcase.quantize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.schedule(change{
+			quantize: q,
+			msg:      osc.Message{Address: syncosc.AddressTempo, Arguments: osc.Arguments{osc.Float(140)}},
+			apply:    func(sess *Session) error { return nil },
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, slave := range []struct {
+			master *testMaster
+			pulse  int32
+		}{
+			{master: full, pulse: testcase.full},
+			{master: divided, pulse: testcase.divided},
+		} {
+			m := slave.master.receive(t)
+			if m.Address != syncosc.AddressSchedule || len(m.Arguments) != 3 {
+				t.Fatalf("expected a schedule notice, got %v", m)
+			}
+			if pulse, err := m.Arguments[0].ReadInt32(); err != nil || pulse != slave.pulse {
+				t.Fatalf("expected the %s change to be announced at pulse %d, got %v", testcase.quantize, slave.pulse, m.Arguments[0])
+			}
+		}
+	}
+}
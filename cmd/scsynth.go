@@ -0,0 +1,306 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncclient"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// scsynthCmd represents the scsynth command
+var scsynthCmd = &cobra.Command{
+	Use:   "scsynth",
+	Short: "Send a bundle to scsynth on every beat of an oscsync master",
+	Long: `Send a bundle to scsynth on every beat of an oscsync master
+
+The slave sends scsynth a bundle on every beat of the master's meter, e.g. on every eighth note in 6/8.
+Each bundle is timestamped --latency after its beat on the grid of the master's pulses,
+so that scsynth plays it in time even when it arrives late.
+The bundle has a message for every one of --synth, --node and --bus that is given,
+with the bar and beat counted from 1 since the transport started and the tempo in bpm.
+
+  --synth  /s_new s:synth i:-1 i:0 i:target s:bar f:bar s:beat f:beat s:tempo f:tempo
+  --node   /n_set i:node s:bar f:bar s:beat f:beat s:tempo f:tempo
+  --bus    /c_set i:bus f:bar i:bus+1 f:beat i:bus+2 f:tempo
+
+The latency should be the same as the latency of the other clients of scsynth,
+and must cover the network and the master's jitter.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		s := &scsynthSlave{
+			latency: viper.GetDuration("latency"),
+			ppqn:    int32(viper.GetInt("ppqn")),
+			synth:   viper.GetString("synth"),
+			target:  int32(viper.GetInt("target")),
+			node:    int32(viper.GetInt("node")),
+			bus:     int32(viper.GetInt("bus")),
+		}
+		if err := s.validate(); err != nil {
+			return err
+		}
+		addr, err := net.ResolveUDPAddr("udp", viper.GetString("scsynth"))
+		if err != nil {
+			return errors.Wrap(err, "resolving scsynth")
+		}
+		conn, err := oscnet.DialUDP("udp", nil, addr)
+		if err != nil {
+			return errors.Wrap(err, "connecting to scsynth")
+		}
+		defer func() { _ = conn.Close() }()
+
+		s.conn = conn
+
+		opts := syncclient.Options{
+			Session:   viper.GetString("session"),
+			Group:     viper.GetString("group"),
+			Heartbeat: viper.GetDuration("heartbeat"),
+		}
+		return syncclient.ConnectAny(context.Background(), s, configStrings("master"), opts)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(scsynthCmd)
+
+	flags := scsynthCmd.Flags()
+	flags.String("master", "127.0.0.1", "comma-separated host[:port] of the oscsync masters")
+	flags.String("session", "", "session to sync to, the default session if empty")
+	flags.String("group", "", "group to register in")
+	flags.Duration("heartbeat", time.Second, "how often to register with the master again, 0 registers once")
+	flags.String("scsynth", "127.0.0.1:57110", "host:port of scsynth")
+	flags.Duration("latency", 200*time.Millisecond, "how long after its beat on the grid of the master's pulses scsynth plays a bundle")
+	flags.Int("ppqn", syncosc.PulsesPerQuarter, "pulses per quarter note the master sends")
+	flags.String("synth", "", "synth to start on every beat")
+	flags.Int("target", 1, "node the synths are added to the head of")
+	flags.Int("node", -1, "node to set the bar, beat and tempo controls of on every beat, -1 for none")
+	flags.Int("bus", -1, "first of three control buses to set to the bar, beat and tempo on every beat, -1 for none")
+}
+
+// scsynthSlave sends a bundle to scsynth on every beat of the master's meter.
+// A node or bus that is negative is left out of the bundle.
+type scsynthSlave struct {
+	conn    oscnet.Conn
+	latency time.Duration
+	ppqn    int32
+	synth   string
+	target  int32
+	node    int32
+	bus     int32
+
+	// The pulses are handled concurrently, mu guards the grid and the meter.
+	mu   sync.Mutex
+	grid pulseGrid
+
+	// meter took effect at pulse barOrigin, at PulsesPerQuarter, after originBar bars.
+	// pending is a meter change that takes effect at the next pulse.
+	meter     Meter
+	barOrigin uint64
+	originBar uint64
+	pending   *Meter
+}
+
+// validate returns an error if the slave would send nothing or can not count beats.
+func (s *scsynthSlave) validate() error {
+	if s.ppqn <= 0 || syncosc.PulsesPerQuarter%s.ppqn != 0 {
+		return errors.Errorf("ppqn must divide %d, got %d", syncosc.PulsesPerQuarter, s.ppqn)
+	}
+	if s.latency < 0 {
+		return errors.Errorf("latency must not be negative, got %s", s.latency)
+	}
+	if s.synth == "" && s.node < 0 && s.bus < 0 {
+		return errors.New("expected at least one of --synth, --node or --bus")
+	}
+	return nil
+}
+
+// Meter handles the master's meter.
+// A meter change takes effect at the next pulse.
+func (s *scsynthSlave) Meter(m syncosc.Meter) error {
+	meter := Meter{Beats: m.Beats, Unit: m.Unit}
+	if err := meter.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.Pulse < 0 {
+		s.pending = &meter
+		return nil
+	}
+	s.meter, s.barOrigin, s.originBar = meter, uint64(m.Pulse), uint64(m.Bar)
+	return nil
+}
+
+// Pulse sends scsynth the bundles of the beats that start at the pulse or before the next one.
+func (s *scsynthSlave) Pulse(p syncosc.Pulse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.Bundles(p, time.Now()) {
+		if err := s.conn.Send(b); err != nil {
+			return errors.Wrap(err, "sending bundle to scsynth")
+		}
+	}
+	return nil
+}
+
+// Bundles returns the bundles of the beats that start at a pulse that arrived at now,
+// or before the next pulse if the slave's ppqn is lower than the master's.
+// The caller must hold mu.
+func (s *scsynthSlave) Bundles(p syncosc.Pulse, now time.Time) []osc.Bundle {
+	var (
+		div   = uint64(syncosc.PulsesPerQuarter / s.ppqn)
+		pulse = uint64(p.Count) * div
+		dur   = syncosc.GetPulseDuration(p.Tempo)
+		at    = s.grid.Pulse(p.Count, time.Duration(div)*dur, s.latency, now)
+	)
+	if s.meter == (Meter{}) {
+		s.meter = DefaultMeter
+	}
+	// The transport started, which starts the first bar.
+	if p.Count == 0 {
+		s.barOrigin, s.originBar = 0, 0
+	}
+	if s.pending != nil {
+		s.originBar = meterOriginBar(positionAt(pulse, s.barOrigin, s.originBar, s.meter))
+		s.barOrigin, s.meter, s.pending = pulse, *s.pending, nil
+	}
+	if pulse < s.barOrigin {
+		return nil
+	}
+	var (
+		ppbeat  = s.meter.PulsesPerBeat()
+		bundles []osc.Bundle
+	)
+	for beat := pulse + (ppbeat-(pulse-s.barOrigin)%ppbeat)%ppbeat; beat < pulse+div; beat += ppbeat {
+		var (
+			pos = positionAt(beat, s.barOrigin, s.originBar, s.meter)
+			t   = at.Add(time.Duration(beat-pulse)*dur + s.latency)
+		)
+		bundles = append(bundles, s.Bundle(pos, p.Tempo, t))
+	}
+	return bundles
+}
+
+// Bundle returns the bundle of a beat at a position that scsynth plays at t.
+func (s *scsynthSlave) Bundle(pos Position, tempo float32, t time.Time) osc.Bundle {
+	var (
+		bar     = osc.Float(float32(pos.Bar))
+		beat    = osc.Float(float32(pos.Beat))
+		bpm     = osc.Float(tempo)
+		packets []osc.Packet
+	)
+	if s.synth != "" {
+		packets = append(packets, osc.Message{
+			Address: "/s_new",
+			Arguments: osc.Arguments{
+				osc.String(s.synth),
+				osc.Int(-1), // scsynth chooses the node ID
+				osc.Int(0),  // add to the head of the target
+				osc.Int(s.target),
+				osc.String("bar"), bar,
+				osc.String("beat"), beat,
+				osc.String("tempo"), bpm,
+			},
+		})
+	}
+	if s.node >= 0 {
+		packets = append(packets, osc.Message{
+			Address: "/n_set",
+			Arguments: osc.Arguments{
+				osc.Int(s.node),
+				osc.String("bar"), bar,
+				osc.String("beat"), beat,
+				osc.String("tempo"), bpm,
+			},
+		})
+	}
+	if s.bus >= 0 {
+		packets = append(packets, osc.Message{
+			Address:   "/c_set",
+			Arguments: osc.Arguments{osc.Int(s.bus), bar, osc.Int(s.bus + 1), beat, osc.Int(s.bus + 2), bpm},
+		})
+	}
+	return osc.Bundle{
+		Timetag: oscnet.FromTime(t),
+		Packets: packets,
+	}
+}
+
+// pulseGrid follows the grid of a master's pulses from when they arrive.
+// Pulses arrive late by the jitter of the network and the master,
+// so the grid is moved to every pulse that arrives earlier than it says,
+// and after every window of pulses to the earliest of them,
+// which also follows the drift between the clocks of the master and the slave.
+type pulseGrid struct {
+	origin time.Time
+	count  int32
+	dur    time.Duration
+
+	// last is the count of the last pulse, and earliest how late
+	// the earliest pulse of the window arrived, which has left pulses to go.
+	last     int32
+	earliest time.Duration
+	left     int32
+}
+
+// pulseGridWindow is the number of pulses of a window of the grid.
+const pulseGridWindow = 32
+
+// Pulse returns the time of a pulse on the grid, with a pulse duration at its tempo, that arrived at now.
+// A pulse that does not follow the last one, or arrives later than the grid says by more than
+// the latency, restarts the grid: the transport started or continued, or the master changed.
+// A new tempo continues the grid from the pulse.
+func (g *pulseGrid) Pulse(count int32, dur, latency time.Duration, now time.Time) time.Time {
+	switch {
+	case g.origin.IsZero() || count <= g.last || now.Sub(g.at(count)) > latency:
+		g.origin, g.count, g.dur, g.left = now, count, dur, 0
+	case dur != g.dur:
+		g.origin, g.count, g.dur = g.at(count), count, dur
+	}
+	g.last = count
+
+	at := g.at(count)
+	if late := now.Sub(at); late < 0 {
+		g.origin, at = g.origin.Add(late), now
+	}
+	if late := now.Sub(at); g.left == 0 || late < g.earliest {
+		g.earliest = late
+	}
+	if g.left == 0 {
+		g.left = pulseGridWindow
+	}
+	if g.left--; g.left == 0 {
+		g.origin = g.origin.Add(g.earliest)
+	}
+	return at
+}
+
+// at returns the time of a pulse on the grid.
+func (g *pulseGrid) at(count int32) time.Time {
+	return g.origin.Add(time.Duration(count-g.count) * g.dur)
+}
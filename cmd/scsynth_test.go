@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncclient"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// fakeScsynth is a UDP listener that reads bundles like scsynth.
+type fakeScsynth struct {
+	conn *net.UDPConn
+}
+
+func newFakeScsynth(t *testing.T) *fakeScsynth {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &fakeScsynth{conn: conn}
+}
+
+// receive returns the next bundle, or false if none arrives within timeout.
+func (s *fakeScsynth) receive(t *testing.T, timeout time.Duration) (osc.Bundle, bool) {
+	t.Helper()
+
+	if err := s.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := s.conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return osc.Bundle{}, false
+		}
+		t.Fatal(err)
+	}
+	b, err := osc.ParseBundle(buf[:n], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, true
+}
+
+func TestScsynthSlave(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		scsynth = newFakeScsynth(t)
+		master  = newTestMaster(ctx, t)
+	)
+	conn, err := oscnet.DialUDP("udp", nil, scsynth.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	s := &scsynthSlave{
+		conn:    conn,
+		latency: 300 * time.Millisecond,
+		ppqn:    syncosc.PulsesPerQuarter,
+		synth:   "click",
+		target:  1,
+		node:    1000,
+		bus:     4,
+	}
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = syncclient.ConnectAny(ctx, s, []string{master.conn.LocalAddr().String()}, syncclient.Options{})
+	}()
+	m := master.receive(t)
+	if expected, got := syncosc.AddressSlaveAdd, m.Address; expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+	addr, err := readUDPAddr(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slave asks for the meter, which is 6/8.
+	if m := master.receive(t); m.Address != syncosc.AddressMeter || len(m.Arguments) != 0 {
+		t.Fatalf("expected a meter query, got %s", m)
+	}
+	if err := master.conn.SendTo(addr, osc.Message{
+		Address:   "/reply",
+		Arguments: osc.Arguments{osc.String(syncosc.AddressMeter), osc.Int(6), osc.Int(8), osc.Int(0), osc.Int(0)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Pulses 0, 12 and 24 start the first three eighth notes.
+	var (
+		dur    = syncosc.GetPulseDuration(120)
+		before = time.Now()
+	)
+	for count := int32(0); count < 30; count++ {
+		if err := master.conn.SendTo(addr, osc.Message{
+			Address:   syncosc.AddressPulse,
+			Arguments: osc.Arguments{osc.Float(120), osc.Int(count)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(dur)
+	}
+	var bundles []osc.Bundle
+	for i := 0; i < 3; i++ {
+		b, ok := scsynth.receive(t, 2*time.Second)
+		if !ok {
+			t.Fatalf("timeout waiting for bundle %d", i)
+		}
+		bundles = append(bundles, b)
+	}
+	if _, ok := scsynth.receive(t, 100*time.Millisecond); ok {
+		t.Fatal("expected one bundle per beat")
+	}
+	// The pulses are handled concurrently, so the bundles can arrive in any order.
+	beatOf := func(b osc.Bundle) float32 {
+		m, ok := b.Packets[len(b.Packets)-1].(osc.Message)
+		if !ok || len(m.Arguments) < 4 {
+			t.Fatalf("expected /c_set at the end of the bundle, got %v", b.Packets)
+		}
+		beat, err := m.Arguments[3].ReadFloat32()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return beat
+	}
+	sort.Slice(bundles, func(i, j int) bool { return beatOf(bundles[i]) < beatOf(bundles[j]) })
+
+	first := oscnet.Time(bundles[0].Timetag)
+	if first.Before(before.Add(s.latency)) || first.After(before.Add(s.latency+dur)) {
+		t.Fatalf("expected the first bundle at %s plus the latency, got %s", before, first)
+	}
+	for i, b := range bundles {
+		// The grid only moves to pulses that arrive earlier than it within a window,
+		// so however late the pulses arrived the beats are no further apart than on the master's grid.
+		if i > 0 {
+			gap := oscnet.Time(b.Timetag).Sub(oscnet.Time(bundles[i-1].Timetag))
+			if gap <= 0 || gap > 12*dur+time.Millisecond {
+				t.Fatalf("expected bundle %d at most %s after the one before, got %s", i, 12*dur, gap)
+			}
+		}
+		var (
+			bar      = osc.Float(1)
+			beat     = osc.Float(float32(i + 1))
+			expected = []osc.Message{
+				{
+					Address: "/s_new",
+					Arguments: osc.Arguments{
+						osc.String("click"), osc.Int(-1), osc.Int(0), osc.Int(1),
+						osc.String("bar"), bar, osc.String("beat"), beat, osc.String("tempo"), osc.Float(120),
+					},
+				},
+				{
+					Address:   "/n_set",
+					Arguments: osc.Arguments{osc.Int(1000), osc.String("bar"), bar, osc.String("beat"), beat, osc.String("tempo"), osc.Float(120)},
+				},
+				{
+					Address:   "/c_set",
+					Arguments: osc.Arguments{osc.Int(4), bar, osc.Int(5), beat, osc.Int(6), osc.Float(120)},
+				},
+			}
+		)
+		if expected, got := len(expected), len(b.Packets); expected != got {
+			t.Fatalf("expected %d messages in bundle %d, got %d", expected, i, got)
+		}
+		for j, p := range b.Packets {
+			got, ok := p.(osc.Message)
+			if !ok {
+				t.Fatalf("expected a message in bundle %d, got %T", i, p)
+			}
+			if !expected[j].Equal(got) {
+				t.Fatalf("expected %s in bundle %d, got %s", expected[j], i, got)
+			}
+		}
+	}
+}
+
+func TestScsynthSlaveBundles(t *testing.T) {
+	var (
+		s       = &scsynthSlave{latency: 50 * time.Millisecond, ppqn: 4, node: 7, bus: -1}
+		dur     = syncosc.GetPulseDuration(90)
+		base    = time.Unix(100, 0)
+		latency = s.latency
+	)
+	// arrive returns when pulse count arrives, jitter after its time on the master's grid.
+	arrive := func(count int32, jitter time.Duration) time.Time {
+		return base.Add(time.Duration(count*6)*dur + jitter)
+	}
+	expectBundles := func(count int32, jitter time.Duration, expected ...osc.Bundle) {
+		t.Helper()
+
+		got := s.Bundles(syncosc.Pulse{Tempo: 90, Count: count}, arrive(count, jitter))
+		if len(expected) != len(got) {
+			t.Fatalf("expected %d bundles at pulse %d, got %v", len(expected), count, got)
+		}
+		for i := range expected {
+			if !reflect.DeepEqual(expected[i], got[i]) {
+				t.Fatalf("expected %v at pulse %d, got %v", expected[i], count, got[i])
+			}
+		}
+	}
+	bundle := func(bar, beat uint64, t time.Time) osc.Bundle {
+		return osc.Bundle{
+			Timetag: oscnet.FromTime(t.Add(latency)),
+			Packets: []osc.Packet{osc.Message{
+				Address: "/n_set",
+				Arguments: osc.Arguments{
+					osc.Int(7),
+					osc.String("bar"), osc.Float(float32(bar)),
+					osc.String("beat"), osc.Float(float32(beat)),
+					osc.String("tempo"), osc.Float(90),
+				},
+			}},
+		}
+	}
+	// In 4/4 every fourth pulse at 4 ppqn starts a beat.
+	// The first beat is as late as its pulse, the second is on the grid of the earliest pulse.
+	expectBundles(0, 5*time.Millisecond, bundle(1, 1, arrive(0, 5*time.Millisecond)))
+	expectBundles(1, 0)
+	expectBundles(2, 2*time.Millisecond)
+	expectBundles(3, time.Millisecond)
+	expectBundles(4, 3*time.Millisecond, bundle(1, 2, arrive(4, 0)))
+
+	// A change to 7/32 in the middle of a beat starts a bar with two beats before the next pulse.
+	if err := s.Meter(syncosc.Meter{Beats: 7, Unit: 32, Pulse: -1}); err != nil {
+		t.Fatal(err)
+	}
+	expectBundles(5, time.Millisecond, bundle(2, 1, arrive(5, 0)), bundle(2, 2, arrive(5, 0).Add(3*dur)))
+
+	// The meter of a master that is asked for it took effect in the past.
+	if err := s.Meter(syncosc.Meter{Beats: 3, Unit: 4, Pulse: 24, Bar: 9}); err != nil {
+		t.Fatal(err)
+	}
+	expectBundles(8, 0, bundle(10, 2, arrive(8, 0)))
+
+	// A restart of the transport restarts the grid and the bars.
+	restart := base.Add(time.Minute)
+	got := s.Bundles(syncosc.Pulse{Tempo: 90, Count: 0}, restart)
+	if expected := []osc.Bundle{bundle(1, 1, restart)}; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if err := s.Meter(syncosc.Meter{Beats: 4, Unit: 3, Pulse: -1}); err == nil {
+		t.Fatal("expected an error for an invalid meter")
+	}
+}
+
+func TestPulseGrid(t *testing.T) {
+	var (
+		g       pulseGrid
+		dur     = 10 * time.Millisecond
+		base    = time.Unix(100, 0)
+		latency = 100 * time.Millisecond
+	)
+	// The pulses that arrive late do not move the grid of the earliest one.
+	for count := int32(0); count < pulseGridWindow; count++ {
+		now := base.Add(time.Duration(count)*dur + 2*time.Millisecond)
+		if count == 0 {
+			now = base
+		}
+		if expected, got := base.Add(time.Duration(count)*dur), g.Pulse(count, dur, latency, now); !expected.Equal(got) {
+			t.Fatalf("expected pulse %d at %s, got %s", count, expected, got)
+		}
+	}
+	// Every pulse of the next window arrives 3ms late, which moves the grid after the window.
+	for count := int32(pulseGridWindow); count < 2*pulseGridWindow; count++ {
+		now := base.Add(time.Duration(count)*dur + 3*time.Millisecond)
+		if expected, got := base.Add(time.Duration(count)*dur), g.Pulse(count, dur, latency, now); !expected.Equal(got) {
+			t.Fatalf("expected pulse %d at %s, got %s", count, expected, got)
+		}
+	}
+	// A new tempo continues the grid from its pulse.
+	count := int32(2 * pulseGridWindow)
+	at := base.Add(time.Duration(count)*dur + 3*time.Millisecond)
+	if expected, got := at, g.Pulse(count, 2*dur, latency, at.Add(time.Millisecond)); !expected.Equal(got) {
+		t.Fatalf("expected pulse %d at %s, got %s", count, expected, got)
+	}
+	if expected, got := at.Add(2*dur), g.Pulse(count+1, 2*dur, latency, at.Add(2*dur+time.Millisecond)); !expected.Equal(got) {
+		t.Fatalf("expected pulse %d at %s, got %s", count+1, expected, got)
+	}
+	// A pulse that is later than the latency, after the transport continued, restarts the grid.
+	later := at.Add(time.Minute)
+	if expected, got := later, g.Pulse(count+2, 2*dur, latency, later); !expected.Equal(got) {
+		t.Fatalf("expected pulse %d at %s, got %s", count+2, expected, got)
+	}
+}
+
+func TestScsynthSlaveValidate(t *testing.T) {
+	for i, s := range []*scsynthSlave{
+		{ppqn: 24, node: -1, bus: -1},
+		{ppqn: 5, synth: "click", node: -1, bus: -1},
+		{ppqn: 0, synth: "click", node: -1, bus: -1},
+		{ppqn: 24, latency: -time.Second, synth: "click", node: -1, bus: -1},
+	} {
+		if err := s.validate(); err == nil {
+			t.Fatalf("(test case %d) expected an error", i)
+		}
+	}
+}
@@ -16,13 +16,16 @@ package cmd
 
 import (
 	"context"
+	"log/slog"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/scgolang/osc"
-	"github.com/scgolang/syncosc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -31,17 +34,17 @@ import (
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start an oscsync server",
-	Long:  `Start an oscsync server`,
+	Long: `Start an oscsync server
+
+With --standby the server mirrors the state of a primary server
+and takes over if the primary stops sending its state for longer than --failover.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var (
-			config = ServerConfig{}
-			flags  = cmd.Flags()
-		)
-		flags.StringVar(&config.host, "h", "0.0.0.0", "listen addr")
-		flags.Float32Var(&config.tempo, "t", 120, "tempo in bpm")
-
-		if err := flags.Parse(args); err != nil {
-			return errors.Wrap(err, "parsing flags")
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		config, err := readServerConfig(cmd.Flags())
+		if err != nil {
+			return errors.Wrap(err, "reading config")
 		}
 		srv, err := NewServer(config)
 		if err != nil {
@@ -53,23 +56,57 @@ var serveCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(serveCmd)
+
+	flags := serveCmd.Flags()
+	addServerFlags(flags)
+	flags.String("standby", "", "run as a hot standby for the primary server at host[:port]")
+	flags.String("state", "", "file the state of the sessions is saved to")
+	flags.Bool("resume", false, "restore the sessions from the state file")
+	flags.Bool("resume-clock", false, "continue the position of resumed sessions from the time the state was saved")
+	flags.Duration("failover", time.Second, "how long a standby waits for the primary before taking over")
 }
 
 // Server runs an oscsync server.
+// It hosts the default session and any number of named sessions.
 type Server struct {
 	ServerConfig
 
-	conn osc.Conn
+	conn oscnet.Conn
 	ctx  context.Context
 
-	pulse uint64
+	// g runs the main loops of the sessions.
+	g    *errgroup.Group
+	gctx context.Context
+
+	mu       sync.RWMutex
+	sessions map[string]*Session
+
+	// replicas are the standby servers that the sessions send their state to.
+	replicas *replicaSet
 
-	slaves      map[net.Addr]struct{}
-	slaveAdd    chan net.Addr
-	slaveRemove chan net.Addr
+	// replicated is the latest state of each of the primary's sessions
+	// and primarySeen is when the last one arrived.
+	// replicated is nil unless the server is a standby that has not taken over yet.
+	replicated  map[string]replicatedState
+	primarySeen time.Time
 
-	tempoChan chan float32
-	ticker    *time.Ticker
+	// peers are the other peers that have been heard from, by ID.
+	peers map[int32]*peer
+
+	// stateUpdates queues the state of the sessions when they change.
+	stateUpdates *stateQueue
+
+	// live holds the settings that are reloaded when the config file changes.
+	live *liveSettings
+
+	// events receives the events of every session.
+	events *eventHub
+
+	// metrics counts what the sessions do.
+	metrics *metrics
+
+	// log records what happens in the server.
+	log *slog.Logger
 }
 
 // NewServer creates a new oscsync server.
@@ -79,173 +116,234 @@ func NewServer(config ServerConfig) (*Server, error) {
 
 		ctx: context.Background(),
 
-		slaveAdd:    make(chan net.Addr, 8),
-		slaveRemove: make(chan net.Addr, 8),
-		slaves:      map[net.Addr]struct{}{},
+		sessions: map[string]*Session{},
+		replicas: newReplicaSet(),
+		peers:    map[int32]*peer{},
 
-		tempoChan: make(chan float32, 8),
+		stateUpdates: newStateQueue(),
+		live:         newLiveSettings(config.settings),
+		events:       newEventHub(),
+		metrics:      newMetrics(),
+		log:          slog.Default(),
+	}
+	if err := config.settings.validateTempo(config.tempo); err != nil {
+		return nil, err
+	}
+	if config.resume && config.stateFile == "" {
+		return nil, errors.New("resuming requires a state file")
+	}
+	if config.resume && (config.primary != "" || config.id > 0) {
+		return nil, errors.New("only a primary server can resume from a state file")
+	}
+	if config.primary != "" || config.id > 0 {
+		if config.failover <= 0 {
+			return nil, errors.Errorf("failover must be positive, got %s", config.failover)
+		}
+		srv.replicated = map[string]replicatedState{}
 	}
 	return srv, nil
 }
 
-// HandleSlaveAdd handles the OSC message to add a slave.
-func (srv *Server) HandleSlaveAdd(m osc.Message) error {
-	addr, err := readUDPAddr(m)
+// Run runs an oscsync server.
+func (srv *Server) Run() error {
+	// Run the osc server.
+	g, ctx := errgroup.WithContext(srv.ctx)
+
+	laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(srv.host, strconv.Itoa(srv.port)))
 	if err != nil {
-		return errors.Wrap(err, "getting addr from osc message")
+		return errors.Wrap(err, "resolving listen address")
 	}
-	srv.slaveAdd <- addr
-	return nil
-}
-
-// HandleSlaveRemove handles the OSC message to remove a slave.
-func (srv *Server) HandleSlaveRemove(m osc.Message) error {
-	addr, err := readUDPAddr(m)
+	oscsrv, err := oscnet.ListenUDPContext(ctx, "udp", laddr)
 	if err != nil {
-		return errors.Wrap(err, "getting addr from osc message")
+		return errors.Wrap(err, "creating OSC server")
 	}
-	srv.slaveRemove <- addr
-	return nil
-}
+	srv.conn = oscsrv
+	srv.g, srv.gctx = g, ctx
 
-// HandleTempo handles tempo updates.
-func (srv *Server) HandleTempo(m osc.Message) error {
-	if len(m.Arguments) == 0 {
-		return srv.conn.SendTo(m.Sender, osc.Message{
-			Address: "/reply",
-			Arguments: osc.Arguments{
-				osc.String(syncosc.AddressTempo),
-				osc.Float(srv.tempo),
-			},
+	srv.watchConfig()
+
+	// Session messages are found by routeSession.
+	dispatcher := osc.Dispatcher{
+		syncosc.AddressPeerAlive:     osc.Method(srv.HandlePeerAlive),
+		syncosc.AddressPeerForward:   osc.Method(srv.HandlePeerForward),
+		syncosc.AddressReplicaAdd:    osc.Method(srv.HandleReplicaAdd),
+		syncosc.AddressReplicaState:  osc.Method(srv.HandleReplicaState),
+		syncosc.AddressSessionAdd:    osc.Method(srv.HandleSessionAdd),
+		syncosc.AddressSessionList:   osc.Method(srv.HandleSessionList),
+		syncosc.AddressSessionRemove: osc.Method(srv.HandleSessionRemove),
+		oscnet.DefaultAddress:        osc.Method(srv.routeSession),
+	}
+	dispatcher = logMessages(srv.log, "", srv.metrics.CountMessages("", dispatcher))
+
+	g.Go(func() error {
+		err := oscsrv.Serve(2, dispatcher, oscnet.OnError(srv.dropPacket))
+		if err != nil && ctx.Err() == nil {
+			srv.log.Error("OSC server stopped", errAttr(err))
+		}
+		return err
+	})
+	srv.log.Info("listening", "addr", oscsrv.LocalAddr().String())
+
+	// A standby starts its sessions when it takes over from the primary,
+	// a peer when it is elected leader.
+	if srv.id > 0 {
+		g.Go(func() error {
+			return srv.runPeer(ctx)
+		})
+	} else if srv.primary != "" {
+		g.Go(func() error {
+			return srv.runStandby(ctx)
 		})
+	} else if err := srv.start(); err != nil {
+		return err
 	}
-	tempo, err := m.Arguments[0].ReadFloat32()
-	if err != nil {
-		return errors.Wrap(err, "reading float argument")
+	if srv.stateFile != "" {
+		g.Go(func() error {
+			return srv.runStateWriter(ctx)
+		})
 	}
-	srv.tempoChan <- tempo
-	return nil
+	if srv.advertise != "" {
+		g.Go(func() error {
+			return srv.runResponder(ctx)
+		})
+	}
+	if srv.oscQuery != "" {
+		g.Go(func() error {
+			return srv.runOSCQuery(ctx)
+		})
+	}
+	if srv.httpAddr != "" {
+		g.Go(func() error {
+			return srv.runHTTP(ctx)
+		})
+	}
+	if srv.metricsAddr != "" {
+		g.Go(func() error {
+			return srv.runMetrics(ctx)
+		})
+	}
+	return g.Wait()
 }
 
-// incrPulse increments the pulse and broadcasts to all slaves.
-func (srv *Server) incrPulse(newTempo, oldTempo float32, newSlave net.Addr) error {
-	srv.pulse++
-
-	var (
-		i      = 0
-		slaves = make([]net.Addr, len(srv.slaves))
-	)
-	for slave := range srv.slaves {
-		slaves[i] = slave
-		i++
+// start starts the sessions of a primary server.
+// If the server resumes from a state file the sessions in the file are restored,
+// otherwise only the default session is started.
+func (srv *Server) start() error {
+	if !srv.resume {
+		return srv.startSession(NewSession("", srv.conn, srv.tempo))
 	}
-	if err := srv.sendPulse(srv.pulse, slaves, newTempo); err != nil {
-		return errors.Wrap(err, "sending pulse")
+	state, err := loadState(srv.stateFile)
+	if err != nil {
+		return err
 	}
-	if newSlave != nil {
-		if err := srv.sendPulse(srv.pulse, []net.Addr{newSlave}, newTempo); err != nil {
-			return errors.Wrap(err, "sending pulse")
+	if srv.resumeClock {
+		now := time.Now()
+		for i, sess := range state.Sessions {
+			state.Sessions[i] = sess.Extrapolate(now)
 		}
 	}
-	return nil
+	return srv.restoreSessions(state.Sessions)
 }
 
-// Main is the main loop of the server.
-func (srv *Server) Main(ctx context.Context) error {
-	srv.ticker = time.NewTicker(syncosc.GetPulseDuration(srv.tempo))
-
-EnterLoop:
-	for range srv.ticker.C {
-		var (
-			newSlave net.Addr
-			newTempo = srv.tempo
-		)
-		select {
-		default:
-		case newSlave = <-srv.slaveAdd:
-			srv.slaves[newSlave] = struct{}{}
-		case slave := <-srv.slaveRemove:
-			delete(srv.slaves, slave)
-		case newTempo = <-srv.tempoChan:
-			srv.ticker.Stop()
-			srv.ticker = time.NewTicker(syncosc.GetPulseDuration(newTempo))
+// restoreSessions starts sessions from their state.
+// The default session is started even if there is no state for it.
+func (srv *Server) restoreSessions(states []SessionState) error {
+	for _, state := range states {
+		sess := NewSession(state.Name, srv.conn, state.Tempo)
+		if err := sess.restore(state); err != nil {
+			return errors.Wrapf(err, "restoring session %q", state.Name)
 		}
-		if err := srv.incrPulse(newTempo, srv.tempo, newSlave); err != nil {
-			return errors.Wrap(err, "incrementing pulse")
-		}
-		if srv.tempo != newTempo {
-			srv.tempo = newTempo
-			goto EnterLoop // re-enter the loop since we've changed the ticker
+		if err := srv.startSession(sess); err != nil {
+			return err
 		}
 	}
-	return nil
+	srv.mu.RLock()
+	_, ok := srv.sessions[""]
+	srv.mu.RUnlock()
+
+	if ok {
+		return nil
+	}
+	return srv.startSession(NewSession("", srv.conn, srv.tempo))
 }
 
-// Run runs an oscsync server.
-func (srv *Server) Run() error {
-	// Run the osc server.
-	g, ctx := errgroup.WithContext(srv.ctx)
+// startSession adds a session to the server and starts its main loop.
+func (srv *Server) startSession(sess *Session) error {
+	sess.replicas = srv.replicas
+	sess.live = srv.live
+	sess.events = srv.events
+	sess.metrics = srv.metrics
+	sess.timecode = srv.timecode
+	sess.methods = logMessages(sess.log, sess.name, srv.metrics.CountMessages(sess.name, sess.methods))
 
-	laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(srv.host, strconv.Itoa(syncosc.MasterPort)))
-	if err != nil {
-		return errors.Wrap(err, "resolving listen address")
+	for _, ss := range srv.staticSlaves {
+		if ss.session == sess.name {
+			s := ss.slave
+			s.seen = time.Now()
+			sess.slaves[s.addr.String()] = &s
+			sess.log.Info("added static slave", "slave", s.addr.String(), "group", s.group)
+		}
 	}
-	oscsrv, err := osc.ListenUDPContext(ctx, "udp", laddr)
-	if err != nil {
-		return errors.Wrap(err, "creating OSC server")
+	if srv.stateFile != "" {
+		sess.stateUpdates = srv.stateUpdates
 	}
-	srv.conn = oscsrv
 
-	g.Go(func() error {
-		return oscsrv.Serve(2, osc.Dispatcher{
-			syncosc.AddressTempo:       osc.Method(srv.HandleTempo),
-			syncosc.AddressSlaveAdd:    osc.Method(srv.HandleSlaveAdd),
-			syncosc.AddressSlaveRemove: osc.Method(srv.HandleSlaveRemove),
-		})
-	})
-	g.Go(func() error {
-		return srv.Main(ctx)
-	})
-	return g.Wait()
-}
-
-// sendPulse sends a pulse message to addr.
-func (srv *Server) sendPulse(pulse uint64, slaves []net.Addr, tempo float32) error {
-	if srv.conn == nil {
-		return errors.New("OSC connection has not been initialized")
-	}
-	for _, slave := range slaves {
-		if err := srv.conn.SendTo(slave, osc.Message{
-			Address: syncosc.AddressPulse,
-			Arguments: osc.Arguments{
-				osc.Float(tempo),
-				osc.Int(int32(pulse)),
-			},
-		}); err != nil {
-			return errors.Wrapf(err, "sending pulse message to %s", slave)
-		}
+	srv.mu.Lock()
+	if _, exists := srv.sessions[sess.name]; exists {
+		srv.mu.Unlock()
+		return errors.Errorf("session %q already exists", sess.name)
 	}
+	srv.sessions[sess.name] = sess
+	srv.mu.Unlock()
+
+	sess.log.Info("started session", "tempo", sess.tempo)
+
+	srv.g.Go(func() error {
+		return errors.Wrapf(sess.Main(srv.gctx), "running session %q", sess.name)
+	})
 	return nil
 }
 
 // ServerConfig contains configurationn for an oscsync server.
 type ServerConfig struct {
 	host  string
+	port  int
 	tempo float32
-}
 
-// readUDPAddr reads a host/port from an osc message and returns it as a net.Addr
-func readUDPAddr(m osc.Message) (net.Addr, error) {
-	if expected, got := 2, len(m.Arguments); expected != got {
-		return nil, errors.Errorf("expected %d arguments, got %d", expected, got)
-	}
-	host, err := m.Arguments[0].ReadString()
-	if err != nil {
-		return nil, errors.Wrap(err, "reading host")
-	}
-	port, err := m.Arguments[1].ReadInt32()
-	if err != nil {
-		return nil, errors.Wrap(err, "reading port")
-	}
-	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	// primary is the address of the primary server if this server is a standby.
+	// failover is how long the standby waits for the primary's state before taking over.
+	primary  string
+	failover time.Duration
+
+	// stateFile is where the state of the sessions is saved.
+	// If resume is true the sessions are restored from it at startup,
+	// and if resumeClock is true their position continues from when it was saved.
+	stateFile   string
+	resume      bool
+	resumeClock bool
+
+	// settings are the initial live settings.
+	settings settings
+
+	// staticSlaves are added to their session whenever it starts.
+	staticSlaves []staticSlave
+
+	// id is the server's ID if it runs as a peer and peerHosts are the addresses of the other peers.
+	id        int32
+	peerHosts []string
+
+	// advertise is the name the server is advertised under with mDNS, if any,
+	// and mdnsAddr is the address the mDNS responder listens on.
+	advertise string
+	mdnsAddr  string
+
+	// oscQuery is the host:port the OSCQuery server listens on, if any,
+	// httpAddr is the host:port of the HTTP API
+	// and metricsAddr is the host:port that serves only the metrics.
+	oscQuery    string
+	httpAddr    string
+	metricsAddr string
+
+	// timecode is the frame rate of the timecode the sessions send, if any.
+	timecode FrameRate
 }
@@ -0,0 +1,605 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// Session is an independent clock with its own tempo, meter, transport, pulse counter and slaves.
+// The default session has an empty name and uses the /sync/... addresses,
+// other sessions use /sync/<name>/... addresses.
+type Session struct {
+	name     string
+	conn     oscnet.Conn
+	done     chan struct{}
+	detached chan struct{}
+	methods  osc.Dispatcher
+
+	tempo     float32
+	pulse     uint64
+	barOrigin uint64
+	originBar uint64
+	meter     Meter
+	playing   bool
+
+	cues *cueSchedule
+
+	grooves      *grooveLibrary
+	groupGrooves map[string]string
+	slaveGrooves map[string]string
+
+	slaves      map[string]*slave
+	slaveAdd    chan *slave
+	slaveList   chan net.Addr
+	slaveRemove chan net.Addr
+
+	muted   map[string]bool
+	stopped map[string]bool
+
+	changes chan change
+	pending []scheduledChange
+	ticker  *time.Ticker
+
+	// gridStart is when gridPulse was due, the pulses after it are due every pulse duration.
+	// The grid is restarted by the first pulse after the ticker is reset.
+	gridStart time.Time
+	gridPulse uint64
+
+	// timecode is the frame rate of the timecode sent to the slaves that subscribe to it,
+	// no timecode is sent if it is zero.
+	// played is for how long the transport played before playingSince,
+	// which is when it last started or continued,
+	// and lastQuarterFrame is the last quarter frame of timecode that was sent.
+	timecode         FrameRate
+	played           time.Duration
+	playingSince     time.Time
+	lastQuarterFrame int64
+
+	// metrics counts the pulses sent to the slaves and how late they are.
+	metrics *metrics
+
+	// log records what happens in the session.
+	log *slog.Logger
+
+	// replicas are the standby servers the session sends its state to.
+	// replicaOversize is true while the state is too large to replicate.
+	replicas        *replicaSet
+	replicaOversize bool
+
+	// live holds the server settings that can change while the session runs.
+	live *liveSettings
+
+	// stateUpdates queues the state of the session when it changes
+	// and saved is the state that was sent last.
+	stateUpdates *stateQueue
+	saved        *SessionState
+
+	// stateRequests receives the channels that snapshots of the session are sent to.
+	stateRequests chan chan SessionState
+
+	// events receives the pulses and the control changes of the session.
+	events *eventHub
+}
+
+// NewSession creates a new session that sends messages with conn.
+func NewSession(name string, conn oscnet.Conn, tempo float32) *Session {
+	sess := &Session{
+		name:     name,
+		conn:     conn,
+		done:     make(chan struct{}),
+		detached: make(chan struct{}),
+
+		tempo:   tempo,
+		meter:   DefaultMeter,
+		playing: true,
+
+		cues: newCueSchedule(),
+
+		grooves:      newGrooveLibrary(),
+		groupGrooves: map[string]string{},
+		slaveGrooves: map[string]string{},
+
+		slaveAdd:    make(chan *slave, 8),
+		slaveList:   make(chan net.Addr, 8),
+		slaveRemove: make(chan net.Addr, 8),
+		slaves:      map[string]*slave{},
+
+		muted:   map[string]bool{},
+		stopped: map[string]bool{},
+
+		changes: make(chan change, 8),
+
+		lastQuarterFrame: -1,
+
+		stateRequests: make(chan chan SessionState, 8),
+
+		log: slog.Default().With("session", name),
+	}
+	sess.methods = sess.dispatcher()
+	return sess
+}
+
+// address returns the session's version of an oscsync address.
+func (sess *Session) address(addr string) string {
+	return syncosc.SessionAddress(sess.name, addr)
+}
+
+// close stops the session's main loop.
+func (sess *Session) close() {
+	close(sess.done)
+}
+
+// detach stops the session's main loop without telling the slaves,
+// so that another server can continue the session.
+func (sess *Session) detach() {
+	close(sess.detached)
+}
+
+// dispatcher returns the OSC methods of the session.
+func (sess *Session) dispatcher() osc.Dispatcher {
+	return osc.Dispatcher{
+		sess.address(syncosc.AddressCueAdd):       osc.Method(sess.HandleCueAdd),
+		sess.address(syncosc.AddressCueList):      osc.Method(sess.HandleCueList),
+		sess.address(syncosc.AddressCueRemove):    osc.Method(sess.HandleCueRemove),
+		sess.address(syncosc.AddressGroupCueAdd):  osc.Method(sess.HandleGroupCueAdd),
+		sess.address(syncosc.AddressGroupMute):    osc.Method(sess.HandleGroupMute),
+		sess.address(syncosc.AddressGroupUnmute):  osc.Method(sess.HandleGroupUnmute),
+		sess.address(syncosc.AddressGrooveAdd):    osc.Method(sess.HandleGrooveAdd),
+		sess.address(syncosc.AddressGrooveGroup):  osc.Method(sess.HandleGrooveGroup),
+		sess.address(syncosc.AddressGrooveList):   osc.Method(sess.HandleGrooveList),
+		sess.address(syncosc.AddressGrooveRemove): osc.Method(sess.HandleGrooveRemove),
+		sess.address(syncosc.AddressGrooveSlave):  osc.Method(sess.HandleGrooveSlave),
+		sess.address(syncosc.AddressGrooveSwing):  osc.Method(sess.HandleGrooveSwing),
+		sess.address(syncosc.AddressMeter):        osc.Method(sess.HandleMeter),
+		sess.address(syncosc.AddressSlaveAdd):     osc.Method(sess.HandleSlaveAdd),
+		sess.address(syncosc.AddressSlaveList):    osc.Method(sess.HandleSlaveList),
+		sess.address(syncosc.AddressSlaveRemove):  osc.Method(sess.HandleSlaveRemove),
+		sess.address(syncosc.AddressTempo):        osc.Method(sess.HandleTempo),
+		sess.address(syncosc.AddressTransport):    osc.Method(sess.HandleTransport),
+	}
+}
+
+// HandleTempo handles tempo updates.
+func (sess *Session) HandleTempo(m osc.Message) error {
+	if len(m.Arguments) == 0 {
+		state, err := sess.query()
+		if err != nil {
+			return err
+		}
+		return sess.conn.SendTo(m.Sender, osc.Message{
+			Address: "/reply",
+			Arguments: osc.Arguments{
+				osc.String(sess.address(syncosc.AddressTempo)),
+				osc.Float(state.Tempo),
+			},
+		})
+	}
+	tempo, err := m.Arguments[0].ReadFloat32()
+	if err != nil {
+		return errors.Wrap(err, "reading float argument")
+	}
+	if err := sess.live.Get().validateTempo(tempo); err != nil {
+		return err
+	}
+	q, err := readQuantization(m, 1)
+	if err != nil {
+		return err
+	}
+	return sess.submit(change{
+		quantize: q,
+		msg: osc.Message{
+			Address:   sess.address(syncosc.AddressTempo),
+			Arguments: osc.Arguments{osc.Float(tempo)},
+		},
+		apply: func(sess *Session) error {
+			sess.tempo = tempo
+			sess.resetClock()
+			return nil
+		},
+	})
+}
+
+// broadcast sends a message to all the slaves in a group.
+// The empty group means all the slaves.
+// A slave that the message can not be sent to is skipped and marked unhealthy like in sendPulse.
+func (sess *Session) broadcast(group string, m osc.Message) {
+	for _, s := range sess.slaves {
+		if sess.receives(s, group) {
+			sess.send(s, m)
+		}
+	}
+}
+
+// tick applies the changes that are due and sends the current pulse to all slaves.
+func (sess *Session) tick() error {
+	if !sess.playing {
+		return nil
+	}
+	if err := sess.applyDue(); err != nil {
+		return errors.Wrap(err, "applying scheduled changes")
+	}
+	if !sess.playing { // A change might have stopped the transport.
+		return nil
+	}
+	sess.evictFailing()
+
+	slaves := make([]*slave, 0, len(sess.slaves))
+	for _, s := range sess.slaves {
+		if sess.receivesPulses(s) {
+			slaves = append(slaves, s)
+		}
+	}
+	var cues []Cue
+	if pos := sess.position(sess.pulse); pos.OnBeat() {
+		cues = sess.cues.At(pos.Bar, pos.Beat)
+	}
+	if err := sess.sendPulse(sess.pulse, slaves, sess.tempo, cues); err != nil {
+		return errors.Wrap(err, "sending pulse")
+	}
+	sess.events.Publish(event{
+		session: sess.name,
+		msg: osc.Message{
+			Address:   sess.address(syncosc.AddressPulse),
+			Arguments: osc.Arguments{osc.Float(sess.tempo), osc.Int(int32(sess.pulse))},
+		},
+		position: sess.position(sess.pulse),
+		cues:     cues,
+	})
+	sess.pulse++
+	return nil
+}
+
+// resetClock restarts the ticker at the tempo of the session.
+func (sess *Session) resetClock() {
+	sess.ticker.Reset(syncosc.GetPulseDuration(sess.tempo))
+	sess.gridStart = time.Time{}
+}
+
+// due returns when a pulse should be sent according to the pulse grid.
+// The grid starts at now if it has been restarted.
+func (sess *Session) due(pulse uint64, tempo float32, now time.Time) time.Time {
+	if sess.gridStart.IsZero() || pulse < sess.gridPulse {
+		sess.gridStart, sess.gridPulse = now, pulse
+	}
+	return sess.gridStart.Add(time.Duration(pulse-sess.gridPulse) * syncosc.GetPulseDuration(tempo))
+}
+
+// Main is the main loop of the session.
+// When the session is closed the slaves are told that the transport has stopped.
+func (sess *Session) Main(ctx context.Context) error {
+	sess.ticker = time.NewTicker(syncosc.GetPulseDuration(sess.tempo))
+	defer sess.ticker.Stop()
+
+	housekeeping := time.NewTicker(replicationInterval)
+	defer housekeeping.Stop()
+
+	// Timecode starts when the session starts, from the play time of a restored session.
+	sess.playingSince = time.Now()
+
+	var timecode <-chan time.Time
+	if !sess.timecode.IsZero() {
+		ticker := time.NewTicker(sess.timecode.QuarterFrameDuration())
+		defer ticker.Stop()
+		timecode = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sess.done:
+			sess.broadcast("", osc.Message{
+				Address:   sess.address(syncosc.AddressTransport),
+				Arguments: osc.Arguments{osc.String(syncosc.TransportStop)},
+			})
+			return nil
+		case <-sess.detached:
+			return nil
+		case s := <-sess.slaveAdd:
+			sess.addSlave(s)
+		case addr := <-sess.slaveList:
+			if err := sess.sendSlaveList(addr); err != nil {
+				sess.log.Warn("sending slave list failed", "addr", addr.String(), errAttr(err))
+			}
+		case addr := <-sess.slaveRemove:
+			if _, ok := sess.slaves[addr.String()]; ok {
+				sess.log.Info("removed slave", "slave", addr.String())
+			}
+			delete(sess.slaves, addr.String())
+			sess.metrics.ForgetSlave(sess.name, addr.String())
+		case reply := <-sess.stateRequests:
+			reply <- sess.snapshot()
+		case c := <-sess.changes:
+			if err := sess.schedule(c); err != nil {
+				return errors.Wrap(err, "scheduling change")
+			}
+		case <-sess.ticker.C:
+			if err := sess.tick(); err != nil {
+				return errors.Wrap(err, "incrementing pulse")
+			}
+		case now := <-timecode:
+			sess.sendTimecode(now)
+		case now := <-housekeeping.C:
+			sess.expireSlaves(now)
+			sess.evictFailing()
+			if err := sess.replicate(); err != nil {
+				return errors.Wrap(err, "replicating state")
+			}
+			sess.save()
+		}
+	}
+}
+
+// sendPulse sends a pulse message to the slaves.
+// If there are any cues for a slave's group they are sent in the same bundle as the pulse.
+// If a slave has a groove or a latency its pulse is delayed by the groove's offset plus the latency.
+// Pulses that are not on the grid of the slave's ppqn are not sent,
+// but the cues at those pulses are.
+// How late each packet is sent is measured against the pulse grid.
+// A slave that a packet can not be sent to is skipped and marked unhealthy
+// until a packet can be sent to it again, so it does not stop the other slaves from being pulsed.
+func (sess *Session) sendPulse(pulse uint64, slaves []*slave, tempo float32, cues []Cue) error {
+	if sess.conn == nil {
+		return errors.New("OSC connection has not been initialized")
+	}
+	due := sess.due(pulse, tempo, time.Now())
+	defer sess.checkOverrun(pulse, tempo, due)
+
+	for _, s := range slaves {
+		var packets []osc.Packet
+		if div := sess.pulseDivider(s); pulse%div == 0 {
+			packets = append(packets, osc.Message{
+				Address: sess.address(syncosc.AddressPulse),
+				Arguments: osc.Arguments{
+					osc.Float(tempo),
+					osc.Int(int32(pulse / div)),
+				},
+			})
+		}
+		for _, cue := range cues {
+			if cue.Group != "" && cue.Group != s.group {
+				continue
+			}
+			packets = append(packets, cue.Message)
+		}
+		var p osc.Packet
+		switch len(packets) {
+		case 0:
+			continue
+		case 1:
+			p = packets[0]
+		default:
+			p = osc.Bundle{Timetag: osc.Immediately, Packets: packets}
+		}
+		if offset := sess.grooveOffset(s, pulse) + s.latency; offset > 0 {
+			sess.sendLater(offset, s, p, due.Add(offset))
+			continue
+		}
+		sess.sendTo(s, p, due)
+	}
+	return nil
+}
+
+// sendTo sends a packet to a slave and records whether it could be sent.
+// due is when the packet should be sent, which it is measured against.
+func (sess *Session) sendTo(s *slave, p osc.Packet, due time.Time) {
+	if !sess.send(s, p) {
+		return
+	}
+	sess.metrics.PulseSent(sess.name, s.addr.String())
+	sess.metrics.Lateness(sess.name, time.Since(due))
+}
+
+// send sends a packet to a slave and counts whether it could be sent.
+// A slave is unhealthy while packets can not be sent to it
+// and is evicted after maxSendFailures failures in a row.
+// send reports whether the packet was sent.
+func (sess *Session) send(s *slave, p osc.Packet) bool {
+	addr := s.addr.String()
+
+	if err := sess.conn.SendTo(s.addr, p); err != nil {
+		sess.metrics.SendError(sess.name, addr)
+
+		if failures := s.sendFailed(); failures == 1 {
+			sess.log.Warn("slave is unhealthy", "slave", addr, errAttr(err))
+		} else {
+			sess.log.Debug("sending to slave failed", "slave", addr, "failures", failures, errAttr(err))
+		}
+		return false
+	}
+	if failures := s.sent(); failures > 0 {
+		sess.log.Info("slave is healthy again", "slave", addr, "failures", failures)
+	}
+	return true
+}
+
+// checkOverrun logs a pulse that was sent so late that the next pulse was already due.
+func (sess *Session) checkOverrun(pulse uint64, tempo float32, due time.Time) {
+	if late := time.Since(due); late > syncosc.GetPulseDuration(tempo) {
+		sess.log.Warn("scheduling overrun", "pulse", pulse, "late", late)
+	}
+}
+
+// sendLater sends a packet to a slave after the given delay.
+// due is when the packet should be sent, which it is measured against.
+func (sess *Session) sendLater(delay time.Duration, s *slave, p osc.Packet, due time.Time) {
+	time.AfterFunc(delay, func() {
+		sess.sendTo(s, p, due)
+	})
+}
+
+// HandleSessionAdd handles the OSC message to create a named session.
+// The optional second argument is the initial tempo of the session.
+func (srv *Server) HandleSessionAdd(m osc.Message) error {
+	if len(m.Arguments) == 0 {
+		return errors.New("expected at least 1 argument")
+	}
+	name, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading session name")
+	}
+	if err := srv.validateSessionName(name); err != nil {
+		return err
+	}
+	srv.mu.RLock()
+	standby := srv.replicated != nil
+	srv.mu.RUnlock()
+
+	if standby {
+		return errors.New("sessions can not be created on a standby server")
+	}
+	tempo := srv.tempo
+	if len(m.Arguments) > 1 {
+		if tempo, err = m.Arguments[1].ReadFloat32(); err != nil {
+			return errors.Wrap(err, "reading tempo")
+		}
+		if err := srv.live.Get().validateTempo(tempo); err != nil {
+			return err
+		}
+	}
+	if err := srv.startSession(NewSession(name, srv.conn, tempo)); err != nil {
+		return err
+	}
+	return srv.conn.SendTo(m.Sender, osc.Message{
+		Address: "/reply",
+		Arguments: osc.Arguments{
+			osc.String(syncosc.AddressSessionAdd),
+			osc.String(name),
+		},
+	})
+}
+
+// HandleSessionList handles the OSC message to list the named sessions.
+func (srv *Server) HandleSessionList(m osc.Message) error {
+	args := osc.Arguments{osc.String(syncosc.AddressSessionList)}
+
+	for _, name := range srv.sessionNames() {
+		args = append(args, osc.String(name))
+	}
+	return srv.conn.SendTo(m.Sender, osc.Message{
+		Address:   "/reply",
+		Arguments: args,
+	})
+}
+
+// HandleSessionRemove handles the OSC message to destroy a named session.
+func (srv *Server) HandleSessionRemove(m osc.Message) error {
+	if expected, got := 1, len(m.Arguments); expected != got {
+		return errors.Errorf("expected %d arguments, got %d", expected, got)
+	}
+	name, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading session name")
+	}
+	if name == "" {
+		return errors.New("the default session can not be removed")
+	}
+	srv.mu.Lock()
+	sess, ok := srv.sessions[name]
+	delete(srv.sessions, name)
+	srv.mu.Unlock()
+
+	if !ok {
+		return errors.Errorf("no session named %q", name)
+	}
+	sess.close()
+	srv.metrics.ForgetSession(name)
+
+	if srv.stateFile != "" {
+		srv.stateUpdates.put(name, nil)
+	}
+	return nil
+}
+
+// routeSession invokes the methods of the session that a message is addressed to.
+// Messages that are not addressed to a named session go to the default session.
+// If the server is not running the session the message is forwarded to the leader
+// when the server is a peer and ignored otherwise.
+func (srv *Server) routeSession(m osc.Message) error {
+	if !strings.HasPrefix(m.Address, syncosc.AddressPrefix) {
+		srv.log.Warn("dropped message with unknown address", messageAttrs(m)...)
+		return nil
+	}
+	name := strings.TrimPrefix(m.Address, syncosc.AddressPrefix)
+	if idx := strings.Index(name, "/"); idx != -1 {
+		name = name[:idx]
+	}
+	srv.mu.RLock()
+	sess, ok := srv.sessions[name]
+	if !ok {
+		sess, ok = srv.sessions[""]
+	}
+	srv.mu.RUnlock()
+
+	if !ok {
+		return srv.forwardToLeader(m)
+	}
+	return sess.methods.Invoke(m)
+}
+
+// sessionNames returns the sorted names of the named sessions.
+func (srv *Server) sessionNames() []string {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	names := []string{}
+	for name := range srv.sessions {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateSessionName returns an error if name can not be used for a new session.
+// Names must be a single address part and must not clash with the addresses of the default session.
+func (srv *Server) validateSessionName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return errors.Errorf("invalid session name %q", name)
+	}
+	prefix := syncosc.AddressPrefix + name
+	if err := osc.ValidateAddress(prefix); err != nil {
+		return errors.Wrapf(err, "invalid session name %q", name)
+	}
+	addresses := []string{
+		syncosc.AddressPeerAlive,
+		syncosc.AddressReplicaAdd,
+		syncosc.AddressReplicaState,
+		syncosc.AddressSessionAdd,
+		syncosc.AddressSessionList,
+		syncosc.AddressSessionRemove,
+	}
+	for address := range (&Session{}).dispatcher() {
+		addresses = append(addresses, address)
+	}
+	for _, address := range addresses {
+		if address == prefix || strings.HasPrefix(address, prefix+"/") {
+			return errors.Errorf("session name %q is reserved", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// newTestSession returns a session that sends from a UDP connection on the loopback interface.
+func newTestSession(ctx context.Context, t *testing.T, tempo float32) *Session {
+	conn, err := oscnet.ListenUDPContext(ctx, "udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return NewSession("", conn, tempo)
+}
+
+func TestBroadcastDeadSlave(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess   = newTestSession(ctx, t, 120)
+		master = newTestMaster(ctx, t)
+		live   = &slave{addr: master.conn.LocalAddr()}
+
+		// Nothing can be sent to port 0.
+		dead = &slave{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	)
+	sess.addSlave(dead)
+	sess.addSlave(live)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sess.Main(ctx)
+	}()
+
+	if err := sess.HandleTempo(osc.Message{
+		Address:   syncosc.AddressTempo,
+		Arguments: osc.Arguments{osc.Float(140), osc.String("beat")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	isTempo := func(args osc.Arguments) bool {
+		for _, arg := range args {
+			if f, err := arg.ReadFloat32(); err == nil && f == 140 {
+				return true
+			}
+		}
+		return false
+	}
+	master.receiveMatching(t, syncosc.AddressSchedule, isTempo)
+	master.receiveMatching(t, syncosc.AddressTempo, isTempo)
+
+	sess.close()
+	if err := <-errs; err != nil {
+		t.Fatalf("session stopped with %v", err)
+	}
+	master.receiveMatching(t, syncosc.AddressTransport, func(args osc.Arguments) bool {
+		s, err := args[0].ReadString()
+		return err == nil && s == syncosc.TransportStop
+	})
+	if failures := atomic.LoadInt32(&dead.failures); failures == 0 {
+		t.Fatal("expected the dead slave to be unhealthy")
+	}
+}
+
+func TestTransportQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess   = newTestSession(ctx, t, 120)
+		client = newTestMaster(ctx, t)
+		query  = osc.Message{Address: syncosc.AddressTransport, Sender: client.conn.LocalAddr()}
+	)
+	go func() { _ = sess.Main(ctx) }()
+	defer sess.close()
+
+	isTransport := func(state string) func(osc.Arguments) bool {
+		return func(args osc.Arguments) bool {
+			if len(args) != 2 {
+				return false
+			}
+			s, err := args[1].ReadString()
+			return err == nil && s == state
+		}
+	}
+	if err := sess.HandleTransport(query); err != nil {
+		t.Fatal(err)
+	}
+	client.receiveMatching(t, "/reply", isTransport(syncosc.TransportStart))
+
+	// The stop is applied by the main loop on the next pulse.
+	if err := sess.HandleTransport(osc.Message{
+		Address:   syncosc.AddressTransport,
+		Arguments: osc.Arguments{osc.String(syncosc.TransportStop)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the transport to stop", func() bool {
+		state, err := sess.query()
+		return err == nil && !state.Playing
+	})
+	if err := sess.HandleTransport(query); err != nil {
+		t.Fatal(err)
+	}
+	client.receiveMatching(t, "/reply", isTransport(syncosc.TransportStop))
+}
+
+func TestMeterQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess   = newTestSession(ctx, t, 120)
+		client = newTestMaster(ctx, t)
+	)
+	go func() { _ = sess.Main(ctx) }()
+	defer sess.close()
+
+	if err := sess.HandleMeter(osc.Message{
+		Address:   syncosc.AddressMeter,
+		Arguments: osc.Arguments{osc.Int(6), osc.Int(8)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var state SessionState
+	waitFor(t, "the meter to change", func() bool {
+		var err error
+		state, err = sess.query()
+		return err == nil && state.Meter == Meter{Beats: 6, Unit: 8}
+	})
+	if err := sess.HandleMeter(osc.Message{Address: syncosc.AddressMeter, Sender: client.conn.LocalAddr()}); err != nil {
+		t.Fatal(err)
+	}
+	// The reply has the pulse the meter took effect at and the bars before it.
+	expected := syncosc.Meter{Beats: 6, Unit: 8, Pulse: int32(state.BarOrigin), Bar: int32(state.OriginBar)}
+	client.receiveMatching(t, "/reply", func(args osc.Arguments) bool {
+		if len(args) == 0 {
+			return false
+		}
+		meter, err := syncosc.MeterFromMessage(osc.Message{Arguments: args[1:]})
+		return err == nil && meter == expected
+	})
+}
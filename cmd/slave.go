@@ -0,0 +1,316 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// slave is a slave that has registered with the server.
+// seen is when the slave last registered.
+// Static slaves are configured instead of registering themselves and never expire.
+// If ppqn is not 0 it overrides the server's ppqn for the slave,
+// and latency delays all the slave's pulses.
+// timecode is the rate the slave receives timecode at, the empty rate means no timecode.
+type slave struct {
+	addr     net.Addr
+	group    string
+	seen     time.Time
+	static   bool
+	ppqn     int32
+	latency  time.Duration
+	timecode string
+
+	// failures is how many packets in a row could not be sent to the slave.
+	// The slave is unhealthy if it is not 0.
+	// It is updated atomically since delayed pulses are sent from their own goroutines.
+	failures int32
+}
+
+// sendFailed records a packet that could not be sent to the slave
+// and returns how many in a row could not be sent.
+func (s *slave) sendFailed() int32 {
+	return atomic.AddInt32(&s.failures, 1)
+}
+
+// sent records a packet that was sent to the slave
+// and returns how many in a row could not be sent before it.
+func (s *slave) sent() int32 {
+	return atomic.SwapInt32(&s.failures, 0)
+}
+
+// healthy returns true if the last packet could be sent to the slave.
+func (s *slave) healthy() bool {
+	return atomic.LoadInt32(&s.failures) == 0
+}
+
+// kind returns "static" for static slaves and "dynamic" for slaves that registered themselves.
+func (s *slave) kind() string {
+	if s.static {
+		return "static"
+	}
+	return "dynamic"
+}
+
+// staticSlave is a static slave of a session.
+type staticSlave struct {
+	session string
+	slave   slave
+}
+
+// parseStaticSlave parses a static slave from host:port?key=value&...
+// The keys are group, session, ppqn, latency and timecode, e.g.
+// 10.0.0.5:9000?group=lights&ppqn=4&latency=20ms&timecode=frame
+func parseStaticSlave(spec string) (staticSlave, error) {
+	hostport, query := spec, ""
+	if idx := strings.Index(spec, "?"); idx != -1 {
+		hostport, query = spec[:idx], spec[idx+1:]
+	}
+	addr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return staticSlave{}, errors.Wrapf(err, "resolving static slave %s", hostport)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return staticSlave{}, errors.Wrapf(err, "parsing options of static slave %s", hostport)
+	}
+	ss := staticSlave{slave: slave{addr: addr, static: true}}
+
+	for key := range values {
+		value := values.Get(key)
+
+		switch key {
+		case "group":
+			ss.slave.group = value
+		case "session":
+			ss.session = value
+		case "ppqn":
+			ppqn, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return staticSlave{}, errors.Wrapf(err, "parsing ppqn of static slave %s", hostport)
+			}
+			if ppqn <= 0 || syncosc.PulsesPerQuarter%ppqn != 0 {
+				return staticSlave{}, errors.Errorf("ppqn of static slave %s must divide %d, got %d", hostport, syncosc.PulsesPerQuarter, ppqn)
+			}
+			ss.slave.ppqn = int32(ppqn)
+		case "latency":
+			latency, err := time.ParseDuration(value)
+			if err != nil {
+				return staticSlave{}, errors.Wrapf(err, "parsing latency of static slave %s", hostport)
+			}
+			if latency < 0 {
+				return staticSlave{}, errors.Errorf("latency of static slave %s must not be negative, got %s", hostport, latency)
+			}
+			ss.slave.latency = latency
+		case "timecode":
+			if err := validateTimecodeRate(value); err != nil {
+				return staticSlave{}, errors.Wrapf(err, "static slave %s", hostport)
+			}
+			ss.slave.timecode = value
+		default:
+			return staticSlave{}, errors.Errorf("unknown option %q for static slave %s", key, hostport)
+		}
+	}
+	return ss, nil
+}
+
+// HandleSlaveAdd handles the OSC message to add a slave.
+// The optional third argument is the name of the group the slave belongs to
+// and the optional fourth argument is the rate the slave receives timecode at.
+func (sess *Session) HandleSlaveAdd(m osc.Message) error {
+	addr, err := readUDPAddr(m)
+	if err != nil {
+		return errors.Wrap(err, "getting addr from osc message")
+	}
+	s := &slave{addr: addr}
+
+	if len(m.Arguments) > 2 {
+		group, err := m.Arguments[2].ReadString()
+		if err != nil {
+			return errors.Wrap(err, "reading group")
+		}
+		s.group = group
+	}
+	if len(m.Arguments) > 3 {
+		rate, err := m.Arguments[3].ReadString()
+		if err != nil {
+			return errors.Wrap(err, "reading timecode rate")
+		}
+		if err := validateTimecodeRate(rate); err != nil {
+			return err
+		}
+		s.timecode = rate
+	}
+	select {
+	case sess.slaveAdd <- s:
+		return nil
+	case <-sess.done:
+		return errSessionStopped
+	case <-sess.detached:
+		return errSessionStopped
+	}
+}
+
+// HandleSlaveList handles the OSC message to list the slaves.
+// The reply is sent by the main loop since it owns the slaves.
+func (sess *Session) HandleSlaveList(m osc.Message) error {
+	select {
+	case sess.slaveList <- m.Sender:
+		return nil
+	case <-sess.done:
+		return errSessionStopped
+	case <-sess.detached:
+		return errSessionStopped
+	}
+}
+
+// HandleSlaveRemove handles the OSC message to remove a slave.
+func (sess *Session) HandleSlaveRemove(m osc.Message) error {
+	addr, err := readUDPAddr(m)
+	if err != nil {
+		return errors.Wrap(err, "getting addr from osc message")
+	}
+	select {
+	case sess.slaveRemove <- addr:
+		return nil
+	case <-sess.done:
+		return errSessionStopped
+	case <-sess.detached:
+		return errSessionStopped
+	}
+}
+
+// sendSlaveList replies to addr with the address, group, group state and kind of every slave.
+func (sess *Session) sendSlaveList(addr net.Addr) error {
+	args := osc.Arguments{osc.String(sess.address(syncosc.AddressSlaveList))}
+
+	for _, s := range sess.sortedSlaves() {
+		args = append(args,
+			osc.String(s.addr.String()),
+			osc.String(s.group),
+			osc.String(sess.groupState(s.group)),
+			osc.String(s.kind()),
+		)
+	}
+	return sess.conn.SendTo(addr, osc.Message{
+		Address:   "/reply",
+		Arguments: args,
+	})
+}
+
+// addSlave adds a slave that registered itself.
+// A static slave with the same address keeps its configuration.
+func (sess *Session) addSlave(s *slave) {
+	s.seen = time.Now()
+
+	existing, ok := sess.slaves[s.addr.String()]
+	if ok && existing.static {
+		existing.seen = s.seen
+		return
+	}
+	if ok {
+		// Registering again does not make a slave that can not be sent to healthy.
+		s.failures = atomic.LoadInt32(&existing.failures)
+	}
+	if ok && existing.group == s.group {
+		sess.log.Debug("slave registered again", "slave", s.addr.String(), "group", s.group)
+	} else {
+		sess.log.Info("added slave", "slave", s.addr.String(), "group", s.group)
+	}
+	sess.slaves[s.addr.String()] = s
+}
+
+// expireSlaves removes the slaves that have not registered again within the slave TTL.
+// Static slaves never expire.
+func (sess *Session) expireSlaves(now time.Time) {
+	ttl := sess.live.Get().slaveTTL
+	if ttl == 0 {
+		return
+	}
+	for key, s := range sess.slaves {
+		if !s.static && now.Sub(s.seen) > ttl {
+			delete(sess.slaves, key)
+			sess.metrics.ForgetSlave(sess.name, key)
+			sess.log.Info("expired slave", "slave", key, "last_seen", s.seen)
+		}
+	}
+}
+
+// evictFailing removes the slaves that packets could not be sent to
+// for at least the configured number of times in a row.
+// Static slaves are never evicted.
+func (sess *Session) evictFailing() {
+	limit := sess.live.Get().maxSendFailures
+	if limit == 0 {
+		return
+	}
+	for key, s := range sess.slaves {
+		if failures := atomic.LoadInt32(&s.failures); !s.static && failures >= limit {
+			delete(sess.slaves, key)
+			sess.metrics.ForgetSlave(sess.name, key)
+			sess.log.Warn("evicted slave", "slave", key, "failures", failures)
+		}
+	}
+}
+
+// sortedSlaves returns the slaves ordered by group and address.
+func (sess *Session) sortedSlaves() []*slave {
+	slaves := make([]*slave, 0, len(sess.slaves))
+	for _, s := range sess.slaves {
+		slaves = append(slaves, s)
+	}
+	sort.Slice(slaves, func(i, j int) bool {
+		if slaves[i].group != slaves[j].group {
+			return slaves[i].group < slaves[j].group
+		}
+		return slaves[i].addr.String() < slaves[j].addr.String()
+	})
+	return slaves
+}
+
+// readUDPAddr reads a host/port from an osc message and returns it as a net.Addr
+func readUDPAddr(m osc.Message) (net.Addr, error) {
+	if len(m.Arguments) < 2 {
+		return nil, errors.Errorf("expected at least 2 arguments, got %d", len(m.Arguments))
+	}
+	host, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading host")
+	}
+	port, err := m.Arguments[1].ReadInt32()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading port")
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	// Slaves that found the master on the network do not know their own address
+	// and announce a loopback address, so the address the message came from is used.
+	if sender, ok := m.Sender.(*net.UDPAddr); ok && addr.IP.IsLoopback() && !sender.IP.IsLoopback() {
+		addr.IP = sender.IP
+	}
+	return addr, nil
+}
@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+func TestParseStaticSlave(t *testing.T) {
+	for _, testcase := range []struct {
+		spec     string
+		addr     string
+		session  string
+		group    string
+		ppqn     int32
+		latency  time.Duration
+		timecode string
+	}{
+		{spec: "10.0.0.5:9000", addr: "10.0.0.5:9000"},
+		{
+			spec:    "10.0.0.5:9000?group=lights&ppqn=4&latency=20ms",
+			addr:    "10.0.0.5:9000",
+			group:   "lights",
+			ppqn:    4,
+			latency: 20 * time.Millisecond,
+		},
+		{spec: "10.0.0.6:8000?session=live&timecode=frame", addr: "10.0.0.6:8000", session: "live", timecode: syncosc.TimecodeFrame},
+	} {
+		ss, err := parseStaticSlave(testcase.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", testcase.spec, err)
+		}
+		s := ss.slave
+		if !s.static {
+			t.Fatalf("%s: expected a static slave", testcase.spec)
+		}
+		if s.addr.String() != testcase.addr || ss.session != testcase.session || s.group != testcase.group ||
+			s.ppqn != testcase.ppqn || s.latency != testcase.latency || s.timecode != testcase.timecode {
+			t.Fatalf("%s: expected %+v, got %+v in session %q", testcase.spec, testcase, s, ss.session)
+		}
+	}
+	for _, spec := range []string{
+		"10.0.0.5",
+		"10.0.0.5:9000?ppqn=5",
+		"10.0.0.5:9000?ppqn=0",
+		"10.0.0.5:9000?ppqn=x",
+		"10.0.0.5:9000?latency=-1ms",
+		"10.0.0.5:9000?latency=soon",
+		"10.0.0.5:9000?timecode=60",
+		"10.0.0.5:9000?color=red",
+		"10.0.0.5:9000?group=%zz",
+	} {
+		if _, err := parseStaticSlave(spec); err == nil {
+			t.Fatalf("expected an error for %s", spec)
+		}
+	}
+}
+
+func TestStaticSlavesNeverExpire(t *testing.T) {
+	settings := defaultSettings
+	settings.slaveTTL = time.Second
+
+	sess := NewSession("", nil, 120)
+	sess.live = newLiveSettings(settings)
+
+	static, err := parseStaticSlave("127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.addSlave(&static.slave)
+	sess.addSlave(&slave{addr: mustUDPAddr(t, "127.0.0.1:9001")})
+
+	// A slave that registers with the address of a static slave does not replace it.
+	sess.addSlave(&slave{addr: mustUDPAddr(t, "127.0.0.1:9000"), group: "other"})
+
+	sess.expireSlaves(time.Now().Add(time.Hour))
+
+	if len(sess.slaves) != 1 {
+		t.Fatalf("expected only the static slave to be left, got %d slaves", len(sess.slaves))
+	}
+	s, ok := sess.slaves["127.0.0.1:9000"]
+	if !ok || !s.static || s.group != "" {
+		t.Fatalf("expected the static slave to be left as configured, got %+v", s)
+	}
+}
+
+func TestSlaveListKind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		sess   = newTestSession(ctx, t, 120)
+		client = newTestMaster(ctx, t)
+	)
+	static, err := parseStaticSlave("127.0.0.1:9000?group=lights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.addSlave(&static.slave)
+	sess.addSlave(&slave{addr: mustUDPAddr(t, "127.0.0.1:9001")})
+
+	if err := sess.sendSlaveList(client.conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	reply := client.receive(t)
+
+	var got []string
+	for _, arg := range reply.Arguments[1:] {
+		s, err := arg.ReadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	expected := []string{
+		"127.0.0.1:9001", "", GroupActive, "dynamic",
+		"127.0.0.1:9000", "lights", GroupActive, "static",
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRestoreStaticSlavesFromConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	saved := testSessionState("")
+	saved.Time = time.Now()
+	saved.Slaves = []SlaveState{
+		// This slave was removed from the config after the state was saved.
+		{Addr: "127.0.0.1:9000", Static: true},
+		{Addr: "127.0.0.1:9001", Group: "old"},
+	}
+	if err := writeState(path, ServerState{Sessions: []SessionState{saved}}); err != nil {
+		t.Fatal(err)
+	}
+	configured, err := parseStaticSlave("127.0.0.1:9001?group=lights")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := runTestServer(t, ServerConfig{
+		tempo:        120,
+		stateFile:    path,
+		resume:       true,
+		staticSlaves: []staticSlave{configured},
+	})
+	state := srv.sessionState(t, "")
+
+	expected := []SlaveState{
+		{Addr: "127.0.0.1:9000"},
+		{Addr: "127.0.0.1:9001", Group: "lights", Static: true},
+	}
+	if len(expected) != len(state.Slaves) {
+		t.Fatalf("expected slaves %+v, got %+v", expected, state.Slaves)
+	}
+	for i, ss := range state.Slaves {
+		if ss.Addr != expected[i].Addr || ss.Group != expected[i].Group || ss.Static != expected[i].Static {
+			t.Fatalf("expected slaves %+v, got %+v", expected, state.Slaves)
+		}
+	}
+}
+
+func TestEvictFailing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := defaultSettings
+	settings.maxSendFailures = 3
+
+	var (
+		sess   = newTestSession(ctx, t, 120)
+		master = newTestMaster(ctx, t)
+		live   = &slave{addr: master.conn.LocalAddr()}
+		pulse  = osc.Message{Address: syncosc.AddressPulse, Arguments: osc.Arguments{osc.Float(120), osc.Int(0)}}
+
+		// Nothing can be sent to port 0.
+		dead   = &slave{addr: mustUDPAddr(t, "127.0.0.1:0")}
+		static = &slave{addr: mustUDPAddr(t, "[::1]:0"), static: true}
+	)
+	sess.live = newLiveSettings(settings)
+
+	for _, s := range []*slave{live, dead, static} {
+		sess.addSlave(s)
+	}
+	// sendAll sends a pulse to every slave and evicts the ones that keep failing,
+	// like the main loop does.
+	sendAll := func() {
+		for _, s := range sess.sortedSlaves() {
+			sess.send(s, pulse)
+		}
+		sess.evictFailing()
+	}
+	for i := int32(1); i < settings.maxSendFailures; i++ {
+		sendAll()
+
+		if _, ok := sess.slaves[dead.addr.String()]; !ok {
+			t.Fatalf("expected the slave to be kept after %d failures", i)
+		}
+	}
+	sendAll()
+
+	if _, ok := sess.slaves[dead.addr.String()]; ok {
+		t.Fatalf("expected the slave to be evicted after %d failures", settings.maxSendFailures)
+	}
+	if _, ok := sess.slaves[live.addr.String()]; !ok {
+		t.Fatal("expected the slave that can be sent to to be kept")
+	}
+	if _, ok := sess.slaves[static.addr.String()]; !ok {
+		t.Fatal("expected the static slave to be kept")
+	}
+	// A packet that can be sent starts the count again.
+	dead.failures = 0
+	sess.addSlave(dead)
+	sendAll()
+	sendAll()
+
+	// One packet reaches the slave.
+	dead.addr = live.addr
+	sendAll()
+	dead.addr = mustUDPAddr(t, "127.0.0.1:0")
+	sendAll()
+	sendAll()
+
+	if _, ok := sess.slaves[dead.addr.String()]; !ok {
+		t.Fatal("expected the slave to be kept after failures that were not in a row")
+	}
+}
+
+func TestSlaveHandlersStoppedSession(t *testing.T) {
+	var (
+		add    = slaveMessage(syncosc.AddressSlaveAdd, 9000)
+		remove = slaveMessage(syncosc.AddressSlaveRemove, 9000)
+		list   = osc.Message{Address: syncosc.AddressSlaveList, Sender: mustUDPAddr(t, "127.0.0.1:9000")}
+	)
+	for _, stop := range []func(*Session){(*Session).close, (*Session).detach} {
+		// The main loop of the session never runs, so nothing is taken from its channels.
+		sess := NewSession("", nil, 120)
+
+		for _, testcase := range []struct {
+			handle func(osc.Message) error
+			m      osc.Message
+			n      int
+		}{
+			{handle: sess.HandleSlaveAdd, m: add, n: cap(sess.slaveAdd)},
+			{handle: sess.HandleSlaveRemove, m: remove, n: cap(sess.slaveRemove)},
+			{handle: sess.HandleSlaveList, m: list, n: cap(sess.slaveList)},
+		} {
+			for i := 0; i < testcase.n; i++ {
+				if err := testcase.handle(testcase.m); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		stop(sess)
+
+		for _, handle := range []func(osc.Message) error{sess.HandleSlaveAdd, sess.HandleSlaveRemove, sess.HandleSlaveList} {
+			errs := make(chan error, 1)
+			go func() {
+				errs <- handle(add)
+			}()
+			select {
+			case err := <-errs:
+				if err != errSessionStopped {
+					t.Fatalf("expected %v, got %v", errSessionStopped, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("handler blocked on a stopped session")
+			}
+		}
+	}
+}
+
+// slaveMessage returns a slave add or remove message for a slave on the loopback interface.
+func slaveMessage(address string, port int32) osc.Message {
+	return osc.Message{
+		Address:   address,
+		Arguments: osc.Arguments{osc.String("127.0.0.1"), osc.Int(port)},
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// slavesCmd represents the slaves command
+var slavesCmd = &cobra.Command{
+	Use:   "slaves",
+	Short: "List the slaves of an oscsync server",
+	Long:  `List the slaves of an oscsync server along with their group, the group's state and whether they are static`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
+			return err
+		}
+		addr, err := resolveServer(viper.GetString("master"))
+		if err != nil {
+			return err
+		}
+		return listSlaves(addr.String())
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(slavesCmd)
+
+	slavesCmd.Flags().String("master", "127.0.0.1", "host[:port] of the oscsync server")
+}
+
+// listSlaves prints the slaves of an oscsync server.
+func listSlaves(addr string) error {
+	laddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	conn, err := oscnet.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	var (
+		done    = make(chan struct{})
+		errchan = make(chan error, 1)
+	)
+	go func() {
+		if err := conn.Serve(1, osc.Dispatcher{
+			"/reply": handleSlaveListReply(done),
+		}); err != nil {
+			errchan <- err
+		}
+		close(errchan)
+	}()
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	if err := conn.SendTo(raddr, osc.Message{Address: syncosc.AddressSlaveList}); err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		return errors.New("timeout waiting for slave list reply")
+	}
+
+	select {
+	default:
+	case err := <-errchan:
+		return err
+	}
+	return nil
+}
+
+// handleSlaveListReply handles a reply to list the slaves of an oscsync server.
+func handleSlaveListReply(done chan struct{}) osc.Method {
+	return osc.Method(func(m osc.Message) error {
+		defer close(done)
+
+		if len(m.Arguments) < 1 {
+			return errors.New("expected at least 1 argument to /reply")
+		}
+		address, err := m.Arguments[0].ReadString()
+		if err != nil {
+			return err
+		}
+		if address != syncosc.AddressSlaveList {
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ADDRESS\tGROUP\tSTATE\tKIND")
+
+		for i := 1; i+3 < len(m.Arguments); i += 4 {
+			fields := make([]interface{}, 4)
+			for j := range fields {
+				s, err := m.Arguments[i+j].ReadString()
+				if err != nil {
+					return err
+				}
+				fields[j] = s
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", fields...)
+		}
+		return w.Flush()
+	})
+}
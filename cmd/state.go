@@ -0,0 +1,455 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// ServerState is the content of a state file.
+type ServerState struct {
+	Sessions []SessionState `json:"sessions"`
+}
+
+// SessionState is a snapshot of a session that can be encoded as JSON.
+// Changes that are waiting for a quantization boundary are not part of the state.
+type SessionState struct {
+	Name string `json:"name"`
+
+	// Pulse is the next pulse the session will send.
+	// Time is when the snapshot was taken, which is used to extrapolate the position.
+	Pulse     uint64    `json:"pulse"`
+	Time      time.Time `json:"time"`
+	Tempo     float32   `json:"tempo"`
+	BarOrigin uint64    `json:"bar_origin"`
+	OriginBar uint64    `json:"origin_bar"`
+	Meter     Meter     `json:"meter"`
+	Playing   bool      `json:"playing"`
+
+	// PlayTime is for how long the transport had played at Time, which timecode is derived from.
+	PlayTime time.Duration `json:"play_time"`
+
+	Slaves  []SlaveState `json:"slaves"`
+	Muted   []string     `json:"muted"`
+	Stopped []string     `json:"stopped"`
+	Cues    []CueState   `json:"cues"`
+
+	Grooves      []Groove          `json:"grooves"`
+	GroupGrooves map[string]string `json:"group_grooves"`
+	SlaveGrooves map[string]string `json:"slave_grooves"`
+}
+
+// SlaveState is the state of a slave.
+// Static is not restored: static slaves only come from the config,
+// so a slave that was removed from it is restored as a slave that expires.
+type SlaveState struct {
+	Addr    string        `json:"addr"`
+	Group   string        `json:"group"`
+	Static  bool          `json:"static,omitempty"`
+	PPQN    int32         `json:"ppqn,omitempty"`
+	Latency time.Duration `json:"latency,omitempty"`
+
+	// Timecode is the rate the slave receives timecode at.
+	Timecode string `json:"timecode,omitempty"`
+
+	// Unhealthy is true if the last packet could not be sent to the slave.
+	// It is not restored since it depends on the network of the server.
+	Unhealthy bool `json:"unhealthy,omitempty"`
+}
+
+// CueState is the state of a cue.
+type CueState struct {
+	ID        int32           `json:"id"`
+	Bar       uint64          `json:"bar"`
+	Beat      uint64          `json:"beat"`
+	Group     string          `json:"group"`
+	Address   string          `json:"address"`
+	Arguments []ArgumentState `json:"arguments"`
+}
+
+// ArgumentState is an OSC argument that can be encoded as JSON.
+type ArgumentState struct {
+	Type   string  `json:"type"`
+	Int    int32   `json:"int,omitempty"`
+	Float  float32 `json:"float,omitempty"`
+	String string  `json:"string,omitempty"`
+	Blob   []byte  `json:"blob,omitempty"`
+}
+
+// Extrapolate returns the state advanced to the given time,
+// as if the session had kept running since the snapshot was taken.
+func (state SessionState) Extrapolate(now time.Time) SessionState {
+	if !state.Playing || state.Tempo <= 0 || now.Before(state.Time) {
+		return state
+	}
+	d := syncosc.GetPulseDuration(state.Tempo)
+	if d <= 0 {
+		return state
+	}
+	n := uint64(now.Sub(state.Time) / d)
+	state.Pulse += n
+	state.Time = state.Time.Add(time.Duration(n) * d)
+	state.PlayTime += time.Duration(n) * d
+	return state
+}
+
+// stateQueue hands the states of changed sessions to the state file writer.
+// Only the latest state of each session is kept, so putting a state never blocks
+// the session's main loop, however long writing the file takes.
+type stateQueue struct {
+	mu      sync.Mutex
+	pending map[string]*SessionState
+
+	// ready has a value when there are pending states.
+	ready chan struct{}
+}
+
+// newStateQueue creates an empty state queue.
+func newStateQueue() *stateQueue {
+	return &stateQueue{
+		pending: map[string]*SessionState{},
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// put queues the state of a session, replacing a state of the session that was not taken yet.
+// A nil state means the session may have been removed.
+func (q *stateQueue) put(name string, state *SessionState) {
+	q.mu.Lock()
+	q.pending[name] = state
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending states and empties the queue.
+func (q *stateQueue) take() map[string]*SessionState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := q.pending
+	q.pending = map[string]*SessionState{}
+	return pending
+}
+
+// snapshot returns the state of the session.
+// It must only be called from the main loop.
+func (sess *Session) snapshot() SessionState {
+	now := time.Now()
+
+	state := SessionState{
+		Name:         sess.name,
+		Pulse:        sess.pulse,
+		Time:         now,
+		Tempo:        sess.tempo,
+		BarOrigin:    sess.barOrigin,
+		OriginBar:    sess.originBar,
+		Meter:        sess.meter,
+		Playing:      sess.playing,
+		PlayTime:     sess.playTime(now),
+		Slaves:       []SlaveState{},
+		Muted:        sortedKeys(sess.muted),
+		Stopped:      sortedKeys(sess.stopped),
+		Cues:         []CueState{},
+		Grooves:      sess.grooves.List(),
+		GroupGrooves: map[string]string{},
+		SlaveGrooves: map[string]string{},
+	}
+	for _, s := range sess.sortedSlaves() {
+		state.Slaves = append(state.Slaves, SlaveState{
+			Addr:    s.addr.String(),
+			Group:   s.group,
+			Static:  s.static,
+			PPQN:    s.ppqn,
+			Latency: s.latency,
+
+			Timecode: s.timecode,
+
+			Unhealthy: !s.healthy(),
+		})
+	}
+	for _, cue := range sess.cues.List() {
+		state.Cues = append(state.Cues, CueState{
+			ID:        cue.ID,
+			Bar:       cue.Bar,
+			Beat:      cue.Beat,
+			Group:     cue.Group,
+			Address:   cue.Message.Address,
+			Arguments: encodeArguments(cue.Message.Arguments),
+		})
+	}
+	for group, name := range sess.groupGrooves {
+		state.GroupGrooves[group] = name
+	}
+	for addr, name := range sess.slaveGrooves {
+		state.SlaveGrooves[addr] = name
+	}
+	return state
+}
+
+// restore restores the state of a session that is not running yet.
+func (sess *Session) restore(state SessionState) error {
+	if err := state.Meter.Validate(); err != nil {
+		return errors.Wrap(err, "validating meter")
+	}
+	if state.Tempo <= 0 {
+		return errors.Errorf("tempo must be positive, got %f", state.Tempo)
+	}
+	sess.pulse = state.Pulse
+	sess.tempo = state.Tempo
+	sess.barOrigin = state.BarOrigin
+	sess.originBar = state.OriginBar
+	sess.meter = state.Meter
+	sess.playing = state.Playing
+	sess.played = state.PlayTime
+
+	for _, ss := range state.Slaves {
+		addr, err := net.ResolveUDPAddr("udp", ss.Addr)
+		if err != nil {
+			return errors.Wrapf(err, "resolving slave address %s", ss.Addr)
+		}
+		sess.slaves[addr.String()] = &slave{
+			addr:    addr,
+			group:   ss.Group,
+			seen:    time.Now(),
+			ppqn:    ss.PPQN,
+			latency: ss.Latency,
+
+			timecode: ss.Timecode,
+		}
+	}
+	for _, group := range state.Muted {
+		sess.muted[group] = true
+	}
+	for _, group := range state.Stopped {
+		sess.stopped[group] = true
+	}
+	for _, cs := range state.Cues {
+		args, err := decodeArguments(cs.Arguments)
+		if err != nil {
+			return errors.Wrapf(err, "decoding arguments of cue %d", cs.ID)
+		}
+		sess.cues.Restore(Cue{
+			ID:      cs.ID,
+			Bar:     cs.Bar,
+			Beat:    cs.Beat,
+			Group:   cs.Group,
+			Message: osc.Message{Address: cs.Address, Arguments: args},
+		})
+	}
+	for _, g := range state.Grooves {
+		g, err := NewGroove(g.Name, g.Offsets)
+		if err != nil {
+			return errors.Wrap(err, "validating groove")
+		}
+		sess.grooves.Add(g)
+	}
+	for group, name := range state.GroupGrooves {
+		sess.groupGrooves[group] = name
+	}
+	for addr, name := range state.SlaveGrooves {
+		sess.slaveGrooves[addr] = name
+	}
+	return nil
+}
+
+// save sends the state of the session to the state file writer
+// if it changed since it was last saved, or if the position
+// has drifted from the position that the saved state predicts.
+// It must only be called from the main loop.
+func (sess *Session) save() {
+	if sess.stateUpdates == nil {
+		return
+	}
+	state := sess.snapshot()
+
+	if sess.saved != nil && !sess.saved.differs(state) {
+		return
+	}
+	sess.saved = &state
+	sess.stateUpdates.put(sess.name, &state)
+}
+
+// differs returns true if the other state is not what this state turns into
+// when the session keeps running.
+func (state SessionState) differs(other SessionState) bool {
+	expected := state.Extrapolate(other.Time)
+	if expected.Pulse > other.Pulse+1 || other.Pulse > expected.Pulse+1 {
+		return true
+	}
+	expected.Pulse, expected.Time = other.Pulse, other.Time
+
+	a, errA := json.Marshal(expected)
+	b, errB := json.Marshal(other)
+	return errA != nil || errB != nil || string(a) != string(b)
+}
+
+// loadState reads a state file.
+// A state file that does not exist contains no sessions.
+func loadState(path string) (ServerState, error) {
+	state := ServerState{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, errors.Wrap(err, "reading state file")
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.Wrapf(err, "decoding state file %s", path)
+	}
+	return state, nil
+}
+
+// writeState writes a state file atomically by writing a temporary file
+// and renaming it.
+func writeState(path string, state ServerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding state")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary state file")
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return errors.Wrap(err, "writing temporary state file")
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return errors.Wrap(err, "syncing temporary state file")
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Wrap(err, "closing temporary state file")
+	}
+	return errors.Wrap(os.Rename(f.Name(), path), "renaming temporary state file")
+}
+
+// runStateWriter writes the state file whenever a session changes.
+// Only the sessions that the server is running are written.
+// A state file that can not be written is logged, and written again with the next change.
+func (srv *Server) runStateWriter(ctx context.Context) error {
+	states := map[string]SessionState{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-srv.stateUpdates.ready:
+			for name, state := range srv.stateUpdates.take() {
+				if state != nil {
+					states[name] = *state
+				}
+			}
+			srv.mu.RLock()
+			for name := range states {
+				if _, ok := srv.sessions[name]; !ok {
+					delete(states, name)
+				}
+			}
+			srv.mu.RUnlock()
+
+			server := ServerState{Sessions: make([]SessionState, 0, len(states))}
+			for _, state := range states {
+				server.Sessions = append(server.Sessions, state)
+			}
+			sort.Slice(server.Sessions, func(i, j int) bool {
+				return server.Sessions[i].Name < server.Sessions[j].Name
+			})
+			if err := writeState(srv.stateFile, server); err != nil {
+				srv.log.Warn("writing state file failed", "file", srv.stateFile, errAttr(err))
+			}
+		}
+	}
+}
+
+// encodeArguments converts OSC arguments to a form that can be encoded as JSON.
+func encodeArguments(args osc.Arguments) []ArgumentState {
+	states := make([]ArgumentState, len(args))
+	for i, arg := range args {
+		state := ArgumentState{Type: string(arg.Typetag())}
+		switch arg.Typetag() {
+		case osc.TypetagInt:
+			state.Int, _ = arg.ReadInt32()
+		case osc.TypetagFloat:
+			state.Float, _ = arg.ReadFloat32()
+		case osc.TypetagString:
+			state.String, _ = arg.ReadString()
+		case osc.TypetagBlob:
+			state.Blob, _ = arg.ReadBlob()
+		}
+		states[i] = state
+	}
+	return states
+}
+
+// decodeArguments converts the result of encodeArguments back to OSC arguments.
+func decodeArguments(states []ArgumentState) (osc.Arguments, error) {
+	args := make(osc.Arguments, len(states))
+	for i, state := range states {
+		if len(state.Type) != 1 {
+			return nil, errors.Errorf("invalid type tag %q", state.Type)
+		}
+		switch state.Type[0] {
+		case osc.TypetagInt:
+			args[i] = osc.Int(state.Int)
+		case osc.TypetagFloat:
+			args[i] = osc.Float(state.Float)
+		case osc.TypetagString:
+			args[i] = osc.String(state.String)
+		case osc.TypetagBlob:
+			args[i] = osc.Blob(state.Blob)
+		case osc.TypetagTrue:
+			args[i] = osc.Bool(true)
+		case osc.TypetagFalse:
+			args[i] = osc.Bool(false)
+		default:
+			return nil, errors.Errorf("invalid type tag %q", state.Type)
+		}
+	}
+	return args, nil
+}
+
+// sortedKeys returns the keys of a set ordered alphabetically.
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key, ok := range set {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// testSessionState returns the state of a session with something in every field.
+func testSessionState(name string) SessionState {
+	return SessionState{
+		Name:      name,
+		Pulse:     1000,
+		Time:      time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		Tempo:     120,
+		BarOrigin: 960,
+		OriginBar: 10,
+		Meter:     Meter{Beats: 3, Unit: 4},
+		Playing:   true,
+		PlayTime:  20 * time.Second,
+		Slaves: []SlaveState{
+			{Addr: "127.0.0.1:9000", Group: "drums", PPQN: 4, Latency: 5 * time.Millisecond, Timecode: syncosc.TimecodeFrame},
+			{Addr: "127.0.0.1:9001"},
+		},
+		Muted:   []string{"bass"},
+		Stopped: []string{"lights"},
+		Cues: []CueState{
+			{
+				ID:      1,
+				Bar:     12,
+				Beat:    2,
+				Group:   "drums",
+				Address: "/fill",
+				Arguments: []ArgumentState{
+					{Type: "i", Int: 3},
+					{Type: "f", Float: 0.5},
+					{Type: "s", String: "crash"},
+					{Type: "b", Blob: []byte{1, 2}},
+					{Type: "T"},
+				},
+			},
+		},
+		Grooves:      []Groove{{Name: "push", Offsets: []float32{0, 0.5}}},
+		GroupGrooves: map[string]string{"drums": "push"},
+		SlaveGrooves: map[string]string{"127.0.0.1:9001": "push"},
+	}
+}
+
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	// A state file that does not exist yet has no sessions.
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Sessions) != 0 {
+		t.Fatalf("expected no sessions, got %d", len(state.Sessions))
+	}
+	expected := ServerState{Sessions: []SessionState{testSessionState(""), testSessionState("live")}}
+
+	if err := writeState(path, expected); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected\n%+v\ngot\n%+v", expected, got)
+	}
+	// The temporary file is renamed, so it does not stay around.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the state file, got %d files", len(entries))
+	}
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(path); err == nil {
+		t.Fatal("expected an error for an invalid state file")
+	}
+}
+
+func TestArgumentsRoundTrip(t *testing.T) {
+	args := osc.Arguments{
+		osc.Int(-3),
+		osc.Float(1.5),
+		osc.String("fill"),
+		osc.Blob([]byte{0, 1, 2}),
+		osc.Bool(true),
+		osc.Bool(false),
+	}
+	got, err := decodeArguments(encodeArguments(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, got) {
+		t.Fatalf("expected %v, got %v", args, got)
+	}
+	for _, typ := range []string{"", "x", "if"} {
+		if _, err := decodeArguments([]ArgumentState{{Type: typ}}); err == nil {
+			t.Fatalf("expected an error for type tag %q", typ)
+		}
+	}
+}
+
+func TestSessionStateExtrapolate(t *testing.T) {
+	var (
+		state = testSessionState("")
+		pulse = syncosc.GetPulseDuration(state.Tempo)
+	)
+	stopped := state
+	stopped.Playing = false
+
+	for _, testcase := range []struct {
+		name     string
+		state    SessionState
+		now      time.Time
+		pulses   uint64
+		playTime time.Duration
+	}{
+		{name: "playing", state: state, now: state.Time.Add(10*pulse + pulse/2), pulses: 10, playTime: 10 * pulse},
+		{name: "same time", state: state, now: state.Time},
+		{name: "earlier", state: state, now: state.Time.Add(-time.Second)},
+		{name: "stopped", state: stopped, now: state.Time.Add(time.Minute)},
+	} {
+		got := testcase.state.Extrapolate(testcase.now)
+
+		if expected := testcase.state.Pulse + testcase.pulses; expected != got.Pulse {
+			t.Fatalf("%s: expected pulse %d, got %d", testcase.name, expected, got.Pulse)
+		}
+		if expected := testcase.state.Time.Add(time.Duration(testcase.pulses) * pulse); !expected.Equal(got.Time) {
+			t.Fatalf("%s: expected time %s, got %s", testcase.name, expected, got.Time)
+		}
+		if expected := testcase.state.PlayTime + testcase.playTime; expected != got.PlayTime {
+			t.Fatalf("%s: expected play time %s, got %s", testcase.name, expected, got.PlayTime)
+		}
+		if got.Tempo != testcase.state.Tempo || got.BarOrigin != testcase.state.BarOrigin {
+			t.Fatalf("%s: expected only the position to change", testcase.name)
+		}
+	}
+}
+
+func TestSessionStateDiffers(t *testing.T) {
+	var (
+		state = testSessionState("")
+		pulse = syncosc.GetPulseDuration(state.Tempo)
+	)
+	later := state.Extrapolate(state.Time.Add(100 * pulse))
+
+	jitter := later
+	jitter.Pulse++
+
+	drifted := later
+	drifted.Pulse += 2
+
+	tempo := later
+	tempo.Tempo = 140
+
+	muted := later
+	muted.Muted = append(muted.Muted, "keys")
+
+	for _, testcase := range []struct {
+		name     string
+		other    SessionState
+		expected bool
+	}{
+		{name: "same", other: state},
+		{name: "later", other: later},
+		{name: "one pulse off", other: jitter},
+		{name: "drifted", other: drifted, expected: true},
+		{name: "tempo", other: tempo, expected: true},
+		{name: "muted", other: muted, expected: true},
+	} {
+		if got := state.differs(testcase.other); testcase.expected != got {
+			t.Fatalf("%s: expected differs to be %t, got %t", testcase.name, testcase.expected, got)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	saved := testSessionState("live")
+	saved.Time = time.Now()
+
+	if err := writeState(path, ServerState{Sessions: []SessionState{saved}}); err != nil {
+		t.Fatal(err)
+	}
+	srv := runTestServer(t, ServerConfig{tempo: 100, stateFile: path, resume: true})
+
+	// The default session is started even though it is not in the file.
+	if tempo := srv.sessionState(t, "").Tempo; tempo != 100 {
+		t.Fatalf("expected the default session at tempo 100, got %f", tempo)
+	}
+	state := srv.sessionState(t, "live")
+
+	// Without --resume-clock the session continues from the saved position.
+	if state.Pulse < saved.Pulse || state.Pulse > saved.Pulse+24 {
+		t.Fatalf("expected pulse near %d, got %d", saved.Pulse, state.Pulse)
+	}
+	for _, field := range []struct {
+		name          string
+		expected, got interface{}
+	}{
+		{name: "tempo", expected: saved.Tempo, got: state.Tempo},
+		{name: "meter", expected: saved.Meter, got: state.Meter},
+		{name: "bar origin", expected: saved.BarOrigin, got: state.BarOrigin},
+		{name: "muted", expected: saved.Muted, got: state.Muted},
+		{name: "stopped", expected: saved.Stopped, got: state.Stopped},
+		{name: "cues", expected: saved.Cues, got: state.Cues},
+		{name: "grooves", expected: saved.Grooves, got: state.Grooves},
+		{name: "group grooves", expected: saved.GroupGrooves, got: state.GroupGrooves},
+		{name: "slave grooves", expected: saved.SlaveGrooves, got: state.SlaveGrooves},
+	} {
+		if !reflect.DeepEqual(field.expected, field.got) {
+			t.Fatalf("expected %s %v, got %v", field.name, field.expected, field.got)
+		}
+	}
+	if expected, got := len(saved.Slaves), len(state.Slaves); expected != got {
+		t.Fatalf("expected %d slaves, got %d", expected, got)
+	}
+	// The resumed sessions are saved again.
+	waitFor(t, "the state file to be written", func() bool {
+		state, err := loadState(path)
+		return err == nil && len(state.Sessions) == 2
+	})
+}
+
+func TestResumeClock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	saved := testSessionState("")
+	saved.Time = time.Now().Add(-time.Minute)
+
+	if err := writeState(path, ServerState{Sessions: []SessionState{saved}}); err != nil {
+		t.Fatal(err)
+	}
+	srv := runTestServer(t, ServerConfig{tempo: 100, stateFile: path, resume: true, resumeClock: true})
+	state := srv.sessionState(t, "")
+
+	// A minute at 120 bpm is 2880 pulses.
+	expected := saved.Extrapolate(state.Time)
+	if diff := int64(state.Pulse) - int64(expected.Pulse); diff < -8 || diff > 8 {
+		t.Fatalf("expected pulse %d, got %d", expected.Pulse, state.Pulse)
+	}
+}
+
+func TestStateFileNotWritable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The directory of the state file does not exist, so every write fails.
+	path := filepath.Join(t.TempDir(), "missing", "state.json")
+
+	var (
+		srv    = runTestServer(t, ServerConfig{tempo: 120, stateFile: path})
+		client = newTestMaster(ctx, t)
+	)
+	srv.sessionState(t, "")
+
+	addr, err := net.ResolveUDPAddr("udp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.conn.SendTo(addr, osc.Message{
+		Address:   syncosc.AddressTempo,
+		Arguments: osc.Arguments{osc.Float(140)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the tempo change", func() bool {
+		return srv.sessionState(t, "").Tempo == 140
+	})
+	select {
+	case err := <-srv.errs:
+		t.Fatalf("server stopped with %v", err)
+	default:
+	}
+}
+
+func TestStateQueueCoalesces(t *testing.T) {
+	q := newStateQueue()
+
+	for pulse := uint64(0); pulse < 100; pulse++ {
+		state := testSessionState("")
+		state.Pulse = pulse
+		q.put("", &state)
+	}
+	q.put("live", nil)
+
+	<-q.ready
+	pending := q.take()
+
+	if expected, got := 2, len(pending); expected != got {
+		t.Fatalf("expected %d pending states, got %d", expected, got)
+	}
+	if state := pending[""]; state == nil || state.Pulse != 99 {
+		t.Fatalf("expected the last state of the default session, got %+v", state)
+	}
+	if state, ok := pending["live"]; !ok || state != nil {
+		t.Fatalf("expected the removal of session live, got %+v", state)
+	}
+	if len(q.take()) != 0 {
+		t.Fatal("expected the queue to be empty")
+	}
+}
@@ -18,57 +18,64 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/scgolang/osc"
-	"github.com/scgolang/syncosc"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // tempoCmd represents the tempo command
 var tempoCmd = &cobra.Command{
-	Use:   "tempo",
+	Use:   "tempo [bpm] [quantization]",
 	Short: "Change the tempo of an oscsync server.",
-	Long:  `Change the tempo of an oscsync server.`,
-	RunE: func(cmd *cobra.Command, args []string) error {
-		var (
-			flags = cmd.Flags()
-			host  string
-		)
-		flags.StringVar(&host, "h", "127.0.0.1", "hostname of oscsync server")
+	Long: `Change the tempo of an oscsync server.
 
-		if err := flags.Parse(args); err != nil {
+The optional quantization says when the change should happen,
+e.g. "now" (the default), "beat", "bar" or "2 bars".`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindFlags(cmd); err != nil {
 			return err
 		}
-		addr := fmt.Sprintf("%s:%d", host, syncosc.MasterPort)
-
-		if len(flags.Args()) == 0 {
-			return readTempo(addr)
-		}
-		raddr, err := net.ResolveUDPAddr("udp", addr)
+		addr, err := resolveServer(viper.GetString("master"))
 		if err != nil {
 			return err
 		}
-		conn, err := osc.DialUDP("udp", nil, raddr)
+		if len(args) == 0 {
+			return readTempo(addr.String())
+		}
+		conn, err := oscnet.DialUDP("udp", nil, addr.(*net.UDPAddr))
 		if err != nil {
 			return err
 		}
-		tempo, err := strconv.ParseFloat(flags.Args()[0], 32)
+		tempo, err := strconv.ParseFloat(args[0], 32)
 		if err != nil {
 			return err
 		}
+		msgArgs := osc.Arguments{osc.Float(tempo)}
+
+		if len(args) > 1 {
+			q, err := ParseQuantization(strings.Join(args[1:], " "))
+			if err != nil {
+				return err
+			}
+			msgArgs = append(msgArgs, osc.String(q.String()))
+		}
 		return conn.Send(osc.Message{
-			Address: syncosc.AddressTempo,
-			Arguments: osc.Arguments{
-				osc.Float(tempo),
-			},
+			Address:   syncosc.AddressTempo,
+			Arguments: msgArgs,
 		})
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(tempoCmd)
+
+	tempoCmd.Flags().String("master", "127.0.0.1", "host[:port] of the oscsync server")
 }
 
 // readTempo reads the current tempo of an oscsync server.
@@ -77,7 +84,7 @@ func readTempo(addr string) error {
 	if err != nil {
 		return err
 	}
-	conn, err := osc.ListenUDP("udp", laddr)
+	conn, err := oscnet.ListenUDP("udp", laddr)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,277 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// FrameRate is a SMPTE timecode frame rate.
+// The zero FrameRate means no timecode.
+type FrameRate struct {
+	name string
+
+	// FPS is the number of frames in a second of timecode.
+	FPS int64
+
+	// Drop is true for drop-frame timecode, which skips frame numbers
+	// so that the timecode keeps up with a clock that has fewer than FPS frames per second.
+	Drop bool
+
+	// Num/Den is the number of frames in a second of wall-clock time.
+	Num int64
+	Den int64
+}
+
+// The frame rates of SMPTE timecode.
+var (
+	FrameRate24     = FrameRate{name: "24", FPS: 24, Num: 24, Den: 1}
+	FrameRate25     = FrameRate{name: "25", FPS: 25, Num: 25, Den: 1}
+	FrameRate2997DF = FrameRate{name: "29.97df", FPS: 30, Drop: true, Num: 30000, Den: 1001}
+	FrameRate30     = FrameRate{name: "30", FPS: 30, Num: 30, Den: 1}
+)
+
+// FrameRates are the frame rates that ParseFrameRate accepts.
+var FrameRates = []FrameRate{FrameRate24, FrameRate25, FrameRate2997DF, FrameRate30}
+
+// ParseFrameRate parses a frame rate: 24, 25, 29.97df or 30.
+func ParseFrameRate(s string) (FrameRate, error) {
+	names := make([]string, len(FrameRates))
+	for i, r := range FrameRates {
+		if r.name == s {
+			return r, nil
+		}
+		names[i] = r.name
+	}
+	return FrameRate{}, errors.Errorf("invalid frame rate %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// String returns the name of the frame rate, e.g. 29.97df.
+func (r FrameRate) String() string {
+	return r.name
+}
+
+// IsZero returns true for the zero FrameRate.
+func (r FrameRate) IsZero() bool {
+	return r.FPS == 0
+}
+
+// QuarterFrames returns how many quarter frames have passed after d of wall-clock time.
+func (r FrameRate) QuarterFrames(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	// d*4*Num overflows 64 bits after a few days, so it is computed with 128 bits.
+	hi, lo := bits.Mul64(uint64(d), uint64(4*r.Num))
+	q, _ := bits.Div64(hi, lo, uint64(r.Den)*uint64(time.Second))
+	return int64(q)
+}
+
+// Frames returns how many frames have passed after d of wall-clock time.
+func (r FrameRate) Frames(d time.Duration) int64 {
+	return r.QuarterFrames(d) / 4
+}
+
+// QuarterFrameDuration returns the wall-clock duration of a quarter frame, rounded down to the nanosecond.
+func (r FrameRate) QuarterFrameDuration() time.Duration {
+	return time.Duration(r.Den * int64(time.Second) / (4 * r.Num))
+}
+
+// dropPerMinute returns how many frame numbers are skipped at the start of every minute
+// that is not a multiple of ten, which is 2 for 29.97df.
+func (r FrameRate) dropPerMinute() int64 {
+	if !r.Drop {
+		return 0
+	}
+	return r.FPS / 15
+}
+
+// FramesPerDay returns the number of frames from 00:00:00:00 until the timecode wraps around after 24 hours.
+func (r FrameRate) FramesPerDay() int64 {
+	return 24*60*60*r.FPS - (24*60-24*6)*r.dropPerMinute()
+}
+
+// Timecode returns the timecode of a frame counted from 00:00:00:00.
+// Timecode wraps around after 24 hours.
+func (r FrameRate) Timecode(frame int64) Timecode {
+	frame %= r.FramesPerDay()
+	if frame < 0 {
+		frame += r.FramesPerDay()
+	}
+	if d := r.dropPerMinute(); d > 0 {
+		var (
+			perMinute    = r.FPS*60 - d
+			perTenMinute = r.FPS*600 - 9*d
+			tens         = frame / perTenMinute
+			rem          = frame % perTenMinute
+		)
+		// Add back the frame numbers that were skipped in the whole ten minutes before the frame
+		// and in the minutes of the current ten minutes, whose first minute skips none.
+		frame += 9 * d * tens
+		if rem > d {
+			frame += d * ((rem - d) / perMinute)
+		}
+	}
+	return Timecode{
+		Hours:   int(frame / (r.FPS * 3600)),
+		Minutes: int(frame / (r.FPS * 60) % 60),
+		Seconds: int(frame / r.FPS % 60),
+		Frames:  int(frame % r.FPS),
+		Drop:    r.Drop,
+	}
+}
+
+// Frame returns the frame of a timecode counted from 00:00:00:00.
+// It returns an error if the timecode does not exist at the frame rate,
+// such as the frame numbers that drop-frame timecode skips.
+func (r FrameRate) Frame(tc Timecode) (int64, error) {
+	if tc.Hours < 0 || tc.Hours > 23 || tc.Minutes < 0 || tc.Minutes > 59 || tc.Seconds < 0 || tc.Seconds > 59 {
+		return 0, errors.Errorf("invalid timecode %s", tc)
+	}
+	if tc.Frames < 0 || int64(tc.Frames) >= r.FPS {
+		return 0, errors.Errorf("invalid timecode %s, frames must be less than %d", tc, r.FPS)
+	}
+	var (
+		minutes = int64(tc.Hours)*60 + int64(tc.Minutes)
+		frame   = (minutes*60+int64(tc.Seconds))*r.FPS + int64(tc.Frames)
+	)
+	if d := r.dropPerMinute(); d > 0 {
+		if tc.Seconds == 0 && tc.Minutes%10 != 0 && int64(tc.Frames) < d {
+			return 0, errors.Errorf("timecode %s is dropped at %s fps", tc, r)
+		}
+		frame -= d * (minutes - minutes/10)
+	}
+	return frame, nil
+}
+
+// Timecode is a SMPTE timecode.
+// Drop is true for drop-frame timecode, which is written with a semicolon before the frames.
+type Timecode struct {
+	Hours   int
+	Minutes int
+	Seconds int
+	Frames  int
+	Drop    bool
+}
+
+// ParseTimecode parses a timecode written as hh:mm:ss:ff, or hh:mm:ss;ff for drop-frame timecode.
+func ParseTimecode(s string) (Timecode, error) {
+	var (
+		tc  Timecode
+		sep rune
+	)
+	if _, err := fmt.Sscanf(s, "%2d:%2d:%2d%c%2d", &tc.Hours, &tc.Minutes, &tc.Seconds, &sep, &tc.Frames); err != nil {
+		return Timecode{}, errors.Errorf("invalid timecode %q, expected hh:mm:ss:ff", s)
+	}
+	if sep != ':' && sep != ';' {
+		return Timecode{}, errors.Errorf("invalid timecode %q, expected hh:mm:ss:ff", s)
+	}
+	tc.Drop = sep == ';'
+	return tc, nil
+}
+
+// String returns the timecode as hh:mm:ss:ff, or hh:mm:ss;ff for drop-frame timecode.
+func (tc Timecode) String() string {
+	sep := ':'
+	if tc.Drop {
+		sep = ';'
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%c%02d", tc.Hours, tc.Minutes, tc.Seconds, sep, tc.Frames)
+}
+
+// validateTimecodeRate returns an error if a slave can not subscribe to timecode at a rate.
+// The empty rate means no timecode.
+func validateTimecodeRate(rate string) error {
+	switch rate {
+	case "", syncosc.TimecodeFrame, syncosc.TimecodeQuarterFrame:
+		return nil
+	}
+	return errors.Errorf("invalid timecode rate %q, expected %s or %s", rate, syncosc.TimecodeFrame, syncosc.TimecodeQuarterFrame)
+}
+
+// playTime returns for how long the transport has played since it started.
+// The time it was stopped is left out.
+func (sess *Session) playTime(now time.Time) time.Duration {
+	if !sess.playing {
+		return sess.played
+	}
+	return sess.played + now.Sub(sess.playingSince)
+}
+
+// restartPlayTime restarts the play time at 0 when the transport starts.
+func (sess *Session) restartPlayTime() {
+	sess.played = 0
+	sess.playingSince = time.Now()
+	sess.lastQuarterFrame = -1
+}
+
+// continuePlayTime continues the play time when the transport continues.
+// It must be called before the session is playing.
+func (sess *Session) continuePlayTime() {
+	if !sess.playing {
+		sess.playingSince = time.Now()
+	}
+}
+
+// pausePlayTime stops the play time when the transport stops.
+// It must be called before the session stops playing.
+func (sess *Session) pausePlayTime() {
+	if sess.playing {
+		sess.played += time.Since(sess.playingSince)
+	}
+}
+
+// sendTimecode sends the timecode of the play time to the slaves that subscribed to it
+// if a new quarter frame has started.
+// Frame slaves only receive the first quarter frame of every frame they are sent.
+func (sess *Session) sendTimecode(now time.Time) {
+	if !sess.playing {
+		return
+	}
+	q := sess.timecode.QuarterFrames(sess.playTime(now))
+	if q == sess.lastQuarterFrame {
+		return
+	}
+	newFrame := sess.lastQuarterFrame < 0 || q/4 != sess.lastQuarterFrame/4
+	sess.lastQuarterFrame = q
+
+	var (
+		address = sess.address(syncosc.AddressTimecode)
+		tc      = osc.String(sess.timecode.Timecode(q / 4).String())
+	)
+	for _, s := range sess.slaves {
+		if !sess.receivesPulses(s) {
+			continue
+		}
+		var m osc.Message
+
+		switch {
+		case s.timecode == syncosc.TimecodeQuarterFrame:
+			m = osc.Message{Address: address, Arguments: osc.Arguments{tc, osc.Int(int32(q % 4))}}
+		case s.timecode == syncosc.TimecodeFrame && newFrame:
+			m = osc.Message{Address: address, Arguments: osc.Arguments{tc}}
+		default:
+			continue
+		}
+		sess.send(s, m)
+	}
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameRateTimecodeDropFrame(t *testing.T) {
+	for i, testcase := range []struct {
+		frame    int64
+		timecode string
+	}{
+		{frame: 0, timecode: "00:00:00;00"},
+		{frame: 29, timecode: "00:00:00;29"},
+		{frame: 30, timecode: "00:00:01;00"},
+		{frame: 1799, timecode: "00:00:59;29"},
+		{frame: 1800, timecode: "00:01:00;02"},
+		{frame: 1801, timecode: "00:01:00;03"},
+		{frame: 3597, timecode: "00:01:59;29"},
+		{frame: 3598, timecode: "00:02:00;02"},
+		{frame: 16183, timecode: "00:08:59;29"},
+		{frame: 16184, timecode: "00:09:00;02"},
+		{frame: 17981, timecode: "00:09:59;29"},
+		{frame: 17982, timecode: "00:10:00;00"},
+		{frame: 17983, timecode: "00:10:00;01"},
+		{frame: 19781, timecode: "00:10:59;29"},
+		{frame: 19782, timecode: "00:11:00;02"},
+		{frame: 107891, timecode: "00:59:59;29"},
+		{frame: 107892, timecode: "01:00:00;00"},
+		{frame: 109692, timecode: "01:01:00;02"},
+		{frame: 2589407, timecode: "23:59:59;29"},
+		{frame: 2589408, timecode: "00:00:00;00"},
+		{frame: -1, timecode: "23:59:59;29"},
+	} {
+		tc := FrameRate2997DF.Timecode(testcase.frame)
+
+		if expected, got := testcase.timecode, tc.String(); expected != got {
+			t.Fatalf("(test case %d) expected %s for frame %d, got %s", i, expected, testcase.frame, got)
+		}
+		frame, err := FrameRate2997DF.Frame(tc)
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if expected, got := (testcase.frame%2589408+2589408)%2589408, frame; expected != got {
+			t.Fatalf("(test case %d) expected frame %d for %s, got %d", i, expected, tc, got)
+		}
+	}
+}
+
+func TestFrameRateTimecodeNonDropFrame(t *testing.T) {
+	for i, testcase := range []struct {
+		rate     FrameRate
+		frame    int64
+		timecode string
+	}{
+		{rate: FrameRate24, frame: 23, timecode: "00:00:00:23"},
+		{rate: FrameRate24, frame: 24, timecode: "00:00:01:00"},
+		{rate: FrameRate24, frame: 86399, timecode: "00:59:59:23"},
+		{rate: FrameRate25, frame: 1500, timecode: "00:01:00:00"},
+		{rate: FrameRate25, frame: 90000, timecode: "01:00:00:00"},
+		{rate: FrameRate30, frame: 1800, timecode: "00:01:00:00"},
+		{rate: FrameRate30, frame: 2591999, timecode: "23:59:59:29"},
+		{rate: FrameRate30, frame: 2592000, timecode: "00:00:00:00"},
+	} {
+		if expected, got := testcase.timecode, testcase.rate.Timecode(testcase.frame).String(); expected != got {
+			t.Fatalf("(test case %d) expected %s for frame %d at %s fps, got %s", i, expected, testcase.frame, testcase.rate, got)
+		}
+	}
+}
+
+// TestFrameRateTimecodeDay checks every frame of a day:
+// timecodes count up without gaps except for the dropped frame numbers,
+// and converting them back gives the frame.
+func TestFrameRateTimecodeDay(t *testing.T) {
+	for _, rate := range FrameRates {
+		prev := rate.Timecode(-1)
+
+		for frame := int64(0); frame < rate.FramesPerDay(); frame++ {
+			tc := rate.Timecode(frame)
+
+			if expected := nextTimecode(rate, prev); expected != tc {
+				t.Fatalf("expected %s after %s at %s fps, got %s", expected, prev, rate, tc)
+			}
+			got, err := rate.Frame(tc)
+			if err != nil {
+				t.Fatalf("%s fps: %s", rate, err)
+			}
+			if frame != got {
+				t.Fatalf("expected frame %d for %s at %s fps, got %d", frame, tc, rate, got)
+			}
+			prev = tc
+		}
+	}
+}
+
+// nextTimecode counts up a timecode by one frame number, skipping the frame numbers
+// that drop-frame timecode drops, without any of the arithmetic of FrameRate.
+func nextTimecode(rate FrameRate, tc Timecode) Timecode {
+	for {
+		tc.Frames++
+		if int64(tc.Frames) == rate.FPS {
+			tc.Frames, tc.Seconds = 0, tc.Seconds+1
+		}
+		if tc.Seconds == 60 {
+			tc.Seconds, tc.Minutes = 0, tc.Minutes+1
+		}
+		if tc.Minutes == 60 {
+			tc.Minutes, tc.Hours = 0, tc.Hours+1
+		}
+		if tc.Hours == 24 {
+			tc.Hours = 0
+		}
+		if !rate.Drop || tc.Seconds != 0 || tc.Minutes%10 == 0 || tc.Frames >= 2 {
+			return tc
+		}
+	}
+}
+
+func TestFrameRateFrameInvalid(t *testing.T) {
+	for i, testcase := range []struct {
+		rate     FrameRate
+		timecode Timecode
+		valid    bool
+	}{
+		{rate: FrameRate2997DF, timecode: Timecode{Minutes: 1}},
+		{rate: FrameRate2997DF, timecode: Timecode{Minutes: 1, Frames: 1}},
+		{rate: FrameRate2997DF, timecode: Timecode{Minutes: 1, Frames: 2}, valid: true},
+		{rate: FrameRate2997DF, timecode: Timecode{Hours: 5, Minutes: 59, Frames: 1}},
+		{rate: FrameRate2997DF, timecode: Timecode{Minutes: 10}, valid: true},
+		{rate: FrameRate2997DF, timecode: Timecode{Minutes: 10, Frames: 1}, valid: true},
+		{rate: FrameRate2997DF, timecode: Timecode{Minutes: 1, Seconds: 1}, valid: true},
+		{rate: FrameRate30, timecode: Timecode{Minutes: 1}, valid: true},
+		{rate: FrameRate25, timecode: Timecode{Frames: 24}, valid: true},
+		{rate: FrameRate25, timecode: Timecode{Frames: 25}},
+		{rate: FrameRate24, timecode: Timecode{Frames: 24}},
+		{rate: FrameRate30, timecode: Timecode{Hours: 24}},
+		{rate: FrameRate30, timecode: Timecode{Minutes: 60}},
+		{rate: FrameRate30, timecode: Timecode{Seconds: -1}},
+	} {
+		_, err := testcase.rate.Frame(testcase.timecode)
+		if testcase.valid && err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Fatalf("(test case %d) expected %s to be invalid at %s fps", i, testcase.timecode, testcase.rate)
+		}
+	}
+}
+
+func TestFrameRateFrames(t *testing.T) {
+	for i, testcase := range []struct {
+		rate     FrameRate
+		d        time.Duration
+		frames   int64
+		quarters int64
+		timecode string
+	}{
+		{rate: FrameRate25, d: 0, frames: 0, quarters: 0, timecode: "00:00:00:00"},
+		{rate: FrameRate25, d: -time.Second, frames: 0, quarters: 0, timecode: "00:00:00:00"},
+		{rate: FrameRate25, d: 10*time.Millisecond - 1, frames: 0, quarters: 0, timecode: "00:00:00:00"},
+		{rate: FrameRate25, d: 10 * time.Millisecond, frames: 0, quarters: 1, timecode: "00:00:00:00"},
+		{rate: FrameRate25, d: 40 * time.Millisecond, frames: 1, quarters: 4, timecode: "00:00:00:01"},
+		{rate: FrameRate24, d: time.Minute, frames: 1440, quarters: 5760, timecode: "00:01:00:00"},
+		{rate: FrameRate30, d: time.Hour, frames: 108000, quarters: 432000, timecode: "01:00:00:00"},
+		// 29.97 fps plays 30000 frames in 1001 seconds.
+		{rate: FrameRate2997DF, d: 1001 * time.Second, frames: 30000, quarters: 120000, timecode: "00:16:41;00"},
+		// Drop-frame timecode keeps up with the clock.
+		{rate: FrameRate2997DF, d: time.Hour, frames: 107892, quarters: 431568, timecode: "01:00:00;00"},
+		{rate: FrameRate2997DF, d: 10 * time.Minute, frames: 17982, quarters: 71928, timecode: "00:10:00;00"},
+		// Long durations do not overflow.
+		{rate: FrameRate30, d: 30 * 24 * time.Hour, frames: 77760000, quarters: 311040000, timecode: "00:00:00:00"},
+	} {
+		if expected, got := testcase.frames, testcase.rate.Frames(testcase.d); expected != got {
+			t.Fatalf("(test case %d) expected %d frames, got %d", i, expected, got)
+		}
+		if expected, got := testcase.quarters, testcase.rate.QuarterFrames(testcase.d); expected != got {
+			t.Fatalf("(test case %d) expected %d quarter frames, got %d", i, expected, got)
+		}
+		if expected, got := testcase.timecode, testcase.rate.Timecode(testcase.frames).String(); expected != got {
+			t.Fatalf("(test case %d) expected %s, got %s", i, expected, got)
+		}
+	}
+}
+
+func TestParseTimecode(t *testing.T) {
+	for i, testcase := range []struct {
+		input  string
+		output Timecode
+		err    bool
+	}{
+		{input: "01:02:03:04", output: Timecode{Hours: 1, Minutes: 2, Seconds: 3, Frames: 4}},
+		{input: "00:10:00;00", output: Timecode{Minutes: 10, Drop: true}},
+		{input: "23:59:59;29", output: Timecode{Hours: 23, Minutes: 59, Seconds: 59, Frames: 29, Drop: true}},
+		{input: "00:10:00.00", err: true},
+		{input: "00:10:00", err: true},
+		{input: "timecode", err: true},
+	} {
+		tc, err := ParseTimecode(testcase.input)
+		if testcase.err {
+			if err == nil {
+				t.Fatalf("(test case %d) expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if expected, got := testcase.output, tc; expected != got {
+			t.Fatalf("(test case %d) expected %+v, got %+v", i, expected, got)
+		}
+		if expected, got := testcase.input, tc.String(); expected != got {
+			t.Fatalf("(test case %d) expected %s, got %s", i, expected, got)
+		}
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	for _, rate := range FrameRates {
+		got, err := ParseFrameRate(rate.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := rate; expected != got {
+			t.Fatalf("expected %+v, got %+v", expected, got)
+		}
+	}
+	if _, err := ParseFrameRate("29.97"); err == nil {
+		t.Fatal("expected an error for 29.97 without df")
+	}
+}
+
+func TestPlayTimeRestored(t *testing.T) {
+	sess := NewSession("", nil, 120)
+	sess.played = 90 * time.Second
+	sess.playingSince = time.Now().Add(-10 * time.Second)
+
+	state := sess.snapshot()
+	if state.PlayTime < 100*time.Second || state.PlayTime > 101*time.Second {
+		t.Fatalf("expected a play time of 100s, got %s", state.PlayTime)
+	}
+	later := state.Extrapolate(state.Time.Add(2 * time.Second))
+	if expected, got := later.Time.Sub(state.Time), later.PlayTime-state.PlayTime; expected != got {
+		t.Fatalf("expected the play time to advance by %s, got %s", expected, got)
+	}
+	restored := NewSession("", nil, 120)
+	if err := restored.restore(later); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := later.PlayTime, restored.playTime(restored.playingSince); expected != got {
+		t.Fatalf("expected play time %s, got %s", expected, got)
+	}
+
+	// The play time stands still while the transport is stopped.
+	later.Playing = false
+	if expected, got := later.PlayTime, later.Extrapolate(later.Time.Add(time.Minute)).PlayTime; expected != got {
+		t.Fatalf("expected play time %s, got %s", expected, got)
+	}
+}
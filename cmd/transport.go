@@ -0,0 +1,104 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+// HandleTransport handles transport (start, stop, continue) updates.
+// The optional third argument is a group. If it is provided only that group
+// is started or stopped, and the master keeps running for the other slaves.
+func (sess *Session) HandleTransport(m osc.Message) error {
+	if len(m.Arguments) == 0 {
+		state, err := sess.query()
+		if err != nil {
+			return err
+		}
+		transport := syncosc.TransportStop
+		if state.Playing {
+			transport = syncosc.TransportStart
+		}
+		return sess.conn.SendTo(m.Sender, osc.Message{
+			Address: "/reply",
+			Arguments: osc.Arguments{
+				osc.String(sess.address(syncosc.AddressTransport)),
+				osc.String(transport),
+			},
+		})
+	}
+	state, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return errors.Wrap(err, "reading transport state")
+	}
+	group, err := readGroup(m, 2)
+	if err != nil {
+		return err
+	}
+	var apply func(sess *Session) error
+
+	switch {
+	case group != "" && (state == syncosc.TransportStart || state == syncosc.TransportContinue):
+		apply = func(sess *Session) error {
+			delete(sess.stopped, group)
+			return nil
+		}
+	case group != "" && state == syncosc.TransportStop:
+		apply = func(sess *Session) error {
+			sess.stopped[group] = true
+			return nil
+		}
+	case state == syncosc.TransportStart:
+		apply = func(sess *Session) error {
+			sess.pulse = 0
+			sess.barOrigin = 0
+			sess.originBar = 0
+			sess.restartPlayTime()
+			sess.playing = true
+			sess.resetClock()
+			return nil
+		}
+	case state == syncosc.TransportContinue:
+		apply = func(sess *Session) error {
+			sess.continuePlayTime()
+			sess.playing = true
+			sess.resetClock()
+			return nil
+		}
+	case state == syncosc.TransportStop:
+		apply = func(sess *Session) error {
+			sess.pausePlayTime()
+			sess.playing = false
+			return nil
+		}
+	default:
+		return errors.Errorf("invalid transport state %q", state)
+	}
+	q, err := readQuantization(m, 1)
+	if err != nil {
+		return err
+	}
+	return sess.submit(change{
+		quantize: q,
+		group:    group,
+		msg: osc.Message{
+			Address:   sess.address(syncosc.AddressTransport),
+			Arguments: osc.Arguments{osc.String(state)},
+		},
+		apply: apply,
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// wavWriter writes a mono 16-bit PCM WAV file.
+// The number of samples is written in the header, so it has to be known up front.
+type wavWriter struct {
+	w       *bufio.Writer
+	samples int64
+	written int64
+}
+
+// newWAVWriter writes the header of a WAV file with the given sample rate and number of samples.
+func newWAVWriter(w io.Writer, sampleRate int, samples int64) (*wavWriter, error) {
+	const (
+		channels      = 1
+		bitsPerSample = 16
+		blockAlign    = channels * bitsPerSample / 8
+	)
+	if sampleRate <= 0 {
+		return nil, errors.Errorf("invalid sample rate %d", sampleRate)
+	}
+	size := samples * blockAlign
+	if samples < 0 || size > math.MaxUint32-36 {
+		return nil, errors.Errorf("a WAV file can not hold %d samples", samples)
+	}
+	bw := bufio.NewWriter(w)
+
+	for _, v := range []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'},
+		uint32(36 + size),
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		uint32(16),
+		uint16(1), // PCM
+		uint16(channels),
+		uint32(sampleRate),
+		uint32(sampleRate * blockAlign),
+		uint16(blockAlign),
+		uint16(bitsPerSample),
+		[4]byte{'d', 'a', 't', 'a'},
+		uint32(size),
+	} {
+		if err := binary.Write(bw, binary.LittleEndian, v); err != nil {
+			return nil, errors.Wrap(err, "writing WAV header")
+		}
+	}
+	return &wavWriter{w: bw, samples: samples}, nil
+}
+
+// Write writes a sample between -1 and 1. Samples outside of that are clipped.
+func (w *wavWriter) Write(sample float64) error {
+	if w.written == w.samples {
+		return errors.Errorf("WAV file already has %d samples", w.samples)
+	}
+	sample = math.Max(-1, math.Min(1, sample))
+
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], uint16(int16(math.Round(sample*math.MaxInt16))))
+	if _, err := w.w.Write(b[:]); err != nil {
+		return errors.Wrap(err, "writing WAV sample")
+	}
+	w.written++
+	return nil
+}
+
+// Close flushes the WAV file.
+// It returns an error if fewer samples were written than the header says.
+func (w *wavWriter) Close() error {
+	if w.written != w.samples {
+		return errors.Errorf("wrote %d of %d WAV samples", w.written, w.samples)
+	}
+	return errors.Wrap(w.w.Flush(), "flushing WAV file")
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// readTestWAV reads back a mono 16-bit PCM WAV file written by wavWriter.
+func readTestWAV(t *testing.T, data []byte) (int, []int16) {
+	t.Helper()
+
+	var header struct {
+		Riff          [4]byte
+		Size          uint32
+		Wave          [4]byte
+		Fmt           [4]byte
+		FmtSize       uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Data          [4]byte
+		DataSize      uint32
+	}
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if string(header.Riff[:]) != "RIFF" || string(header.Wave[:]) != "WAVE" || string(header.Fmt[:]) != "fmt " || string(header.Data[:]) != "data" {
+		t.Fatalf("invalid header %+v", header)
+	}
+	if header.Format != 1 || header.Channels != 1 || header.BitsPerSample != 16 || header.BlockAlign != 2 {
+		t.Fatalf("expected mono 16-bit PCM, got %+v", header)
+	}
+	if expected, got := header.SampleRate*2, header.ByteRate; expected != got {
+		t.Fatalf("expected byte rate %d, got %d", expected, got)
+	}
+	if expected, got := uint32(len(data)-8), header.Size; expected != got {
+		t.Fatalf("expected RIFF size %d, got %d", expected, got)
+	}
+	if expected, got := uint32(r.Len()), header.DataSize; expected != got {
+		t.Fatalf("expected data size %d, got %d", expected, got)
+	}
+	samples := make([]int16, header.DataSize/2)
+	if err := binary.Read(r, binary.LittleEndian, samples); err != nil {
+		t.Fatal(err)
+	}
+	return int(header.SampleRate), samples
+}
+
+func TestWAVWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := newWAVWriter(&buf, 44100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range []float64{0, 1, -1, 0.5, 2} {
+		if err := w.Write(sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write(0); err == nil {
+		t.Fatal("expected an error for too many samples")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sampleRate, samples := readTestWAV(t, buf.Bytes())
+
+	if expected, got := 44100, sampleRate; expected != got {
+		t.Fatalf("expected sample rate %d, got %d", expected, got)
+	}
+	if expected, got := []int16{0, math.MaxInt16, -math.MaxInt16, 16384, math.MaxInt16}, samples; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestWAVWriterShort(t *testing.T) {
+	w, err := newWAVWriter(&bytes.Buffer{}, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("expected an error for too few samples")
+	}
+	if _, err := newWAVWriter(&bytes.Buffer{}, 0, 2); err == nil {
+		t.Fatal("expected an error for sample rate 0")
+	}
+}
@@ -0,0 +1,521 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dnssd advertises and discovers oscsync masters with
+// DNS service discovery over multicast DNS (RFC 6762 and RFC 6763).
+//
+// Only what oscsync needs is implemented: a responder that answers
+// questions about one service and a browser that asks for every master.
+// Both also work with a unicast address, which allows them to be tested
+// on the loopback interface.
+package dnssd
+
+import (
+	"context"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MulticastAddr is the address of the mDNS group.
+	MulticastAddr = "224.0.0.251:5353"
+
+	// ServiceType is the DNS-SD service type of oscsync masters.
+	ServiceType = "_oscsync._udp"
+
+	// Domain is the domain that mDNS names belong to.
+	Domain = "local."
+
+	// TTL is the time to live of the records the responder sends, in seconds.
+	TTL = 120
+)
+
+// servicesName is the name that lists every service type on the network.
+const servicesName = "_services._dns-sd._udp." + Domain
+
+// maxPacketSize is the largest mDNS packet we read.
+const maxPacketSize = 9000
+
+// Service is an oscsync master advertised with DNS-SD.
+type Service struct {
+	// Instance is the name of the master, e.g. "studio".
+	Instance string
+
+	// Host is the fully qualified host name of the master, e.g. "studio-mac.local."
+	Host string
+
+	// Port is the port the master listens on.
+	Port int
+
+	// IPs are the IPv4 addresses of the host.
+	IPs []net.IP
+}
+
+// Addr returns the host:port address of the master.
+// The first IP is used if there is one, otherwise the host name.
+func (svc Service) Addr() string {
+	host := strings.TrimSuffix(svc.Host, ".")
+	if len(svc.IPs) > 0 {
+		host = svc.IPs[0].String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(svc.Port))
+}
+
+// serviceName returns the name that lists the instances of the service type.
+func serviceName() string {
+	return ServiceType + "." + Domain
+}
+
+// instanceName returns the full name of a service instance.
+func instanceName(instance string) string {
+	return instance + "." + serviceName()
+}
+
+// Responder answers mDNS questions about a service.
+type Responder struct {
+	conn      *net.UDPConn
+	group     *net.UDPAddr
+	svc       Service
+	multicast bool
+}
+
+// NewResponder creates a responder for a service that listens on addr.
+// If addr is a multicast address the responder joins the group,
+// otherwise it answers unicast questions on addr, which is what tests use.
+// The empty addr means MulticastAddr.
+// If the service has no host its host name is the local host name in the .local domain,
+// and if it has no IPs the IPv4 addresses of the network interfaces are used.
+func NewResponder(addr string, svc Service) (*Responder, error) {
+	if addr == "" {
+		addr = MulticastAddr
+	}
+	if svc.Instance == "" || strings.Contains(svc.Instance, ".") {
+		return nil, errors.Errorf("invalid instance name %q", svc.Instance)
+	}
+	if svc.Port <= 0 || svc.Port > 65535 {
+		return nil, errors.Errorf("invalid port %d", svc.Port)
+	}
+	if svc.Host == "" {
+		host, err := localHost()
+		if err != nil {
+			return nil, err
+		}
+		svc.Host = host
+	}
+	if !strings.HasSuffix(svc.Host, ".") {
+		svc.Host += "."
+	}
+	if len(svc.IPs) == 0 {
+		ips, err := localIPs()
+		if err != nil {
+			return nil, err
+		}
+		svc.IPs = ips
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", addr)
+	}
+	r := &Responder{group: udpAddr, svc: svc, multicast: udpAddr.IP.IsMulticast()}
+
+	if r.multicast {
+		r.conn, err = net.ListenMulticastUDP("udp4", nil, udpAddr)
+	} else {
+		r.conn, err = net.ListenUDP("udp4", udpAddr)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "listening on %s", addr)
+	}
+	return r, nil
+}
+
+// LocalAddr returns the address the responder listens on.
+func (r *Responder) LocalAddr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Close closes the responder.
+func (r *Responder) Close() error {
+	return r.conn.Close()
+}
+
+// Serve answers questions until the context is done or the responder is closed.
+func (r *Responder) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		_ = r.conn.Close()
+	}()
+	buf := make([]byte, maxPacketSize)
+
+	for {
+		n, sender, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "reading mDNS packet")
+		}
+		// Malformed packets and packets that we have no answer for are ignored.
+		reply, unicast, ok := r.answer(buf[:n])
+		if !ok {
+			continue
+		}
+		// Legacy unicast queries come from a port other than 5353
+		// and are answered directly (RFC 6762 section 6.7).
+		to := r.group
+		if unicast || !r.multicast || sender.Port != r.group.Port {
+			to = sender
+		}
+		data, err := reply.Pack()
+		if err != nil {
+			return errors.Wrap(err, "packing mDNS reply")
+		}
+		if _, err := r.conn.WriteToUDP(data, to); err != nil {
+			return errors.Wrapf(err, "sending mDNS reply to %s", to)
+		}
+	}
+}
+
+// answer returns the reply to a query.
+// unicast is true if one of the questions asked for a unicast response.
+// ok is false if the packet is not a query that the responder can answer.
+func (r *Responder) answer(packet []byte) (reply dnsmessage.Message, unicast, ok bool) {
+	var p dnsmessage.Parser
+
+	hdr, err := p.Start(packet)
+	if err != nil || hdr.Response || hdr.OpCode != 0 {
+		return reply, false, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return reply, false, false
+	}
+	var (
+		records = r.records()
+		answers = map[int]bool{}
+	)
+	for _, q := range questions {
+		matched := false
+		for i, rec := range records {
+			h := rec.Header()
+			if !strings.EqualFold(h.Name, q.Name) || (q.Type != h.Type && q.Type != dnsmessage.TypeALL) {
+				continue
+			}
+			answers[i], matched = true, true
+		}
+		// The top bit of the class asks for a unicast response.
+		if matched && q.Class&(1<<15) != 0 {
+			unicast = true
+		}
+	}
+	if len(answers) == 0 {
+		return reply, false, false
+	}
+	reply.Header = dnsmessage.Header{ID: hdr.ID, Response: true, Authoritative: true}
+
+	// Legacy unicast replies repeat the questions.
+	reply.Questions = questions
+	for i, rec := range records {
+		if answers[i] {
+			reply.Answers = append(reply.Answers, rec)
+		} else if i > 0 {
+			// Everything but the service type enumeration is useful to a browser.
+			reply.Additionals = append(reply.Additionals, rec)
+		}
+	}
+	return reply, unicast, true
+}
+
+// records returns every record the responder knows about.
+// The first record enumerates the service type.
+func (r *Responder) records() []dnsmessage.Resource {
+	var (
+		svc      = serviceName()
+		instance = instanceName(r.svc.Instance)
+	)
+	records := []dnsmessage.Resource{
+		&dnsmessage.PTRResource{
+			ResourceHeader: header(servicesName, dnsmessage.TypePTR),
+			PTR:            svc,
+		},
+		&dnsmessage.PTRResource{
+			ResourceHeader: header(svc, dnsmessage.TypePTR),
+			PTR:            instance,
+		},
+		&dnsmessage.SRVResource{
+			ResourceHeader: header(instance, dnsmessage.TypeSRV),
+			Port:           uint16(r.svc.Port),
+			Target:         r.svc.Host,
+		},
+		&dnsmessage.TXTResource{
+			ResourceHeader: header(instance, dnsmessage.TypeTXT),
+			Txt:            "txtvers=1",
+		},
+	}
+	for _, ip := range r.svc.IPs {
+		a := &dnsmessage.AResource{ResourceHeader: header(r.svc.Host, dnsmessage.TypeA)}
+		copy(a.A[:], ip.To4())
+		records = append(records, a)
+	}
+	return records
+}
+
+// header returns the header of a record that the responder sends.
+func header(name string, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: TTL}
+}
+
+// Browse asks for oscsync masters at addr and collects the answers until the context is done.
+// The question is repeated every second.
+// The empty addr means MulticastAddr.
+// Services are returned ordered by instance name.
+func Browse(ctx context.Context, addr string) ([]Service, error) {
+	if addr == "" {
+		addr = MulticastAddr
+	}
+	to, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", addr)
+	}
+	// Listening on a random port makes this a legacy unicast query,
+	// so the answers are sent straight to us.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, errors.Wrap(err, "listening for mDNS replies")
+	}
+	defer func() { _ = conn.Close() }()
+
+	query, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			{Name: serviceName(), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "packing mDNS query")
+	}
+	var (
+		b       = newBrowser()
+		packets = make(chan []byte)
+		errs    = make(chan error, 1)
+	)
+	go func() {
+		for {
+			buf := make([]byte, maxPacketSize)
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case packets <- buf[:n]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		if _, err := conn.WriteToUDP(query, to); err != nil {
+			return nil, errors.Wrapf(err, "sending mDNS query to %s", to)
+		}
+	Receive:
+		for {
+			select {
+			case <-ctx.Done():
+				return b.services(), nil
+			case err := <-errs:
+				return nil, errors.Wrap(err, "reading mDNS reply")
+			case packet := <-packets:
+				b.add(packet)
+			case <-ticker.C:
+				break Receive
+			}
+		}
+	}
+}
+
+// browser collects the records of oscsync masters.
+type browser struct {
+	instances map[string]bool
+	srv       map[string]*dnsmessage.SRVResource
+	ips       map[string][]net.IP
+}
+
+// newBrowser creates a browser that has not seen any records.
+func newBrowser() *browser {
+	return &browser{
+		instances: map[string]bool{},
+		srv:       map[string]*dnsmessage.SRVResource{},
+		ips:       map[string][]net.IP{},
+	}
+}
+
+// add adds the records of a reply.
+// Records of types that are not used are skipped, and malformed replies are ignored.
+func (b *browser) add(packet []byte) {
+	var p dnsmessage.Parser
+
+	hdr, err := p.Start(packet)
+	if err != nil || !hdr.Response {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for sec := 0; sec < 3; sec++ {
+		for {
+			var (
+				h   dnsmessage.ResourceHeader
+				res dnsmessage.Resource
+				err error
+			)
+			switch sec {
+			case 0:
+				h, err = p.AnswerHeader()
+			case 1:
+				h, err = p.AuthorityHeader()
+			case 2:
+				h, err = p.AdditionalHeader()
+			}
+			if err == dnsmessage.ErrSectionDone {
+				break
+			}
+			if err != nil {
+				return
+			}
+			switch h.Type {
+			case dnsmessage.TypePTR, dnsmessage.TypeSRV, dnsmessage.TypeA:
+				switch sec {
+				case 0:
+					res, err = p.Answer()
+				case 1:
+					res, err = p.Authority()
+				case 2:
+					res, err = p.Additional()
+				}
+			default:
+				switch sec {
+				case 0:
+					err = p.SkipAnswer()
+				case 1:
+					err = p.SkipAuthority()
+				case 2:
+					err = p.SkipAdditional()
+				}
+			}
+			if err != nil {
+				return
+			}
+			if res != nil {
+				b.record(res)
+			}
+		}
+	}
+}
+
+// record adds a record.
+func (b *browser) record(res dnsmessage.Resource) {
+	name := strings.ToLower(res.Header().Name)
+
+	switch rec := res.(type) {
+	case *dnsmessage.PTRResource:
+		if name == strings.ToLower(serviceName()) {
+			b.instances[rec.PTR] = true
+		}
+	case *dnsmessage.SRVResource:
+		b.srv[name] = rec
+	case *dnsmessage.AResource:
+		ip := net.IPv4(rec.A[0], rec.A[1], rec.A[2], rec.A[3])
+		for _, known := range b.ips[name] {
+			if known.Equal(ip) {
+				return
+			}
+		}
+		b.ips[name] = append(b.ips[name], ip)
+	}
+}
+
+// services returns the instances whose port and host are known.
+func (b *browser) services() []Service {
+	suffix := "." + strings.ToLower(serviceName())
+	services := []Service{}
+
+	for instance := range b.instances {
+		lower := strings.ToLower(instance)
+		if !strings.HasSuffix(lower, suffix) {
+			continue
+		}
+		srv, ok := b.srv[lower]
+		if !ok {
+			continue
+		}
+		services = append(services, Service{
+			Instance: instance[:len(instance)-len(suffix)],
+			Host:     srv.Target,
+			Port:     int(srv.Port),
+			IPs:      b.ips[strings.ToLower(srv.Target)],
+		})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Instance < services[j].Instance
+	})
+	return services
+}
+
+// localHost returns the host name of the machine in the .local domain.
+func localHost() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "getting host name")
+	}
+	if i := strings.Index(hostname, "."); i >= 0 {
+		hostname = hostname[:i]
+	}
+	return hostname + "." + Domain, nil
+}
+
+// localIPs returns the IPv4 addresses of the network interfaces.
+// Loopback addresses are only returned if there are no others.
+func localIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing interface addresses")
+	}
+	var ips, loopback []net.IP
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		if ipnet.IP.IsLoopback() {
+			loopback = append(loopback, ipnet.IP.To4())
+		} else {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	if len(ips) == 0 {
+		return loopback, nil
+	}
+	return ips, nil
+}
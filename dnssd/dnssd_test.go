@@ -0,0 +1,86 @@
+package dnssd_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scgolang/oscsync/dnssd"
+)
+
+func TestBrowse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := dnssd.NewResponder("127.0.0.1:0", dnssd.Service{
+		Instance: "studio",
+		Host:     "studio.local.",
+		Port:     5776,
+		IPs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = r.Serve(ctx) }()
+
+	browseCtx, browseCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer browseCancel()
+
+	services, err := dnssd.Browse(browseCtx, r.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(services); expected != got {
+		t.Fatalf("expected %d services, got %d", expected, got)
+	}
+	svc := services[0]
+	if expected, got := "studio", svc.Instance; expected != got {
+		t.Fatalf("expected instance %s, got %s", expected, got)
+	}
+	if expected, got := "studio.local.", svc.Host; expected != got {
+		t.Fatalf("expected host %s, got %s", expected, got)
+	}
+	if expected, got := "127.0.0.1:5776", svc.Addr(); expected != got {
+		t.Fatalf("expected addr %s, got %s", expected, got)
+	}
+}
+
+func TestBrowseNothing(t *testing.T) {
+	// Nobody answers on this address.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	services, err := dnssd.Browse(ctx, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 0, len(services); expected != got {
+		t.Fatalf("expected %d services, got %d", expected, got)
+	}
+}
+
+func TestNewResponder(t *testing.T) {
+	for i, svc := range []dnssd.Service{
+		{Instance: "", Port: 5776},
+		{Instance: "a.b", Port: 5776},
+		{Instance: "studio", Port: 0},
+	} {
+		if _, err := dnssd.NewResponder("127.0.0.1:0", svc); err == nil {
+			t.Fatalf("(test case %d) expected error, got nil", i)
+		}
+	}
+}
+
+func TestServiceAddr(t *testing.T) {
+	svc := dnssd.Service{Instance: "studio", Host: "studio.local.", Port: 5776}
+	if expected, got := "studio.local:5776", svc.Addr(); expected != got {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
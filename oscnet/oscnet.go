@@ -0,0 +1,162 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oscnet sends and serves OSC packets over UDP on top of github.com/scgolang/osc.
+//
+// It differs from the osc package where oscsync needs it to:
+// empty strings are encoded as four zero bytes, malformed packets are errors
+// instead of panics, every message of a bundle is dispatched,
+// a dispatcher can have a default handler, Serve can drop the packets
+// it fails to handle instead of stopping, and timetags have a real
+// NTP fraction of a second.
+package oscnet
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+)
+
+// Conn is an OSC connection.
+type Conn interface {
+	net.Conn
+
+	Context() context.Context
+	Serve(int, osc.Dispatcher, ...ServeOption) error
+	Send(osc.Packet) error
+	SendTo(net.Addr, osc.Packet) error
+}
+
+// UDPConn is an OSC connection over UDP.
+type UDPConn struct {
+	*osc.UDPConn
+}
+
+// DialUDP creates a new OSC connection over UDP.
+func DialUDP(network string, laddr, raddr *net.UDPAddr) (*UDPConn, error) {
+	return DialUDPContext(context.Background(), network, laddr, raddr)
+}
+
+// DialUDPContext returns a new OSC connection over UDP that can be canceled with the provided context.
+func DialUDPContext(ctx context.Context, network string, laddr, raddr *net.UDPAddr) (*UDPConn, error) {
+	conn, err := osc.DialUDPContext(ctx, network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPConn{UDPConn: conn}, nil
+}
+
+// ListenUDP creates a new UDP server.
+func ListenUDP(network string, laddr *net.UDPAddr) (*UDPConn, error) {
+	return ListenUDPContext(context.Background(), network, laddr)
+}
+
+// ListenUDPContext creates a UDP listener that can be canceled with the provided context.
+func ListenUDPContext(ctx context.Context, network string, laddr *net.UDPAddr) (*UDPConn, error) {
+	conn, err := osc.ListenUDPContext(ctx, network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPConn{UDPConn: conn}, nil
+}
+
+// Send sends a packet to the address the conn is connected to.
+func (conn *UDPConn) Send(p osc.Packet) error {
+	_, err := conn.Write(Bytes(p))
+	return err
+}
+
+// SendTo sends a packet to the given address.
+func (conn *UDPConn) SendTo(addr net.Addr, p osc.Packet) error {
+	_, err := conn.WriteTo(Bytes(p), addr)
+	return err
+}
+
+// Bytes encodes a packet.
+// Unlike the Bytes methods of the osc package it encodes the empty string
+// as four zero bytes, so that the arguments after it are not shifted.
+func Bytes(p osc.Packet) []byte {
+	switch x := p.(type) {
+	case osc.Message:
+		bss := [][]byte{stringBytes(x.Address), x.Typetags()}
+		for _, arg := range x.Arguments {
+			if s, ok := arg.(osc.String); ok {
+				bss = append(bss, stringBytes(string(s)))
+				continue
+			}
+			bss = append(bss, arg.Bytes())
+		}
+		return bytes.Join(bss, nil)
+	case osc.Bundle:
+		bss := [][]byte{stringBytes(osc.BundleTag), x.Timetag.Bytes()}
+		for _, packet := range x.Packets {
+			bs := Bytes(packet)
+			bss = append(bss, osc.Int(int32(len(bs))).Bytes(), bs)
+		}
+		return bytes.Join(bss, nil)
+	default:
+		return p.Bytes()
+	}
+}
+
+// stringBytes encodes an OSC string, which ends with at least one zero byte.
+func stringBytes(s string) []byte {
+	return osc.Pad(append([]byte(s), 0))
+}
+
+// ParsePacket parses a message or a bundle.
+// Malformed packets are an error instead of a panic of the parser.
+func ParsePacket(data []byte, sender net.Addr) (p osc.Packet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p, err = nil, errors.Errorf("malformed packet: %v", r)
+		}
+	}()
+	if len(data) == 0 {
+		return nil, osc.ErrParse
+	}
+	switch data[0] {
+	case osc.BundleTag[0]:
+		b, err := osc.ParseBundle(data, sender)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case osc.MessageChar:
+		m, err := osc.ParseMessage(data, sender)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		return nil, osc.ErrParse
+	}
+}
+
+// ParseMessage parses a message.
+// Malformed messages are an error instead of a panic of the parser.
+func ParseMessage(data []byte, sender net.Addr) (osc.Message, error) {
+	p, err := ParsePacket(data, sender)
+	if err != nil {
+		return osc.Message{}, err
+	}
+	m, ok := p.(osc.Message)
+	if !ok {
+		return osc.Message{}, errors.New("expected a message, got a bundle")
+	}
+	return m, nil
+}
@@ -0,0 +1,238 @@
+package oscnet
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+)
+
+// testServer serves a dispatcher on the loopback interface with the given options
+// and returns a conn that sends to it and the error Serve returns.
+func testServer(t *testing.T, dispatcher osc.Dispatcher, opts ...ServeOption) (*UDPConn, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	server, err := ListenUDPContext(ctx, "udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(1, dispatcher, opts...)
+	}()
+	conn, err := DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn, errs
+}
+
+func TestBytesEmptyString(t *testing.T) {
+	m := osc.Message{
+		Address:   "/foo",
+		Arguments: osc.Arguments{osc.String(""), osc.String("bar"), osc.Int(1)},
+	}
+	for _, p := range []osc.Packet{
+		m,
+		osc.Bundle{Timetag: osc.Immediately, Packets: []osc.Packet{m}},
+	} {
+		got, err := ParsePacket(Bytes(p), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Empty strings are padded like all the others and do not shift the arguments after them.
+		if b, ok := got.(osc.Bundle); ok {
+			got = b.Packets[0]
+		}
+		if !reflect.DeepEqual(m.Arguments, got.(osc.Message).Arguments) {
+			t.Fatalf("expected %v, got %v", m.Arguments, got.(osc.Message).Arguments)
+		}
+	}
+	// Packets without empty strings are encoded like the osc package does.
+	for _, p := range []osc.Packet{
+		osc.Message{Address: "/foo", Arguments: osc.Arguments{osc.String("bar"), osc.Float(1.5)}},
+		osc.Bundle{Timetag: FromTime(time.Unix(1, 0)), Packets: []osc.Packet{osc.Message{Address: "/baz"}}},
+	} {
+		if expected, got := p.Bytes(), Bytes(p); !reflect.DeepEqual(expected, got) {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestParsePacketMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		[]byte("foo"),
+		{'/', 'b', 0, 0, ',', 'b', 0, 0, 0xFF, 0xFF, 0xFF, 0xFC},
+		{'/', 'f', 'o', 'o', 0, 0, 0, 0, ',', 's', 's', 's'},
+		append(osc.Bundle{Timetag: osc.Immediately}.Bytes(), 0xFF, 0xFF, 0xFF, 0xFC),
+		[]byte("#bundle\x0000000000\x00\x00\x00\x14/000000\x00b00\x00000000000"),
+	} {
+		if _, err := ParsePacket(data, nil); err == nil {
+			t.Fatalf("expected an error parsing %q", data)
+		}
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	for _, p := range []osc.Packet{
+		osc.Message{Address: "/foo"},
+		osc.Message{Address: "/foo/bar", Arguments: osc.Arguments{osc.Int(1), osc.Float(2.5), osc.String("")}},
+		osc.Message{Address: "/blob", Arguments: osc.Arguments{osc.Blob([]byte{1, 2, 3}), osc.Bool(true)}},
+		osc.Bundle{
+			Timetag: FromTime(time.Unix(0, 0)),
+			Packets: []osc.Packet{
+				osc.Message{Address: "/foo", Arguments: osc.Arguments{osc.Int(1), osc.String("bar")}},
+				osc.Bundle{Timetag: osc.Immediately, Packets: []osc.Packet{osc.Message{Address: "/baz"}}},
+			},
+		},
+	} {
+		f.Add(Bytes(p))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := ParsePacket(data, nil)
+		if err != nil {
+			return
+		}
+		// Packets that could be parsed can be encoded again.
+		_ = Bytes(p)
+	})
+}
+
+func TestServe(t *testing.T) {
+	var (
+		foo    = make(chan struct{}, 1)
+		bar    = make(chan struct{}, 1)
+		missed = make(chan string, 1)
+	)
+	conn, _ := testServer(t, osc.Dispatcher{
+		"/foo": osc.Method(func(osc.Message) error {
+			foo <- struct{}{}
+			return nil
+		}),
+		"/bar": osc.Method(func(osc.Message) error {
+			bar <- struct{}{}
+			return nil
+		}),
+		DefaultAddress: osc.Method(func(m osc.Message) error {
+			missed <- m.Address
+			return nil
+		}),
+	})
+	// Every message of a bundle is invoked.
+	b := osc.Bundle{
+		Timetag: osc.Immediately,
+		Packets: []osc.Packet{osc.Message{Address: "/foo"}, osc.Message{Address: "/bar"}},
+	}
+	if err := conn.Send(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []chan struct{}{foo, bar} {
+		select {
+		case <-c:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected every message of the bundle to be invoked")
+		}
+	}
+	// Messages that do not match any address go to the default handler.
+	if err := conn.Send(osc.Message{Address: "/baz/qux"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case address := <-missed:
+		if expected, got := "/baz/qux", address; expected != got {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the default handler to be invoked")
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	oops := errors.New("oops")
+
+	// By default Serve stops on the first error.
+	conn, errs := testServer(t, osc.Dispatcher{
+		"/foo": osc.Method(func(osc.Message) error { return oops }),
+	})
+	if err := conn.Send(osc.Message{Address: "/foo"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if errors.Cause(err) != oops {
+			t.Fatalf("expected %s, got %v", oops, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Serve to stop")
+	}
+	// OnError decides which errors stop Serve.
+	var (
+		packetErrs = make(chan PacketError, 2)
+		stop       = errors.New("stop")
+	)
+	conn, errs = testServer(t, osc.Dispatcher{
+		"/foo": osc.Method(func(osc.Message) error { return oops }),
+	}, OnError(func(err PacketError) error {
+		packetErrs <- err
+		if err.Parse {
+			return nil
+		}
+		return stop
+	}))
+	if _, err := conn.Write([]byte{'/', 'b', 0, 0, ',', 'b', 0, 0, 0xFF, 0xFF, 0xFF, 0xFC}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Send(osc.Message{Address: "/foo"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if errors.Cause(err) != stop {
+			t.Fatalf("expected %s, got %v", stop, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Serve to stop")
+	}
+	parseErr, dispatchErr := <-packetErrs, <-packetErrs
+	if !parseErr.Parse || dispatchErr.Parse {
+		t.Fatalf("expected a parse error and a dispatch error, got %+v and %+v", parseErr, dispatchErr)
+	}
+	if expected, got := conn.LocalAddr().String(), parseErr.Sender.String(); expected != got {
+		t.Fatalf("expected sender %s, got %s", expected, got)
+	}
+}
+
+func TestFromTime(t *testing.T) {
+	// The last 32 bits are the fraction of a second like NTP timestamps.
+	for _, testcase := range []struct {
+		input    time.Time
+		expected osc.Timetag
+	}{
+		{input: time.Unix(0, 0), expected: osc.Timetag(osc.SecondsFrom1900To1970 << 32)},
+		{input: time.Unix(0, 500000000), expected: osc.Timetag(osc.SecondsFrom1900To1970<<32 | 1<<31)},
+		{input: time.Unix(2, 250000000), expected: osc.Timetag((osc.SecondsFrom1900To1970+2)<<32 | 1<<30)},
+	} {
+		if expected, got := testcase.expected, FromTime(testcase.input); expected != got {
+			t.Fatalf("expected %x, got %x", uint64(expected), uint64(got))
+		}
+	}
+	// Every nanosecond survives the round trip.
+	for ns := int64(0); ns < int64(time.Second); ns += 999983 {
+		if expected, got := time.Unix(5, ns), Time(FromTime(time.Unix(5, ns))); !expected.Equal(got) {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+	if !Time(osc.Immediately).Before(time.Now()) {
+		t.Fatal("expected immediately to be in the past")
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oscnet
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+)
+
+// bufSize is the size of the buffer packets are read into.
+const bufSize = 65536
+
+// DefaultAddress is the dispatcher address of the default handler.
+// The default handler is invoked for every message that does not match
+// any of the other addresses in a dispatcher.
+const DefaultAddress = ""
+
+// PacketError is an error that Serve encountered with a packet it received.
+// Parse is true if the packet could not be parsed,
+// otherwise a method returned the error.
+type PacketError struct {
+	Err    error
+	Sender net.Addr
+	Parse  bool
+}
+
+// Error returns the error message of the underlying error.
+func (e PacketError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error.
+func (e PacketError) Cause() error {
+	return e.Err
+}
+
+// ErrorHandler decides what Serve does with the errors of the packets it receives.
+// If it returns an error Serve stops and returns that error,
+// if it returns nil Serve drops the packet and continues with the next one.
+// It may be called by several workers at the same time.
+type ErrorHandler func(err PacketError) error
+
+// ServeOption configures Serve.
+type ServeOption func(*serveConfig)
+
+// serveConfig is the configuration of Serve.
+type serveConfig struct {
+	onError ErrorHandler
+}
+
+// OnError makes Serve call h with the errors of the packets it receives.
+// Without it Serve fails on the first error.
+func OnError(h ErrorHandler) ServeOption {
+	return func(config *serveConfig) {
+		config.onError = h
+	}
+}
+
+// Serve dispatches the packets the conn receives with numWorkers workers.
+// By default any errors parsing packets or returned from a dispatched method will be returned,
+// unless the OnError option says otherwise.
+// If the context of the conn is canceled its error is returned,
+// if the conn is closed Serve returns nil.
+func (conn *UDPConn) Serve(numWorkers int, dispatcher osc.Dispatcher, opts ...ServeOption) error {
+	if dispatcher == nil {
+		return osc.ErrNilDispatcher
+	}
+	for addr := range dispatcher {
+		if err := osc.ValidateAddress(addr); err != nil {
+			return err
+		}
+	}
+	config := serveConfig{onError: func(err PacketError) error { return err.Err }}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	var (
+		done    = make(chan struct{})
+		errs    = make(chan error, 1)
+		packets = make(chan osc.Incoming)
+	)
+	defer close(done)
+
+	// fail reports the first error that stops Serve.
+	fail := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case incoming := <-packets:
+					if err := handle(dispatcher, incoming, config.onError); err != nil {
+						fail(err)
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		for {
+			data := make([]byte, bufSize)
+			_, sender, err := conn.ReadFromUDP(data)
+			if err != nil {
+				if !strings.Contains(err.Error(), "use of closed network connection") {
+					fail(err)
+				}
+				return
+			}
+			select {
+			case packets <- osc.Incoming{Data: data, Sender: sender}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-errs:
+		return errors.Wrap(err, "error serving udp")
+	case <-conn.CloseChan():
+		return nil
+	case <-conn.Context().Done():
+		return conn.Context().Err()
+	}
+}
+
+// handle parses and dispatches a packet.
+// Packets that can not be parsed are not dispatched.
+func handle(dispatcher osc.Dispatcher, incoming osc.Incoming, onError ErrorHandler) error {
+	p, err := ParsePacket(incoming.Data, incoming.Sender)
+	if err != nil {
+		return onError(PacketError{Err: err, Sender: incoming.Sender, Parse: true})
+	}
+	switch x := p.(type) {
+	case osc.Bundle:
+		err = errors.Wrap(Dispatch(dispatcher, x), "dispatch bundle")
+	case osc.Message:
+		err = errors.Wrap(Invoke(dispatcher, x), "dispatch message")
+	}
+	if err != nil {
+		return onError(PacketError{Err: err, Sender: incoming.Sender})
+	}
+	return nil
+}
+
+// Dispatch invokes the messages of a bundle at the time of its timetag.
+// Every message is invoked even if some of them fail.
+func Dispatch(dispatcher osc.Dispatcher, b osc.Bundle) error {
+	if wait := time.Until(Time(b.Timetag)); wait > 0 {
+		time.Sleep(wait)
+	}
+	return immediately(dispatcher, b)
+}
+
+// immediately invokes the messages of a bundle and the bundles in it.
+func immediately(dispatcher osc.Dispatcher, b osc.Bundle) error {
+	var errs []string
+	for _, p := range b.Packets {
+		var err error
+		switch x := p.(type) {
+		case osc.Bundle:
+			err = immediately(dispatcher, x)
+		case osc.Message:
+			err = Invoke(dispatcher, x)
+		default:
+			err = errors.Errorf("unsupported type for dispatcher: %T", p)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, " and "))
+	}
+	return nil
+}
+
+// Invoke invokes the method of the dispatcher that matches a message.
+// If the message does not match any address the default handler is invoked, if there is one.
+func Invoke(dispatcher osc.Dispatcher, msg osc.Message) error {
+	for address, handler := range dispatcher {
+		if address == DefaultAddress {
+			continue
+		}
+		matched, err := msg.Match(address)
+		if err != nil {
+			return err
+		}
+		if matched {
+			return handler.Handle(msg)
+		}
+	}
+	if handler, ok := dispatcher[DefaultAddress]; ok {
+		return handler.Handle(msg)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright © 2017 Brian Sorahan <bsorahan@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oscnet
+
+import (
+	"time"
+
+	"github.com/scgolang/osc"
+)
+
+// FromTime converts the given time to an OSC timetag.
+// Unlike osc.FromTime the nanoseconds become the fraction of a second
+// in the last 32 bits, like in NTP timestamps.
+func FromTime(t time.Time) osc.Timetag {
+	t = t.UTC()
+	var (
+		secs = uint64((osc.SecondsFrom1900To1970 + t.Unix()) << 32)
+		frac = uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	)
+	return osc.Timetag(secs + frac)
+}
+
+// Time converts an OSC timetag to a time.Time.
+// The fraction is rounded up to the nanosecond, so that FromTime and Time give back the same time.
+func Time(tt osc.Timetag) time.Time {
+	var (
+		secs = (uint64(tt) >> 32) - osc.SecondsFrom1900To1970
+		frac = uint64(tt) & 0xFFFFFFFF
+		nsec = (frac*uint64(time.Second) + 1<<32 - 1) >> 32
+	)
+	return time.Unix(int64(secs), int64(nsec)).UTC()
+}
@@ -0,0 +1,353 @@
+// Package syncclient allows programs to easily sync to an oscsync master.
+package syncclient
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/dnssd"
+	"github.com/scgolang/oscsync/oscnet"
+	"github.com/scgolang/oscsync/syncosc"
+	"golang.org/x/sync/errgroup"
+)
+
+// Connect connects a slave to an oscsync master.
+// This func blocks forever.
+func Connect(ctx context.Context, slave syncosc.Slave, host string) error {
+	return ConnectOptions(ctx, slave, host, Options{})
+}
+
+// ConnectGroup connects a slave to an oscsync master as a member of the named group.
+// The empty group means the slave does not belong to any group.
+// This func blocks forever.
+func ConnectGroup(ctx context.Context, slave syncosc.Slave, host, group string) error {
+	return ConnectOptions(ctx, slave, host, Options{Group: group})
+}
+
+// Options configures how a slave connects to a master.
+type Options struct {
+	// Group is the name of the group the slave joins.
+	// The empty group means the slave does not belong to any group.
+	Group string
+
+	// Session is the name of the master session the slave syncs to.
+	// The empty session is the master's default session.
+	Session string
+
+	// Timeout is how long ConnectAny waits for a pulse before
+	// switching to the next master. The zero value means DefaultTimeout.
+	Timeout time.Duration
+
+	// Heartbeat is how often the slave registers with the master again,
+	// for masters that remove slaves that have not registered for a while.
+	// The zero value means the slave registers once.
+	Heartbeat time.Duration
+
+	// Instance is the name of the master that ConnectDiscovered connects to.
+	// The empty instance means the first master that is found.
+	Instance string
+
+	// DiscoveryAddr is where ConnectDiscovered asks for masters.
+	// The empty address means dnssd.MulticastAddr.
+	DiscoveryAddr string
+
+	// Timecode subscribes the slave to the master's timecode at a rate,
+	// syncosc.TimecodeFrame or syncosc.TimecodeQuarterFrame.
+	// The slave must be a syncosc.TimecodeSlave to receive it.
+	// The empty rate means the slave does not receive timecode.
+	Timecode string
+}
+
+// DefaultTimeout is the default time ConnectAny waits for a pulse before switching masters.
+const DefaultTimeout = time.Second
+
+// DefaultDiscoveryTimeout is how long Discover looks for masters
+// if the context has no deadline.
+const DefaultDiscoveryTimeout = time.Second
+
+// Discover finds the oscsync masters on the local network with mDNS.
+// It returns the masters that answered before the context's deadline,
+// or within DefaultDiscoveryTimeout if the context has none.
+func Discover(ctx context.Context) ([]dnssd.Service, error) {
+	return DiscoverAddr(ctx, dnssd.MulticastAddr)
+}
+
+// DiscoverAddr is like Discover but asks for masters at the given address,
+// which may be a unicast address.
+func DiscoverAddr(ctx context.Context, addr string) ([]dnssd.Service, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultDiscoveryTimeout)
+		defer cancel()
+	}
+	return dnssd.Browse(ctx, addr)
+}
+
+// ConnectDiscovered connects a slave to a master that is found with DiscoverAddr.
+// opts.Instance chooses the master, otherwise the first master that is found is used.
+// If the master has several addresses the slave fails over between them like ConnectAny.
+// This func blocks forever.
+func ConnectDiscovered(ctx context.Context, slave syncosc.Slave, opts Options) error {
+	masters, err := DiscoverAddr(ctx, opts.DiscoveryAddr)
+	if err != nil {
+		return errors.Wrap(err, "discovering masters")
+	}
+	for _, master := range masters {
+		if opts.Instance != "" && master.Instance != opts.Instance {
+			continue
+		}
+		var hosts []string
+		for _, ip := range master.IPs {
+			hosts = append(hosts, net.JoinHostPort(ip.String(), strconv.Itoa(master.Port)))
+		}
+		if len(hosts) == 0 {
+			hosts = []string{master.Addr()}
+		}
+		return ConnectAny(ctx, slave, hosts, opts)
+	}
+	if opts.Instance != "" {
+		return errors.Errorf("master %q not found", opts.Instance)
+	}
+	return errors.New("no master found")
+}
+
+// ConnectOptions connects a slave to an oscsync master with the given options.
+// This func blocks forever.
+func ConnectOptions(ctx context.Context, slave syncosc.Slave, host string, opts Options) error {
+	local, err := net.ResolveUDPAddr("udp", "0.0.0.0:0")
+	if err != nil {
+		return errors.Wrap(err, "creating listening address")
+	}
+	remote, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(syncosc.MasterPort)))
+	if err != nil {
+		return errors.Wrap(err, "creating listening address")
+	}
+	g, gctx := errgroup.WithContext(ctx)
+
+	conn, err := oscnet.DialUDPContext(gctx, "udp", local, remote)
+	if err != nil {
+		return errors.Wrap(err, "connecting to master")
+	}
+	// Start the OSC server so we receive the master's messages.
+	g.Go(func() error {
+		return receivePulses(conn, slave, opts.Session, nil)
+	})
+	// Announce the slave to the master.
+	portStr := strings.Split(conn.LocalAddr().String(), ":")[1]
+	lport, err := strconv.ParseInt(portStr, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing int from %s", portStr)
+	}
+	if err := conn.Send(slaveAddMessage(lport, opts)); err != nil {
+		return errors.Wrap(err, "sending add-slave message")
+	}
+	if _, ok := slave.(syncosc.MeterSlave); ok {
+		if err := conn.Send(meterQuery(opts)); err != nil {
+			return errors.Wrap(err, "asking for the meter")
+		}
+	}
+	if opts.Heartbeat > 0 {
+		g.Go(func() error {
+			ticker := time.NewTicker(opts.Heartbeat)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-gctx.Done():
+					return gctx.Err()
+				case <-ticker.C:
+					if err := conn.Send(slaveAddMessage(lport, opts)); err != nil {
+						return errors.Wrap(err, "sending add-slave message")
+					}
+				}
+			}
+		})
+	}
+	return g.Wait()
+}
+
+// ConnectAny connects a slave to the first of a list of oscsync masters.
+// If no pulse arrives from the current master within opts.Timeout
+// the slave registers with the next master in the list.
+// Hosts may include a port, otherwise syncosc.MasterPort is used.
+// This func blocks forever.
+func ConnectAny(ctx context.Context, slave syncosc.Slave, hosts []string, opts Options) error {
+	if len(hosts) == 0 {
+		return errors.New("at least one master is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	masters := make([]net.Addr, len(hosts))
+	for i, host := range hosts {
+		addr, err := resolveMaster(host)
+		if err != nil {
+			return errors.Wrapf(err, "resolving master %s", host)
+		}
+		masters[i] = addr
+	}
+	local, err := net.ResolveUDPAddr("udp", "0.0.0.0:0")
+	if err != nil {
+		return errors.Wrap(err, "creating listening address")
+	}
+	g, gctx := errgroup.WithContext(ctx)
+
+	conn, err := oscnet.ListenUDPContext(gctx, "udp", local)
+	if err != nil {
+		return errors.Wrap(err, "listening for pulses")
+	}
+	pulses := make(chan struct{}, 1)
+
+	g.Go(func() error {
+		return receivePulses(conn, slave, opts.Session, pulses)
+	})
+	_, meter := slave.(syncosc.MeterSlave)
+
+	g.Go(func() error {
+		return failover(gctx, conn, masters, opts, meter, pulses)
+	})
+	return g.Wait()
+}
+
+// failover registers the slave with one master after the other
+// whenever the current master stops sending pulses.
+// If meter is true the slave asks every master it registers with for its meter.
+func failover(ctx context.Context, conn *oscnet.UDPConn, masters []net.Addr, opts Options, meter bool, pulses <-chan struct{}) error {
+	var (
+		current    = 0
+		last       = time.Now()
+		registered = time.Now()
+		lport      = int64(conn.LocalAddr().(*net.UDPAddr).Port)
+		ticker     = time.NewTicker(opts.Timeout / 4)
+	)
+	defer ticker.Stop()
+
+	register := func() error {
+		if err := conn.SendTo(masters[current], slaveAddMessage(lport, opts)); err != nil {
+			return errors.Wrap(err, "sending add-slave message")
+		}
+		if !meter {
+			return nil
+		}
+		return errors.Wrap(conn.SendTo(masters[current], meterQuery(opts)), "asking for the meter")
+	}
+	if err := register(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pulses:
+			last = time.Now()
+		case now := <-ticker.C:
+			switch {
+			case now.Sub(last) >= opts.Timeout:
+				current = (current + 1) % len(masters)
+				last = now
+			case opts.Heartbeat > 0 && now.Sub(registered) >= opts.Heartbeat:
+			default:
+				continue
+			}
+			registered = now
+
+			if err := register(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resolveMaster resolves the address of a master.
+// If host does not include a port syncosc.MasterPort is used.
+func resolveMaster(host string) (net.Addr, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(syncosc.MasterPort))
+	}
+	return net.ResolveUDPAddr("udp", host)
+}
+
+// slaveAddMessage returns the message that announces a slave listening on port to a master.
+func slaveAddMessage(port int64, opts Options) osc.Message {
+	args := osc.Arguments{
+		osc.String("127.0.0.1"),
+		osc.Int(port),
+	}
+	if opts.Group != "" || opts.Timecode != "" {
+		args = append(args, osc.String(opts.Group))
+	}
+	if opts.Timecode != "" {
+		args = append(args, osc.String(opts.Timecode))
+	}
+	return osc.Message{
+		Address:   syncosc.SessionAddress(opts.Session, syncosc.AddressSlaveAdd),
+		Arguments: args,
+	}
+}
+
+// meterQuery returns the message that asks a master for the meter of the session.
+func meterQuery(opts Options) osc.Message {
+	return osc.Message{Address: syncosc.SessionAddress(opts.Session, syncosc.AddressMeter)}
+}
+
+// receivePulses passes the master's pulses to the slave,
+// its timecode if the slave is a syncosc.TimecodeSlave,
+// and its meter if the slave is a syncosc.MeterSlave.
+// If pulses is not nil it is notified of every pulse without blocking.
+func receivePulses(conn oscnet.Conn, slave syncosc.Slave, session string, pulses chan<- struct{}) error {
+	dispatcher := osc.Dispatcher{
+		syncosc.SessionAddress(session, syncosc.AddressPulse): osc.Method(func(m osc.Message) error {
+			pulse, err := syncosc.PulseFromMessage(m)
+			if err != nil {
+				return errors.Wrap(err, "getting pulse from message")
+			}
+			if pulses != nil {
+				select {
+				case pulses <- struct{}{}:
+				default:
+				}
+			}
+			return slave.Pulse(pulse)
+		}),
+	}
+	if ts, ok := slave.(syncosc.TimecodeSlave); ok {
+		dispatcher[syncosc.SessionAddress(session, syncosc.AddressTimecode)] = osc.Method(func(m osc.Message) error {
+			tc, err := syncosc.TimecodeFromMessage(m)
+			if err != nil {
+				return errors.Wrap(err, "getting timecode from message")
+			}
+			return ts.Timecode(tc)
+		})
+	}
+	if ms, ok := slave.(syncosc.MeterSlave); ok {
+		address := syncosc.SessionAddress(session, syncosc.AddressMeter)
+
+		dispatcher[address] = osc.Method(func(m osc.Message) error {
+			meter, err := syncosc.MeterFromMessage(m)
+			if err != nil {
+				return errors.Wrap(err, "getting meter from message")
+			}
+			return ms.Meter(meter)
+		})
+		dispatcher["/reply"] = osc.Method(func(m osc.Message) error {
+			if len(m.Arguments) == 0 {
+				return nil
+			}
+			if replyTo, err := m.Arguments[0].ReadString(); err != nil || replyTo != address {
+				return nil
+			}
+			meter, err := syncosc.MeterFromMessage(osc.Message{Address: address, Arguments: m.Arguments[1:]})
+			if err != nil {
+				return errors.Wrap(err, "getting meter from reply")
+			}
+			return ms.Meter(meter)
+		})
+	}
+	// Arbitrary number of worker routines.
+	return conn.Serve(8, dispatcher)
+}
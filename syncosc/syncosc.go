@@ -0,0 +1,228 @@
+// Package syncosc exists to define constants used in the oscsync protocol.
+// See http://github.com/scgolang/oscsync/README.md
+package syncosc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scgolang/osc"
+)
+
+// OSC addresses.
+const (
+	AddressCueAdd        = "/sync/cue/add"
+	AddressCueList       = "/sync/cue/list"
+	AddressCueRemove     = "/sync/cue/remove"
+	AddressGrooveAdd     = "/sync/groove/add"
+	AddressGrooveGroup   = "/sync/groove/group"
+	AddressGrooveList    = "/sync/groove/list"
+	AddressGrooveRemove  = "/sync/groove/remove"
+	AddressGrooveSlave   = "/sync/groove/slave"
+	AddressGrooveSwing   = "/sync/groove/swing"
+	AddressGroupCueAdd   = "/sync/group/cue/add"
+	AddressGroupMute     = "/sync/group/mute"
+	AddressGroupUnmute   = "/sync/group/unmute"
+	AddressMeter         = "/sync/meter"
+	AddressPeerAlive     = "/sync/peer/alive"
+	AddressPeerForward   = "/sync/peer/forward"
+	AddressPulse         = "/sync/pulse"
+	AddressReplicaAdd    = "/sync/replica/add"
+	AddressReplicaState  = "/sync/replica/state"
+	AddressSchedule      = "/sync/schedule"
+	AddressSessionAdd    = "/sync/session/add"
+	AddressSessionList   = "/sync/session/list"
+	AddressSessionRemove = "/sync/session/remove"
+	AddressSlaveAdd      = "/sync/slave/add"
+	AddressSlaveList     = "/sync/slave/list"
+	AddressSlaveRemove   = "/sync/slave/remove"
+	AddressTempo         = "/sync/tempo"
+	AddressTimecode      = "/sync/timecode"
+	AddressTransport     = "/sync/transport"
+)
+
+// AddressPrefix is the prefix of every oscsync address.
+const AddressPrefix = "/sync/"
+
+// SessionAddress returns the version of an oscsync address for the named session.
+// The default session has an empty name and uses the plain addresses,
+// e.g. the tempo address of the session "live" is /sync/live/tempo
+func SessionAddress(session, address string) string {
+	if session == "" {
+		return address
+	}
+	return strings.Replace(address, AddressPrefix, AddressPrefix+session+"/", 1)
+}
+
+// Transport states.
+const (
+	TransportContinue = "continue"
+	TransportStart    = "start"
+	TransportStop     = "stop"
+)
+
+// Timecode rates that slaves can subscribe to.
+// Frame slaves receive a timecode message for every frame,
+// quarter-frame slaves receive four with the quarter of the frame they are sent in.
+const (
+	TimecodeFrame        = "frame"
+	TimecodeQuarterFrame = "quarter"
+)
+
+// MasterPort is the listening port for the oscsync master.
+const MasterPort = 5776
+
+// PulsesPerBar is the number of pulses in a bar (measure).
+const PulsesPerBar = 96
+
+// PulsesPerQuarter is the number of pulses in a quarter note.
+const PulsesPerQuarter = 24
+
+// GetPulseDuration converts the tempo in bpm to a time.Duration
+// callers are responsible for making concurrent access safe.
+func GetPulseDuration(tempo float32) time.Duration {
+	if tempo == 0 {
+		return time.Duration(0)
+	}
+	return time.Duration(float32(int64(24e10)/PulsesPerBar) / tempo)
+}
+
+// Pulse represents the arguments in a /sync/pulse message.
+type Pulse struct {
+	Tempo float32
+	Count int32
+}
+
+// PulseFromMessage gets a Pulse from an OSC message.
+func PulseFromMessage(m osc.Message) (Pulse, error) {
+	p := Pulse{}
+	if expected, got := 2, len(m.Arguments); expected != got {
+		return p, errors.Errorf("expected %d arguments, got %d", expected, got)
+	}
+	tempo, err := m.Arguments[0].ReadFloat32()
+	if err != nil {
+		return p, errors.Wrap(err, "reading tempo")
+	}
+	count, err := m.Arguments[1].ReadInt32()
+	if err != nil {
+		return p, errors.Wrap(err, "reading counter")
+	}
+	p.Tempo = tempo
+	p.Count = count
+	return p, nil
+}
+
+// Timecode represents the arguments in a /sync/timecode message.
+// Timecode is SMPTE timecode as hh:mm:ss:ff, or hh:mm:ss;ff for drop-frame timecode.
+// Quarter is the quarter of the frame from 0 to 3 for quarter-frame messages and -1 for frame messages.
+type Timecode struct {
+	Timecode string
+	Quarter  int32
+}
+
+// TimecodeFromMessage gets a Timecode from an OSC message.
+func TimecodeFromMessage(m osc.Message) (Timecode, error) {
+	tc := Timecode{Quarter: -1}
+	if len(m.Arguments) != 1 && len(m.Arguments) != 2 {
+		return tc, errors.Errorf("expected 1 or 2 arguments, got %d", len(m.Arguments))
+	}
+	s, err := m.Arguments[0].ReadString()
+	if err != nil {
+		return tc, errors.Wrap(err, "reading timecode")
+	}
+	tc.Timecode = s
+
+	if len(m.Arguments) == 2 {
+		quarter, err := m.Arguments[1].ReadInt32()
+		if err != nil {
+			return tc, errors.Wrap(err, "reading quarter")
+		}
+		if quarter < 0 || quarter > 3 {
+			return tc, errors.Errorf("quarter must be from 0 to 3, got %d", quarter)
+		}
+		tc.Quarter = quarter
+	}
+	return tc, nil
+}
+
+// Meter represents the arguments in a /sync/meter message, e.g. 6 and 8 for 6/8.
+// A meter change takes effect at the next pulse and has a Pulse of -1.
+// The reply to a meter query also has the pulse the meter took effect at,
+// counted at PulsesPerQuarter since the transport started, and the number of bars before it.
+type Meter struct {
+	Beats int32
+	Unit  int32
+	Pulse int32
+	Bar   int32
+}
+
+// MeterFromMessage gets a Meter from an OSC message.
+func MeterFromMessage(m osc.Message) (Meter, error) {
+	meter := Meter{Pulse: -1}
+	if len(m.Arguments) != 2 && len(m.Arguments) != 4 {
+		return meter, errors.Errorf("expected 2 or 4 arguments, got %d", len(m.Arguments))
+	}
+	for i, v := range []*int32{&meter.Beats, &meter.Unit, &meter.Pulse, &meter.Bar}[:len(m.Arguments)] {
+		x, err := m.Arguments[i].ReadInt32()
+		if err != nil {
+			return meter, errors.Wrapf(err, "reading argument %d", i)
+		}
+		*v = x
+	}
+	if meter.Beats <= 0 || meter.Unit <= 0 || meter.Unit&(meter.Unit-1) != 0 || PulsesPerBar%meter.Unit != 0 {
+		return meter, errors.Errorf("invalid meter %d/%d", meter.Beats, meter.Unit)
+	}
+	return meter, nil
+}
+
+// Slave is any type that can sync to an oscsync master.
+// The slave's Pulse method will be invoked every time a new pulse is received
+// from the oscsync master.
+type Slave interface {
+	Pulse(Pulse) error
+}
+
+// TimecodeSlave is a slave that also receives the master's timecode.
+// The slave's Timecode method will be invoked for every timecode message
+// if the slave subscribed to timecode when it registered.
+type TimecodeSlave interface {
+	Slave
+	Timecode(Timecode) error
+}
+
+// MeterSlave is a slave that also receives the master's meter.
+// The slave's Meter method will be invoked with the master's meter when the slave registers,
+// and with every meter change before the pulse it takes effect at.
+type MeterSlave interface {
+	Slave
+	Meter(Meter) error
+}
+
+// ConnectorFunc connects a slave to an oscsync server.
+type ConnectorFunc func(ctx context.Context, slave Slave, host string) error
+
+// Ticker runs a ticker that triggers the slave.
+// This func blocks forever.
+func Ticker(ctx context.Context, slave Slave, host string) error {
+	var (
+		count = int32(0)
+		tempo = float32(120)
+		tk    = time.NewTicker(GetPulseDuration(tempo))
+	)
+	for {
+		select {
+		case <-tk.C:
+			if err := slave.Pulse(Pulse{
+				Count: count,
+				Tempo: tempo,
+			}); err != nil {
+				return err
+			}
+			count++
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package syncosc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/scgolang/osc"
+	"github.com/scgolang/oscsync/syncosc"
+)
+
+func TestGetPulseDuration(t *testing.T) {
+	for i, testcase := range []struct {
+		input  float32
+		output time.Duration
+	}{
+		{
+			input:  120,
+			output: time.Duration(int64(5e8) / 24),
+		},
+	} {
+		var (
+			got      = syncosc.GetPulseDuration(testcase.input)
+			expected = testcase.output
+		)
+		if !sufficientlyClose(expected, got) {
+			t.Fatalf("(test case %d) expected %s, got %s", i, expected, got)
+		}
+	}
+}
+
+func TestSessionAddress(t *testing.T) {
+	for i, testcase := range []struct {
+		session string
+		input   string
+		output  string
+	}{
+		{
+			session: "",
+			input:   syncosc.AddressTempo,
+			output:  "/sync/tempo",
+		},
+		{
+			session: "live",
+			input:   syncosc.AddressTempo,
+			output:  "/sync/live/tempo",
+		},
+		{
+			session: "live",
+			input:   syncosc.AddressSlaveAdd,
+			output:  "/sync/live/slave/add",
+		},
+	} {
+		if expected, got := testcase.output, syncosc.SessionAddress(testcase.session, testcase.input); expected != got {
+			t.Fatalf("(test case %d) expected %s, got %s", i, expected, got)
+		}
+	}
+}
+
+func TestTimecodeFromMessage(t *testing.T) {
+	for i, testcase := range []struct {
+		args   osc.Arguments
+		output syncosc.Timecode
+		err    bool
+	}{
+		{
+			args:   osc.Arguments{osc.String("01:02:03:04")},
+			output: syncosc.Timecode{Timecode: "01:02:03:04", Quarter: -1},
+		},
+		{
+			args:   osc.Arguments{osc.String("00:10:00;00"), osc.Int(3)},
+			output: syncosc.Timecode{Timecode: "00:10:00;00", Quarter: 3},
+		},
+		{
+			args: osc.Arguments{osc.String("00:10:00;00"), osc.Int(4)},
+			err:  true,
+		},
+		{
+			args: osc.Arguments{osc.Int(1)},
+			err:  true,
+		},
+		{
+			args: osc.Arguments{},
+			err:  true,
+		},
+	} {
+		got, err := syncosc.TimecodeFromMessage(osc.Message{Address: syncosc.AddressTimecode, Arguments: testcase.args})
+		if testcase.err {
+			if err == nil {
+				t.Fatalf("(test case %d) expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if expected := testcase.output; expected != got {
+			t.Fatalf("(test case %d) expected %+v, got %+v", i, expected, got)
+		}
+	}
+}
+
+func sufficientlyClose(d1, d2 time.Duration) bool {
+	var (
+		thresh = time.Duration(10)
+		diff   = d1 - d2
+	)
+	if diff < 0 {
+		diff = -1 * diff
+	}
+	return diff < thresh
+}
+
+func TestMeterFromMessage(t *testing.T) {
+	for i, testcase := range []struct {
+		args   osc.Arguments
+		output syncosc.Meter
+		err    bool
+	}{
+		{
+			args:   osc.Arguments{osc.Int(6), osc.Int(8)},
+			output: syncosc.Meter{Beats: 6, Unit: 8, Pulse: -1},
+		},
+		{
+			args:   osc.Arguments{osc.Int(7), osc.Int(16), osc.Int(480), osc.Int(5)},
+			output: syncosc.Meter{Beats: 7, Unit: 16, Pulse: 480, Bar: 5},
+		},
+		{
+			args: osc.Arguments{osc.Int(4), osc.Int(3)},
+			err:  true,
+		},
+		{
+			args: osc.Arguments{osc.Int(4), osc.Int(4), osc.Int(0)},
+			err:  true,
+		},
+		{
+			args: osc.Arguments{osc.Int(4), osc.String("4")},
+			err:  true,
+		},
+	} {
+		got, err := syncosc.MeterFromMessage(osc.Message{Address: syncosc.AddressMeter, Arguments: testcase.args})
+		if testcase.err {
+			if err == nil {
+				t.Fatalf("(test case %d) expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(test case %d) %s", i, err)
+		}
+		if expected := testcase.output; expected != got {
+			t.Fatalf("(test case %d) expected %+v, got %+v", i, expected, got)
+		}
+	}
+}